@@ -4,14 +4,49 @@ import (
 	"sync"
 )
 
+// Bucket is the entry of a bucket file in the master.
+//
+// The wrapped data keys of envelope encryption are kept here rather than in a
+// header of the bucket file. Bucket files are plain runs of transactions which
+// are appended to, hashed, concatenated and fetched by byte range, and sealed
+// ones are stored under their content hash. A header would have to be
+// rewritten whenever the data keys are wrapped again, changing the hash and
+// object name of every sealed bucket. The master is republished anyway, so a
+// bucket file copied out on its own cannot be decrypted without the master it
+// is listed in: exports and cold tiers carry the master with the buckets
 type Bucket struct {
 	FileName         string
 	Hash             string
 	CompressedHash   string
 	CompressionAlgo  string
+	Size             int64
 	ModTime          int64
 	Version          uint32
 	TransactionCount uint32
+	// Tier is the storage tier the bucket was in when the master was
+	// published, empty unless the storage is tiered. See Tierer
+	Tier string
+	// ObjectName is the immutable object holding a sealed bucket, named after
+	// its content hash. Empty when the bucket is stored under FileName
+	ObjectName string
+	// ChainHash is the hex encoded hash of the last transaction of the hash
+	// chain up to the end of the bucket, see ServerConfig.HashChain
+	ChainHash string
+	// MerkleRoot is the hex encoded root of the Merkle tree over the
+	// transactions in the bucket, see Client.ProveInclusion
+	MerkleRoot string
+	// WrappedDataKey is the data key the transactions in the bucket are
+	// encrypted with, wrapped by a key encryption key. See BucketEncryption
+	WrappedDataKey []byte
+	// RetiredDataKeys are the wrapped data keys earlier transactions in the
+	// bucket were encrypted with, before WrappedDataKey replaced them. See
+	// DataKeyRotation
+	RetiredDataKeys [][]byte
+	// PrefixSize and PrefixHash are the size and hash of the bucket in an
+	// earlier master, which the bucket only appended to since. Clients holding
+	// that copy check it against them before downloading only the rest
+	PrefixSize int64
+	PrefixHash string
 
 	// used internally / not persisted
 	lock *sync.RWMutex
@@ -69,6 +104,14 @@ func (b *Bucket) SetCompressionAlgo(compressionAlgo string) {
 	b.CompressionAlgo = compressionAlgo
 }
 
+func (b *Bucket) GetSize() int64 {
+	return b.Size
+}
+
+func (b *Bucket) SetSize(size int64) {
+	b.Size = size
+}
+
 func (b *Bucket) GetModTime() int64 {
 	return b.ModTime
 }
@@ -92,3 +135,99 @@ func (b *Bucket) GetTransactionCount() uint32 {
 func (b *Bucket) SetTransactionCount(transactionCount uint32) {
 	b.TransactionCount = transactionCount
 }
+
+func (b *Bucket) GetTier() string {
+	return b.Tier
+}
+
+func (b *Bucket) SetTier(tier string) {
+	b.Tier = tier
+}
+
+func (b *Bucket) GetObjectName() string {
+	return b.ObjectName
+}
+
+func (b *Bucket) SetObjectName(objectName string) {
+	b.ObjectName = objectName
+}
+
+// GetStorageName returns the name of the object holding the bucket in the
+// storage provider
+func (b *Bucket) GetStorageName() string {
+	if b.ObjectName != "" {
+		return b.ObjectName
+	}
+	return b.FileName
+}
+
+func (b *Bucket) GetChainHash() string {
+	return b.ChainHash
+}
+
+func (b *Bucket) SetChainHash(chainHash string) {
+	b.ChainHash = chainHash
+}
+
+func (b *Bucket) GetMerkleRoot() string {
+	return b.MerkleRoot
+}
+
+func (b *Bucket) SetMerkleRoot(merkleRoot string) {
+	b.MerkleRoot = merkleRoot
+}
+
+func (b *Bucket) GetWrappedDataKey() []byte {
+	return b.WrappedDataKey
+}
+
+func (b *Bucket) SetWrappedDataKey(wrappedDataKey []byte) {
+	b.WrappedDataKey = wrappedDataKey
+}
+
+func (b *Bucket) GetRetiredDataKeys() [][]byte {
+	return b.RetiredDataKeys
+}
+
+func (b *Bucket) SetRetiredDataKeys(retiredDataKeys [][]byte) {
+	b.RetiredDataKeys = retiredDataKeys
+}
+
+func (b *Bucket) GetPrefixSize() int64 {
+	return b.PrefixSize
+}
+
+func (b *Bucket) SetPrefixSize(prefixSize int64) {
+	b.PrefixSize = prefixSize
+}
+
+func (b *Bucket) GetPrefixHash() string {
+	return b.PrefixHash
+}
+
+func (b *Bucket) SetPrefixHash(prefixHash string) {
+	b.PrefixHash = prefixHash
+}
+
+// persisted returns a copy of the fields of the bucket that are written to the
+// master
+func (b *Bucket) persisted() Bucket {
+	return Bucket{
+		FileName:         b.FileName,
+		Hash:             b.Hash,
+		CompressedHash:   b.CompressedHash,
+		CompressionAlgo:  b.CompressionAlgo,
+		Size:             b.Size,
+		ModTime:          b.ModTime,
+		Version:          b.Version,
+		TransactionCount: b.TransactionCount,
+		Tier:             b.Tier,
+		ObjectName:       b.ObjectName,
+		ChainHash:        b.ChainHash,
+		MerkleRoot:       b.MerkleRoot,
+		WrappedDataKey:   b.WrappedDataKey,
+		RetiredDataKeys:  b.RetiredDataKeys,
+		PrefixSize:       b.PrefixSize,
+		PrefixHash:       b.PrefixHash,
+	}
+}
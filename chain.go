@@ -0,0 +1,81 @@
+package cbtransaction
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"io"
+)
+
+// ErrChainBroken is matched by every ChainError
+var ErrChainBroken = errors.New("hash chain broken")
+
+// ChainError names the transaction at which the hash chain is broken
+type ChainError struct {
+	Bucket string
+	// Offset of the transaction in the bucket, or the end of the bucket when
+	// transactions were removed from its end
+	Offset int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%s in bucket %s at offset %d: %s", ErrChainBroken, e.Bucket, e.Offset, e.Reason)
+}
+
+func (e *ChainError) Is(target error) bool {
+	return target == ErrChainBroken
+}
+
+// decodeChainHash returns the hash a new transaction appended to bucket links to
+func decodeChainHash(bucket *Bucket) ([32]byte, error) {
+	hash := [32]byte{}
+	if bucket.GetChainHash() == "" {
+		return hash, nil
+	}
+	decoded, e := hex.DecodeString(bucket.GetChainHash())
+	if e != nil || len(decoded) != len(hash) {
+		return hash, fmt.Errorf("invalid chain hash in bucket %s", bucket.GetFileName())
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// chainVerifier follows the hash chain through the buckets of a master in order
+type chainVerifier struct {
+	head    [32]byte
+	chained bool
+}
+
+// verifyBucket checks that every chained transaction in reader links to the
+// one before it, which may be in an earlier bucket, and that the chain ends at
+// the hash the master recorded so transactions cannot be cut off the end.
+// Transactions written before the hash chain was enabled are skipped, but none
+// may follow a chained one
+func (c *chainVerifier) verifyBucket(bucket *Bucket, reader io.Reader) error {
+	end, e := eachTransaction(reader, func(offset int64, tran *cbslice.Transaction) error {
+		if tran.GetVersion() == cbslice.Version2 {
+			if tran.GetPreviousHash() != c.head {
+				return &ChainError{Bucket: bucket.GetFileName(), Offset: offset, Reason: "previous hash does not match the transaction before it"}
+			}
+			c.head = tran.Hash()
+			c.chained = true
+		} else if c.chained {
+			return &ChainError{Bucket: bucket.GetFileName(), Offset: offset, Reason: "transaction is not part of the hash chain"}
+		}
+		return nil
+	})
+	if e != nil {
+		if _, ok := e.(*ChainError); ok {
+			return e
+		}
+		return &ChainError{Bucket: bucket.GetFileName(), Offset: end, Reason: e.Error()}
+	}
+
+	if bucket.GetChainHash() != "" && (!c.chained || hex.EncodeToString(c.head[:]) != bucket.GetChainHash()) {
+		return &ChainError{Bucket: bucket.GetFileName(), Offset: end, Reason: "chain does not end at the hash in the master"}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chainedTestBuckets returns the contents of buckets holding a hash chain
+// through count transactions each, along with the hash at the end of each
+func chainedTestBuckets(names []string, count int) (map[string][]byte, map[string]string) {
+	contents := map[string][]byte{}
+	chainHashes := map[string]string{}
+	previous := [32]byte{}
+	for _, name := range names {
+		buffer := &bytes.Buffer{}
+		for i := 0; i < count; i++ {
+			tran := cbslice.NewVersion2()
+			tran.SetTransactionId(uuid.New())
+			tran.SetData([]byte(name))
+			tran.SetPreviousHash(previous)
+			previous = tran.Hash()
+			_, _ = tran.SerialiseWriter(buffer)
+		}
+		contents[name] = buffer.Bytes()
+		chainHashes[name] = hex.EncodeToString(previous[:])
+	}
+	return contents, chainHashes
+}
+
+func TestClient_Verify(t *testing.T) {
+	names := []string{"bucket1", "bucket2"}
+	// every transaction is 8 bytes of length, 66 bytes of header and 7 of data
+	transactionSize := 8 + 66 + 7
+	unchained := cbslice.NewVersion1()
+	unchained.SetData([]byte("bucket2"))
+
+	tests := []struct {
+		name       string
+		modify     func(contents map[string][]byte)
+		wantBucket string
+		wantOffset int64
+		wantErr    bool
+	}{
+		{
+			name:    "intact",
+			modify:  func(contents map[string][]byte) {},
+			wantErr: false,
+		},
+		{
+			name: "altered",
+			modify: func(contents map[string][]byte) {
+				contents["bucket1"][transactionSize+80] = 'X'
+			},
+			wantBucket: "bucket1",
+			wantOffset: int64(transactionSize * 2),
+			wantErr:    true,
+		},
+		{
+			name: "removed",
+			modify: func(contents map[string][]byte) {
+				contents["bucket2"] = append(contents["bucket2"][:transactionSize:transactionSize], contents["bucket2"][transactionSize*2:]...)
+			},
+			wantBucket: "bucket2",
+			wantOffset: int64(transactionSize),
+			wantErr:    true,
+		},
+		{
+			name: "removedAcrossBuckets",
+			modify: func(contents map[string][]byte) {
+				contents["bucket1"] = contents["bucket1"][:transactionSize*2]
+			},
+			wantBucket: "bucket1",
+			wantOffset: int64(transactionSize * 2),
+			wantErr:    true,
+		},
+		{
+			name: "unchainedAppended",
+			modify: func(contents map[string][]byte) {
+				contents["bucket2"] = append(contents["bucket2"], unchained.Serialise()...)
+			},
+			wantBucket: "bucket2",
+			wantOffset: int64(transactionSize * 3),
+			wantErr:    true,
+		},
+		{
+			name: "truncatedTransaction",
+			modify: func(contents map[string][]byte) {
+				contents["bucket2"] = contents["bucket2"][:len(contents["bucket2"])-3]
+			},
+			wantBucket: "bucket2",
+			wantOffset: int64(transactionSize * 2),
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir, e := ioutil.TempDir("", "cbtransaction-chain")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(dataDir)
+
+			contents, chainHashes := chainedTestBuckets(names, 3)
+			tt.modify(contents)
+			master, _ := NewMasterFromFile(nil)
+			for _, name := range names {
+				master.SaveBucket(&Bucket{FileName: name, ChainHash: chainHashes[name]})
+				if e := ioutil.WriteFile(filepath.Join(dataDir, name), contents[name], 0644); e != nil {
+					t.Error(e)
+					return
+				}
+			}
+			c, e := getDefaultTestClient(nil, dataDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			c.master = master
+
+			got, err := c.Verify()
+			if (err != nil) != tt.wantErr || got == tt.wantErr {
+				t.Errorf("Verify() = %v, error = %v, wantErr %v", got, err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				return
+			}
+			var chainError *ChainError
+			if !errors.As(err, &chainError) || !errors.Is(err, ErrChainBroken) {
+				t.Errorf("Verify() error = %v, want a *ChainError", err)
+				return
+			}
+			if chainError.Bucket != tt.wantBucket || chainError.Offset != tt.wantOffset {
+				t.Errorf("Verify() error at %s offset %d, want %s offset %d", chainError.Bucket, chainError.Offset, tt.wantBucket, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestServer_verifyBucketChainHash(t *testing.T) {
+	dataDir, e := ioutil.TempDir("", "cbtransaction-chain-server")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(nil, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	contents, chainHashes := chainedTestBuckets([]string{"bucket"}, 2)
+	file, e := ioutil.TempFile(dataDir, "bucket")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer file.Close()
+	_, _ = file.Write(contents["bucket"])
+	bucket, _ := NewBucketFromFile(file)
+
+	verified, e := s.verifyBucket(bucket)
+	if e != nil {
+		t.Errorf("verifyBucket() error = %v", e)
+		return
+	}
+	if verified.GetChainHash() != chainHashes["bucket"] || verified.GetTransactionCount() != 2 {
+		t.Errorf("verifyBucket() chain hash = %s, count = %d, want %s, 2", verified.GetChainHash(), verified.GetTransactionCount(), chainHashes["bucket"])
+	}
+}
@@ -1,7 +1,20 @@
 package cbtransaction
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 type Client struct {
@@ -11,8 +24,14 @@ type Client struct {
 	defaultEncryptionProvider Encryption
 	encodingProviders         []Encoding
 	defaultEncodingProvider   Encoding
+	storageProvider           Storage
+	storageTimeout            time.Duration
 	dataDir                   string
+	pinnedMasterVersion       uint64
+	previousMaster            bool
+	trustedKeys               map[string]ed25519.PublicKey
 	master                    *Master
+	masterVersion             uint64
 }
 
 type ClientConfig struct {
@@ -22,7 +41,17 @@ type ClientConfig struct {
 	EncryptionProviders  []Encryption
 	DefaultEncodingKey   [8]byte
 	EncodingProviders    []Encoding
+	StorageProvider      Storage
+	StorageTimeout       time.Duration
 	DataDir              string
+	// MasterVersion pins the client to a master from the history kept by the
+	// server, see ServerConfig.MasterHistory. 0 follows the latest master
+	MasterVersion uint64
+	// PreviousMaster rolls back to the master published before the latest one
+	PreviousMaster bool
+	// TrustedKeys are the public keys masters have to be signed with, by key
+	// ID. When set, unsigned masters and buckets without a hash are rejected
+	TrustedKeys map[string]ed25519.PublicKey
 }
 
 func NewClient(config ClientConfig) (*Client, error) {
@@ -53,7 +82,12 @@ func NewClient(config ClientConfig) (*Client, error) {
 		encryptionProviders:       config.EncryptionProviders,
 		defaultEncodingProvider:   defaultEncodingProvider,
 		encodingProviders:         config.EncodingProviders,
+		storageProvider:           config.StorageProvider,
+		storageTimeout:            config.StorageTimeout,
 		dataDir:                   config.DataDir,
+		pinnedMasterVersion:       config.MasterVersion,
+		previousMaster:            config.PreviousMaster,
+		trustedKeys:               config.TrustedKeys,
 	}, nil
 }
 
@@ -61,22 +95,398 @@ func (s *Client) Start() error {
 	return nil
 }
 
+// Verify walks the hash chain through the transactions of every downloaded
+// bucket, see ServerConfig.HashChain. A broken link returns false and a
+// *ChainError naming the bucket and offset of the transaction
 func (s *Client) Verify() (bool, error) {
+	if s.master == nil {
+		return false, errors.New("no master downloaded")
+	}
+
+	verifier := &chainVerifier{}
+	for _, bucket := range s.master.GetBuckets() {
+		file, e := os.Open(filepath.Join(s.dataDir, bucket.GetFileName()))
+		if e != nil {
+			return false, e
+		}
+		e = verifier.verifyBucket(bucket, file)
+		_ = file.Close()
+		if e != nil {
+			return false, e
+		}
+	}
+
 	return true, nil
 }
 
 func (s *Client) Download() error {
+	return s.DownloadContext(context.Background())
+}
+
+func (s *Client) DownloadContext(ctx context.Context) error {
+	if s.storageProvider == nil {
+		return errors.New("no storage provider configured")
+	}
+
+	e := os.MkdirAll(s.dataDir, os.ModePerm)
+	if e != nil {
+		return e
+	}
+
+	storageCtx, cancel := s.storageContext(ctx)
+	masterName, masterVersion, e := s.resolveMaster(storageCtx)
+	if e != nil {
+		cancel()
+		return e
+	}
+	buffer := &bytes.Buffer{}
+	e = s.storageProvider.DownloadContext(storageCtx, masterName, buffer)
+	cancel()
+	if e != nil {
+		return e
+	}
+
+	master, e := s.verifyMaster(buffer.Bytes())
+	if e != nil {
+		return e
+	}
+
+	for _, bucket := range master.GetBuckets() {
+		e := s.downloadBucket(ctx, bucket)
+		if e != nil {
+			return e
+		}
+	}
+
+	s.master = master
+	s.masterVersion = masterVersion
+
 	return nil
 }
 
+// verifyMaster decodes a downloaded master, checking its signature first when
+// trusted keys are configured. Buckets are only trusted through the hash in the
+// signed master, so every bucket has to have one
+func (s *Client) verifyMaster(data []byte) (*Master, error) {
+	if len(s.trustedKeys) == 0 {
+		return NewMasterFromReader(bytes.NewReader(data), s.encodingProviders)
+	}
+
+	data, _, e := VerifyMaster(data, s.trustedKeys)
+	if e != nil {
+		return nil, e
+	}
+	master, e := NewMasterFromReader(bytes.NewReader(data), s.encodingProviders)
+	if e != nil {
+		return nil, e
+	}
+	for _, bucket := range master.GetBuckets() {
+		if bucket.GetHash() == "" {
+			return nil, fmt.Errorf("%w: bucket %s has no hash", ErrUntrustedMaster, bucket.GetFileName())
+		}
+	}
+
+	return master, nil
+}
+
+// resolveMaster returns the name and version of the master to download. The
+// version is 0 when the server keeps no history
+func (s *Client) resolveMaster(ctx context.Context) (string, uint64, error) {
+	if s.pinnedMasterVersion > 0 {
+		return masterVersionName(s.pinnedMasterVersion), s.pinnedMasterVersion, nil
+	}
+
+	latest, e := downloadMasterPointer(ctx, s.storageProvider)
+	if e != nil {
+		return "", 0, e
+	}
+	if !s.previousMaster {
+		if latest == 0 {
+			return masterFileName, 0, nil
+		}
+		return masterVersionName(latest), latest, nil
+	}
+
+	if latest == 0 {
+		return "", 0, errors.New("cannot roll back, the server keeps no master history")
+	}
+	versions, e := listMasterVersions(ctx, s.storageProvider)
+	if e != nil {
+		return "", 0, e
+	}
+	// versions are not contiguous as the server only keeps the last few
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i] < latest {
+			return masterVersionName(versions[i]), versions[i], nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("no master older than version %d is kept", latest)
+}
+
+// MasterVersions returns the versions of the masters kept by the server,
+// oldest first
+func (s *Client) MasterVersions() ([]uint64, error) {
+	return s.MasterVersionsContext(context.Background())
+}
+
+func (s *Client) MasterVersionsContext(ctx context.Context) ([]uint64, error) {
+	if s.storageProvider == nil {
+		return nil, errors.New("no storage provider configured")
+	}
+
+	storageCtx, cancel := s.storageContext(ctx)
+	defer cancel()
+
+	return listMasterVersions(storageCtx, s.storageProvider)
+}
+
+func (s *Client) downloadBucket(ctx context.Context, bucket *Bucket) error {
+	bucketPath := filepath.Join(s.dataDir, bucket.GetFileName())
+	e := os.MkdirAll(filepath.Dir(bucketPath), os.ModePerm)
+	if e != nil {
+		return e
+	}
+
+	if bucket.GetHash() != "" {
+		info, e := os.Stat(bucketPath)
+		if e == nil && info.Size() > 0 && info.Size() <= bucket.GetSize() {
+			downloaded, e := s.downloadBucketTail(ctx, bucket, bucketPath, info.Size())
+			if e != nil || downloaded {
+				return e
+			}
+		}
+	}
+
+	// download next to the bucket and only move it into place once it matches
+	// the master, so a failed download never leaves a corrupt bucket behind
+	writer, e := ioutil.TempFile(filepath.Dir(bucketPath), filepath.Base(bucketPath)+".*.download")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(writer.Name())
+	defer writer.Close()
+
+	hash := sha256.New()
+	storageCtx, cancel := s.storageContext(ctx)
+	defer cancel()
+
+	if downloader, ok := s.storageProvider.(HashDownloader); ok && bucket.GetHash() != "" {
+		e = downloader.DownloadHashContext(storageCtx, bucket.GetStorageName(), bucket.GetHash(), io.MultiWriter(writer, hash))
+	} else {
+		e = s.storageProvider.DownloadContext(storageCtx, bucket.GetStorageName(), io.MultiWriter(writer, hash))
+	}
+	if e != nil {
+		return e
+	}
+
+	if bucket.GetHash() != "" && hex.EncodeToString(hash.Sum(nil)) != bucket.GetHash() {
+		return fmt.Errorf("downloaded bucket %s does not match the hash in the master", bucket.GetFileName())
+	}
+
+	e = writer.Chmod(0644)
+	if e != nil {
+		return e
+	}
+	e = writer.Close()
+	if e != nil {
+		return e
+	}
+
+	return os.Rename(writer.Name(), bucketPath)
+}
+
+// downloadBucketTail appends the part of the bucket past the end of the local
+// copy. Only a local copy matching the prefix the master records, or the whole
+// bucket, is kept: nothing is fetched for any other. It returns false when the
+// local copy or the bucket with the tail appended does not match and the whole
+// bucket needs downloading instead
+func (s *Client) downloadBucketTail(ctx context.Context, bucket *Bucket, bucketPath string, offset int64) (bool, error) {
+	want := bucket.GetHash()
+	if offset < bucket.GetSize() {
+		if offset != bucket.GetPrefixSize() || bucket.GetPrefixHash() == "" {
+			return false, nil
+		}
+		want = bucket.GetPrefixHash()
+	}
+
+	file, e := os.OpenFile(bucketPath, os.O_RDWR, 0644)
+	if e != nil {
+		return false, e
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, e = io.Copy(hash, file)
+	if e != nil {
+		return false, e
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != want {
+		return false, nil
+	}
+	if offset == bucket.GetSize() {
+		return true, nil
+	}
+
+	storageCtx, cancel := s.storageContext(ctx)
+	defer cancel()
+
+	e = s.storageProvider.DownloadRangeContext(storageCtx, bucket.GetStorageName(), offset, -1, io.MultiWriter(file, hash))
+	if e != nil {
+		_ = file.Truncate(offset)
+		return false, e
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != bucket.GetHash() {
+		_ = file.Truncate(offset)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (s *Client) storageContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.storageTimeout > 0 {
+		return context.WithTimeout(ctx, s.storageTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ProveInclusion builds a proof that the transaction is part of the downloaded
+// master, which VerifyInclusion checks against the Merkle root of the master
+func (s *Client) ProveInclusion(transactionId uuid.UUID) (*InclusionProof, error) {
+	if s.master == nil {
+		return nil, errors.New("no master downloaded")
+	}
+	masterLeaves, ok := bucketMerkleLeaves(s.master.GetBuckets())
+	if !ok || s.master.GetMerkleRoot() == "" {
+		return nil, errors.New("the master has no merkle root")
+	}
+
+	for index, bucket := range s.master.GetBuckets() {
+		proof, e := s.proveBucketInclusion(bucket, transactionId)
+		if e != nil {
+			return nil, e
+		}
+		if proof != nil {
+			proof.MasterPath = merklePath(masterLeaves, index)
+			return proof, nil
+		}
+	}
+
+	return nil, fmt.Errorf("transaction %s is not in any bucket", transactionId)
+}
+
+// proveBucketInclusion returns the proof up to the root of the bucket, nil when
+// the transaction is not in it
+func (s *Client) proveBucketInclusion(bucket *Bucket, transactionId uuid.UUID) (*InclusionProof, error) {
+	file, e := os.Open(filepath.Join(s.dataDir, bucket.GetFileName()))
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+
+	var leaves [][32]byte
+	var proof *InclusionProof
+	proofIndex := 0
+	_, e = eachTransaction(file, func(offset int64, tran *cbslice.Transaction) error {
+		if proof == nil && tran.GetTransactionId() == transactionId {
+			proof = &InclusionProof{TransactionId: transactionId, Transaction: *tran, Bucket: bucket.GetFileName()}
+			proofIndex = len(leaves)
+		}
+		leaves = append(leaves, merkleLeafHash(*tran))
+		return nil
+	})
+	if e != nil {
+		return nil, fmt.Errorf("reading bucket %s: %w", bucket.GetFileName(), e)
+	}
+	if proof == nil {
+		return nil, nil
+	}
+
+	root := merkleRoot(leaves)
+	if hex.EncodeToString(root[:]) != bucket.GetMerkleRoot() {
+		return nil, fmt.Errorf("bucket %s does not match the merkle root in the master", bucket.GetFileName())
+	}
+	proof.BucketPath = merklePath(leaves, proofIndex)
+
+	return proof, nil
+}
+
 func (s *Client) GetTransactions(currentVersion uint64, limit uint64) []Transaction {
 	var transactions []Transaction
 
 	return transactions
 }
 
+// Decrypt returns a copy of transaction with its data decrypted by the
+// encryption provider it was written with. Providers using data keys find
+// theirs among the buckets of the master. A transaction about a forgotten
+// subject is returned as a *ShreddedTransaction, without an error
 func (s *Client) Decrypt(transaction Transaction) (Transaction, error) {
-	return transaction, nil
+	provider := s.encryptionProvider(transaction.GetEncryptionProviderKey())
+	if provider == nil {
+		return nil, fmt.Errorf("could not find encryption provider for transaction %s", transaction.GetTransactionId())
+	}
+
+	ctx, cancel := s.storageContext(context.Background())
+	defer cancel()
+	subjectEncryption, ok := provider.(SubjectEncryption)
+	if !ok {
+		decrypted, e := s.decryptData(ctx, provider, transaction.GetData())
+		if e != nil {
+			return nil, fmt.Errorf("transaction %s: %w", transaction.GetTransactionId(), e)
+		}
+		return withData(transaction, decrypted)
+	}
+
+	// data about a subject is encrypted again by the provider whose key it starts with
+	data := transaction.GetData()
+	key := [8]byte{}
+	if len(data) < len(key) {
+		return nil, fmt.Errorf("transaction %s: subject data is truncated", transaction.GetTransactionId())
+	}
+	copy(key[:], data)
+	outer := s.encryptionProvider(key)
+	if outer == nil {
+		return nil, fmt.Errorf("could not find encryption provider for transaction %s", transaction.GetTransactionId())
+	}
+	subjectEncrypted, e := s.decryptData(ctx, outer, data[len(key):])
+	if e != nil {
+		return nil, fmt.Errorf("transaction %s: %w", transaction.GetTransactionId(), e)
+	}
+	subjectID, decrypted, shredded, e := subjectEncryption.DecryptSubjectContext(ctx, subjectEncrypted)
+	if e != nil {
+		return nil, fmt.Errorf("transaction %s: %w", transaction.GetTransactionId(), e)
+	}
+	if shredded {
+		return &ShreddedTransaction{Transaction: transaction, SubjectID: subjectID}, nil
+	}
+	return withData(transaction, decrypted)
+}
+
+func (s *Client) encryptionProvider(key [8]byte) Encryption {
+	var provider Encryption
+	for _, encryptionProvider := range s.encryptionProviders {
+		if encryptionProvider.GetKey() == key {
+			provider = encryptionProvider
+		}
+	}
+	return provider
+}
+
+// decryptData decrypts data with provider, using the data keys of the
+// downloaded buckets when it is a BucketEncryption
+func (s *Client) decryptData(ctx context.Context, provider Encryption, data []byte) ([]byte, error) {
+	bucketEncryption, ok := provider.(BucketEncryption)
+	if !ok {
+		decrypted := provider.Decrypt(data)
+		if decrypted == nil && len(data) > 0 {
+			key := provider.GetKey()
+			return nil, fmt.Errorf("encryption provider %s could not decrypt the data", bytes.TrimRight(key[:], "\x00"))
+		}
+		return decrypted, nil
+	}
+	return bucketEncryption.DecryptWithDataKeysContext(ctx, s.wrappedDataKeys(), data)
 }
 
 func (s *Client) Decode(transaction Transaction) (interface{}, error) {
@@ -86,3 +496,9 @@ func (s *Client) Decode(transaction Transaction) (interface{}, error) {
 func (s *Client) GetMaster() *Master {
 	return s.master
 }
+
+// GetMasterVersion returns the version of the downloaded master, 0 when the
+// server keeps no master history
+func (s *Client) GetMasterVersion() uint64 {
+	return s.masterVersion
+}
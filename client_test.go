@@ -0,0 +1,565 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
+	"github.com/codingbeard/cbtransaction/encryption/cbnone"
+	"github.com/codingbeard/cbtransaction/storage/cbfile"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var getDefaultTestClient = func(storage Storage, dataDir string) (*Client, error) {
+	return NewClient(ClientConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbnone.Key,
+		EncryptionProviders:  []Encryption{&cbnone.Encryption{}},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		StorageProvider:      storage,
+		DataDir:              dataDir,
+	})
+}
+
+// testStorageProviders are the storage the client and server tests run
+// against: the filesystem, with its real not found and rename behaviour, and memory
+var testStorageProviders = []struct {
+	name string
+	new  func(dir string) (Storage, error)
+}{
+	{
+		name: "file",
+		new: func(dir string) (Storage, error) {
+			return cbfile.New(cbfile.Config{BasePath: dir})
+		},
+	},
+	{
+		name: "memory",
+		new: func(dir string) (Storage, error) {
+			return cbmemory.New(cbmemory.Config{})
+		},
+	},
+}
+
+func TestClient_DownloadContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		buckets     map[string]string
+		wantErr     bool
+		wantBuckets int
+	}{
+		{
+			name:    "missingMaster",
+			ctx:     context.Background(),
+			wantErr: true,
+		},
+		{
+			name: "twoBuckets",
+			ctx:  context.Background(),
+			buckets: map[string]string{
+				"bucket1": "bucket1-contents",
+				"bucket2": "bucket2-contents",
+			},
+			wantErr:     false,
+			wantBuckets: 2,
+		},
+		{
+			name: "cancelled",
+			ctx:  cancelled,
+			buckets: map[string]string{
+				"bucket1": "bucket1-contents",
+			},
+			wantErr: true,
+		},
+	}
+	for _, provider := range testStorageProviders {
+		for _, tt := range tests {
+			t.Run(provider.name+"/"+tt.name, func(t *testing.T) {
+				storageDir, e := ioutil.TempDir("", "cbtransaction-client-storage")
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				defer os.RemoveAll(storageDir)
+				dataDir, e := ioutil.TempDir("", "cbtransaction-client-data")
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				defer os.RemoveAll(dataDir)
+
+				storage, e := provider.new(storageDir)
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				if tt.buckets != nil {
+					master, e := NewMasterFromFile(nil)
+					if e != nil {
+						t.Error(e)
+						return
+					}
+					for fileName, contents := range tt.buckets {
+						bucket, e := NewBucketFromFile(nil)
+						if e != nil {
+							t.Error(e)
+							return
+						}
+						bucket.SetFileName(fileName)
+						master.SaveBucket(bucket)
+						e = storage.Upload(fileName, bytes.NewReader([]byte(contents)))
+						if e != nil {
+							t.Error(e)
+							return
+						}
+					}
+					buffer := &bytes.Buffer{}
+					e = master.SerialiseWriter(buffer, cbmsgpack.New())
+					if e != nil {
+						t.Error(e)
+						return
+					}
+					e = storage.Upload(masterFileName, buffer)
+					if e != nil {
+						t.Error(e)
+						return
+					}
+				}
+
+				c, e := getDefaultTestClient(storage, dataDir)
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				err := c.DownloadContext(tt.ctx)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("DownloadContext() error = %v, wantErr %v", err, tt.wantErr)
+					return
+				}
+				if tt.wantErr {
+					return
+				}
+				if got := len(c.GetMaster().GetBuckets()); got != tt.wantBuckets {
+					t.Errorf("len(GetMaster().GetBuckets()) = %d, want %d", got, tt.wantBuckets)
+				}
+				for fileName, contents := range tt.buckets {
+					got, e := ioutil.ReadFile(filepath.Join(dataDir, fileName))
+					if e != nil {
+						t.Error(e)
+						continue
+					}
+					if string(got) != contents {
+						t.Errorf("downloaded bucket %s = %s, want %s", fileName, string(got), contents)
+					}
+				}
+			})
+		}
+	}
+}
+
+type recordingTestStorage struct {
+	Storage
+	downloads    []string
+	rangeOffsets []int64
+}
+
+func (r *recordingTestStorage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	r.downloads = append(r.downloads, filename)
+	return r.Storage.DownloadContext(ctx, filename, writer)
+}
+
+func (r *recordingTestStorage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	r.rangeOffsets = append(r.rangeOffsets, offset)
+	return r.Storage.DownloadRangeContext(ctx, filename, offset, length, writer)
+}
+
+func TestClient_downloadBucket(t *testing.T) {
+	remote := "0123456789"
+	remoteHash := sha256.Sum256([]byte(remote))
+	prefixHash := sha256.Sum256([]byte("0123"))
+	tests := []struct {
+		name             string
+		local            string
+		hash             string
+		prefixSize       int64
+		prefixHash       string
+		wantDownloads    []string
+		wantRangeOffsets []int64
+	}{
+		{
+			name:          "noLocalCopy",
+			hash:          hex.EncodeToString(remoteHash[:]),
+			prefixSize:    4,
+			prefixHash:    hex.EncodeToString(prefixHash[:]),
+			wantDownloads: []string{"bucket"},
+		},
+		{
+			name:             "localPrefix",
+			local:            "0123",
+			hash:             hex.EncodeToString(remoteHash[:]),
+			prefixSize:       4,
+			prefixHash:       hex.EncodeToString(prefixHash[:]),
+			wantRangeOffsets: []int64{4},
+		},
+		{
+			// the local copy does not match the prefix, so no tail is fetched
+			name:          "localDiverged",
+			local:         "abcd",
+			hash:          hex.EncodeToString(remoteHash[:]),
+			prefixSize:    4,
+			prefixHash:    hex.EncodeToString(prefixHash[:]),
+			wantDownloads: []string{"bucket"},
+		},
+		{
+			name:          "localNotPrefixSize",
+			local:         "012",
+			hash:          hex.EncodeToString(remoteHash[:]),
+			prefixSize:    4,
+			prefixHash:    hex.EncodeToString(prefixHash[:]),
+			wantDownloads: []string{"bucket"},
+		},
+		{
+			name:          "noPrefix",
+			local:         "0123",
+			hash:          hex.EncodeToString(remoteHash[:]),
+			wantDownloads: []string{"bucket"},
+		},
+		{
+			name:  "upToDate",
+			local: remote,
+			hash:  hex.EncodeToString(remoteHash[:]),
+		},
+		{
+			name:          "upToDateDiverged",
+			local:         "abcdefghij",
+			hash:          hex.EncodeToString(remoteHash[:]),
+			wantDownloads: []string{"bucket"},
+		},
+		{
+			name:          "noHash",
+			local:         "0123",
+			wantDownloads: []string{"bucket"},
+		},
+	}
+	for _, provider := range testStorageProviders {
+		for _, tt := range tests {
+			t.Run(provider.name+"/"+tt.name, func(t *testing.T) {
+				storageDir, e := ioutil.TempDir("", "cbtransaction-client-storage")
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				defer os.RemoveAll(storageDir)
+				dataDir, e := ioutil.TempDir("", "cbtransaction-client-data")
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				defer os.RemoveAll(dataDir)
+
+				remoteStorage, e := provider.new(storageDir)
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = remoteStorage.Upload("bucket", bytes.NewReader([]byte(remote)))
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				if tt.local != "" {
+					e = ioutil.WriteFile(filepath.Join(dataDir, "bucket"), []byte(tt.local), os.ModePerm)
+					if e != nil {
+						t.Error(e)
+						return
+					}
+				}
+				recording := &recordingTestStorage{Storage: remoteStorage}
+				c, e := getDefaultTestClient(recording, dataDir)
+				if e != nil {
+					t.Error(e)
+					return
+				}
+
+				bucket, e := NewBucketFromFile(nil)
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				bucket.SetFileName("bucket")
+				bucket.SetSize(int64(len(remote)))
+				bucket.SetHash(tt.hash)
+				bucket.SetPrefixSize(tt.prefixSize)
+				bucket.SetPrefixHash(tt.prefixHash)
+
+				err := c.downloadBucket(context.Background(), bucket)
+				if err != nil {
+					t.Errorf("downloadBucket() error = %v", err)
+					return
+				}
+				got, e := ioutil.ReadFile(filepath.Join(dataDir, "bucket"))
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				if string(got) != remote {
+					t.Errorf("downloadBucket() local bucket = %s, want %s", string(got), remote)
+				}
+				if !reflect.DeepEqual(recording.downloads, tt.wantDownloads) {
+					t.Errorf("downloadBucket() downloads = %v, want %v", recording.downloads, tt.wantDownloads)
+				}
+				if !reflect.DeepEqual(recording.rangeOffsets, tt.wantRangeOffsets) {
+					t.Errorf("downloadBucket() range offsets = %v, want %v", recording.rangeOffsets, tt.wantRangeOffsets)
+				}
+			})
+		}
+	}
+}
+
+func TestClient_downloadBucketCorrupt(t *testing.T) {
+	for _, provider := range testStorageProviders {
+		t.Run(provider.name, func(t *testing.T) {
+			storageDir, e := ioutil.TempDir("", "cbtransaction-client-storage")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(storageDir)
+			dataDir, e := ioutil.TempDir("", "cbtransaction-client-data")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(dataDir)
+
+			remoteStorage, e := provider.new(storageDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			e = remoteStorage.Upload("bucket", bytes.NewReader([]byte("corrupted")))
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			c, e := getDefaultTestClient(remoteStorage, dataDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+
+			bucket, e := NewBucketFromFile(nil)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			bucket.SetFileName("bucket")
+			bucket.SetSize(int64(len("0123456789")))
+			hash := sha256.Sum256([]byte("0123456789"))
+			bucket.SetHash(hex.EncodeToString(hash[:]))
+
+			err := c.downloadBucket(context.Background(), bucket)
+			if err == nil {
+				t.Error("downloadBucket() error = nil, want hash mismatch")
+			}
+			files, e := ioutil.ReadDir(dataDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			for _, file := range files {
+				t.Errorf("downloadBucket() left %s in the data dir", file.Name())
+			}
+		})
+	}
+}
+
+func TestClient_resolveMaster(t *testing.T) {
+	tests := []struct {
+		name        string
+		history     []uint64
+		pinned      uint64
+		previous    bool
+		wantName    string
+		wantVersion uint64
+		wantErr     bool
+	}{
+		{
+			name:     "noHistory",
+			wantName: masterFileName,
+		},
+		{
+			name:        "latest",
+			history:     []uint64{3, 5},
+			wantName:    masterVersionName(5),
+			wantVersion: 5,
+		},
+		{
+			name:        "pinned",
+			history:     []uint64{3, 5},
+			pinned:      3,
+			wantName:    masterVersionName(3),
+			wantVersion: 3,
+		},
+		{
+			name:        "previousSkipsTrimmedVersions",
+			history:     []uint64{3, 5},
+			previous:    true,
+			wantName:    masterVersionName(3),
+			wantVersion: 3,
+		},
+		{
+			name:     "previousWithoutHistory",
+			previous: true,
+			wantErr:  true,
+		},
+		{
+			name:     "previousOfOnlyVersion",
+			history:  []uint64{5},
+			previous: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage, e := cbmemory.New(cbmemory.Config{})
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			for _, version := range tt.history {
+				_ = storage.Upload(masterVersionName(version), bytes.NewReader(nil))
+				_ = storage.Upload(masterPointerFileName, bytes.NewReader([]byte(strconv.FormatUint(version, 10))))
+			}
+			c, e := getDefaultTestClient(storage, "")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			c.pinnedMasterVersion = tt.pinned
+			c.previousMaster = tt.previous
+
+			name, version, err := c.resolveMaster(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolveMaster() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if name != tt.wantName || version != tt.wantVersion {
+				t.Errorf("resolveMaster() = %s, %d, want %s, %d", name, version, tt.wantName, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestClient_DownloadSignedMaster(t *testing.T) {
+	key, publicKey := getTestSigningKey(t, "current")
+	_, otherPublicKey := getTestSigningKey(t, "current")
+	contents := "bucket-contents"
+	hash := sha256.Sum256([]byte(contents))
+	serialise := func(hash string) []byte {
+		master, _ := NewMasterFromFile(nil)
+		master.SaveBucket(&Bucket{FileName: "bucket", Hash: hash, Size: int64(len(contents))})
+		buffer := &bytes.Buffer{}
+		if e := master.SerialiseWriter(buffer, cbmsgpack.New()); e != nil {
+			t.Fatal(e)
+		}
+		return buffer.Bytes()
+	}
+	sign := func(master []byte) []byte {
+		signed, e := SignMaster(master, key)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name        string
+		master      []byte
+		trustedKeys map[string]ed25519.PublicKey
+		wantErr     bool
+	}{
+		{
+			name:        "signed",
+			master:      sign(serialise(hex.EncodeToString(hash[:]))),
+			trustedKeys: map[string]ed25519.PublicKey{"current": publicKey},
+		},
+		{
+			name:   "signedWithoutTrustedKeys",
+			master: sign(serialise(hex.EncodeToString(hash[:]))),
+		},
+		{
+			name:        "otherKey",
+			master:      sign(serialise(hex.EncodeToString(hash[:]))),
+			trustedKeys: map[string]ed25519.PublicKey{"current": otherPublicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "unsigned",
+			master:      serialise(hex.EncodeToString(hash[:])),
+			trustedKeys: map[string]ed25519.PublicKey{"current": publicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "bucketWithoutHash",
+			master:      sign(serialise("")),
+			trustedKeys: map[string]ed25519.PublicKey{"current": publicKey},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir, e := ioutil.TempDir("", "cbtransaction-client-signed")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(dataDir)
+			memoryStorage, e := cbmemory.New(cbmemory.Config{})
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			recording := &recordingTestStorage{Storage: memoryStorage}
+			_ = memoryStorage.Upload("bucket", bytes.NewReader([]byte(contents)))
+			_ = memoryStorage.Upload(masterFileName, bytes.NewReader(tt.master))
+			c, e := getDefaultTestClient(recording, dataDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			c.trustedKeys = tt.trustedKeys
+
+			err := c.Download()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Download() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrUntrustedMaster) {
+					t.Errorf("Download() error = %v, want %v", err, ErrUntrustedMaster)
+				}
+				for _, filename := range recording.downloads {
+					if filename == "bucket" {
+						t.Error("Download() downloaded a bucket of an untrusted master")
+					}
+				}
+			}
+		})
+	}
+}
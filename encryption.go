@@ -1,6 +1,9 @@
 package cbtransaction
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 type Encryption interface {
 	GetKey() [8]byte
@@ -9,3 +12,45 @@ type Encryption interface {
 	Decrypt(encrypted []byte) []byte
 	DecryptReader(reader io.Reader, out []byte) error
 }
+
+// BucketEncryption is implemented by encryption providers which encrypt the
+// transactions of every bucket with a data key of its own. The data key is
+// kept in the bucket wrapped by a key encryption key, see Bucket.WrappedDataKey,
+// so rotating the key encryption key only wraps the data keys again
+type BucketEncryption interface {
+	// NewDataKeyContext returns a random data key for a new bucket, wrapped
+	NewDataKeyContext(ctx context.Context) ([]byte, error)
+	// EncryptWithDataKeyContext encrypts data with the data key in wrappedKey
+	EncryptWithDataKeyContext(ctx context.Context, wrappedKey []byte, data []byte) ([]byte, error)
+	// DecryptWithDataKeysContext decrypts data with whichever of the wrapped
+	// data keys it was encrypted with
+	DecryptWithDataKeysContext(ctx context.Context, wrappedKeys [][]byte, encrypted []byte) ([]byte, error)
+	// RewrapDataKeyContext wraps the data key in wrappedKey with the current
+	// key encryption key, the data key itself stays the same
+	RewrapDataKeyContext(ctx context.Context, wrappedKey []byte) ([]byte, error)
+}
+
+// DataKeyRotation is implemented by BucketEncryption providers whose data keys
+// can go stale, such as when a recipient who was given the data key is
+// revoked. The server then retires the data key of the current bucket and
+// encrypts later transactions with a new one, see Bucket.RetiredDataKeys
+type DataKeyRotation interface {
+	// DataKeyCurrentContext reports whether new data may still be encrypted
+	// with the data key in wrappedKey
+	DataKeyCurrentContext(ctx context.Context, wrappedKey []byte) (bool, error)
+}
+
+// SubjectEncryption is implemented by encryption providers which encrypt each
+// transaction under a key of the subject it is about, such as a user, held in
+// a local key store. Forgetting a subject destroys their key, which shreds
+// every transaction about them even where the log cannot be rewritten
+type SubjectEncryption interface {
+	// EncryptSubjectContext encrypts data under the key of subjectID, creating
+	// the key for a new subject
+	EncryptSubjectContext(ctx context.Context, subjectID string, data []byte) ([]byte, error)
+	// DecryptSubjectContext returns the subject encrypted is about and its
+	// data, or shredded true without data when the subject has been forgotten
+	DecryptSubjectContext(ctx context.Context, encrypted []byte) (subjectID string, data []byte, shredded bool, e error)
+	// ForgetSubjectContext destroys the key of subjectID
+	ForgetSubjectContext(ctx context.Context, subjectID string) error
+}
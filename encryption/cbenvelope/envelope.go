@@ -0,0 +1,281 @@
+package cbenvelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+var Key = [8]byte{'e', 'n', 'v', 'e', 'l', 'o', 'p', 'e'}
+
+var (
+	// ErrNoDataKey is returned when data was not encrypted with any of the data keys given
+	ErrNoDataKey = errors.New("data key not found")
+	// ErrInvalidData is returned for wrapped keys and ciphertexts which cannot be read or were altered
+	ErrInvalidData = errors.New("invalid envelope data")
+)
+
+const (
+	formatVersion = 1
+	dataKeySize   = 32
+	dataKeyIDSize = 16
+)
+
+// KeyManager wraps data keys with key encryption keys it holds, such as key
+// files or the keys of a cloud KMS, which never leave it
+type KeyManager interface {
+	// WrapContext encrypts dataKey with the current key encryption key and
+	// returns the ID of that key along with the wrapped data key
+	WrapContext(ctx context.Context, dataKey []byte) (string, []byte, error)
+	// UnwrapContext decrypts a data key wrapped by the key encryption key keyID
+	UnwrapContext(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// ErrorHandler receives the errors of the methods of the plain Encryption
+// interface, which cannot return them
+type ErrorHandler interface {
+	Error(e error)
+}
+
+type logErrorHandler struct{}
+
+func (l logErrorHandler) Error(e error) {
+	log.Println("ERROR", e.Error())
+}
+
+type Config struct {
+	KeyManager KeyManager
+	// ErrorHandler receives the errors of Encrypt and Decrypt, by default they
+	// are logged
+	ErrorHandler ErrorHandler
+}
+
+// Encryption encrypts the transactions of each bucket with AES-256-GCM under
+// a random data key of the bucket, which is stored wrapped by the KeyManager.
+// Wrapped keys and ciphertexts both start with a version byte and the random
+// ID of the data key, so a ciphertext can be matched to its wrapped key.
+// Without a data key it cannot encrypt anything, so the methods of the plain
+// Encryption interface fail: see cbtransaction.BucketEncryption
+type Encryption struct {
+	keyManager   KeyManager
+	errorHandler ErrorHandler
+
+	lock     *sync.RWMutex
+	dataKeys map[[dataKeyIDSize]byte]cipher.AEAD
+}
+
+func New(config Config) (*Encryption, error) {
+	if config.KeyManager == nil {
+		return nil, errors.New("cbenvelope: a key manager is required")
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = logErrorHandler{}
+	}
+	return &Encryption{
+		keyManager:   config.KeyManager,
+		errorHandler: config.ErrorHandler,
+		lock:         &sync.RWMutex{},
+		dataKeys:     map[[dataKeyIDSize]byte]cipher.AEAD{},
+	}, nil
+}
+
+func (n *Encryption) GetKey() [8]byte {
+	return Key
+}
+
+// Encrypt reports ErrNoDataKey to the ErrorHandler and returns nil as there is
+// no data key to encrypt with, see EncryptWithDataKeyContext
+func (n *Encryption) Encrypt(data []byte) []byte {
+	n.errorHandler.Error(fmt.Errorf("cbenvelope: Encrypt: %w", ErrNoDataKey))
+	return nil
+}
+
+func (n *Encryption) EncryptWriter(data []byte, writer io.Writer) error {
+	return ErrNoDataKey
+}
+
+// Decrypt reports ErrNoDataKey to the ErrorHandler and returns nil as there is
+// no data key to decrypt with, see DecryptWithDataKeysContext
+func (n *Encryption) Decrypt(encrypted []byte) []byte {
+	n.errorHandler.Error(fmt.Errorf("cbenvelope: Decrypt: %w", ErrNoDataKey))
+	return nil
+}
+
+func (n *Encryption) DecryptReader(reader io.Reader, out []byte) error {
+	return ErrNoDataKey
+}
+
+func (n *Encryption) NewDataKeyContext(ctx context.Context) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, e := io.ReadFull(rand.Reader, dataKey)
+	if e != nil {
+		return nil, e
+	}
+	dataKeyID := [dataKeyIDSize]byte{}
+	_, e = io.ReadFull(rand.Reader, dataKeyID[:])
+	if e != nil {
+		return nil, e
+	}
+
+	wrappedKey, e := n.wrap(ctx, dataKeyID, dataKey)
+	if e != nil {
+		return nil, e
+	}
+	aead, e := newAEAD(dataKey)
+	if e != nil {
+		return nil, e
+	}
+	n.lock.Lock()
+	n.dataKeys[dataKeyID] = aead
+	n.lock.Unlock()
+
+	return wrappedKey, nil
+}
+
+func (n *Encryption) EncryptWithDataKeyContext(ctx context.Context, wrappedKey []byte, data []byte) ([]byte, error) {
+	dataKeyID, keyID, wrapped, e := parseWrappedKey(wrappedKey)
+	if e != nil {
+		return nil, e
+	}
+	aead, e := n.dataKey(ctx, dataKeyID, keyID, wrapped)
+	if e != nil {
+		return nil, e
+	}
+
+	encrypted := make([]byte, 1+dataKeyIDSize+aead.NonceSize(), 1+dataKeyIDSize+aead.NonceSize()+len(data)+aead.Overhead())
+	encrypted[0] = formatVersion
+	copy(encrypted[1:], dataKeyID[:])
+	nonce := encrypted[1+dataKeyIDSize:]
+	_, e = io.ReadFull(rand.Reader, nonce)
+	if e != nil {
+		return nil, e
+	}
+
+	return aead.Seal(encrypted, nonce, data, dataKeyID[:]), nil
+}
+
+func (n *Encryption) DecryptWithDataKeysContext(ctx context.Context, wrappedKeys [][]byte, encrypted []byte) ([]byte, error) {
+	if len(encrypted) < 1+dataKeyIDSize || encrypted[0] != formatVersion {
+		return nil, fmt.Errorf("%w: unknown ciphertext format", ErrInvalidData)
+	}
+	dataKeyID := [dataKeyIDSize]byte{}
+	copy(dataKeyID[:], encrypted[1:])
+
+	n.lock.RLock()
+	aead, ok := n.dataKeys[dataKeyID]
+	n.lock.RUnlock()
+	if !ok {
+		for _, wrappedKey := range wrappedKeys {
+			id, keyID, wrapped, e := parseWrappedKey(wrappedKey)
+			if e != nil || id != dataKeyID {
+				continue
+			}
+			aead, e = n.dataKey(ctx, dataKeyID, keyID, wrapped)
+			if e != nil {
+				return nil, e
+			}
+			break
+		}
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoDataKey, hex.EncodeToString(dataKeyID[:]))
+	}
+
+	sealed := encrypted[1+dataKeyIDSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated ciphertext", ErrInvalidData)
+	}
+	data, e := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], dataKeyID[:])
+	if e != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidData, e.Error())
+	}
+	return data, nil
+}
+
+func (n *Encryption) RewrapDataKeyContext(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	dataKeyID, keyID, wrapped, e := parseWrappedKey(wrappedKey)
+	if e != nil {
+		return nil, e
+	}
+	dataKey, e := n.keyManager.UnwrapContext(ctx, keyID, wrapped)
+	if e != nil {
+		return nil, e
+	}
+	return n.wrap(ctx, dataKeyID, dataKey)
+}
+
+// dataKey returns the cipher of a data key, unwrapping it the first time
+func (n *Encryption) dataKey(ctx context.Context, dataKeyID [dataKeyIDSize]byte, keyID string, wrapped []byte) (cipher.AEAD, error) {
+	n.lock.RLock()
+	aead, ok := n.dataKeys[dataKeyID]
+	n.lock.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	dataKey, e := n.keyManager.UnwrapContext(ctx, keyID, wrapped)
+	if e != nil {
+		return nil, e
+	}
+	aead, e = newAEAD(dataKey)
+	if e != nil {
+		return nil, e
+	}
+	n.lock.Lock()
+	n.dataKeys[dataKeyID] = aead
+	n.lock.Unlock()
+
+	return aead, nil
+}
+
+func (n *Encryption) wrap(ctx context.Context, dataKeyID [dataKeyIDSize]byte, dataKey []byte) ([]byte, error) {
+	keyID, wrapped, e := n.keyManager.WrapContext(ctx, dataKey)
+	if e != nil {
+		return nil, e
+	}
+	if keyID == "" || len(keyID) > 255 {
+		return nil, fmt.Errorf("cbenvelope: invalid key id: %q", keyID)
+	}
+
+	wrappedKey := make([]byte, 0, 2+dataKeyIDSize+len(keyID)+len(wrapped))
+	wrappedKey = append(wrappedKey, formatVersion)
+	wrappedKey = append(wrappedKey, dataKeyID[:]...)
+	wrappedKey = append(wrappedKey, byte(len(keyID)))
+	wrappedKey = append(wrappedKey, keyID...)
+	return append(wrappedKey, wrapped...), nil
+}
+
+// WrappedKeyID returns the ID of the key encryption key wrappedKey is wrapped with
+func WrappedKeyID(wrappedKey []byte) (string, error) {
+	_, keyID, _, e := parseWrappedKey(wrappedKey)
+	return keyID, e
+}
+
+func parseWrappedKey(wrappedKey []byte) ([dataKeyIDSize]byte, string, []byte, error) {
+	dataKeyID := [dataKeyIDSize]byte{}
+	if len(wrappedKey) < 2+dataKeyIDSize || wrappedKey[0] != formatVersion {
+		return dataKeyID, "", nil, fmt.Errorf("%w: unknown wrapped key format", ErrInvalidData)
+	}
+	copy(dataKeyID[:], wrappedKey[1:])
+	keyIDLength := int(wrappedKey[1+dataKeyIDSize])
+	rest := wrappedKey[2+dataKeyIDSize:]
+	if len(rest) < keyIDLength {
+		return dataKeyID, "", nil, fmt.Errorf("%w: truncated wrapped key", ErrInvalidData)
+	}
+	return dataKeyID, string(rest[:keyIDLength]), rest[keyIDLength:], nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
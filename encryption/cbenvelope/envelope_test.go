@@ -0,0 +1,221 @@
+package cbenvelope
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func getTestEncryption(t *testing.T) (*Encryption, *FileKeyManager, func()) {
+	dir, e := ioutil.TempDir("", "cbenvelope")
+	if e != nil {
+		t.Fatal(e)
+	}
+	keyManager, e := NewFileKeyManager(FileKeyManagerConfig{Dir: dir})
+	if e != nil {
+		os.RemoveAll(dir)
+		t.Fatal(e)
+	}
+	encryption, e := New(Config{KeyManager: keyManager})
+	if e != nil {
+		os.RemoveAll(dir)
+		t.Fatal(e)
+	}
+	return encryption, keyManager, func() { os.RemoveAll(dir) }
+}
+
+func TestEncryption_DecryptWithDataKeysContext(t *testing.T) {
+	encryption, keyManager, cleanup := getTestEncryption(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	wrappedKey1, e := encryption.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	wrappedKey2, e := encryption.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted, e := encryption.EncryptWithDataKeyContext(ctx, wrappedKey2, []byte("some string"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if bytes.Contains(encrypted, []byte("some string")) {
+		t.Error("EncryptWithDataKeyContext() left the data readable")
+	}
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name        string
+		wrappedKeys [][]byte
+		encrypted   []byte
+		// fresh decrypts with a new Encryption which has not unwrapped any data key yet
+		fresh   bool
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:        "cached",
+			wrappedKeys: nil,
+			encrypted:   encrypted,
+			want:        []byte("some string"),
+		},
+		{
+			name:        "unwrapped",
+			wrappedKeys: [][]byte{wrappedKey1, wrappedKey2},
+			encrypted:   encrypted,
+			fresh:       true,
+			want:        []byte("some string"),
+		},
+		{
+			name:        "otherDataKey",
+			wrappedKeys: [][]byte{wrappedKey1},
+			encrypted:   encrypted,
+			fresh:       true,
+			wantErr:     ErrNoDataKey,
+		},
+		{
+			name:        "tampered",
+			wrappedKeys: [][]byte{wrappedKey2},
+			encrypted:   tampered,
+			wantErr:     ErrInvalidData,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := encryption
+			if tt.fresh {
+				n, _ = New(Config{KeyManager: keyManager})
+			}
+			got, err := n.DecryptWithDataKeysContext(ctx, tt.wrappedKeys, tt.encrypted)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecryptWithDataKeysContext() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("DecryptWithDataKeysContext() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryption_RewrapDataKeyContext(t *testing.T) {
+	encryption, keyManager, cleanup := getTestEncryption(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	oldKeyID, _ := keyManager.CurrentKeyID()
+	wrappedKey, e := encryption.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted, e := encryption.EncryptWithDataKeyContext(ctx, wrappedKey, []byte("some string"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	newKeyID, e := keyManager.Rotate()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	rewrapped, e := encryption.RewrapDataKeyContext(ctx, wrappedKey)
+	if e != nil {
+		t.Errorf("RewrapDataKeyContext() error = %v", e)
+		return
+	}
+	_, keyID, _, _ := parseWrappedKey(rewrapped)
+	if keyID != newKeyID {
+		t.Errorf("RewrapDataKeyContext() wrapped with %s, want %s", keyID, newKeyID)
+	}
+	if e := keyManager.DeleteKey(oldKeyID); e != nil {
+		t.Error(e)
+		return
+	}
+	if e := keyManager.DeleteKey(newKeyID); e == nil {
+		t.Error("DeleteKey() error = nil for the current key")
+	}
+
+	// the payload encrypted before the rotation decrypts without the old key
+	fresh, _ := New(Config{KeyManager: keyManager})
+	got, e := fresh.DecryptWithDataKeysContext(ctx, [][]byte{rewrapped}, encrypted)
+	if e != nil || !bytes.Equal(got, []byte("some string")) {
+		t.Errorf("DecryptWithDataKeysContext() = %s, error = %v", got, e)
+	}
+	fresh, _ = New(Config{KeyManager: keyManager})
+	if _, e := fresh.DecryptWithDataKeysContext(ctx, [][]byte{wrappedKey}, encrypted); e == nil {
+		t.Error("DecryptWithDataKeysContext() error = nil with a deleted key encryption key")
+	}
+}
+
+func TestCloudKeyManager(t *testing.T) {
+	ctx := context.Background()
+	if _, _, e := NewCloudKeyManager(CloudKeyManagerConfig{}).WrapContext(ctx, []byte("key")); !errors.Is(e, ErrNotConfigured) {
+		t.Errorf("WrapContext() error = %v, want %v", e, ErrNotConfigured)
+	}
+
+	// a reversible stand-in for the KMS
+	reverse := func(ctx context.Context, keyID string, data []byte) ([]byte, error) {
+		reversed := make([]byte, len(data))
+		for i := range data {
+			reversed[len(data)-1-i] = data[i]
+		}
+		return reversed, nil
+	}
+	keyManager := NewCloudKeyManager(CloudKeyManagerConfig{
+		KeyID:   "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		Encrypt: reverse,
+		Decrypt: reverse,
+	})
+	encryption, _ := New(Config{KeyManager: keyManager})
+	wrappedKey, e := encryption.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted, _ := encryption.EncryptWithDataKeyContext(ctx, wrappedKey, []byte("some string"))
+	fresh, _ := New(Config{KeyManager: keyManager})
+	got, e := fresh.DecryptWithDataKeysContext(ctx, [][]byte{wrappedKey}, encrypted)
+	if e != nil || !bytes.Equal(got, []byte("some string")) {
+		t.Errorf("DecryptWithDataKeysContext() = %s, error = %v", got, e)
+	}
+}
+
+type recordingErrorHandler struct {
+	errors []error
+}
+
+func (r *recordingErrorHandler) Error(e error) {
+	r.errors = append(r.errors, e)
+}
+
+func TestEncryption_Encrypt(t *testing.T) {
+	encryption, _, cleanup := getTestEncryption(t)
+	defer cleanup()
+	handler := &recordingErrorHandler{}
+	encryption.errorHandler = handler
+
+	if got := encryption.Encrypt([]byte("data")); got != nil {
+		t.Errorf("Encrypt() = %v, want nil", got)
+	}
+	if got := encryption.Decrypt([]byte("data")); got != nil {
+		t.Errorf("Decrypt() = %v, want nil", got)
+	}
+	if len(handler.errors) != 2 || !errors.Is(handler.errors[0], ErrNoDataKey) || !errors.Is(handler.errors[1], ErrNoDataKey) {
+		t.Errorf("errors handled = %v, want %v twice", handler.errors, ErrNoDataKey)
+	}
+	if e := encryption.EncryptWriter([]byte("data"), &bytes.Buffer{}); !errors.Is(e, ErrNoDataKey) {
+		t.Errorf("EncryptWriter() error = %v, want %v", e, ErrNoDataKey)
+	}
+}
@@ -0,0 +1,203 @@
+package cbenvelope
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	currentKeyFileName = "current"
+	keyFileSuffix      = ".key"
+)
+
+type FileKeyManagerConfig struct {
+	// Dir holds the key files, it is created when missing
+	Dir string
+}
+
+// FileKeyManager keeps key encryption keys as files in a directory, named by
+// their key ID, and the ID of the current key in a file named current.
+// Rotating adds a new current key; old keys are kept for unwrapping until
+// every data key has been wrapped again and they are deleted
+type FileKeyManager struct {
+	dir  string
+	lock *sync.Mutex
+}
+
+// NewFileKeyManager opens the key directory, creating a first key when it has none
+func NewFileKeyManager(config FileKeyManagerConfig) (*FileKeyManager, error) {
+	e := os.MkdirAll(config.Dir, 0700)
+	if e != nil {
+		return nil, e
+	}
+	m := &FileKeyManager{
+		dir:  config.Dir,
+		lock: &sync.Mutex{},
+	}
+	_, e = m.CurrentKeyID()
+	if errors.Is(e, os.ErrNotExist) {
+		_, e = m.Rotate()
+	}
+	if e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+// CurrentKeyID returns the ID of the key new data keys are wrapped with
+func (m *FileKeyManager) CurrentKeyID() (string, error) {
+	data, e := ioutil.ReadFile(filepath.Join(m.dir, currentKeyFileName))
+	if e != nil {
+		return "", e
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// KeyIDs returns the IDs of every key in the directory
+func (m *FileKeyManager) KeyIDs() ([]string, error) {
+	files, e := ioutil.ReadDir(m.dir)
+	if e != nil {
+		return nil, e
+	}
+	var keyIDs []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), keyFileSuffix) {
+			keyIDs = append(keyIDs, strings.TrimSuffix(file.Name(), keyFileSuffix))
+		}
+	}
+	return keyIDs, nil
+}
+
+// Rotate creates a new key and makes it the current one, returning its ID
+func (m *FileKeyManager) Rotate() (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id := make([]byte, 8)
+	_, e := io.ReadFull(rand.Reader, id)
+	if e != nil {
+		return "", e
+	}
+	keyID := hex.EncodeToString(id)
+	key := make([]byte, dataKeySize)
+	_, e = io.ReadFull(rand.Reader, key)
+	if e != nil {
+		return "", e
+	}
+
+	e = m.writeFile(keyID+keyFileSuffix, key)
+	if e != nil {
+		return "", e
+	}
+	e = m.writeFile(currentKeyFileName, []byte(keyID))
+	if e != nil {
+		return "", e
+	}
+	return keyID, nil
+}
+
+// DeleteKey removes a key which no data key is wrapped with anymore. The
+// current key cannot be deleted
+func (m *FileKeyManager) DeleteKey(keyID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, e := m.CurrentKeyID()
+	if e != nil {
+		return e
+	}
+	if keyID == current {
+		return fmt.Errorf("cbenvelope: key %s is the current key", keyID)
+	}
+	path, e := m.keyPath(keyID)
+	if e != nil {
+		return e
+	}
+	return os.Remove(path)
+}
+
+func (m *FileKeyManager) WrapContext(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	keyID, e := m.CurrentKeyID()
+	if e != nil {
+		return "", nil, e
+	}
+	aead, e := m.key(keyID)
+	if e != nil {
+		return "", nil, e
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	_, e = io.ReadFull(rand.Reader, nonce)
+	if e != nil {
+		return "", nil, e
+	}
+	return keyID, aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (m *FileKeyManager) UnwrapContext(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, e := m.key(keyID)
+	if e != nil {
+		return nil, e
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated wrapped key", ErrInvalidData)
+	}
+	dataKey, e := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if e != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidData, e.Error())
+	}
+	return dataKey, nil
+}
+
+func (m *FileKeyManager) key(keyID string) (cipher.AEAD, error) {
+	path, e := m.keyPath(keyID)
+	if e != nil {
+		return nil, e
+	}
+	key, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	return newAEAD(key)
+}
+
+// keyPath returns the file of keyID, which must be hex so it stays in the directory
+func (m *FileKeyManager) keyPath(keyID string) (string, error) {
+	if _, e := hex.DecodeString(keyID); e != nil || keyID == "" {
+		return "", fmt.Errorf("cbenvelope: invalid key id: %q", keyID)
+	}
+	return filepath.Join(m.dir, keyID+keyFileSuffix), nil
+}
+
+// writeFile replaces a file in the directory through a temporary file
+func (m *FileKeyManager) writeFile(name string, data []byte) error {
+	temp, e := ioutil.TempFile(m.dir, name+".tmp")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(temp.Name())
+	_, e = temp.Write(data)
+	if e != nil {
+		_ = temp.Close()
+		return e
+	}
+	e = temp.Chmod(0600)
+	if e != nil {
+		_ = temp.Close()
+		return e
+	}
+	e = temp.Close()
+	if e != nil {
+		return e
+	}
+	return os.Rename(temp.Name(), filepath.Join(m.dir, name))
+}
@@ -0,0 +1,182 @@
+package cbshred
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+var Key = [8]byte{'s', 'h', 'r', 'e', 'd', 0, 0, 0}
+
+var (
+	// ErrNoSubject is returned by the plain Encryption methods, which do not know the subject
+	ErrNoSubject = errors.New("no subject to encrypt for")
+	// ErrInvalidData is returned for ciphertexts which cannot be read or were altered
+	ErrInvalidData = errors.New("invalid subject data")
+	// ErrUnknownKey is returned for ciphertexts under a key the KeyStore does
+	// not hold and never forgot, such as a key lost with the key store
+	ErrUnknownKey = errors.New("subject key is unknown")
+)
+
+const (
+	formatVersion = 1
+	keySize       = 32
+	keyIDSize     = 16
+	nonceSize     = 12
+)
+
+// ErrorHandler receives the errors of the methods of the plain Encryption
+// interface, which cannot return them
+type ErrorHandler interface {
+	Error(e error)
+}
+
+type logErrorHandler struct{}
+
+func (l logErrorHandler) Error(e error) {
+	log.Println("ERROR", e.Error())
+}
+
+type Config struct {
+	KeyStore KeyStore
+	// ErrorHandler receives the errors of Encrypt and Decrypt, by default they
+	// are logged
+	ErrorHandler ErrorHandler
+}
+
+// Encryption encrypts transactions with AES-256-GCM under the key of their
+// subject from the KeyStore. A ciphertext starts with a version byte, the ID
+// of the subject key and the subject ID, so transactions about a subject can
+// be recognised once their key is gone. Subject IDs are stored in the clear
+// and should not be personal data themselves, such as a random user ID
+type Encryption struct {
+	keyStore     KeyStore
+	errorHandler ErrorHandler
+}
+
+func New(config Config) (*Encryption, error) {
+	if config.KeyStore == nil {
+		return nil, errors.New("cbshred: a key store is required")
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = logErrorHandler{}
+	}
+	return &Encryption{
+		keyStore:     config.KeyStore,
+		errorHandler: config.ErrorHandler,
+	}, nil
+}
+
+func (n *Encryption) GetKey() [8]byte {
+	return Key
+}
+
+// Encrypt reports ErrNoSubject to the ErrorHandler and returns nil as there is
+// no subject to encrypt for, see EncryptSubjectContext
+func (n *Encryption) Encrypt(data []byte) []byte {
+	n.errorHandler.Error(fmt.Errorf("cbshred: Encrypt: %w", ErrNoSubject))
+	return nil
+}
+
+func (n *Encryption) EncryptWriter(data []byte, writer io.Writer) error {
+	return ErrNoSubject
+}
+
+// Decrypt reports ErrNoSubject to the ErrorHandler and returns nil, see
+// DecryptSubjectContext
+func (n *Encryption) Decrypt(encrypted []byte) []byte {
+	n.errorHandler.Error(fmt.Errorf("cbshred: Decrypt: %w", ErrNoSubject))
+	return nil
+}
+
+func (n *Encryption) DecryptReader(reader io.Reader, out []byte) error {
+	return ErrNoSubject
+}
+
+func (n *Encryption) EncryptSubjectContext(ctx context.Context, subjectID string, data []byte) ([]byte, error) {
+	if subjectID == "" || len(subjectID) > 255 {
+		return nil, fmt.Errorf("cbshred: invalid subject id: %q", subjectID)
+	}
+	keyID, key, e := n.keyStore.KeyContext(ctx, subjectID, true)
+	if e != nil {
+		return nil, e
+	}
+	aead, e := newAEAD(key)
+	if e != nil {
+		return nil, e
+	}
+
+	encrypted := make([]byte, 0, 2+keyIDSize+len(subjectID)+nonceSize+len(data)+aead.Overhead())
+	encrypted = append(encrypted, formatVersion)
+	encrypted = append(encrypted, keyID[:]...)
+	encrypted = append(encrypted, byte(len(subjectID)))
+	encrypted = append(encrypted, subjectID...)
+	header := encrypted
+	nonce := make([]byte, nonceSize)
+	_, e = io.ReadFull(rand.Reader, nonce)
+	if e != nil {
+		return nil, e
+	}
+	encrypted = append(encrypted, nonce...)
+
+	return aead.Seal(encrypted, nonce, data, header), nil
+}
+
+// DecryptSubjectContext reports encrypted as shredded when the KeyStore has a
+// tombstone for its key. A key which is missing without a tombstone returns
+// ErrUnknownKey
+func (n *Encryption) DecryptSubjectContext(ctx context.Context, encrypted []byte) (string, []byte, bool, error) {
+	if len(encrypted) < 2+keyIDSize || encrypted[0] != formatVersion {
+		return "", nil, false, fmt.Errorf("%w: unknown ciphertext format", ErrInvalidData)
+	}
+	keyID := [keyIDSize]byte{}
+	copy(keyID[:], encrypted[1:])
+	length := int(encrypted[1+keyIDSize])
+	headerLength := 2 + keyIDSize + length
+	if len(encrypted) < headerLength+nonceSize {
+		return "", nil, false, fmt.Errorf("%w: truncated ciphertext", ErrInvalidData)
+	}
+	subjectID := string(encrypted[2+keyIDSize : headerLength])
+
+	currentKeyID, key, e := n.keyStore.KeyContext(ctx, subjectID, false)
+	if e != nil && !errors.Is(e, ErrNoKey) {
+		return subjectID, nil, false, e
+	}
+	if e != nil || currentKeyID != keyID {
+		forgotten, e := n.keyStore.ForgottenContext(ctx, subjectID, keyID)
+		if e != nil {
+			return subjectID, nil, false, e
+		}
+		if !forgotten {
+			return subjectID, nil, false, fmt.Errorf("%w: subject %s", ErrUnknownKey, subjectID)
+		}
+		return subjectID, nil, true, nil
+	}
+	aead, e := newAEAD(key)
+	if e != nil {
+		return subjectID, nil, false, e
+	}
+	nonce := encrypted[headerLength : headerLength+nonceSize]
+	data, e := aead.Open(nil, nonce, encrypted[headerLength+nonceSize:], encrypted[:headerLength])
+	if e != nil {
+		return subjectID, nil, false, fmt.Errorf("%w: %s", ErrInvalidData, e.Error())
+	}
+	return subjectID, data, false, nil
+}
+
+func (n *Encryption) ForgetSubjectContext(ctx context.Context, subjectID string) error {
+	return n.keyStore.ForgetContext(ctx, subjectID)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,220 @@
+package cbshred
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEncryption_DecryptSubjectContext(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cbshred")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dir)
+	keyStore, e := NewFileKeyStore(FileKeyStoreConfig{Dir: dir})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	n, _ := New(Config{KeyStore: keyStore})
+	ctx := context.Background()
+
+	kept, e := n.EncryptSubjectContext(ctx, "user-1", []byte("kept"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	forgotten, e := n.EncryptSubjectContext(ctx, "user-2", []byte("forgotten"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if e := n.ForgetSubjectContext(ctx, "user-2"); e != nil {
+		t.Error(e)
+		return
+	}
+	// the subject comes back after being forgotten, with a new key
+	returned, e := n.EncryptSubjectContext(ctx, "user-2", []byte("returned"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	tampered := append([]byte{}, kept...)
+	tampered[len(tampered)-1] ^= 1
+	// a key lost with its file, without the subject being forgotten
+	lost, e := n.EncryptSubjectContext(ctx, "user-3", []byte("lost"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if e := os.Remove(keyStore.keyPath("user-3")); e != nil {
+		t.Error(e)
+		return
+	}
+	// a key replaced by one the forgotten keys do not include
+	replaced := append([]byte{}, returned...)
+	replaced[1] ^= 1
+
+	tests := []struct {
+		name         string
+		encrypted    []byte
+		wantSubject  string
+		want         []byte
+		wantShredded bool
+		wantErr      error
+	}{
+		{
+			name:        "kept",
+			encrypted:   kept,
+			wantSubject: "user-1",
+			want:        []byte("kept"),
+		},
+		{
+			name:         "forgotten",
+			encrypted:    forgotten,
+			wantSubject:  "user-2",
+			wantShredded: true,
+		},
+		{
+			name:        "returned",
+			encrypted:   returned,
+			wantSubject: "user-2",
+			want:        []byte("returned"),
+		},
+		{
+			name:        "lost",
+			encrypted:   lost,
+			wantSubject: "user-3",
+			wantErr:     ErrUnknownKey,
+		},
+		{
+			name:        "unknownKey",
+			encrypted:   replaced,
+			wantSubject: "user-2",
+			wantErr:     ErrUnknownKey,
+		},
+		{
+			name:        "tampered",
+			encrypted:   tampered,
+			wantSubject: "user-1",
+			wantErr:     ErrInvalidData,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subjectID, got, shredded, err := n.DecryptSubjectContext(ctx, tt.encrypted)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecryptSubjectContext() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if subjectID != tt.wantSubject || shredded != tt.wantShredded || !bytes.Equal(got, tt.want) {
+				t.Errorf("DecryptSubjectContext() = %s, %s, %v, want %s, %s, %v", subjectID, got, shredded, tt.wantSubject, tt.want, tt.wantShredded)
+			}
+		})
+	}
+
+	keys, _ := filepath.Glob(filepath.Join(dir, "*.key"))
+	if len(keys) != 2 {
+		t.Errorf("key store holds %d keys, want 2", len(keys))
+	}
+	tombstones, _ := filepath.Glob(filepath.Join(dir, "*.forgotten"))
+	if len(tombstones) != 1 {
+		t.Errorf("key store holds %d tombstones, want 1", len(tombstones))
+	}
+}
+
+type recordingErrorHandler struct {
+	errors []error
+}
+
+func (r *recordingErrorHandler) Error(e error) {
+	r.errors = append(r.errors, e)
+}
+
+func TestEncryption_Encrypt(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cbshred")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dir)
+	keyStore, e := NewFileKeyStore(FileKeyStoreConfig{Dir: dir})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	handler := &recordingErrorHandler{}
+	n, _ := New(Config{KeyStore: keyStore, ErrorHandler: handler})
+
+	if got := n.Encrypt([]byte("data")); got != nil {
+		t.Errorf("Encrypt() = %v, want nil", got)
+	}
+	if got := n.Decrypt([]byte("data")); got != nil {
+		t.Errorf("Decrypt() = %v, want nil", got)
+	}
+	if len(handler.errors) != 2 || !errors.Is(handler.errors[0], ErrNoSubject) || !errors.Is(handler.errors[1], ErrNoSubject) {
+		t.Errorf("errors handled = %v, want %v twice", handler.errors, ErrNoSubject)
+	}
+	if e := n.EncryptWriter([]byte("data"), &bytes.Buffer{}); !errors.Is(e, ErrNoSubject) {
+		t.Errorf("EncryptWriter() error = %v, want %v", e, ErrNoSubject)
+	}
+}
+
+func TestFileKeyStore_ForgetConcurrently(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cbshred")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dir)
+	keyStore, e := NewFileKeyStore(FileKeyStoreConfig{Dir: dir})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	n, _ := New(Config{KeyStore: keyStore})
+	ctx := context.Background()
+
+	var wait sync.WaitGroup
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 200; i++ {
+			encrypted, e := n.EncryptSubjectContext(ctx, "user-1", []byte("data"))
+			if e != nil {
+				t.Errorf("EncryptSubjectContext() error = %v", e)
+				return
+			}
+			// a wiped key file has an all zero key ID
+			if bytes.Equal(encrypted[1:1+keyIDSize], make([]byte, keyIDSize)) {
+				t.Error("EncryptSubjectContext() encrypted under a wiped key")
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 200; i++ {
+			if e := n.ForgetSubjectContext(ctx, "user-1"); e != nil {
+				t.Errorf("ForgetSubjectContext() error = %v", e)
+				return
+			}
+		}
+	}()
+	wait.Wait()
+
+	if e := ioutil.WriteFile(keyStore.keyPath("user-2"), make([]byte, keyIDSize+keySize), 0600); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, err := n.EncryptSubjectContext(ctx, "user-2", []byte("data")); err == nil {
+		t.Error("EncryptSubjectContext() error = nil for an all zero key")
+	}
+}
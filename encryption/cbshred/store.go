@@ -0,0 +1,255 @@
+package cbshred
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNoKey is returned by a KeyStore for a subject without a key, either new or forgotten
+var ErrNoKey = errors.New("subject has no key")
+
+// KeyStore holds a key for every subject. Every key has a random ID, so a
+// key created for a subject after they were forgotten does not match the
+// transactions written before. Forgetting a subject leaves a tombstone with
+// the ID of the destroyed key, which tells a shredded transaction apart from
+// one whose key was lost
+type KeyStore interface {
+	// KeyContext returns the ID and key of subjectID, creating them when
+	// create is true and the subject has none, ErrNoKey otherwise
+	KeyContext(ctx context.Context, subjectID string, create bool) ([keyIDSize]byte, []byte, error)
+	// ForgetContext destroys the key of subjectID and leaves a tombstone for it
+	ForgetContext(ctx context.Context, subjectID string) error
+	// ForgottenContext reports whether the key keyID of subjectID was
+	// destroyed by ForgetContext
+	ForgottenContext(ctx context.Context, subjectID string, keyID [keyIDSize]byte) (bool, error)
+}
+
+type FileKeyStoreConfig struct {
+	// Dir holds the key files, it is created when missing
+	Dir string
+}
+
+// FileKeyStore keeps the key of each subject in a file of its own, named by
+// the SHA-256 of the subject ID. Forgetting appends the key ID to a tombstone
+// file of the subject, moves the key file aside and overwrites it before
+// removing it. That does not reach copies kept by the filesystem, the disk or
+// backups, so Dir should be left out of backups, or kept on an encrypted
+// volume which can be wiped
+type FileKeyStore struct {
+	dir  string
+	lock *sync.Mutex
+}
+
+func NewFileKeyStore(config FileKeyStoreConfig) (*FileKeyStore, error) {
+	e := os.MkdirAll(config.Dir, 0700)
+	if e != nil {
+		return nil, e
+	}
+	return &FileKeyStore{
+		dir:  config.Dir,
+		lock: &sync.Mutex{},
+	}, nil
+}
+
+// KeyContext creates keys in a temporary file which is linked into place once
+// written, so a key file is never read before it is complete
+func (s *FileKeyStore) KeyContext(ctx context.Context, subjectID string, create bool) ([keyIDSize]byte, []byte, error) {
+	keyID := [keyIDSize]byte{}
+	path := s.keyPath(subjectID)
+	data, e := ioutil.ReadFile(path)
+	if e == nil {
+		if len(data) != keyIDSize+keySize || allZero(data[:keyIDSize]) || allZero(data[keyIDSize:]) {
+			return keyID, nil, fmt.Errorf("cbshred: invalid key file for subject %s", subjectID)
+		}
+		copy(keyID[:], data)
+		return keyID, data[keyIDSize:], nil
+	}
+	if !os.IsNotExist(e) {
+		return keyID, nil, e
+	}
+	if !create {
+		return keyID, nil, fmt.Errorf("%w: %s", ErrNoKey, subjectID)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data = make([]byte, keyIDSize+keySize)
+	_, e = io.ReadFull(rand.Reader, data)
+	if e != nil {
+		return keyID, nil, e
+	}
+	file, e := ioutil.TempFile(s.dir, filepath.Base(path)+".*.tmp")
+	if e != nil {
+		return keyID, nil, e
+	}
+	defer os.Remove(file.Name())
+	_, e = file.Write(data)
+	if e == nil {
+		e = file.Sync()
+	}
+	if closeErr := file.Close(); e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		return keyID, nil, e
+	}
+	// unlike a rename, linking never replaces a key another process created
+	// since it was read
+	e = os.Link(file.Name(), path)
+	if os.IsExist(e) {
+		return s.KeyContext(ctx, subjectID, false)
+	}
+	if e != nil {
+		return keyID, nil, e
+	}
+	e = syncDir(s.dir)
+	if e != nil {
+		return keyID, nil, e
+	}
+
+	copy(keyID[:], data)
+	return keyID, data[keyIDSize:], nil
+}
+
+// ForgetContext moves the key file aside before overwriting it, so KeyContext
+// either reads the whole key or none
+func (s *FileKeyStore) ForgetContext(ctx context.Context, subjectID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.keyPath(subjectID)
+	aside := s.forgettingPath(subjectID)
+	// a key moved aside by a ForgetContext which did not finish already has
+	// its tombstone
+	e := wipe(aside)
+	if e != nil {
+		return e
+	}
+	data, e := ioutil.ReadFile(path)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	if len(data) != keyIDSize+keySize {
+		return fmt.Errorf("cbshred: invalid key file for subject %s", subjectID)
+	}
+	// the tombstone is written first, so a key is never gone without one
+	e = s.appendTombstone(subjectID, data[:keyIDSize])
+	if e != nil {
+		return e
+	}
+
+	e = os.Rename(path, aside)
+	if e != nil {
+		return e
+	}
+	return wipe(aside)
+}
+
+// wipe overwrites the file with zeros and removes it, missing files are ignored
+func wipe(path string) error {
+	file, e := os.OpenFile(path, os.O_RDWR, 0600)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	info, e := file.Stat()
+	if e == nil {
+		_, e = file.WriteAt(make([]byte, info.Size()), 0)
+	}
+	if e == nil {
+		e = file.Sync()
+	}
+	if closeErr := file.Close(); e == nil {
+		e = closeErr
+	}
+	if e != nil {
+		return e
+	}
+	return os.Remove(path)
+}
+
+func syncDir(dir string) error {
+	file, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	e = file.Sync()
+	if closeErr := file.Close(); e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *FileKeyStore) ForgottenContext(ctx context.Context, subjectID string, keyID [keyIDSize]byte) (bool, error) {
+	data, e := ioutil.ReadFile(s.tombstonePath(subjectID))
+	if os.IsNotExist(e) {
+		return false, nil
+	}
+	if e != nil {
+		return false, e
+	}
+	if len(data)%keyIDSize != 0 {
+		return false, fmt.Errorf("cbshred: invalid tombstone for subject %s", subjectID)
+	}
+	for i := 0; i < len(data); i += keyIDSize {
+		if bytes.Equal(data[i:i+keyIDSize], keyID[:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *FileKeyStore) appendTombstone(subjectID string, keyID []byte) error {
+	file, e := os.OpenFile(s.tombstonePath(subjectID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if e != nil {
+		return e
+	}
+	_, e = file.Write(keyID)
+	if e == nil {
+		e = file.Sync()
+	}
+	if closeErr := file.Close(); e == nil {
+		e = closeErr
+	}
+	return e
+}
+
+func (s *FileKeyStore) keyPath(subjectID string) string {
+	hash := sha256.Sum256([]byte(subjectID))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+".key")
+}
+
+func (s *FileKeyStore) forgettingPath(subjectID string) string {
+	hash := sha256.Sum256([]byte(subjectID))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+".forgetting")
+}
+
+func (s *FileKeyStore) tombstonePath(subjectID string) string {
+	hash := sha256.Sum256([]byte(subjectID))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+".forgotten")
+}
@@ -0,0 +1,215 @@
+package cbx25519
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/codingbeard/cbtransaction/encryption/cbenvelope"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sort"
+	"sync"
+)
+
+type KeyManagerConfig struct {
+	// Recipients are the public keys each new data key is encrypted to, by recipient ID
+	Recipients map[string][32]byte
+	// RecipientID and PrivateKey decrypt data keys encrypted to this recipient
+	RecipientID string
+	PrivateKey  [32]byte
+}
+
+// KeyManager is a cbenvelope.KeyManager which encrypts data keys to a set of
+// X25519 recipients: an ephemeral X25519 key agrees a key with each
+// recipient's public key, which after HKDF-SHA256 seals the data key. Every
+// recipient unwraps with their own private key. The key ID of a wrapped data
+// key identifies the recipients it was encrypted to, see CurrentKeyID
+type KeyManager struct {
+	recipientID string
+	privateKey  [32]byte
+
+	lock       *sync.RWMutex
+	recipients map[string][32]byte
+}
+
+func NewKeyManager(config KeyManagerConfig) (*KeyManager, error) {
+	recipients := map[string][32]byte{}
+	for recipientID, publicKey := range config.Recipients {
+		if recipientID == "" || len(recipientID) > 255 {
+			return nil, fmt.Errorf("cbx25519: invalid recipient id: %q", recipientID)
+		}
+		recipients[recipientID] = publicKey
+	}
+	return &KeyManager{
+		recipientID: config.RecipientID,
+		privateKey:  config.PrivateKey,
+		lock:        &sync.RWMutex{},
+		recipients:  recipients,
+	}, nil
+}
+
+// AddRecipient encrypts the data keys wrapped from now on to publicKey as well
+func (m *KeyManager) AddRecipient(recipientID string, publicKey [32]byte) error {
+	if recipientID == "" || len(recipientID) > 255 {
+		return fmt.Errorf("cbx25519: invalid recipient id: %q", recipientID)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.recipients[recipientID] = publicKey
+	return nil
+}
+
+// Revoke stops encrypting the data keys wrapped from now on to recipientID
+func (m *KeyManager) Revoke(recipientID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.recipients, recipientID)
+}
+
+// CurrentKeyID returns the key ID data keys are wrapped under, derived from the
+// current recipients. It changes whenever a recipient is added or revoked
+func (m *KeyManager) CurrentKeyID() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.currentKeyID()
+}
+
+func (m *KeyManager) currentKeyID() string {
+	recipientIDs := make([]string, 0, len(m.recipients))
+	for recipientID := range m.recipients {
+		recipientIDs = append(recipientIDs, recipientID)
+	}
+	sort.Strings(recipientIDs)
+	hash := sha256.New()
+	for _, recipientID := range recipientIDs {
+		publicKey := m.recipients[recipientID]
+		hash.Write([]byte{byte(len(recipientID))})
+		hash.Write([]byte(recipientID))
+		hash.Write(publicKey[:])
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// WrapContext encrypts dataKey to every recipient. The wrapped key holds the
+// ephemeral public key and the number of recipients, followed by the id and
+// sealed data key of each recipient
+func (m *KeyManager) WrapContext(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if len(m.recipients) == 0 || len(m.recipients) > 255 {
+		return "", nil, fmt.Errorf("cbx25519: %d recipients, between 1 and 255 are supported", len(m.recipients))
+	}
+	if len(dataKey) != dataKeySize {
+		return "", nil, fmt.Errorf("cbx25519: data keys of %d bytes are supported, not %d", dataKeySize, len(dataKey))
+	}
+
+	ephemeralPublic, ephemeralPrivate, e := GenerateKey()
+	if e != nil {
+		return "", nil, e
+	}
+	wrapped := append([]byte{}, ephemeralPublic[:]...)
+	wrapped = append(wrapped, byte(len(m.recipients)))
+	for recipientID, publicKey := range m.recipients {
+		shared, e := curve25519.X25519(ephemeralPrivate[:], publicKey[:])
+		if e != nil {
+			return "", nil, fmt.Errorf("cbx25519: recipient %s: %w", recipientID, e)
+		}
+		aead, e := keyEncryptionKey(shared, ephemeralPublic, publicKey)
+		if e != nil {
+			return "", nil, e
+		}
+		nonce := make([]byte, nonceSize, sealedKeySize)
+		_, e = io.ReadFull(rand.Reader, nonce)
+		if e != nil {
+			return "", nil, e
+		}
+		wrapped = append(wrapped, byte(len(recipientID)))
+		wrapped = append(wrapped, recipientID...)
+		wrapped = append(wrapped, aead.Seal(nonce, nonce, dataKey, additionalData(ephemeralPublic, recipientID))...)
+	}
+
+	return m.currentKeyID(), wrapped, nil
+}
+
+// UnwrapContext decrypts the data key sealed for this recipient, whichever
+// recipients keyID stands for
+func (m *KeyManager) UnwrapContext(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	ephemeral, entries, e := parseWrapped(wrapped)
+	if e != nil {
+		return nil, e
+	}
+	sealed, ok := entries[m.recipientID]
+	if !ok || m.recipientID == "" {
+		return nil, fmt.Errorf("%w: not a recipient of a data key wrapped for %s", ErrNoDataKey, keyID)
+	}
+
+	shared, e := curve25519.X25519(m.privateKey[:], ephemeral[:])
+	if e != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidData, e.Error())
+	}
+	publicKey := [32]byte{}
+	public, e := curve25519.X25519(m.privateKey[:], curve25519.Basepoint)
+	if e != nil {
+		return nil, e
+	}
+	copy(publicKey[:], public)
+	aead, e := keyEncryptionKey(shared, ephemeral, publicKey)
+	if e != nil {
+		return nil, e
+	}
+	dataKey, e := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData(ephemeral, m.recipientID))
+	if e != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidData, e.Error())
+	}
+	return dataKey, nil
+}
+
+var _ cbenvelope.KeyManager = (*KeyManager)(nil)
+
+func parseWrapped(wrapped []byte) ([32]byte, map[string][]byte, error) {
+	ephemeral := [32]byte{}
+	if len(wrapped) < keySize+1 {
+		return ephemeral, nil, fmt.Errorf("%w: truncated wrapped key", ErrInvalidData)
+	}
+	copy(ephemeral[:], wrapped)
+	count := int(wrapped[keySize])
+	rest := wrapped[keySize+1:]
+
+	entries := map[string][]byte{}
+	for i := 0; i < count; i++ {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0])+sealedKeySize {
+			return ephemeral, nil, fmt.Errorf("%w: truncated wrapped key", ErrInvalidData)
+		}
+		length := int(rest[0])
+		entries[string(rest[1:1+length])] = rest[1+length : 1+length+sealedKeySize]
+		rest = rest[1+length+sealedKeySize:]
+	}
+	return ephemeral, entries, nil
+}
+
+// keyEncryptionKey derives the key sealing a data key for one recipient from
+// the shared secret and both public keys
+func keyEncryptionKey(shared []byte, ephemeral [32]byte, recipient [32]byte) (cipher.AEAD, error) {
+	salt := make([]byte, 0, 2*keySize)
+	salt = append(salt, ephemeral[:]...)
+	salt = append(salt, recipient[:]...)
+	key := make([]byte, dataKeySize)
+	_, e := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(kdfInfo)), key)
+	if e != nil {
+		return nil, e
+	}
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(ephemeral [32]byte, recipientID string) []byte {
+	return append(append([]byte{}, ephemeral[:]...), recipientID...)
+}
@@ -0,0 +1,112 @@
+package cbx25519
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/codingbeard/cbtransaction/encryption/cbenvelope"
+	"golang.org/x/crypto/curve25519"
+	"io"
+)
+
+var Key = [8]byte{'x', '2', '5', '5', '1', '9', 0, 0}
+
+var (
+	// ErrNoDataKey is returned when data was not encrypted with any of the data
+	// keys given, or none of them is encrypted to this recipient
+	ErrNoDataKey = cbenvelope.ErrNoDataKey
+	// ErrInvalidData is returned for wrapped keys which cannot be read or were altered
+	ErrInvalidData = errors.New("invalid x25519 data")
+)
+
+const (
+	dataKeySize = 32
+	keySize     = 32
+	nonceSize   = 12
+	// sealedKeySize is a data key sealed by AES-GCM, with its nonce
+	sealedKeySize = nonceSize + dataKeySize + 16
+	kdfInfo       = "cbtransaction x25519 data key"
+)
+
+// GenerateKey returns a new X25519 key pair for a recipient
+func GenerateKey() (publicKey [32]byte, privateKey [32]byte, e error) {
+	_, e = io.ReadFull(rand.Reader, privateKey[:])
+	if e != nil {
+		return publicKey, privateKey, e
+	}
+	public, e := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if e != nil {
+		return publicKey, privateKey, e
+	}
+	copy(publicKey[:], public)
+	return publicKey, privateKey, nil
+}
+
+type Config struct {
+	// Recipients are the public keys each new data key is encrypted to, by recipient ID
+	Recipients map[string][32]byte
+	// RecipientID and PrivateKey decrypt data keys encrypted to this recipient.
+	// A server writing to a bucket it did not create the data key of in this
+	// process, such as after a restart, needs them and to be a recipient too
+	RecipientID string
+	PrivateKey  [32]byte
+	// ErrorHandler receives the errors of Encrypt and Decrypt, see cbenvelope.Config
+	ErrorHandler cbenvelope.ErrorHandler
+}
+
+// Encryption is a cbenvelope.Encryption whose data keys are wrapped by a
+// KeyManager for X25519 recipients. Revoking a recipient makes the data key
+// of the current bucket stale, see DataKeyCurrentContext, so the server
+// rotates it and the recipient cannot decrypt anything written afterwards.
+// They keep the data keys they were given until RewrapDataKeyContext takes
+// them out of those as well
+type Encryption struct {
+	*cbenvelope.Encryption
+	keyManager *KeyManager
+}
+
+func New(config Config) (*Encryption, error) {
+	keyManager, e := NewKeyManager(KeyManagerConfig{
+		Recipients:  config.Recipients,
+		RecipientID: config.RecipientID,
+		PrivateKey:  config.PrivateKey,
+	})
+	if e != nil {
+		return nil, e
+	}
+	envelope, e := cbenvelope.New(cbenvelope.Config{
+		KeyManager:   keyManager,
+		ErrorHandler: config.ErrorHandler,
+	})
+	if e != nil {
+		return nil, e
+	}
+	return &Encryption{
+		Encryption: envelope,
+		keyManager: keyManager,
+	}, nil
+}
+
+func (n *Encryption) GetKey() [8]byte {
+	return Key
+}
+
+// AddRecipient encrypts the data keys of later buckets to publicKey as well
+func (n *Encryption) AddRecipient(recipientID string, publicKey [32]byte) error {
+	return n.keyManager.AddRecipient(recipientID, publicKey)
+}
+
+// Revoke stops encrypting data keys to recipientID
+func (n *Encryption) Revoke(recipientID string) {
+	n.keyManager.Revoke(recipientID)
+}
+
+// DataKeyCurrentContext reports whether wrappedKey is encrypted to the current
+// recipients, it is not after a recipient has been added or revoked
+func (n *Encryption) DataKeyCurrentContext(ctx context.Context, wrappedKey []byte) (bool, error) {
+	keyID, e := cbenvelope.WrappedKeyID(wrappedKey)
+	if e != nil {
+		return false, e
+	}
+	return keyID == n.keyManager.CurrentKeyID(), nil
+}
@@ -0,0 +1,155 @@
+package cbx25519
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+type testRecipient struct {
+	publicKey  [32]byte
+	privateKey [32]byte
+}
+
+func getTestRecipients(t *testing.T, ids ...string) map[string]testRecipient {
+	recipients := map[string]testRecipient{}
+	for _, id := range ids {
+		publicKey, privateKey, e := GenerateKey()
+		if e != nil {
+			t.Fatal(e)
+		}
+		recipients[id] = testRecipient{publicKey: publicKey, privateKey: privateKey}
+	}
+	return recipients
+}
+
+func TestEncryption_DecryptWithDataKeysContext(t *testing.T) {
+	ctx := context.Background()
+	recipients := getTestRecipients(t, "server", "analytics", "billing", "outsider")
+	publicKeys := map[string][32]byte{}
+	for _, id := range []string{"server", "analytics", "billing"} {
+		publicKeys[id] = recipients[id].publicKey
+	}
+	server, e := New(Config{
+		Recipients:  publicKeys,
+		RecipientID: "server",
+		PrivateKey:  recipients["server"].privateKey,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	wrappedKey1, e := server.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted1, _ := server.EncryptWithDataKeyContext(ctx, wrappedKey1, []byte("bucket1"))
+
+	server.Revoke("billing")
+	wrappedKey2, e := server.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted2, _ := server.EncryptWithDataKeyContext(ctx, wrappedKey2, []byte("bucket2"))
+	wrappedKeys := [][]byte{wrappedKey1, wrappedKey2}
+
+	tests := []struct {
+		name      string
+		recipient string
+		encrypted []byte
+		want      []byte
+		wantErr   error
+	}{
+		{
+			name:      "recipient",
+			recipient: "analytics",
+			encrypted: encrypted2,
+			want:      []byte("bucket2"),
+		},
+		{
+			name:      "revokedEarlierBucket",
+			recipient: "billing",
+			encrypted: encrypted1,
+			want:      []byte("bucket1"),
+		},
+		{
+			name:      "revokedLaterBucket",
+			recipient: "billing",
+			encrypted: encrypted2,
+			wantErr:   ErrNoDataKey,
+		},
+		{
+			name:      "notRecipient",
+			recipient: "outsider",
+			encrypted: encrypted1,
+			wantErr:   ErrNoDataKey,
+		},
+		{
+			name:      "restartedServer",
+			recipient: "server",
+			encrypted: encrypted2,
+			want:      []byte("bucket2"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, _ := New(Config{
+				RecipientID: tt.recipient,
+				PrivateKey:  recipients[tt.recipient].privateKey,
+			})
+			got, err := n.DecryptWithDataKeysContext(ctx, wrappedKeys, tt.encrypted)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecryptWithDataKeysContext() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("DecryptWithDataKeysContext() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// another recipient's private key under their id does not open the data key
+	impostor, _ := New(Config{RecipientID: "analytics", PrivateKey: recipients["outsider"].privateKey})
+	if _, e := impostor.DecryptWithDataKeysContext(ctx, wrappedKeys, encrypted1); !errors.Is(e, ErrInvalidData) {
+		t.Errorf("DecryptWithDataKeysContext() error = %v, want %v", e, ErrInvalidData)
+	}
+}
+
+func TestEncryption_RewrapDataKeyContext(t *testing.T) {
+	ctx := context.Background()
+	recipients := getTestRecipients(t, "server", "billing")
+	server, _ := New(Config{
+		Recipients: map[string][32]byte{
+			"server":  recipients["server"].publicKey,
+			"billing": recipients["billing"].publicKey,
+		},
+		RecipientID: "server",
+		PrivateKey:  recipients["server"].privateKey,
+	})
+	wrappedKey, e := server.NewDataKeyContext(ctx)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted, _ := server.EncryptWithDataKeyContext(ctx, wrappedKey, []byte("some string"))
+
+	server.Revoke("billing")
+	rewrapped, e := server.RewrapDataKeyContext(ctx, wrappedKey)
+	if e != nil {
+		t.Errorf("RewrapDataKeyContext() error = %v", e)
+		return
+	}
+	billing, _ := New(Config{RecipientID: "billing", PrivateKey: recipients["billing"].privateKey})
+	if _, e := billing.DecryptWithDataKeysContext(ctx, [][]byte{rewrapped}, encrypted); !errors.Is(e, ErrNoDataKey) {
+		t.Errorf("DecryptWithDataKeysContext() error = %v, want %v", e, ErrNoDataKey)
+	}
+	restarted, _ := New(Config{RecipientID: "server", PrivateKey: recipients["server"].privateKey})
+	got, e := restarted.DecryptWithDataKeysContext(ctx, [][]byte{rewrapped}, encrypted)
+	if e != nil || !bytes.Equal(got, []byte("some string")) {
+		t.Errorf("DecryptWithDataKeysContext() = %s, error = %v", got, e)
+	}
+}
@@ -0,0 +1,106 @@
+package cbtransaction
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+)
+
+// RewrapDataKeys wraps the data key of every bucket with the current key
+// encryption key of the default BucketEncryption provider, after the key
+// encryption key has been rotated. The payloads are not encrypted again, so
+// the bucket files and their hashes stay the same and only the next master
+// changes. The old key encryption key is still needed for buckets written
+// while this runs, so it should be kept until a later call has published
+func (s *Server) RewrapDataKeys() error {
+	bucketEncryption, ok := s.defaultEncryptionProvider.(BucketEncryption)
+	if !ok {
+		return errors.New("the default encryption provider does not use data keys")
+	}
+
+	s.globalLock.Lock()
+	defer s.globalLock.Unlock()
+
+	buckets := s.master.GetBuckets()
+	current := s.master.GetCurrentBucket()
+	if current != nil && !containsBucket(buckets, current) {
+		buckets = append(buckets, current)
+	}
+	for _, bucket := range buckets {
+		bucket.Lock()
+		var e error
+		if bucket == current {
+			// a stale data key would stay current once wrapped again
+			e = s.ensureDataKey(bucketEncryption, bucket)
+		}
+		if e == nil {
+			e = s.rewrapDataKeys(bucketEncryption, bucket)
+		}
+		bucket.Unlock()
+		if e != nil {
+			return fmt.Errorf("bucket %s: %w", bucket.GetFileName(), e)
+		}
+	}
+
+	return nil
+}
+
+// rewrapDataKeys wraps the current and retired data keys of bucket again
+func (s *Server) rewrapDataKeys(bucketEncryption BucketEncryption, bucket *Bucket) error {
+	if len(bucket.GetWrappedDataKey()) > 0 {
+		rewrapped, e := bucketEncryption.RewrapDataKeyContext(s.ctx, bucket.GetWrappedDataKey())
+		if e != nil {
+			return e
+		}
+		bucket.SetWrappedDataKey(rewrapped)
+	}
+	retired := make([][]byte, 0, len(bucket.GetRetiredDataKeys()))
+	for _, wrappedKey := range bucket.GetRetiredDataKeys() {
+		rewrapped, e := bucketEncryption.RewrapDataKeyContext(s.ctx, wrappedKey)
+		if e != nil {
+			return e
+		}
+		retired = append(retired, rewrapped)
+	}
+	if len(retired) > 0 {
+		bucket.SetRetiredDataKeys(retired)
+	}
+	return nil
+}
+
+func containsBucket(buckets []*Bucket, bucket *Bucket) bool {
+	for _, b := range buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// wrappedDataKeys returns the wrapped data keys of the buckets in the master
+func (s *Client) wrappedDataKeys() [][]byte {
+	if s.master == nil {
+		return nil
+	}
+	var wrappedKeys [][]byte
+	for _, bucket := range s.master.GetBuckets() {
+		if len(bucket.GetWrappedDataKey()) > 0 {
+			wrappedKeys = append(wrappedKeys, bucket.GetWrappedDataKey())
+		}
+		wrappedKeys = append(wrappedKeys, bucket.GetRetiredDataKeys()...)
+	}
+	return wrappedKeys
+}
+
+// withData returns a copy of transaction holding data in place of its own
+func withData(transaction Transaction, data []byte) (Transaction, error) {
+	tran, ok := transaction.(*cbslice.Transaction)
+	if !ok {
+		return nil, fmt.Errorf("unsupported transaction type %T", transaction)
+	}
+	header := (*tran)[:len(*tran)-len(tran.GetData())]
+	replaced := make(cbslice.Transaction, len(header), len(header)+len(data))
+	copy(replaced, header)
+	replaced.SetData(data)
+	return &replaced, nil
+}
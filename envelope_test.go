@@ -0,0 +1,261 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
+	"github.com/codingbeard/cbtransaction/encryption/cbenvelope"
+	"github.com/codingbeard/cbtransaction/encryption/cbnone"
+	"github.com/codingbeard/cbtransaction/encryption/cbx25519"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer_RewrapDataKeys(t *testing.T) {
+	dataDir, e := ioutil.TempDir("", "cbtransaction-envelope")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	keyManager, e := cbenvelope.NewFileKeyManager(cbenvelope.FileKeyManagerConfig{Dir: filepath.Join(dataDir, "keys")})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	newEncryption := func() Encryption {
+		encryption, _ := cbenvelope.New(cbenvelope.Config{KeyManager: keyManager})
+		return encryption
+	}
+	s, e := NewServer(ServerConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbenvelope.Key,
+		EncryptionProviders:  []Encryption{newEncryption()},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s.master, _ = NewMasterFromFile(nil)
+
+	// a bucket written the way insertTransactionsQueue writes it
+	bucketEncryption := s.defaultEncryptionProvider.(BucketEncryption)
+	wrappedKey, e := bucketEncryption.NewDataKeyContext(context.Background())
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	encrypted, e := bucketEncryption.EncryptWithDataKeyContext(context.Background(), wrappedKey, []byte("some string"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	tran := cbslice.NewVersion1()
+	tran.SetEncryptionProviderKey(cbenvelope.Key)
+	tran.SetData(encrypted)
+	bucket, _ := NewBucketFromFile(nil)
+	bucket.SetFileName("bucket")
+	bucket.SetWrappedDataKey(wrappedKey)
+	s.master.SaveBucket(bucket)
+	s.master.currentBucket = bucket
+
+	oldKeyID, _ := keyManager.CurrentKeyID()
+	if _, e := keyManager.Rotate(); e != nil {
+		t.Error(e)
+		return
+	}
+	if e := s.RewrapDataKeys(); e != nil {
+		t.Errorf("RewrapDataKeys() error = %v", e)
+		return
+	}
+	if bytes.Equal(bucket.GetWrappedDataKey(), wrappedKey) {
+		t.Error("RewrapDataKeys() did not wrap the data key again")
+	}
+	if e := keyManager.DeleteKey(oldKeyID); e != nil {
+		t.Error(e)
+		return
+	}
+
+	c, e := NewClient(ClientConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbnone.Key,
+		EncryptionProviders:  []Encryption{&cbnone.Encryption{}, newEncryption()},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	c.master = s.master
+
+	decrypted, e := c.Decrypt(tran)
+	if e != nil {
+		t.Errorf("Decrypt() error = %v", e)
+		return
+	}
+	if string(decrypted.GetData()) != "some string" || decrypted.GetTransactionId() != tran.GetTransactionId() {
+		t.Errorf("Decrypt() = %s, want some string", decrypted.GetData())
+	}
+
+	plain := cbslice.NewVersion1()
+	plain.SetEncryptionProviderKey(cbnone.Key)
+	plain.SetData([]byte("plain"))
+	decrypted, e = c.Decrypt(plain)
+	if e != nil || string(decrypted.GetData()) != "plain" {
+		t.Errorf("Decrypt() = %s, error = %v, want plain", decrypted.GetData(), e)
+	}
+}
+
+func TestServer_revokeRecipient(t *testing.T) {
+	dataDir, e := ioutil.TempDir("", "cbtransaction-envelope")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	privateKeys := map[string][32]byte{}
+	publicKeys := map[string][32]byte{}
+	for _, recipientID := range []string{"server", "billing"} {
+		publicKey, privateKey, e := cbx25519.GenerateKey()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		publicKeys[recipientID] = publicKey
+		privateKeys[recipientID] = privateKey
+	}
+	encryption, e := cbx25519.New(cbx25519.Config{
+		Recipients:  publicKeys,
+		RecipientID: "server",
+		PrivateKey:  privateKeys["server"],
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s, e := NewServer(ServerConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbx25519.Key,
+		EncryptionProviders:  []Encryption{encryption},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s.master, _ = NewMasterFromFile(nil)
+	bucket, _ := NewBucketFromFile(nil)
+	bucket.SetFileName("bucket")
+	s.master.SaveBucket(bucket)
+	s.master.currentBucket = bucket
+
+	// transactions encrypted the way insertTransactionsQueue encrypts them
+	encrypt := func(data string) Transaction {
+		if e := s.ensureDataKey(encryption, bucket); e != nil {
+			t.Fatal(e)
+		}
+		key, encrypted, e := s.encryptTransactionData(transactionInsertQueueItem{}, []byte(data), encryption, bucket.GetWrappedDataKey())
+		if e != nil {
+			t.Fatal(e)
+		}
+		tran := cbslice.NewVersion1()
+		tran.SetEncryptionProviderKey(key)
+		tran.SetData(encrypted)
+		return tran
+	}
+	before := encrypt("before")
+	encryption.Revoke("billing")
+	after := encrypt("after")
+	if len(bucket.GetRetiredDataKeys()) != 1 {
+		t.Errorf("retired data keys = %d after revoking, want 1", len(bucket.GetRetiredDataKeys()))
+	}
+
+	newClient := func(recipientID string) *Client {
+		decryption, _ := cbx25519.New(cbx25519.Config{RecipientID: recipientID, PrivateKey: privateKeys[recipientID]})
+		c, e := NewClient(ClientConfig{
+			Logger:               defaultLogger{},
+			ErrorHandler:         DefaultErrorHandler{},
+			DefaultEncryptionKey: cbnone.Key,
+			EncryptionProviders:  []Encryption{&cbnone.Encryption{}, decryption},
+			DefaultEncodingKey:   cbmsgpack.Key,
+			EncodingProviders:    []Encoding{cbmsgpack.New()},
+			DataDir:              dataDir,
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		c.master = s.master
+		return c
+	}
+
+	tests := []struct {
+		name        string
+		recipientID string
+		transaction Transaction
+		want        string
+		wantErr     error
+	}{
+		{
+			name:        "serverBefore",
+			recipientID: "server",
+			transaction: before,
+			want:        "before",
+		},
+		{
+			name:        "serverAfter",
+			recipientID: "server",
+			transaction: after,
+			want:        "after",
+		},
+		{
+			name:        "revokedBefore",
+			recipientID: "billing",
+			transaction: before,
+			want:        "before",
+		},
+		{
+			name:        "revokedAfter",
+			recipientID: "billing",
+			transaction: after,
+			wantErr:     cbx25519.ErrNoDataKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decrypted, err := newClient(tt.recipientID).Decrypt(tt.transaction)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && string(decrypted.GetData()) != tt.want {
+				t.Errorf("Decrypt() = %s, want %s", decrypted.GetData(), tt.want)
+			}
+		})
+	}
+
+	// wrapping the data keys again takes the revoked recipient out of the retired ones
+	if e := s.RewrapDataKeys(); e != nil {
+		t.Errorf("RewrapDataKeys() error = %v", e)
+		return
+	}
+	if _, err := newClient("billing").Decrypt(before); !errors.Is(err, cbx25519.ErrNoDataKey) {
+		t.Errorf("Decrypt() error = %v after RewrapDataKeys, want %v", err, cbx25519.ErrNoDataKey)
+	}
+	if decrypted, err := newClient("server").Decrypt(before); err != nil || string(decrypted.GetData()) != "before" {
+		t.Errorf("Decrypt() = %v, error = %v after RewrapDataKeys, want before", decrypted, err)
+	}
+}
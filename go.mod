@@ -8,5 +8,6 @@ require (
 	github.com/google/uuid v1.1.1
 	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	github.com/vmihailenco/msgpack/v4 v4.3.8 // indirect
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	google.golang.org/api v0.18.0
 )
@@ -0,0 +1,74 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction/storage"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// masterHistoryDir holds a copy of every published master, named by version
+	masterHistoryDir = "masters"
+	// masterPointerFileName holds the version of the latest master
+	masterPointerFileName = "master.version"
+)
+
+func masterVersionName(version uint64) string {
+	return fmt.Sprintf("%s/%020d", masterHistoryDir, version)
+}
+
+func parseMasterVersionName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, masterHistoryDir+"/") {
+		return 0, false
+	}
+	version, e := strconv.ParseUint(strings.TrimPrefix(name, masterHistoryDir+"/"), 10, 64)
+	if e != nil || version == 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// listMasterVersions returns the versions of the masters in the history, oldest first
+func listMasterVersions(ctx context.Context, storageProvider Storage) ([]uint64, error) {
+	objects, e := storageProvider.ListContext(ctx, masterHistoryDir+"/")
+	if e != nil {
+		return nil, e
+	}
+
+	var versions []uint64
+	for _, object := range objects {
+		if version, ok := parseMasterVersionName(object.Name); ok {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+
+	return versions, nil
+}
+
+// downloadMasterPointer returns the version of the latest master, 0 when no
+// history is kept
+func downloadMasterPointer(ctx context.Context, storageProvider Storage) (uint64, error) {
+	buffer := &bytes.Buffer{}
+	e := storageProvider.DownloadContext(ctx, masterPointerFileName, buffer)
+	if e != nil {
+		if errors.Is(e, storage.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, e
+	}
+
+	version, e := strconv.ParseUint(strings.TrimSpace(buffer.String()), 10, 64)
+	if e != nil {
+		return 0, fmt.Errorf("invalid master version pointer: %w", e)
+	}
+
+	return version, nil
+}
@@ -1,11 +1,19 @@
 package cbtransaction
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
 	"sync"
 )
 
 type Master struct {
 	Buckets []Bucket
+	// MerkleRoot is the hex encoded root of the Merkle tree over the roots of
+	// the buckets, empty when a bucket has none. It is set on serialisation
+	MerkleRoot string
 
 	// used internally / not persisted
 	lock          *sync.RWMutex
@@ -21,6 +29,81 @@ func NewMasterFromFile(file ReadWriteSeekCloser) (*Master, error) {
 	}, nil
 }
 
+// NewMasterFromReader decodes a serialised master. The signature of a signed
+// master is skipped without verifying it, see VerifyMaster
+func NewMasterFromReader(reader io.Reader, encodingProviders []Encoding) (*Master, error) {
+	key := [8]byte{}
+	_, e := io.ReadFull(reader, key[:])
+	if e != nil {
+		return nil, e
+	}
+	if key == signedMasterKey {
+		length := []byte{0}
+		_, e = io.ReadFull(reader, length)
+		if e != nil {
+			return nil, e
+		}
+		_, e = io.CopyN(ioutil.Discard, reader, int64(length[0])+ed25519.SignatureSize)
+		if e != nil {
+			return nil, e
+		}
+		_, e = io.ReadFull(reader, key[:])
+		if e != nil {
+			return nil, e
+		}
+	}
+	var encodingProvider Encoding
+	for _, provider := range encodingProviders {
+		if provider.GetKey() == key {
+			encodingProvider = provider
+		}
+	}
+	if encodingProvider == nil {
+		return nil, errors.New("could not find encoding provider for master")
+	}
+
+	master := &Master{
+		lock: &sync.RWMutex{},
+	}
+	e = encodingProvider.DecodeReader(reader, master)
+	if e != nil {
+		return nil, e
+	}
+
+	for key := range master.Buckets {
+		bucket := &master.Buckets[key]
+		bucket.lock = &sync.RWMutex{}
+		master.buckets = append(master.buckets, bucket)
+	}
+	if len(master.buckets) > 0 {
+		master.currentBucket = master.buckets[len(master.buckets)-1]
+	}
+
+	return master, nil
+}
+
+func (m *Master) SerialiseWriter(writer io.Writer, encodingProvider Encoding) error {
+	key := encodingProvider.GetKey()
+	_, e := writer.Write(key[:])
+	if e != nil {
+		return e
+	}
+	root := ""
+	if leaves, ok := bucketMerkleLeaves(m.buckets); ok {
+		hash := merkleRoot(leaves)
+		root = hex.EncodeToString(hash[:])
+	}
+	buckets := make([]Bucket, len(m.buckets))
+	for key, bucket := range m.buckets {
+		buckets[key] = bucket.persisted()
+	}
+	return encodingProvider.EncodeWriter(&Master{Buckets: buckets, MerkleRoot: root}, writer)
+}
+
+func (m *Master) GetMerkleRoot() string {
+	return m.MerkleRoot
+}
+
 func (m *Master) GetFile() ReadWriteSeekCloser {
 	return m.file
 }
@@ -0,0 +1,162 @@
+package cbtransaction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"github.com/google/uuid"
+)
+
+// ErrNotIncluded is returned by VerifyInclusion when a proof does not lead to the root hash
+var ErrNotIncluded = errors.New("transaction is not included under the root hash")
+
+// The trees follow RFC 6962: leaves and nodes are hashed with different
+// prefixes so a node can never be passed off as a leaf
+const (
+	merkleLeafPrefix = 0
+	merkleNodePrefix = 1
+)
+
+// ProofStep is a sibling on the path from a leaf to the root of a Merkle tree
+type ProofStep struct {
+	// Hash is the hex encoded hash of the sibling
+	Hash string
+	// Left is true when the sibling is the left child of their parent
+	Left bool
+}
+
+// InclusionProof shows that a transaction is part of a bucket, and that the
+// bucket is part of a master, with only the Merkle root of the master
+type InclusionProof struct {
+	TransactionId uuid.UUID
+	// Transaction is the serialised transaction without its length prefix
+	Transaction []byte
+	Bucket      string
+	// BucketPath leads from the transaction to the Merkle root of its bucket
+	BucketPath []ProofStep
+	// MasterPath leads from the root of the bucket to the Merkle root of the master
+	MasterPath []ProofStep
+}
+
+// VerifyInclusion checks proof against the Merkle root of a master, see
+// Master.GetMerkleRoot. It needs nothing else, so when the master is signed
+// the root can be taken from it after checking the signature with VerifyMaster
+func VerifyInclusion(proof *InclusionProof, rootHash string) error {
+	tran := cbslice.Transaction(proof.Transaction)
+	if len(tran) < 17 || (tran.GetVersion() != cbslice.Version1 && tran.GetVersion() != cbslice.Version2) {
+		return fmt.Errorf("%w: invalid transaction in proof", ErrNotIncluded)
+	}
+	if tran.GetTransactionId() != proof.TransactionId {
+		return fmt.Errorf("%w: the proof is for transaction %s", ErrNotIncluded, tran.GetTransactionId())
+	}
+
+	bucketRoot, e := foldMerklePath(merkleLeafHash(proof.Transaction), proof.BucketPath)
+	if e != nil {
+		return e
+	}
+	root, e := foldMerklePath(merkleLeafHash(bucketRoot[:]), proof.MasterPath)
+	if e != nil {
+		return e
+	}
+	if hex.EncodeToString(root[:]) != rootHash {
+		return fmt.Errorf("%w: transaction %s in bucket %s", ErrNotIncluded, proof.TransactionId, proof.Bucket)
+	}
+
+	return nil
+}
+
+func foldMerklePath(hash [32]byte, path []ProofStep) ([32]byte, error) {
+	for _, step := range path {
+		sibling, e := decodeMerkleHash(step.Hash)
+		if e != nil {
+			return hash, fmt.Errorf("%w: %s", ErrNotIncluded, e.Error())
+		}
+		if step.Left {
+			hash = merkleNodeHash(sibling, hash)
+		} else {
+			hash = merkleNodeHash(hash, sibling)
+		}
+	}
+	return hash, nil
+}
+
+func merkleLeafHash(data []byte) [32]byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleLeafPrefix})
+	hash.Write(data)
+	sum := [32]byte{}
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+func merkleNodeHash(left [32]byte, right [32]byte) [32]byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left[:])
+	hash.Write(right[:])
+	sum := [32]byte{}
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// merkleSplit returns the largest power of two smaller than n
+func merkleSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// merkleRoot returns the root of the tree over leaves, the hash of nothing
+// for an empty tree
+func merkleRoot(leaves [][32]byte) [32]byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath returns the siblings from the leaf at index up to the root
+func merklePath(leaves [][32]byte, index int) []ProofStep {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		right := merkleRoot(leaves[k:])
+		return append(merklePath(leaves[:k], index), ProofStep{Hash: hex.EncodeToString(right[:])})
+	}
+	left := merkleRoot(leaves[:k])
+	return append(merklePath(leaves[k:], index-k), ProofStep{Hash: hex.EncodeToString(left[:]), Left: true})
+}
+
+func decodeMerkleHash(value string) ([32]byte, error) {
+	hash := [32]byte{}
+	decoded, e := hex.DecodeString(value)
+	if e != nil || len(decoded) != len(hash) {
+		return hash, fmt.Errorf("invalid merkle hash: %q", value)
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// bucketMerkleLeaves returns the leaves of the tree over the buckets of a
+// master, false when a bucket has no Merkle root
+func bucketMerkleLeaves(buckets []*Bucket) ([][32]byte, bool) {
+	leaves := make([][32]byte, 0, len(buckets))
+	for _, bucket := range buckets {
+		root, e := decodeMerkleHash(bucket.GetMerkleRoot())
+		if e != nil {
+			return nil, false
+		}
+		leaves = append(leaves, merkleLeafHash(root[:]))
+	}
+	return leaves, true
+}
@@ -0,0 +1,156 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMerklePath(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := make([][32]byte, n)
+		for i := range leaves {
+			leaves[i] = merkleLeafHash([]byte{byte(i)})
+		}
+		root := merkleRoot(leaves)
+		for index := range leaves {
+			got, e := foldMerklePath(leaves[index], merklePath(leaves, index))
+			if e != nil || got != root {
+				t.Errorf("merklePath(%d leaves, %d) does not lead to the root: %v", n, index, e)
+			}
+		}
+	}
+}
+
+func TestClient_ProveInclusion(t *testing.T) {
+	dataDir, e := ioutil.TempDir("", "cbtransaction-merkle")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(nil, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	var transactionIds []uuid.UUID
+	for _, name := range []string{"bucket1", "bucket2", "bucket3"} {
+		buffer := &bytes.Buffer{}
+		for i := 0; i < 3; i++ {
+			tran := cbslice.NewVersion1()
+			transactionId := uuid.New()
+			transactionIds = append(transactionIds, transactionId)
+			tran.SetTransactionId(transactionId)
+			tran.SetData([]byte(name))
+			_, _ = tran.SerialiseWriter(buffer)
+		}
+		if e := ioutil.WriteFile(filepath.Join(dataDir, name), buffer.Bytes(), 0644); e != nil {
+			t.Error(e)
+			return
+		}
+		file, e := os.Open(filepath.Join(dataDir, name))
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		bucket, _ := NewBucketFromFile(file)
+		bucket.SetFileName(name)
+		if _, e := s.verifyBucket(bucket); e != nil {
+			t.Error(e)
+			return
+		}
+		_ = file.Close()
+		s.master.SaveBucket(bucket)
+	}
+
+	// the client gets the root through the serialised master
+	buffer := &bytes.Buffer{}
+	if e := s.master.SerialiseWriter(buffer, cbmsgpack.New()); e != nil {
+		t.Error(e)
+		return
+	}
+	master, e := NewMasterFromReader(buffer, []Encoding{cbmsgpack.New()})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	rootHash := master.GetMerkleRoot()
+	c, e := getDefaultTestClient(nil, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	c.master = master
+
+	for _, transactionId := range transactionIds {
+		proof, e := c.ProveInclusion(transactionId)
+		if e != nil {
+			t.Errorf("ProveInclusion() error = %v", e)
+			return
+		}
+		if e := VerifyInclusion(proof, rootHash); e != nil {
+			t.Errorf("VerifyInclusion() error = %v", e)
+		}
+	}
+
+	if _, e := c.ProveInclusion(uuid.New()); e == nil {
+		t.Error("ProveInclusion() error = nil for an unknown transaction")
+	}
+
+	proof, _ := c.ProveInclusion(transactionIds[4])
+	tests := []struct {
+		name     string
+		modify   func(proof InclusionProof) *InclusionProof
+		rootHash string
+	}{
+		{
+			name: "alteredTransaction",
+			modify: func(proof InclusionProof) *InclusionProof {
+				proof.Transaction = append([]byte{}, proof.Transaction...)
+				proof.Transaction[len(proof.Transaction)-1] ^= 1
+				return &proof
+			},
+			rootHash: rootHash,
+		},
+		{
+			name: "otherTransactionId",
+			modify: func(proof InclusionProof) *InclusionProof {
+				proof.TransactionId = transactionIds[0]
+				return &proof
+			},
+			rootHash: rootHash,
+		},
+		{
+			name: "otherRoot",
+			modify: func(proof InclusionProof) *InclusionProof {
+				return &proof
+			},
+			rootHash: hex.EncodeToString(make([]byte, 32)),
+		},
+		{
+			name: "truncatedPath",
+			modify: func(proof InclusionProof) *InclusionProof {
+				proof.MasterPath = proof.MasterPath[1:]
+				return &proof
+			},
+			rootHash: rootHash,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyInclusion(tt.modify(*proof), tt.rootHash)
+			if !errors.Is(err, ErrNotIncluded) {
+				t.Errorf("VerifyInclusion() error = %v, want %v", err, ErrNotIncluded)
+			}
+		})
+	}
+}
@@ -1,16 +1,26 @@
 package cbtransaction
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/codingbeard/cbtransaction/storage"
 	"github.com/codingbeard/cbtransaction/transaction"
 	"github.com/codingbeard/cbtransaction/transaction/cbslice"
 	"github.com/codingbeard/cbutil"
 	"github.com/google/uuid"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,11 +28,15 @@ import (
 var (
 	uploadDir = "cbtransaction_upload"
 	clientDir = "cbtransaction_client_buckets"
+	objectDir = "objects"
+
+	masterFileName = "master"
 )
 
 type transactionInsertQueueItem struct {
-	action transaction.ActionEnum
-	data   interface{}
+	action    transaction.ActionEnum
+	data      interface{}
+	subjectID string
 }
 
 type Server struct {
@@ -31,14 +45,29 @@ type Server struct {
 	errorHandler              ErrorHandler
 	defaultEncryptionProvider Encryption
 	encryptionProviders       []Encryption
+	subjectEncryptionProvider SubjectEncryption
 	defaultEncodingProvider   Encoding
 	encodingProviders         []Encoding
 	client                    *Client
 	master                    *Master
 	dataDir                   string
+	storageTimeout            time.Duration
+	ctx                       context.Context
+	cancel                    context.CancelFunc
 	globalLock                *sync.Mutex
 	transactionQueueLock      *sync.Mutex
 	transactionInsertQueue    []transactionInsertQueueItem
+	masterGeneration          string
+	masterGenerationLoaded    bool
+	contentAddressedBuckets   bool
+	uploadedObjects           map[string]bool
+	uploadLock                *sync.Mutex
+	masterHistory             int
+	masterVersion             uint64
+	masterVersionLoaded       bool
+	signingKey                *SigningKey
+	trustedKeys               map[string]ed25519.PublicKey
+	hashChain                 bool
 }
 
 type ServerConfig struct {
@@ -52,6 +81,21 @@ type ServerConfig struct {
 	Concat               bool
 	DestructiveCompact   bool
 	DataDir              string
+	StorageTimeout       time.Duration
+	// ContentAddressedBuckets uploads sealed buckets under names derived from
+	// their hash instead of overwriting them in place, see Bucket.ObjectName
+	ContentAddressedBuckets bool
+	// MasterHistory is the number of published masters kept under versioned
+	// names for clients to pin or roll back to, 0 keeps no history
+	MasterHistory int
+	// SigningKey signs every published master, see SigningKey
+	SigningKey *SigningKey
+	// TrustedKeys verify masters read back from storage, see ClientConfig.TrustedKeys.
+	// The public key of SigningKey is always trusted
+	TrustedKeys map[string]ed25519.PublicKey
+	// HashChain writes transactions which carry the hash of the transaction
+	// before them, so Client.Verify can prove none were altered or removed
+	HashChain bool
 }
 
 func NewServer(config ServerConfig) (*Server, error) {
@@ -65,6 +109,12 @@ func NewServer(config ServerConfig) (*Server, error) {
 	if defaultEncryptionProvider == nil {
 		return nil, errors.New("could not find default encryption provider")
 	}
+	var subjectEncryptionProvider SubjectEncryption
+	for _, provider := range config.EncryptionProviders {
+		if subjectEncryption, ok := provider.(SubjectEncryption); ok {
+			subjectEncryptionProvider = subjectEncryption
+		}
+	}
 	var defaultEncodingProvider Encoding
 	for _, provider := range config.EncodingProviders {
 		key := provider.GetKey()
@@ -75,6 +125,17 @@ func NewServer(config ServerConfig) (*Server, error) {
 	if defaultEncodingProvider == nil {
 		return nil, errors.New("could not find default encoding provider")
 	}
+	trustedKeys := map[string]ed25519.PublicKey{}
+	for keyID, publicKey := range config.TrustedKeys {
+		trustedKeys[keyID] = publicKey
+	}
+	if config.SigningKey != nil {
+		publicKey, ok := config.SigningKey.PrivateKey.Public().(ed25519.PublicKey)
+		if !ok || len(config.SigningKey.PrivateKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid private key for signing key id %s", config.SigningKey.KeyID)
+		}
+		trustedKeys[config.SigningKey.KeyID] = publicKey
+	}
 	client, e := NewClient(ClientConfig{
 		Logger:               config.Logger,
 		ErrorHandler:         config.ErrorHandler,
@@ -82,23 +143,38 @@ func NewServer(config ServerConfig) (*Server, error) {
 		EncryptionProviders:  config.EncryptionProviders,
 		DefaultEncodingKey:   defaultEncodingProvider.GetKey(),
 		EncodingProviders:    config.EncodingProviders,
+		StorageProvider:      config.StorageProvider,
+		StorageTimeout:       config.StorageTimeout,
 		DataDir:              filepath.Join(config.DataDir, clientDir),
+		TrustedKeys:          trustedKeys,
 	})
 	if e != nil {
 		return nil, e
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		logger:                    config.Logger,
 		errorHandler:              config.ErrorHandler,
 		defaultEncryptionProvider: defaultEncryptionProvider,
 		encryptionProviders:       config.EncryptionProviders,
+		subjectEncryptionProvider: subjectEncryptionProvider,
 		defaultEncodingProvider:   defaultEncodingProvider,
 		encodingProviders:         config.EncodingProviders,
 		storageProvider:           config.StorageProvider,
 		dataDir:                   config.DataDir,
+		storageTimeout:            config.StorageTimeout,
+		ctx:                       ctx,
+		cancel:                    cancel,
 		client:                    client,
 		globalLock:                &sync.Mutex{},
 		transactionQueueLock:      &sync.Mutex{},
+		contentAddressedBuckets:   config.ContentAddressedBuckets,
+		uploadedObjects:           map[string]bool{},
+		uploadLock:                &sync.Mutex{},
+		masterHistory:             config.MasterHistory,
+		signingKey:                config.SigningKey,
+		trustedKeys:               trustedKeys,
+		hashChain:                 config.HashChain,
 	}, nil
 }
 
@@ -131,7 +207,20 @@ func (s *Server) Run() error {
 		Run:        s.uploadLatestBuckets,
 	}.Start()
 
-	select {}
+	<-s.ctx.Done()
+
+	return nil
+}
+
+func (s *Server) Stop() {
+	s.cancel()
+}
+
+func (s *Server) storageContext() (context.Context, context.CancelFunc) {
+	if s.storageTimeout > 0 {
+		return context.WithTimeout(s.ctx, s.storageTimeout)
+	}
+	return context.WithCancel(s.ctx)
 }
 
 func (s *Server) AddTransaction(action transaction.ActionEnum, data interface{}) {
@@ -143,6 +232,34 @@ func (s *Server) AddTransaction(action transaction.ActionEnum, data interface{})
 	)
 }
 
+// AddSubjectTransaction queues a transaction about subjectID, which is
+// encrypted under the key of the subject by the SubjectEncryption provider in
+// EncryptionProviders and then by the default provider, see ForgetSubject
+func (s *Server) AddSubjectTransaction(action transaction.ActionEnum, subjectID string, data interface{}) error {
+	if s.subjectEncryptionProvider == nil {
+		return errors.New("no encryption provider supports subjects")
+	}
+	if subjectID == "" {
+		return errors.New("empty subject id")
+	}
+	s.transactionQueueLock.Lock()
+	defer s.transactionQueueLock.Unlock()
+	s.transactionInsertQueue = append(
+		s.transactionInsertQueue,
+		transactionInsertQueueItem{action: action, data: data, subjectID: subjectID},
+	)
+	return nil
+}
+
+// ForgetSubject destroys the key of subjectID, after which Client.Decrypt
+// returns every transaction about the subject as a *ShreddedTransaction
+func (s *Server) ForgetSubject(subjectID string) error {
+	if s.subjectEncryptionProvider == nil {
+		return errors.New("no encryption provider supports subjects")
+	}
+	return s.subjectEncryptionProvider.ForgetSubjectContext(s.ctx, subjectID)
+}
+
 func (s *Server) insertTransactionsQueue() {
 	if len(s.transactionInsertQueue) == 0 {
 		return
@@ -171,8 +288,36 @@ func (s *Server) insertTransactionsQueue() {
 	}
 	tempBucket.Lock()
 
+	previousHash, e := decodeChainHash(currentBucket)
+	if e != nil {
+		s.errorHandler.Error(e)
+
+		s.transactionQueueLock.Lock()
+		s.transactionInsertQueue = append(insertItems, s.transactionInsertQueue...)
+		s.transactionQueueLock.Unlock()
+		_ = s.removeBucket(tempBucket)
+		return
+	}
+
+	bucketEncryption, _ := s.defaultEncryptionProvider.(BucketEncryption)
+	if bucketEncryption != nil {
+		e := s.ensureDataKey(bucketEncryption, tempBucket)
+		if e != nil {
+			s.errorHandler.Error(e)
+
+			s.transactionQueueLock.Lock()
+			s.transactionInsertQueue = append(insertItems, s.transactionInsertQueue...)
+			s.transactionQueueLock.Unlock()
+			_ = s.removeBucket(tempBucket)
+			return
+		}
+	}
+
 	for _, item := range insertItems {
 		transaction := cbslice.NewVersion1()
+		if s.hashChain {
+			transaction = cbslice.NewVersion2()
+		}
 		transactionId, e := uuid.NewUUID()
 		if e != nil {
 			s.errorHandler.Error(e)
@@ -185,7 +330,6 @@ func (s *Server) insertTransactionsQueue() {
 		}
 		transaction.SetTransactionId(transactionId)
 		transaction.SetActionEnum(item.action)
-		transaction.SetEncryptionProviderKey(s.defaultEncryptionProvider.GetKey())
 		transaction.SetEncodingProviderKey(s.defaultEncodingProvider.GetKey())
 		encoded, e := s.defaultEncodingProvider.Encode(item.data)
 		if e != nil {
@@ -197,7 +341,22 @@ func (s *Server) insertTransactionsQueue() {
 			_ = s.removeBucket(tempBucket)
 			return
 		}
-		transaction.SetData(s.defaultEncryptionProvider.Encrypt(encoded))
+		encryptionKey, encrypted, e := s.encryptTransactionData(item, encoded, bucketEncryption, tempBucket.GetWrappedDataKey())
+		if e != nil {
+			s.errorHandler.Error(e)
+
+			s.transactionQueueLock.Lock()
+			s.transactionInsertQueue = append(insertItems, s.transactionInsertQueue...)
+			s.transactionQueueLock.Unlock()
+			_ = s.removeBucket(tempBucket)
+			return
+		}
+		transaction.SetEncryptionProviderKey(encryptionKey)
+		transaction.SetData(encrypted)
+		if s.hashChain {
+			transaction.SetPreviousHash(previousHash)
+			previousHash = transaction.Hash()
+		}
 		_, e = transaction.SerialiseWriter(tempBucket.GetFile())
 		if e != nil {
 			s.errorHandler.Error(e)
@@ -250,6 +409,72 @@ func (s *Server) insertTransactionsQueue() {
 	s.master.currentBucket = currentBucket
 }
 
+// ensureDataKey gives bucket a new data key when it has none, or when the
+// provider reports its data key as stale, keeping the stale one for the
+// transactions already encrypted with it
+func (s *Server) ensureDataKey(bucketEncryption BucketEncryption, bucket *Bucket) error {
+	if len(bucket.GetWrappedDataKey()) > 0 {
+		rotation, ok := bucketEncryption.(DataKeyRotation)
+		if !ok {
+			return nil
+		}
+		current, e := rotation.DataKeyCurrentContext(s.ctx, bucket.GetWrappedDataKey())
+		if e != nil || current {
+			return e
+		}
+	}
+
+	wrappedKey, e := bucketEncryption.NewDataKeyContext(s.ctx)
+	if e != nil {
+		return e
+	}
+	if len(bucket.GetWrappedDataKey()) > 0 {
+		retired := append([][]byte{}, bucket.GetRetiredDataKeys()...)
+		bucket.SetRetiredDataKeys(append(retired, bucket.GetWrappedDataKey()))
+	}
+	bucket.SetWrappedDataKey(wrappedKey)
+	return nil
+}
+
+// encryptTransactionData encrypts the encoded data of item with the default
+// provider, returning the key of the provider used. Data about a subject is
+// encrypted with the subject provider first and then with the default
+// provider, so it is still protected by the bucket or recipient keys. The key
+// of the default provider is prepended to it, see Client.Decrypt
+func (s *Server) encryptTransactionData(item transactionInsertQueueItem, encoded []byte, bucketEncryption BucketEncryption, wrappedKey []byte) ([8]byte, []byte, error) {
+	if item.subjectID == "" {
+		encrypted, e := s.encryptData(encoded, bucketEncryption, wrappedKey)
+		return s.defaultEncryptionProvider.GetKey(), encrypted, e
+	}
+
+	encryption := s.subjectEncryptionProvider.(Encryption)
+	subjectEncrypted, e := s.subjectEncryptionProvider.EncryptSubjectContext(s.ctx, item.subjectID, encoded)
+	if e != nil {
+		return encryption.GetKey(), nil, e
+	}
+	encrypted, e := s.encryptData(subjectEncrypted, bucketEncryption, wrappedKey)
+	if e != nil {
+		return encryption.GetKey(), nil, e
+	}
+	key := s.defaultEncryptionProvider.GetKey()
+	return encryption.GetKey(), append(key[:], encrypted...), nil
+}
+
+// encryptData encrypts data with the default provider, under the data key in
+// wrappedKey when it is a BucketEncryption
+func (s *Server) encryptData(data []byte, bucketEncryption BucketEncryption, wrappedKey []byte) ([]byte, error) {
+	if bucketEncryption != nil {
+		return bucketEncryption.EncryptWithDataKeyContext(s.ctx, wrappedKey, data)
+	}
+	// EncryptWriter returns the errors Encrypt can only report
+	buffer := &bytes.Buffer{}
+	e := s.defaultEncryptionProvider.EncryptWriter(data, buffer)
+	if e != nil {
+		return nil, e
+	}
+	return buffer.Bytes(), nil
+}
+
 func (s *Server) createTempBucketClone(bucket *Bucket) (*Bucket, error) {
 	tempFileName := bucket.GetFileName() + ".temp." + strconv.FormatInt(time.Now().UnixNano(), 10)
 	tempFile, e := os.Create(filepath.Join(
@@ -279,6 +504,9 @@ func (s *Server) createTempBucketClone(bucket *Bucket) (*Bucket, error) {
 	tempBucket.SetFileName(tempFileName)
 	tempBucket.SetModTime(time.Now().Unix())
 	tempBucket.SetTransactionCount(bucket.GetTransactionCount())
+	tempBucket.SetChainHash(bucket.GetChainHash())
+	tempBucket.SetWrappedDataKey(bucket.GetWrappedDataKey())
+	tempBucket.SetRetiredDataKeys(bucket.GetRetiredDataKeys())
 
 	return tempBucket, nil
 }
@@ -300,6 +528,8 @@ func (s *Server) verifyBucket(bucket *Bucket) (*Bucket, error) {
 	}
 
 	transactionCount := uint32(0)
+	chainHash := ""
+	var merkleLeaves [][32]byte
 
 	for true {
 		oldPosition, posE := bucket.GetFile().Seek(0, io.SeekCurrent)
@@ -308,7 +538,7 @@ func (s *Server) verifyBucket(bucket *Bucket) (*Bucket, error) {
 			return nil, posE
 		}
 
-		_, e := cbslice.NewFromReader(bucket.GetFile())
+		tran, e := cbslice.NewFromReader(bucket.GetFile())
 
 		newPosition, posE := bucket.GetFile().Seek(0, io.SeekCurrent)
 		if posE != nil {
@@ -326,9 +556,20 @@ func (s *Server) verifyBucket(bucket *Bucket) (*Bucket, error) {
 		}
 
 		transactionCount++
+		merkleLeaves = append(merkleLeaves, merkleLeafHash(*tran))
+		if tran.GetVersion() == cbslice.Version2 {
+			hash := tran.Hash()
+			chainHash = hex.EncodeToString(hash[:])
+		}
 	}
 
 	bucket.SetTransactionCount(transactionCount)
+	root := merkleRoot(merkleLeaves)
+	bucket.SetMerkleRoot(hex.EncodeToString(root[:]))
+	// a bucket without chained transactions continues the chain of the one before it
+	if chainHash != "" {
+		bucket.SetChainHash(chainHash)
+	}
 
 	return bucket, nil
 }
@@ -342,10 +583,21 @@ func (s *Server) negateExpiredTransactions() {
 }
 
 func (s *Server) uploadLatestBuckets() {
+	if s.ctx.Err() != nil || s.master == nil {
+		return
+	}
+
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
 	s.copyBucketsToUploadDir()
 
 	s.concatUploadBuckets()
 
+	s.nameSealedBuckets()
+
+	s.recordBucketTiers()
+
 	s.generateUploadMaster()
 
 	s.compressUploadBuckets()
@@ -358,14 +610,156 @@ func (s *Server) uploadLatestBuckets() {
 func (s *Server) copyBucketsToUploadDir() {
 	s.globalLock.Lock()
 	defer s.globalLock.Unlock()
+
+	for _, bucket := range s.master.GetBuckets() {
+		size, hash, prefixHash, e := s.copyFile(
+			filepath.Join(s.dataDir, bucket.GetFileName()),
+			filepath.Join(s.dataDir, uploadDir, bucket.GetFileName()),
+			bucket.GetSize(),
+		)
+		if e != nil {
+			s.errorHandler.Error(e)
+			return
+		}
+		bucket.Lock()
+		// a bucket which grew keeps the last master's copy as its prefix, so
+		// clients holding it only download the rest
+		if size != bucket.GetSize() || hash != bucket.GetHash() {
+			if bucket.GetHash() != "" && size > bucket.GetSize() && prefixHash == bucket.GetHash() {
+				bucket.SetPrefixSize(bucket.GetSize())
+				bucket.SetPrefixHash(bucket.GetHash())
+			} else {
+				bucket.SetPrefixSize(0)
+				bucket.SetPrefixHash("")
+			}
+		}
+		bucket.SetSize(size)
+		bucket.SetHash(hash)
+		bucket.Unlock()
+	}
+}
+
+// copyFile returns the size and hash of the copy, and the hash of its first
+// prefixSize bytes
+func (s *Server) copyFile(source string, destination string, prefixSize int64) (int64, string, string, error) {
+	reader, e := os.Open(source)
+	if e != nil {
+		return 0, "", "", e
+	}
+	defer reader.Close()
+
+	e = os.MkdirAll(filepath.Dir(destination), os.ModePerm)
+	if e != nil {
+		return 0, "", "", e
+	}
+
+	writer, e := os.Create(destination)
+	if e != nil {
+		return 0, "", "", e
+	}
+	defer writer.Close()
+
+	hash := sha256.New()
+	size, e := io.Copy(io.MultiWriter(writer, hash), io.LimitReader(reader, prefixSize))
+	if e != nil {
+		return 0, "", "", e
+	}
+	prefixHash := hex.EncodeToString(hash.Sum(nil))
+	rest, e := io.Copy(io.MultiWriter(writer, hash), reader)
+	if e != nil {
+		return 0, "", "", e
+	}
+
+	return size + rest, hex.EncodeToString(hash.Sum(nil)), prefixHash, nil
 }
 
 func (s *Server) concatUploadBuckets() {
 
 }
 
+// nameSealedBuckets points every bucket but the current one, which is still
+// being appended to, at an object named after its hash. Those objects are
+// never written again, so clients cannot see a partial upload and caches can
+// keep them forever. The objects buckets were previously stored under are left
+// in place for clients still reading an older master
+func (s *Server) nameSealedBuckets() {
+	if !s.contentAddressedBuckets {
+		return
+	}
+
+	s.globalLock.Lock()
+	defer s.globalLock.Unlock()
+
+	currentBucket := s.master.GetCurrentBucket()
+	for _, bucket := range s.master.GetBuckets() {
+		if bucket.GetHash() == "" || (currentBucket != nil && bucket.GetFileName() == currentBucket.GetFileName()) {
+			continue
+		}
+		bucket.Lock()
+		bucket.SetObjectName(contentAddressedName(bucket.GetHash()))
+		bucket.Unlock()
+	}
+}
+
+func contentAddressedName(hash string) string {
+	return path.Join(objectDir, hash[:2], hash)
+}
+
+// recordBucketTiers stores the current tier of every bucket in the master when
+// the storage provider is tiered. Buckets not uploaded yet keep their tier
+func (s *Server) recordBucketTiers() {
+	tierer, ok := s.storageProvider.(Tierer)
+	if !ok {
+		return
+	}
+
+	for _, bucket := range s.master.GetBuckets() {
+		ctx, cancel := s.storageContext()
+		tier, e := tierer.TierContext(ctx, bucket.GetStorageName())
+		cancel()
+		if e != nil {
+			if !errors.Is(e, storage.ErrNotExist) {
+				s.errorHandler.Error(e)
+			}
+			continue
+		}
+		bucket.Lock()
+		bucket.SetTier(tier)
+		bucket.Unlock()
+	}
+}
+
 func (s *Server) generateUploadMaster() {
+	writer, e := os.Create(filepath.Join(s.dataDir, uploadDir, masterFileName))
+	if e != nil {
+		s.errorHandler.Error(e)
+		return
+	}
+	defer writer.Close()
+
+	if s.signingKey == nil {
+		e = s.master.SerialiseWriter(writer, s.defaultEncodingProvider)
+		if e != nil {
+			s.errorHandler.Error(e)
+		}
+		return
+	}
 
+	buffer := &bytes.Buffer{}
+	e = s.master.SerialiseWriter(buffer, s.defaultEncodingProvider)
+	if e != nil {
+		s.errorHandler.Error(e)
+		return
+	}
+	signed, e := SignMaster(buffer.Bytes(), *s.signingKey)
+	if e != nil {
+		s.errorHandler.Error(e)
+		return
+	}
+	_, e = writer.Write(signed)
+	if e != nil {
+		s.errorHandler.Error(e)
+	}
 }
 
 func (s *Server) compressUploadBuckets() {
@@ -377,5 +771,282 @@ func (s *Server) verifyUploadBuckets() {
 }
 
 func (s *Server) uploadBuckets() {
+	for _, bucket := range s.master.GetBuckets() {
+		if bucket.GetObjectName() != "" && s.objectUploaded(bucket.GetObjectName()) {
+			continue
+		}
+		e := s.uploadObject(bucket.GetFileName(), bucket.GetStorageName())
+		if e != nil {
+			s.errorHandler.Error(e)
+			return
+		}
+		if bucket.GetObjectName() != "" {
+			s.uploadedObjects[bucket.GetObjectName()] = true
+		}
+	}
+
+	// the master is uploaded last so clients never see buckets that do not exist yet
+	e := s.publishMaster()
+	if e != nil {
+		s.errorHandler.Error(e)
+		return
+	}
+
+	e = s.publishMasterVersion()
+	if e != nil {
+		s.errorHandler.Error(e)
+	}
+}
+
+// publishMaster uploads the master only if nobody else has replaced it since
+// this server last published it, so that two servers or a retried upload
+// cannot silently overwrite each other
+func (s *Server) publishMaster() error {
+	if !s.masterGenerationLoaded {
+		ctx, cancel := s.storageContext()
+		info, e := s.storageProvider.StatContext(ctx, masterFileName)
+		cancel()
+		if e != nil && !errors.Is(e, storage.ErrNotExist) {
+			if errors.Is(e, storage.ErrNotSupported) {
+				return s.uploadFile(masterFileName)
+			}
+			return e
+		}
+		s.masterGeneration = info.Generation
+		s.masterGenerationLoaded = true
+	}
+
+	reader, e := os.Open(filepath.Join(s.dataDir, uploadDir, masterFileName))
+	if e != nil {
+		return e
+	}
+	defer reader.Close()
+
+	ctx, cancel := s.storageContext()
+	defer cancel()
+
+	generation, e := s.storageProvider.UploadIfGenerationMatchContext(ctx, masterFileName, reader, s.masterGeneration)
+	if errors.Is(e, storage.ErrPreconditionFailed) {
+		return s.recoverMasterGeneration(ctx, e)
+	}
+	if e != nil {
+		return e
+	}
+	s.masterGeneration = generation
+
+	return nil
+}
+
+// recoverMasterGeneration handles a precondition failure publishing the
+// master. When the master in storage is the one being published, an earlier
+// upload succeeded without its response arriving, so its generation is
+// adopted. Otherwise another writer published it and failed is returned
+func (s *Server) recoverMasterGeneration(ctx context.Context, failed error) error {
+	info, e := s.storageProvider.StatContext(ctx, masterFileName)
+	if errors.Is(e, storage.ErrNotExist) {
+		return failed
+	}
+	if e != nil {
+		return e
+	}
+
+	local, e := ioutil.ReadFile(filepath.Join(s.dataDir, uploadDir, masterFileName))
+	if e != nil {
+		return e
+	}
+	var ours bool
+	if info.Checksum != "" {
+		hash := md5.Sum(local)
+		ours = info.Checksum == hex.EncodeToString(hash[:])
+	} else {
+		remote := &bytes.Buffer{}
+		e = s.storageProvider.DownloadContext(ctx, masterFileName, remote)
+		if e != nil {
+			return e
+		}
+		ours = bytes.Equal(remote.Bytes(), local)
+	}
+	if !ours {
+		return fmt.Errorf("%w: the master was published by another writer", failed)
+	}
+
+	s.masterGeneration = info.Generation
+	return nil
+}
+
+// objectUploaded reports whether a content addressed object is already in
+// storage, as it never changes it only needs uploading once
+func (s *Server) objectUploaded(objectName string) bool {
+	if s.uploadedObjects[objectName] {
+		return true
+	}
+
+	ctx, cancel := s.storageContext()
+	exists, e := s.storageProvider.ExistsContext(ctx, objectName)
+	cancel()
+	if e != nil {
+		if !errors.Is(e, storage.ErrNotSupported) {
+			s.errorHandler.Error(e)
+		}
+		return false
+	}
+	if exists {
+		s.uploadedObjects[objectName] = true
+	}
+
+	return exists
+}
+
+// publishMasterVersion copies the published master into the history under
+// the next version, points clients following the latest master at it and
+// removes the versions beyond MasterHistory
+func (s *Server) publishMasterVersion() error {
+	if s.masterHistory <= 0 {
+		return nil
+	}
+
+	if !s.masterVersionLoaded {
+		e := s.loadMasterVersion()
+		if e != nil {
+			return e
+		}
+	}
+
+	reader, e := os.Open(filepath.Join(s.dataDir, uploadDir, masterFileName))
+	if e != nil {
+		return e
+	}
+	defer reader.Close()
+
+	ctx, cancel := s.storageContext()
+	defer cancel()
+
+	// versions are never overwritten, a conflict means another server published it
+	version := s.masterVersion + 1
+	_, e = s.storageProvider.UploadIfGenerationMatchContext(ctx, masterVersionName(version), reader, "")
+	if e != nil {
+		s.masterVersionLoaded = false
+		return e
+	}
+	s.masterVersion = version
+
+	e = s.storageProvider.UploadContext(ctx, masterPointerFileName, strings.NewReader(strconv.FormatUint(version, 10)+"\n"))
+	if e != nil {
+		return e
+	}
+
+	versions, e := listMasterVersions(ctx, s.storageProvider)
+	if e != nil {
+		if errors.Is(e, storage.ErrNotSupported) {
+			return nil
+		}
+		return e
+	}
+	for len(versions) > s.masterHistory {
+		e := s.storageProvider.DeleteContext(ctx, masterVersionName(versions[0]))
+		if e != nil && !errors.Is(e, storage.ErrNotExist) {
+			return e
+		}
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+// loadMasterVersion finds the latest version in the history. The pointer is
+// written after the version it points at, so a version may be newer than it
+func (s *Server) loadMasterVersion() error {
+	ctx, cancel := s.storageContext()
+	defer cancel()
+
+	version, e := downloadMasterPointer(ctx, s.storageProvider)
+	if e != nil {
+		return e
+	}
+	versions, e := listMasterVersions(ctx, s.storageProvider)
+	if e != nil && !errors.Is(e, storage.ErrNotSupported) {
+		return e
+	}
+	if len(versions) > 0 && versions[len(versions)-1] > version {
+		version = versions[len(versions)-1]
+	}
+	s.masterVersion = version
+	s.masterVersionLoaded = true
+
+	return nil
+}
+
+// RepublishMaster publishes the master kept in the history as version again,
+// as the newest version, which rolls back every client following the latest
+// master. The next upload of a running server publishes its local buckets
+// again, so this is meant for a stopped server or one whose local buckets
+// have been repaired. With a SigningKey the master is signed again, so it stays
+// valid for clients which no longer trust the key it was signed with
+func (s *Server) RepublishMaster(version uint64) error {
+	if s.masterHistory <= 0 {
+		return errors.New("no master history is kept")
+	}
+
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	buffer := &bytes.Buffer{}
+	ctx, cancel := s.storageContext()
+	e := s.storageProvider.DownloadContext(ctx, masterVersionName(version), buffer)
+	cancel()
+	if e != nil {
+		return e
+	}
+
+	// only valid masters are published, and only masters signed by a trusted
+	// key are signed again with the current one
+	data := buffer.Bytes()
+	_, e = s.client.verifyMaster(data)
+	if e != nil {
+		return fmt.Errorf("master version %d: %w", version, e)
+	}
+	if s.signingKey != nil {
+		data, _, e = VerifyMaster(data, s.trustedKeys)
+		if e != nil {
+			return fmt.Errorf("master version %d: %w", version, e)
+		}
+		data, e = SignMaster(data, *s.signingKey)
+		if e != nil {
+			return e
+		}
+	}
+
+	e = os.MkdirAll(filepath.Join(s.dataDir, uploadDir), os.ModePerm)
+	if e != nil {
+		return e
+	}
+	e = ioutil.WriteFile(filepath.Join(s.dataDir, uploadDir, masterFileName), data, 0644)
+	if e != nil {
+		return e
+	}
+
+	e = s.publishMaster()
+	if e != nil {
+		return e
+	}
+
+	return s.publishMasterVersion()
+}
+
+func (s *Server) uploadFile(filename string) error {
+	return s.uploadObject(filename, filename)
+}
+
+// uploadObject uploads filename from the upload directory as objectName
+func (s *Server) uploadObject(filename string, objectName string) error {
+	reader, e := os.Open(filepath.Join(s.dataDir, uploadDir, filename))
+	if e != nil {
+		return e
+	}
+	defer reader.Close()
+
+	ctx, cancel := s.storageContext()
+	defer cancel()
 
+	return s.storageProvider.UploadContext(ctx, objectName, reader)
 }
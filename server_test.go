@@ -1,13 +1,26 @@
 package cbtransaction
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
 	"github.com/codingbeard/cbtransaction/encryption/cbnone"
+	"github.com/codingbeard/cbtransaction/storage"
 	"github.com/codingbeard/cbtransaction/storage/cbfile"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
 	"github.com/codingbeard/cbtransaction/transaction"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 var getDefaultTestServer = func() (*Server, error) {
@@ -32,6 +45,27 @@ var getDefaultTestServer = func() (*Server, error) {
 	})
 }
 
+var getTestServerWithStorage = func(storage Storage, dataDir string) (*Server, error) {
+	server, e := NewServer(ServerConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbnone.Key,
+		EncryptionProviders:  []Encryption{&cbnone.Encryption{}},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		StorageProvider:      storage,
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		return nil, e
+	}
+	server.master, e = NewMasterFromFile(nil)
+	if e != nil {
+		return nil, e
+	}
+	return server, os.MkdirAll(filepath.Join(dataDir, uploadDir), os.ModePerm)
+}
+
 func TestServer_AddTransaction(t *testing.T) {
 	type args struct {
 		action transaction.ActionEnum
@@ -93,7 +127,18 @@ func TestServer_Run(t *testing.T) {
 		cleanup func()
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: "stop",
+			setup: func(s *Server) *Server {
+				go func() {
+					time.Sleep(time.Millisecond * 10)
+					s.Stop()
+				}()
+				return s
+			},
+			cleanup: func() {},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -174,6 +219,75 @@ func TestServer_copyBucketsToUploadDir(t *testing.T) {
 	}
 }
 
+func TestServer_copyBucketsToUploadDirPrefix(t *testing.T) {
+	memoryStorage, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	dataDir, e := ioutil.TempDir("", "cbtransaction-prefix")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(memoryStorage, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	bucket := &Bucket{FileName: "bucket", lock: &sync.RWMutex{}}
+	s.master.SaveBucket(bucket)
+
+	hash := func(contents string) string {
+		sum := sha256.Sum256([]byte(contents))
+		return hex.EncodeToString(sum[:])
+	}
+	tests := []struct {
+		name           string
+		contents       string
+		wantPrefixSize int64
+		wantPrefixHash string
+	}{
+		{
+			name:     "new",
+			contents: "0123",
+		},
+		{
+			name:           "appended",
+			contents:       "0123456789",
+			wantPrefixSize: 4,
+			wantPrefixHash: hash("0123"),
+		},
+		{
+			name:           "unchanged",
+			contents:       "0123456789",
+			wantPrefixSize: 4,
+			wantPrefixHash: hash("0123"),
+		},
+		{
+			name:     "rewritten",
+			contents: "abcdefghijk",
+		},
+	}
+	for _, tt := range tests {
+		e := ioutil.WriteFile(filepath.Join(dataDir, "bucket"), []byte(tt.contents), os.ModePerm)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+
+		s.copyBucketsToUploadDir()
+
+		if bucket.GetSize() != int64(len(tt.contents)) || bucket.GetHash() != hash(tt.contents) {
+			t.Errorf("%s: copyBucketsToUploadDir() size = %d, hash = %s, want %s", tt.name, bucket.GetSize(), bucket.GetHash(), tt.contents)
+		}
+		if bucket.GetPrefixSize() != tt.wantPrefixSize || bucket.GetPrefixHash() != tt.wantPrefixHash {
+			t.Errorf("%s: copyBucketsToUploadDir() prefix = %d %s, want %d %s", tt.name, bucket.GetPrefixSize(), bucket.GetPrefixHash(), tt.wantPrefixSize, tt.wantPrefixHash)
+		}
+	}
+}
+
 func TestServer_createTempBucketClone(t *testing.T) {
 	type args struct {
 		bucket *Bucket
@@ -434,3 +548,467 @@ func TestServer_verifyUploadBuckets(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_publishMaster(t *testing.T) {
+	for _, provider := range testStorageProviders {
+		t.Run(provider.name, func(t *testing.T) {
+			storageDir, e := ioutil.TempDir("", "cbtransaction-publish-storage")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(storageDir)
+			remoteStorage, e := provider.new(storageDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			testPublishMaster(t, remoteStorage)
+		})
+	}
+}
+
+func testPublishMaster(t *testing.T, remoteStorage Storage) {
+	servers := map[string]*Server{}
+	for _, name := range []string{"first", "second"} {
+		dataDir, e := ioutil.TempDir("", "cbtransaction-publish-"+name)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		defer os.RemoveAll(dataDir)
+		servers[name], e = getTestServerWithStorage(remoteStorage, dataDir)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		// each server publishes a master of its own
+		bucket, _ := NewBucketFromFile(nil)
+		bucket.SetFileName(name)
+		servers[name].master.SaveBucket(bucket)
+		servers[name].generateUploadMaster()
+	}
+
+	tests := []struct {
+		name                   string
+		server                 string
+		wantErr                bool
+		wantPreconditionFailed bool
+	}{
+		{
+			name:    "firstPublish",
+			server:  "first",
+			wantErr: false,
+		},
+		{
+			name:    "secondServerLoadsGeneration",
+			server:  "second",
+			wantErr: false,
+		},
+		{
+			name:                   "firstServerIsStale",
+			server:                 "first",
+			wantErr:                true,
+			wantPreconditionFailed: true,
+		},
+		{
+			name:    "secondServerPublishesAgain",
+			server:  "second",
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := servers[tt.server].publishMaster()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("publishMaster() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, storage.ErrPreconditionFailed) != tt.wantPreconditionFailed {
+				t.Errorf("publishMaster() error = %v, wantPreconditionFailed %v", err, tt.wantPreconditionFailed)
+			}
+		})
+	}
+}
+
+// lostResponseTestStorage uploads the master but fails as if the response
+// was lost, while lose is set
+type lostResponseTestStorage struct {
+	*cbmemory.Storage
+	lose bool
+}
+
+func (s *lostResponseTestStorage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	next, e := s.Storage.UploadIfGenerationMatchContext(ctx, filename, reader, generation)
+	if e == nil && s.lose {
+		return "", context.DeadlineExceeded
+	}
+	return next, e
+}
+
+func TestServer_publishMasterLostResponse(t *testing.T) {
+	memoryStorage, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	remoteStorage := &lostResponseTestStorage{Storage: memoryStorage}
+	dataDir, e := ioutil.TempDir("", "cbtransaction-publish-lost")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(remoteStorage, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s.generateUploadMaster()
+
+	remoteStorage.lose = true
+	if e := s.publishMaster(); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("publishMaster() error = %v, want %v", e, context.DeadlineExceeded)
+		return
+	}
+	remoteStorage.lose = false
+	// the retry finds its own master in storage and adopts its generation
+	if e := s.publishMaster(); e != nil {
+		t.Errorf("publishMaster() retry error = %v", e)
+		return
+	}
+	info, e := remoteStorage.Stat(masterFileName)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if s.masterGeneration != info.Generation {
+		t.Errorf("publishMaster() generation = %s, want %s", s.masterGeneration, info.Generation)
+	}
+
+	bucket, _ := NewBucketFromFile(nil)
+	bucket.SetFileName("bucket")
+	s.master.SaveBucket(bucket)
+	s.generateUploadMaster()
+	if e := s.publishMaster(); e != nil {
+		t.Errorf("publishMaster() after the retry error = %v", e)
+	}
+}
+
+type tierTestStorage struct {
+	*cbmemory.Storage
+	tiers map[string]string
+}
+
+func (s *tierTestStorage) TierContext(ctx context.Context, filename string) (string, error) {
+	tier, ok := s.tiers[filename]
+	if !ok {
+		return "", storage.ErrNotExist
+	}
+	return tier, nil
+}
+
+func TestServer_recordBucketTiers(t *testing.T) {
+	memoryStorage, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	dataDir, e := ioutil.TempDir("", "cbtransaction-tiers")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(&tierTestStorage{
+		Storage: memoryStorage,
+		tiers:   map[string]string{"sealed": "cold", "current": "hot"},
+	}, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	for _, fileName := range []string{"sealed", "current", "notUploaded"} {
+		s.master.SaveBucket(&Bucket{FileName: fileName, Tier: "previous", lock: &sync.RWMutex{}})
+	}
+
+	s.recordBucketTiers()
+
+	tiers := map[string]string{}
+	for _, bucket := range s.master.GetBuckets() {
+		tiers[bucket.GetFileName()] = bucket.GetTier()
+	}
+	want := map[string]string{"sealed": "cold", "current": "hot", "notUploaded": "previous"}
+	if !reflect.DeepEqual(tiers, want) {
+		t.Errorf("recordBucketTiers() tiers = %v, want %v", tiers, want)
+	}
+}
+
+type uploadCountingTestStorage struct {
+	*cbmemory.Storage
+	uploads map[string]int
+}
+
+func (s *uploadCountingTestStorage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	s.uploads[filename]++
+	return s.Storage.UploadContext(ctx, filename, reader)
+}
+
+func TestServer_nameSealedBuckets(t *testing.T) {
+	memoryStorage, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	counting := &uploadCountingTestStorage{Storage: memoryStorage, uploads: map[string]int{}}
+	dataDir, e := ioutil.TempDir("", "cbtransaction-content-addressed")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(counting, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s.contentAddressedBuckets = true
+	contents := map[string]string{"sealed": "sealed-contents", "current": "current-contents"}
+	for _, fileName := range []string{"sealed", "current"} {
+		e := ioutil.WriteFile(filepath.Join(dataDir, fileName), []byte(contents[fileName]), 0644)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		s.master.SaveBucket(&Bucket{FileName: fileName, lock: &sync.RWMutex{}})
+	}
+	s.master.currentBucket = s.master.GetBuckets()[1]
+
+	s.uploadLatestBuckets()
+	s.uploadLatestBuckets()
+
+	hash := sha256.Sum256([]byte(contents["sealed"]))
+	objectName := contentAddressedName(hex.EncodeToString(hash[:]))
+	want := map[string]int{objectName: 1, "current": 2}
+	if !reflect.DeepEqual(counting.uploads, want) {
+		t.Errorf("uploadLatestBuckets() uploads = %v, want %v", counting.uploads, want)
+	}
+	if exists, _ := memoryStorage.Exists("sealed"); exists {
+		t.Error("uploadLatestBuckets() uploaded the sealed bucket under its file name")
+	}
+
+	clientDir, e := ioutil.TempDir("", "cbtransaction-content-addressed-client")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(clientDir)
+	c, e := getDefaultTestClient(memoryStorage, clientDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if e := c.Download(); e != nil {
+		t.Errorf("Download() error = %v", e)
+		return
+	}
+	if got := c.GetMaster().GetBuckets()[0].GetObjectName(); got != objectName {
+		t.Errorf("GetObjectName() = %s, want %s", got, objectName)
+	}
+	for fileName, want := range contents {
+		got, e := ioutil.ReadFile(filepath.Join(clientDir, fileName))
+		if e != nil || string(got) != want {
+			t.Errorf("downloaded bucket %s = %s, %v, want %s", fileName, got, e, want)
+		}
+	}
+}
+
+func TestServer_publishMasterVersion(t *testing.T) {
+	memoryStorage, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	dataDir, e := ioutil.TempDir("", "cbtransaction-history")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	s, e := getTestServerWithStorage(memoryStorage, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s.masterHistory = 2
+
+	// every publish adds a bucket, so each version lists one more
+	for _, fileName := range []string{"bucket1", "bucket2", "bucket3"} {
+		s.master.SaveBucket(&Bucket{FileName: fileName, lock: &sync.RWMutex{}})
+		s.generateUploadMaster()
+		if e := s.publishMaster(); e != nil {
+			t.Errorf("publishMaster() error = %v", e)
+			return
+		}
+		if e := s.publishMasterVersion(); e != nil {
+			t.Errorf("publishMasterVersion() error = %v", e)
+			return
+		}
+	}
+
+	bucketCount := func(version uint64) int {
+		buffer := &bytes.Buffer{}
+		if e := memoryStorage.Download(masterVersionName(version), buffer); e != nil {
+			return -1
+		}
+		master, e := NewMasterFromReader(buffer, s.encodingProviders)
+		if e != nil {
+			return -1
+		}
+		return len(master.GetBuckets())
+	}
+	versions, e := listMasterVersions(context.Background(), memoryStorage)
+	if e != nil || !reflect.DeepEqual(versions, []uint64{2, 3}) {
+		t.Errorf("listMasterVersions() = %v, %v, want [2 3]", versions, e)
+	}
+	if latest, e := downloadMasterPointer(context.Background(), memoryStorage); latest != 3 || e != nil {
+		t.Errorf("downloadMasterPointer() = %d, %v, want 3", latest, e)
+	}
+
+	if e := s.RepublishMaster(1); e == nil {
+		t.Error("RepublishMaster() error = nil for a version no longer kept")
+	}
+	if e := s.RepublishMaster(2); e != nil {
+		t.Errorf("RepublishMaster() error = %v", e)
+		return
+	}
+	if latest, _ := downloadMasterPointer(context.Background(), memoryStorage); latest != 4 || bucketCount(4) != 2 {
+		t.Errorf("RepublishMaster() published version %d with %d buckets, want 4 with 2", latest, bucketCount(4))
+	}
+	buffer := &bytes.Buffer{}
+	_ = memoryStorage.Download(masterFileName, buffer)
+	if master, e := NewMasterFromReader(buffer, s.encodingProviders); e != nil || len(master.GetBuckets()) != 2 {
+		t.Errorf("RepublishMaster() did not replace the master read by clients without history: %v", e)
+	}
+
+	// a new server picks up the numbering from storage
+	other, e := getTestServerWithStorage(memoryStorage, dataDir)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	other.masterHistory = 2
+	other.generateUploadMaster()
+	if e := other.publishMasterVersion(); e != nil || other.masterVersion != 5 {
+		t.Errorf("publishMasterVersion() = %d, %v, want version 5", other.masterVersion, e)
+	}
+}
+
+func TestServer_publishMasterVersionFile(t *testing.T) {
+	for _, masterHistory := range []int{0, 2} {
+		t.Run(strconv.Itoa(masterHistory), func(t *testing.T) {
+			dir, e := ioutil.TempDir("", "cbtransaction-history-file")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range []string{"storage", "server", "client"} {
+				if e := os.Mkdir(filepath.Join(dir, name), os.ModePerm); e != nil {
+					t.Error(e)
+					return
+				}
+			}
+			fileStorage, e := cbfile.New(cbfile.Config{BasePath: filepath.Join(dir, "storage")})
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			s, e := getTestServerWithStorage(fileStorage, filepath.Join(dir, "server"))
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			s.masterHistory = masterHistory
+
+			s.generateUploadMaster()
+			if e := s.publishMaster(); e != nil {
+				t.Errorf("publishMaster() error = %v", e)
+				return
+			}
+			if e := s.publishMasterVersion(); e != nil {
+				t.Errorf("publishMasterVersion() error = %v", e)
+				return
+			}
+
+			c, e := getDefaultTestClient(fileStorage, filepath.Join(dir, "client"))
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if e := c.Download(); e != nil {
+				t.Errorf("Download() error = %v", e)
+				return
+			}
+			wantVersion := uint64(0)
+			if masterHistory > 0 {
+				wantVersion = 1
+			}
+			if c.GetMasterVersion() != wantVersion {
+				t.Errorf("GetMasterVersion() = %d, want %d", c.GetMasterVersion(), wantVersion)
+			}
+		})
+	}
+}
+
+// failingTestEncryption cannot encrypt anything, Encrypt returns nil the way
+// providers without a key do
+type failingTestEncryption struct {
+	cbnone.Encryption
+}
+
+func (f *failingTestEncryption) Encrypt(data []byte) []byte {
+	return nil
+}
+
+func (f *failingTestEncryption) EncryptWriter(data []byte, writer io.Writer) error {
+	return errors.New("no key")
+}
+
+func TestServer_encryptTransactionData(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Encryption
+		want     []byte
+		wantErr  bool
+	}{
+		{
+			name:     "none",
+			provider: &cbnone.Encryption{},
+			want:     []byte("data"),
+		},
+		{
+			name:     "failing",
+			provider: &failingTestEncryption{},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := getDefaultTestServer()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			s.defaultEncryptionProvider = tt.provider
+
+			_, got, err := s.encryptTransactionData(transactionInsertQueueItem{}, []byte("data"), nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("encryptTransactionData() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("encryptTransactionData() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// signedMasterKey takes the place of the encoding key at the start of a
+// signed master, the encoding key of the master itself follows the signature
+var signedMasterKey = [8]byte{'e', 'd', '2', '5', '5', '1', '9', 0}
+
+// ErrUntrustedMaster is returned when a master is not signed by a trusted key
+var ErrUntrustedMaster = errors.New("master is not signed by a trusted key")
+
+// SigningKey signs published masters. The master records KeyID so clients
+// know which of their trusted public keys verifies it. Keys are rotated by
+// adding the new key ID to the clients' trusted keys before the server
+// switches to it, and removing the old one once no master signed with it is
+// in use anymore
+type SigningKey struct {
+	KeyID      string
+	PrivateKey ed25519.PrivateKey
+}
+
+// SignMaster wraps a serialised master, which lists the hash of every bucket,
+// in an envelope holding the key ID and an Ed25519 signature. The signature
+// covers the key ID as well, so it cannot be swapped for another trusted key
+func SignMaster(master []byte, key SigningKey) ([]byte, error) {
+	if key.KeyID == "" || len(key.KeyID) > 255 {
+		return nil, fmt.Errorf("invalid signing key id: %q", key.KeyID)
+	}
+	if len(key.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key for signing key id %s", key.KeyID)
+	}
+
+	signature := ed25519.Sign(key.PrivateKey, signedMessage(key.KeyID, master))
+
+	buffer := &bytes.Buffer{}
+	buffer.Write(signedMasterKey[:])
+	buffer.WriteByte(byte(len(key.KeyID)))
+	buffer.WriteString(key.KeyID)
+	buffer.Write(signature)
+	buffer.Write(master)
+
+	return buffer.Bytes(), nil
+}
+
+// VerifyMaster checks a master signed by SignMaster against the trusted public
+// key with its key ID. It returns the serialised master and the key ID
+func VerifyMaster(signed []byte, trustedKeys map[string]ed25519.PublicKey) ([]byte, string, error) {
+	reader := bytes.NewReader(signed)
+	keyID, signature, e := readSignature(reader)
+	if e != nil {
+		return nil, "", e
+	}
+	if signature == nil {
+		return nil, "", fmt.Errorf("%w: the master is not signed", ErrUntrustedMaster)
+	}
+	master := signed[len(signed)-reader.Len():]
+
+	publicKey, ok := trustedKeys[keyID]
+	if !ok {
+		return nil, keyID, fmt.Errorf("%w: key id %s is not trusted", ErrUntrustedMaster, keyID)
+	}
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, signedMessage(keyID, master), signature) {
+		return nil, keyID, fmt.Errorf("%w: invalid signature for key id %s", ErrUntrustedMaster, keyID)
+	}
+
+	return master, keyID, nil
+}
+
+func signedMessage(keyID string, master []byte) []byte {
+	message := make([]byte, 0, len(signedMasterKey)+1+len(keyID)+len(master))
+	message = append(message, signedMasterKey[:]...)
+	message = append(message, byte(len(keyID)))
+	message = append(message, keyID...)
+	return append(message, master...)
+}
+
+// readSignature reads the envelope of a signed master, leaving reader at the
+// start of the serialised master. Unsigned masters return a nil signature and
+// leave reader where it was
+func readSignature(reader io.ReadSeeker) (string, []byte, error) {
+	key := [8]byte{}
+	_, e := io.ReadFull(reader, key[:])
+	if e != nil {
+		return "", nil, e
+	}
+	if key != signedMasterKey {
+		_, e := reader.Seek(-int64(len(key)), io.SeekCurrent)
+		return "", nil, e
+	}
+
+	length := []byte{0}
+	_, e = io.ReadFull(reader, length)
+	if e != nil {
+		return "", nil, e
+	}
+	keyID := make([]byte, length[0])
+	_, e = io.ReadFull(reader, keyID)
+	if e != nil {
+		return "", nil, e
+	}
+	signature := make([]byte, ed25519.SignatureSize)
+	_, e = io.ReadFull(reader, signature)
+	if e != nil {
+		return "", nil, e
+	}
+
+	return string(keyID), signature, nil
+}
@@ -0,0 +1,111 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
+	"testing"
+)
+
+func getTestSigningKey(t *testing.T, keyID string) (SigningKey, ed25519.PublicKey) {
+	publicKey, privateKey, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return SigningKey{KeyID: keyID, PrivateKey: privateKey}, publicKey
+}
+
+func TestVerifyMaster(t *testing.T) {
+	oldKey, oldPublicKey := getTestSigningKey(t, "2020-01")
+	newKey, newPublicKey := getTestSigningKey(t, "2020-02")
+	_, otherPublicKey := getTestSigningKey(t, "other")
+	master := []byte("serialised master")
+	sign := func(key SigningKey) []byte {
+		signed, e := SignMaster(master, key)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return signed
+	}
+	tampered := sign(newKey)
+	tampered[len(tampered)-1] ^= 1
+	// claiming another trusted key id invalidates the signature
+	swapped := bytes.Replace(sign(newKey), []byte("2020-02"), []byte("2020-01"), 1)
+
+	tests := []struct {
+		name        string
+		signed      []byte
+		trustedKeys map[string]ed25519.PublicKey
+		wantKeyID   string
+		wantErr     bool
+	}{
+		{
+			name:        "trusted",
+			signed:      sign(newKey),
+			trustedKeys: map[string]ed25519.PublicKey{"2020-02": newPublicKey},
+			wantKeyID:   "2020-02",
+		},
+		{
+			name:        "rotatedKeyStillTrusted",
+			signed:      sign(oldKey),
+			trustedKeys: map[string]ed25519.PublicKey{"2020-01": oldPublicKey, "2020-02": newPublicKey},
+			wantKeyID:   "2020-01",
+		},
+		{
+			name:        "untrustedKeyID",
+			signed:      sign(oldKey),
+			trustedKeys: map[string]ed25519.PublicKey{"2020-02": newPublicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "wrongPublicKey",
+			signed:      sign(newKey),
+			trustedKeys: map[string]ed25519.PublicKey{"2020-02": otherPublicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "tampered",
+			signed:      tampered,
+			trustedKeys: map[string]ed25519.PublicKey{"2020-02": newPublicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "swappedKeyID",
+			signed:      swapped,
+			trustedKeys: map[string]ed25519.PublicKey{"2020-01": oldPublicKey, "2020-02": newPublicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "unsigned",
+			signed:      append(cbmsgpack.Key[:], master...),
+			trustedKeys: map[string]ed25519.PublicKey{"2020-02": newPublicKey},
+			wantErr:     true,
+		},
+		{
+			name:        "truncated",
+			signed:      sign(newKey)[:20],
+			trustedKeys: map[string]ed25519.PublicKey{"2020-02": newPublicKey},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, keyID, err := VerifyMaster(tt.signed, tt.trustedKeys)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyMaster() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(got, master) || keyID != tt.wantKeyID {
+				t.Errorf("VerifyMaster() = %s, %s, want %s, %s", got, keyID, master, tt.wantKeyID)
+			}
+		})
+	}
+
+	if _, _, e := VerifyMaster(sign(oldKey), map[string]ed25519.PublicKey{}); !errors.Is(e, ErrUntrustedMaster) {
+		t.Errorf("VerifyMaster() error = %v, want %v", e, ErrUntrustedMaster)
+	}
+}
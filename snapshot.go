@@ -0,0 +1,74 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// SnapshotWriter receives the files of a snapshot from ExportSnapshot. It has
+// to read reader to the end, size is the number of bytes it will return
+type SnapshotWriter func(filename string, size int64, reader io.Reader) error
+
+// ExportSnapshot downloads the master from source and passes every bucket it
+// lists, followed by the master itself, to write. This packages everything a
+// Client needs to Download from another storage, such as an archive carried to
+// an offline machine. Buckets are cut off at the size recorded in the master and
+// checked against its hash, so the snapshot stays consistent while the server
+// keeps appending to them
+func ExportSnapshot(ctx context.Context, source Storage, encodingProviders []Encoding, write SnapshotWriter) error {
+	buffer := &bytes.Buffer{}
+	e := source.DownloadContext(ctx, masterFileName, buffer)
+	if e != nil {
+		return e
+	}
+
+	master, e := NewMasterFromReader(bytes.NewReader(buffer.Bytes()), encodingProviders)
+	if e != nil {
+		return e
+	}
+
+	for _, bucket := range master.GetBuckets() {
+		e := exportBucket(ctx, source, bucket, write)
+		if e != nil {
+			return e
+		}
+	}
+
+	return write(masterFileName, int64(buffer.Len()), bytes.NewReader(buffer.Bytes()))
+}
+
+func exportBucket(ctx context.Context, source Storage, bucket *Bucket, write SnapshotWriter) error {
+	size := bucket.GetSize()
+	if bucket.GetHash() == "" {
+		// masters written before buckets were hashed do not record the size either
+		info, e := source.StatContext(ctx, bucket.GetStorageName())
+		if e != nil {
+			return e
+		}
+		size = info.Size
+	}
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hash := sha256.New()
+		e := source.DownloadRangeContext(ctx, bucket.GetStorageName(), 0, size, io.MultiWriter(writer, hash))
+		if e == nil && bucket.GetHash() != "" && hex.EncodeToString(hash.Sum(nil)) != bucket.GetHash() {
+			e = fmt.Errorf("bucket %s does not match the hash in the master", bucket.GetFileName())
+		}
+		// the hash is only checked once everything was read, the error stops
+		// write from seeing the end of the bucket and accepting it
+		_ = writer.CloseWithError(e)
+	}()
+
+	e := write(bucket.GetStorageName(), size, reader)
+	_ = reader.Close()
+	<-done
+
+	return e
+}
@@ -1,10 +1,255 @@
 package cbtransaction
 
-import "io"
+import (
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"sync"
+)
 
 type Storage interface {
 	Upload(filename string, reader io.Reader) error
 	Download(filename string, writer io.Writer) error
 	Concat(destination string, filenames ...string) error
 	Delete(filename string) error
+	List(prefix string) ([]storage.ObjectInfo, error)
+	Stat(filename string) (storage.ObjectInfo, error)
+	Exists(filename string) (bool, error)
+	// UploadIfGenerationMatch only writes the object if its current generation
+	// equals generation, an empty generation requires that the object does not
+	// exist yet. It returns the new generation, or an error wrapping
+	// storage.ErrPreconditionFailed when the generation did not match
+	UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error)
+	// DownloadRange writes length bytes of the object starting at offset, a
+	// negative length reads until the end of the object
+	DownloadRange(filename string, offset int64, length int64, writer io.Writer) error
+	UploadContext(ctx context.Context, filename string, reader io.Reader) error
+	DownloadContext(ctx context.Context, filename string, writer io.Writer) error
+	ConcatContext(ctx context.Context, destination string, filenames ...string) error
+	DeleteContext(ctx context.Context, filename string) error
+	ListContext(ctx context.Context, prefix string) ([]storage.ObjectInfo, error)
+	StatContext(ctx context.Context, filename string) (storage.ObjectInfo, error)
+	ExistsContext(ctx context.Context, filename string) (bool, error)
+	UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error)
+	DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error
+}
+
+// HashDownloader is implemented by storage which can serve an object by the
+// hex encoded SHA-256 of its contents, such as a shared cache. The client uses
+// it for buckets whose hash is known from the master
+type HashDownloader interface {
+	DownloadHashContext(ctx context.Context, filename string, hash string, writer io.Writer) error
+}
+
+// Tierer is implemented by storage which places objects in tiers, the server
+// records the tier of every bucket in the master
+type Tierer interface {
+	TierContext(ctx context.Context, filename string) (string, error)
+}
+
+// BasicStorage is the original storage interface without context support,
+// use NewStorageAdapter to turn an implementation of it into a Storage
+type BasicStorage interface {
+	Upload(filename string, reader io.Reader) error
+	Download(filename string, writer io.Writer) error
+	Concat(destination string, filenames ...string) error
+	Delete(filename string) error
+}
+
+type storageAdapter struct {
+	storage BasicStorage
+}
+
+// NewStorageAdapter wraps a BasicStorage so it can be used as a Storage. The
+// context methods return as soon as the context is done, but the underlying
+// call cannot be interrupted and will finish in the background. Once the
+// context method has returned, the background call can no longer read from or
+// write to the reader or writer it was given. List, Stat,
+// Exists and UploadIfGenerationMatch return storage.ErrNotSupported as
+// BasicStorage cannot provide them. DownloadRange is emulated by downloading the
+// whole object and discarding everything outside of the range
+func NewStorageAdapter(storage BasicStorage) Storage {
+	if s, ok := storage.(Storage); ok {
+		return s
+	}
+	return &storageAdapter{storage: storage}
+}
+
+// errAbandoned is returned to a legacy call that keeps reading or writing after
+// its context method has already returned
+var errAbandoned = errors.New("cbtransaction: storage call abandoned after its context was done")
+
+// callGuard stops a legacy call from touching the caller's reader or writer
+// once the context method it was started from has returned
+type callGuard struct {
+	lock    sync.Mutex
+	stopped bool
+}
+
+func (g *callGuard) stop() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.stopped = true
+}
+
+type guardedReader struct {
+	guard  *callGuard
+	reader io.Reader
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	r.guard.lock.Lock()
+	defer r.guard.lock.Unlock()
+	if r.guard.stopped {
+		return 0, errAbandoned
+	}
+	return r.reader.Read(p)
+}
+
+type guardedWriter struct {
+	guard  *callGuard
+	writer io.Writer
+}
+
+func (w *guardedWriter) Write(p []byte) (int, error) {
+	w.guard.lock.Lock()
+	defer w.guard.lock.Unlock()
+	if w.guard.stopped {
+		return 0, errAbandoned
+	}
+	return w.writer.Write(p)
+}
+
+// run calls the legacy method in the background and returns when it finishes
+// or ctx is done, whichever comes first. The reader or writer handed to call
+// must be wrapped with the guard so an abandoned call cannot use it after run
+// has returned
+func (a *storageAdapter) run(ctx context.Context, call func(guard *callGuard) error) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	guard := &callGuard{}
+	result := make(chan error, 1)
+	go func() {
+		result <- call(guard)
+	}()
+
+	select {
+	case e := <-result:
+		return e
+	case <-ctx.Done():
+		guard.stop()
+		return ctx.Err()
+	}
+}
+
+func (a *storageAdapter) Upload(filename string, reader io.Reader) error {
+	return a.storage.Upload(filename, reader)
+}
+
+func (a *storageAdapter) Download(filename string, writer io.Writer) error {
+	return a.storage.Download(filename, writer)
+}
+
+func (a *storageAdapter) Concat(destination string, filenames ...string) error {
+	return a.storage.Concat(destination, filenames...)
+}
+
+func (a *storageAdapter) Delete(filename string) error {
+	return a.storage.Delete(filename)
+}
+
+func (a *storageAdapter) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	return a.run(ctx, func(guard *callGuard) error {
+		return a.storage.Upload(filename, &guardedReader{guard: guard, reader: reader})
+	})
+}
+
+func (a *storageAdapter) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return a.run(ctx, func(guard *callGuard) error {
+		return a.storage.Download(filename, &guardedWriter{guard: guard, writer: writer})
+	})
+}
+
+func (a *storageAdapter) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	return a.run(ctx, func(guard *callGuard) error {
+		return a.storage.Concat(destination, filenames...)
+	})
+}
+
+func (a *storageAdapter) DeleteContext(ctx context.Context, filename string) error {
+	return a.run(ctx, func(guard *callGuard) error {
+		return a.storage.Delete(filename)
+	})
+}
+
+func (a *storageAdapter) List(prefix string) ([]storage.ObjectInfo, error) {
+	return nil, storage.ErrNotSupported
+}
+
+func (a *storageAdapter) Stat(filename string) (storage.ObjectInfo, error) {
+	return storage.ObjectInfo{}, storage.ErrNotSupported
+}
+
+func (a *storageAdapter) Exists(filename string) (bool, error) {
+	return false, storage.ErrNotSupported
+}
+
+func (a *storageAdapter) ListContext(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	return nil, storage.ErrNotSupported
+}
+
+func (a *storageAdapter) StatContext(ctx context.Context, filename string) (storage.ObjectInfo, error) {
+	return storage.ObjectInfo{}, storage.ErrNotSupported
+}
+
+func (a *storageAdapter) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	return false, storage.ErrNotSupported
+}
+
+func (a *storageAdapter) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return "", storage.ErrNotSupported
+}
+
+func (a *storageAdapter) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	return "", storage.ErrNotSupported
+}
+
+type rangeWriter struct {
+	writer io.Writer
+	skip   int64
+	length int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip >= int64(len(p)) {
+		w.skip -= int64(len(p))
+		return n, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	if w.length >= 0 {
+		if w.length < int64(len(p)) {
+			p = p[:w.length]
+		}
+		w.length -= int64(len(p))
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	_, e := w.writer.Write(p)
+	return n, e
+}
+
+func (a *storageAdapter) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return a.storage.Download(filename, &rangeWriter{writer: writer, skip: offset, length: length})
+}
+
+func (a *storageAdapter) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	return a.run(ctx, func(guard *callGuard) error {
+		return a.DownloadRange(filename, offset, length, &guardedWriter{guard: guard, writer: writer})
+	})
 }
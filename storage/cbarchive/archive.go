@@ -0,0 +1,663 @@
+package cbarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format is the container format of an archive
+type Format string
+
+const (
+	Tar Format = "tar"
+	Zip Format = "zip"
+)
+
+const (
+	// generationRecord is the PAX record holding the generation of a tar
+	// entry, zip entries keep it in their comment
+	generationRecord = "CBTRANSACTION.generation"
+	tarBlockSize     = 512
+)
+
+type entry struct {
+	name       string
+	size       int64
+	modTime    time.Time
+	generation int64
+	// offset of the contents in a tar archive
+	offset int64
+	// zipFile is the entry in a zip archive
+	zipFile *zip.File
+}
+
+// Storage keeps every object as an entry of a single tar or zip archive on
+// disk, such as a snapshot written by Export for a Client on an offline
+// machine. Writes to a tar archive append the new entry, so replaced contents
+// stay in the archive until a Delete rewrites it. Zip archives are rewritten
+// by every write. Either way a write only replaces the archive once it
+// succeeded, so it suits occasional writes rather than serving a busy Server
+type Storage struct {
+	path    string
+	format  Format
+	tempDir string
+
+	lock           sync.RWMutex
+	file           *os.File
+	zipReader      *zip.ReadCloser
+	entries        map[string]*entry
+	end            int64
+	lastGeneration int64
+}
+
+type Config struct {
+	// Path of the archive, it is created by the first write if it does not exist
+	Path string
+	// Format defaults to Zip for paths ending in .zip and to Tar otherwise
+	Format Format
+	// TempDir holds uploads while their size is unknown, defaults to os.TempDir
+	TempDir string
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Path == "" {
+		return nil, errors.New("no archive path configured")
+	}
+	format, e := formatOf(config.Path, config.Format)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &Storage{
+		path:    config.Path,
+		format:  format,
+		tempDir: config.TempDir,
+	}
+	if e := s.load(); e != nil {
+		return nil, e
+	}
+
+	return s, nil
+}
+
+func formatOf(path string, format Format) (Format, error) {
+	switch format {
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".zip") {
+			return Zip, nil
+		}
+		return Tar, nil
+	case Tar, Zip:
+		return format, nil
+	}
+
+	return "", fmt.Errorf("invalid archive format: %s", format)
+}
+
+// Close releases the archive, the Storage cannot be used afterwards
+func (s *Storage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closeArchive()
+}
+
+func (s *Storage) closeArchive() error {
+	var e error
+	if s.file != nil {
+		e = s.file.Close()
+		s.file = nil
+	}
+	if s.zipReader != nil {
+		e = s.zipReader.Close()
+		s.zipReader = nil
+	}
+	return e
+}
+
+// load indexes the entries of the archive, s.lock must be held
+func (s *Storage) load() error {
+	s.entries = map[string]*entry{}
+	s.end = 0
+	if _, e := os.Stat(s.path); os.IsNotExist(e) {
+		return nil
+	}
+	if s.format == Zip {
+		return s.loadZip()
+	}
+	return s.loadTar()
+}
+
+func (s *Storage) loadTar() error {
+	file, e := os.Open(s.path)
+	if e != nil {
+		return e
+	}
+	info, e := file.Stat()
+	if e != nil {
+		_ = file.Close()
+		return e
+	}
+
+	reader := tar.NewReader(file)
+	for {
+		header, e := reader.Next()
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			// an entry cut off by a crash while appending is dropped and
+			// overwritten by the next write
+			break
+		}
+		if e != nil {
+			_ = file.Close()
+			return fmt.Errorf("reading archive %s: %w", s.path, e)
+		}
+		offset, e := file.Seek(0, io.SeekCurrent)
+		if e != nil {
+			_ = file.Close()
+			return e
+		}
+		end := offset + (header.Size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+		if end > info.Size() {
+			break
+		}
+		s.end = end
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		s.index(&entry{
+			name:       header.Name,
+			size:       header.Size,
+			modTime:    header.ModTime,
+			generation: parseGeneration(header.PAXRecords[generationRecord]),
+			offset:     offset,
+		})
+	}
+	s.file = file
+
+	return nil
+}
+
+func (s *Storage) loadZip() error {
+	reader, e := zip.OpenReader(s.path)
+	if e != nil {
+		return fmt.Errorf("reading archive %s: %w", s.path, e)
+	}
+
+	for _, file := range reader.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		s.index(&entry{
+			name:       file.Name,
+			size:       int64(file.UncompressedSize64),
+			modTime:    file.Modified,
+			generation: parseGeneration(file.Comment),
+			zipFile:    file,
+		})
+	}
+	s.zipReader = reader
+
+	return nil
+}
+
+// index adds a loaded entry, later entries replace earlier ones of the same
+// name. Entries written by other tools have no generation, they are numbered
+// in archive order instead
+func (s *Storage) index(loaded *entry) {
+	if loaded.generation == 0 {
+		loaded.generation = s.lastGeneration + 1
+	}
+	if loaded.generation > s.lastGeneration {
+		s.lastGeneration = loaded.generation
+	}
+	s.entries[loaded.name] = loaded
+}
+
+func parseGeneration(value string) int64 {
+	generation, e := strconv.ParseInt(value, 10, 64)
+	if e != nil || generation < 0 {
+		return 0
+	}
+	return generation
+}
+
+func formatGeneration(generation int64) string {
+	return strconv.FormatInt(generation, 10)
+}
+
+func (s *Storage) checkFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." || strings.HasSuffix(filename, "/") {
+		return fmt.Errorf("invalid filename: %s", filename)
+	}
+
+	return nil
+}
+
+// spool returns reader along with its size, copying it to a temporary file
+// first unless it can seek
+func (s *Storage) spool(reader io.Reader) (io.Reader, int64, func(), error) {
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		start, e := seeker.Seek(0, io.SeekCurrent)
+		if e == nil {
+			end, e := seeker.Seek(0, io.SeekEnd)
+			if e != nil {
+				return nil, 0, nil, e
+			}
+			if _, e := seeker.Seek(start, io.SeekStart); e != nil {
+				return nil, 0, nil, e
+			}
+			return seeker, end - start, func() {}, nil
+		}
+	}
+
+	file, e := ioutil.TempFile(s.tempDir, "cbarchive-")
+	if e != nil {
+		return nil, 0, nil, e
+	}
+	cleanup := func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}
+	size, e := io.Copy(file, reader)
+	if e != nil {
+		cleanup()
+		return nil, 0, nil, e
+	}
+	if _, e := file.Seek(0, io.SeekStart); e != nil {
+		cleanup()
+		return nil, 0, nil, e
+	}
+
+	return file, size, cleanup, nil
+}
+
+// open returns the contents of an entry, s.lock must be held
+func (s *Storage) open(existing *entry) (io.ReadCloser, error) {
+	if existing.zipFile == nil {
+		return ioutil.NopCloser(io.NewSectionReader(s.file, existing.offset, existing.size)), nil
+	}
+	return existing.zipFile.Open()
+}
+
+// read writes part of the contents of an entry, s.lock must be held
+func (s *Storage) read(existing *entry, offset int64, length int64, writer io.Writer) error {
+	if offset >= existing.size {
+		return nil
+	}
+	if length < 0 || length > existing.size-offset {
+		length = existing.size - offset
+	}
+
+	if existing.zipFile == nil {
+		_, e := io.Copy(writer, io.NewSectionReader(s.file, existing.offset+offset, length))
+		return e
+	}
+
+	contents, e := existing.zipFile.Open()
+	if e != nil {
+		return e
+	}
+	defer contents.Close()
+	if _, e := io.CopyN(ioutil.Discard, contents, offset); e != nil {
+		return e
+	}
+	_, e = io.CopyN(writer, contents, length)
+
+	return e
+}
+
+// write stores reader as filename, s.lock must be held
+func (s *Storage) write(filename string, size int64, reader io.Reader) (*entry, error) {
+	if s.format == Zip {
+		e := s.rewrite(filename, size, reader)
+		if e != nil {
+			return nil, e
+		}
+		return s.entries[filename], nil
+	}
+
+	file, e := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+	if _, e := file.Seek(s.end, io.SeekStart); e != nil {
+		return nil, e
+	}
+
+	// the new entry overwrites the end of archive marker and writes a new one
+	written := &entry{name: filename, size: size, modTime: time.Now(), generation: s.lastGeneration + 1}
+	writer := newArchiveWriter(Tar, file)
+	if e := writer.add(written, reader); e != nil {
+		return nil, e
+	}
+	if e := writer.close(); e != nil {
+		return nil, e
+	}
+	if e := file.Sync(); e != nil {
+		return nil, e
+	}
+
+	if s.file == nil {
+		s.file, e = os.Open(s.path)
+		if e != nil {
+			return nil, e
+		}
+	}
+	s.end = written.offset + (size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+	s.index(written)
+
+	return written, nil
+}
+
+// rewrite replaces the archive with a copy in which filename has the contents
+// of reader, or is left out when reader is nil. s.lock must be held
+func (s *Storage) rewrite(filename string, size int64, reader io.Reader) error {
+	file, e := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+"-")
+	if e != nil {
+		return e
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	writer := newArchiveWriter(s.format, file)
+	for _, existing := range s.sorted() {
+		if existing.name == filename {
+			continue
+		}
+		contents, e := s.open(existing)
+		if e != nil {
+			return e
+		}
+		copied := &entry{name: existing.name, size: existing.size, modTime: existing.modTime, generation: existing.generation}
+		e = writer.add(copied, contents)
+		_ = contents.Close()
+		if e != nil {
+			return e
+		}
+	}
+	if reader != nil {
+		written := &entry{name: filename, size: size, modTime: time.Now(), generation: s.lastGeneration + 1}
+		if e := writer.add(written, reader); e != nil {
+			return e
+		}
+	}
+	if e := writer.close(); e != nil {
+		return e
+	}
+	if e := file.Chmod(0644); e != nil {
+		return e
+	}
+	if e := file.Sync(); e != nil {
+		return e
+	}
+	if e := file.Close(); e != nil {
+		return e
+	}
+
+	// windows cannot replace a file which is still open
+	_ = s.closeArchive()
+	e = os.Rename(file.Name(), s.path)
+	if e == nil {
+		committed = true
+	}
+	if loadError := s.load(); e == nil {
+		e = loadError
+	}
+
+	return e
+}
+
+func (s *Storage) sorted() []*entry {
+	entries := make([]*entry, 0, len(s.entries))
+	for _, existing := range s.entries {
+		entries = append(entries, existing)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	_, e := s.upload(ctx, filename, reader, nil)
+	return e
+}
+
+// upload writes reader as filename. When generation is not nil the object
+// has to have that generation, with "" meaning it must not exist
+func (s *Storage) upload(ctx context.Context, filename string, reader io.Reader, generation *string) (string, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	body, size, cleanup, e := s.spool(reader)
+	if e != nil {
+		return "", e
+	}
+	defer cleanup()
+	if e := ctx.Err(); e != nil {
+		return "", e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if generation != nil {
+		current := ""
+		if existing, ok := s.entries[filename]; ok {
+			current = formatGeneration(existing.generation)
+		}
+		if current != *generation {
+			return "", fmt.Errorf("%w: %s does not have generation %s", cbstorage.ErrPreconditionFailed, filename, *generation)
+		}
+	}
+	written, e := s.write(filename, size, body)
+	if e != nil {
+		return "", e
+	}
+
+	return formatGeneration(written.generation), nil
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return s.DownloadRangeContext(ctx, filename, 0, -1, writer)
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	existing, ok := s.entries[filename]
+	if !ok {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return s.read(existing, offset, length, writer)
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := s.checkFilename(destination); e != nil {
+		return e
+	}
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+	for _, filename := range filenames {
+		if e := s.checkFilename(filename); e != nil {
+			return e
+		}
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, e := ioutil.TempFile(s.tempDir, "cbarchive-")
+	if e != nil {
+		return e
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	var size int64
+	for _, filename := range filenames {
+		existing, ok := s.entries[filename]
+		if !ok {
+			return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+		}
+		if e := s.read(existing, 0, -1, file); e != nil {
+			return e
+		}
+		size += existing.size
+	}
+	if _, e := file.Seek(0, io.SeekStart); e != nil {
+		return e
+	}
+	_, e = s.write(destination, size, file)
+
+	return e
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.entries[filename]; !ok {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return s.rewrite(filename, 0, nil)
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var objects []cbstorage.ObjectInfo
+	for _, existing := range s.sorted() {
+		if strings.HasPrefix(existing.name, prefix) {
+			objects = append(objects, objectInfo(existing))
+		}
+	}
+
+	return objects, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	if e := ctx.Err(); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	existing, ok := s.entries[filename]
+	if !ok {
+		return cbstorage.ObjectInfo{}, fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return objectInfo(existing), nil
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	return s.upload(ctx, filename, reader, &generation)
+}
+
+// objectInfo describes an entry, archives do not record an md5 so Checksum is empty
+func objectInfo(existing *entry) cbstorage.ObjectInfo {
+	generation := formatGeneration(existing.generation)
+
+	return cbstorage.ObjectInfo{
+		Name:       existing.name,
+		Size:       existing.size,
+		ModTime:    existing.modTime,
+		ETag:       generation,
+		Generation: generation,
+	}
+}
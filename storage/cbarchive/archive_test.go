@@ -0,0 +1,189 @@
+package cbarchive
+
+import (
+	"bytes"
+	"errors"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func getDir(t *testing.T) string {
+	dir, e := ioutil.TempDir("", "cbarchive")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return dir
+}
+
+func getStorage(t *testing.T, path string) *Storage {
+	s, e := New(Config{Path: path})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func contents(s *Storage, filename string) string {
+	writer := &bytes.Buffer{}
+	if e := s.Download(filename, writer); e != nil {
+		return e.Error()
+	}
+	return writer.String()
+}
+
+func TestStorage(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+	}{
+		{
+			name:     "tar",
+			filename: "snapshot.tar",
+		},
+		{
+			name:     "zip",
+			filename: "snapshot.zip",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := getDir(t)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, tt.filename)
+			s := getStorage(t, path)
+			defer s.Close()
+
+			if e := s.Upload("a/1", strings.NewReader("first")); e != nil {
+				t.Errorf("Upload() error = %v", e)
+				return
+			}
+			// not seekable, so it is spooled to find its size
+			if e := s.Upload("b", ioutil.NopCloser(strings.NewReader("second"))); e != nil {
+				t.Errorf("Upload() error = %v", e)
+				return
+			}
+			if e := s.Upload("a/1", strings.NewReader("replaced")); e != nil {
+				t.Errorf("Upload() error = %v", e)
+				return
+			}
+			if e := s.Concat("c", "a/1", "b"); e != nil {
+				t.Errorf("Concat() error = %v", e)
+				return
+			}
+			writer := &bytes.Buffer{}
+			if e := s.DownloadRange("c", 2, 8, writer); e != nil || writer.String() != "placedse" {
+				t.Errorf("DownloadRange() = %s, %v, want placedse", writer.String(), e)
+			}
+			if e := s.Delete("b"); e != nil {
+				t.Errorf("Delete() error = %v", e)
+			}
+			if e := s.Delete("b"); !errors.Is(e, cbstorage.ErrNotExist) {
+				t.Errorf("Delete() error = %v, want %v", e, cbstorage.ErrNotExist)
+			}
+			if e := s.Upload("d", strings.NewReader("after delete")); e != nil {
+				t.Errorf("Upload() error = %v", e)
+			}
+			_ = s.Close()
+
+			// everything is read back from the archive
+			reopened := getStorage(t, path)
+			defer reopened.Close()
+			objects, e := reopened.List("")
+			var names []string
+			for _, object := range objects {
+				names = append(names, object.Name)
+			}
+			if e != nil || !reflect.DeepEqual(names, []string{"a/1", "c", "d"}) {
+				t.Errorf("List() = %v, %v, want [a/1 c d]", names, e)
+			}
+			for filename, want := range map[string]string{"a/1": "replaced", "c": "replacedsecond", "d": "after delete"} {
+				if got := contents(reopened, filename); got != want {
+					t.Errorf("Download(%s) = %s, want %s", filename, got, want)
+				}
+			}
+			if exists, e := reopened.Exists("b"); exists || e != nil {
+				t.Errorf("Exists() = %v, %v for a deleted object", exists, e)
+			}
+		})
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.tar")
+	s := getStorage(t, path)
+	defer s.Close()
+
+	generation, e := s.UploadIfGenerationMatch("master", strings.NewReader("v1"), "")
+	if e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+		return
+	}
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v2"), ""); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+	_ = s.Close()
+
+	// generations are stored in the archive
+	reopened := getStorage(t, path)
+	defer reopened.Close()
+	info, e := reopened.Stat("master")
+	if e != nil || info.Generation != generation || info.Size != 2 {
+		t.Errorf("Stat() = %+v, %v, want generation %s", info, e, generation)
+	}
+	next, e := reopened.UploadIfGenerationMatch("master", strings.NewReader("v2"), generation)
+	if e != nil || next == generation {
+		t.Errorf("UploadIfGenerationMatch() = %s, %v, want a new generation", next, e)
+	}
+	if got := contents(reopened, "master"); got != "v2" {
+		t.Errorf("Download() = %s, want v2", got)
+	}
+}
+
+func TestStorage_TruncatedTar(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.tar")
+	s := getStorage(t, path)
+	_ = s.Upload("kept", strings.NewReader("kept"))
+	info, _ := os.Stat(path)
+	_ = s.Upload("lost", strings.NewReader(strings.Repeat("l", 2000)))
+	_ = s.Close()
+
+	// cut the last append off part way through its contents
+	if e := os.Truncate(path, info.Size()+1024); e != nil {
+		t.Fatal(e)
+	}
+	reopened := getStorage(t, path)
+	defer reopened.Close()
+	if exists, _ := reopened.Exists("lost"); exists {
+		t.Error("Exists() = true for a cut off entry")
+	}
+	if e := reopened.Upload("next", strings.NewReader("next")); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if got := contents(reopened, "kept") + contents(reopened, "next"); got != "keptnext" {
+		t.Errorf("Download() = %s, want keptnext", got)
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	for _, format := range []Format{Tar, Zip} {
+		t.Run(string(format), func(t *testing.T) {
+			dir := getDir(t)
+			defer os.RemoveAll(dir)
+			s, e := New(Config{Path: filepath.Join(dir, "archive"), Format: format})
+			if e != nil {
+				t.Fatal(e)
+			}
+			storagetest.Contract(t, s)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package cbarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveWriter writes entries to a new archive or, for tar, appends them to
+// an existing one positioned at its end of archive marker
+type archiveWriter struct {
+	file *os.File
+	tar  *tar.Writer
+	zip  *zip.Writer
+}
+
+func newArchiveWriter(format Format, file *os.File) *archiveWriter {
+	if format == Zip {
+		return &archiveWriter{file: file, zip: zip.NewWriter(file)}
+	}
+	return &archiveWriter{file: file, tar: tar.NewWriter(file)}
+}
+
+// add writes the contents of an entry, recording where they start in a tar
+// archive. reader has to return exactly written.size bytes
+func (w *archiveWriter) add(written *entry, reader io.Reader) error {
+	var copied int64
+	if w.zip != nil {
+		header := &zip.FileHeader{
+			Name:     written.name,
+			Method:   zip.Deflate,
+			Modified: written.modTime,
+			Comment:  formatGeneration(written.generation),
+		}
+		header.SetMode(0644)
+		writer, e := w.zip.CreateHeader(header)
+		if e != nil {
+			return e
+		}
+		copied, e = io.Copy(writer, reader)
+		if e != nil {
+			return e
+		}
+	} else {
+		e := w.tar.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       written.name,
+			Size:       written.size,
+			Mode:       0644,
+			ModTime:    written.modTime,
+			PAXRecords: map[string]string{generationRecord: formatGeneration(written.generation)},
+			Format:     tar.FormatPAX,
+		})
+		if e != nil {
+			return e
+		}
+		// tar.Writer does not buffer, so the header has been written
+		written.offset, e = w.file.Seek(0, io.SeekCurrent)
+		if e != nil {
+			return e
+		}
+		copied, e = io.Copy(w.tar, reader)
+		if e != nil {
+			return e
+		}
+	}
+	if copied != written.size {
+		return fmt.Errorf("%s has %d bytes, expected %d", written.name, copied, written.size)
+	}
+
+	return nil
+}
+
+// close writes the end of the archive
+func (w *archiveWriter) close() error {
+	if w.zip != nil {
+		return w.zip.Close()
+	}
+	return w.tar.Close()
+}
+
+// Export writes the master in source and every bucket it lists to a new
+// archive at path, see cbtransaction.ExportSnapshot. A Client configured with
+// a Storage opened on the archive can then Download the master and buckets
+// without network access. The format follows the extension of path as in Config, and an existing file at
+// path is only replaced once the archive is complete
+func Export(ctx context.Context, source cbtransaction.Storage, path string, encodingProviders []cbtransaction.Encoding) error {
+	format, e := formatOf(path, "")
+	if e != nil {
+		return e
+	}
+	file, e := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if e != nil {
+		return e
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	writer := newArchiveWriter(format, file)
+	var generation int64
+	e = cbtransaction.ExportSnapshot(ctx, source, encodingProviders, func(filename string, size int64, reader io.Reader) error {
+		generation++
+		return writer.add(&entry{name: filename, size: size, modTime: time.Now(), generation: generation}, reader)
+	})
+	if e != nil {
+		return e
+	}
+	if e := writer.close(); e != nil {
+		return e
+	}
+	if e := file.Chmod(0644); e != nil {
+		return e
+	}
+	if e := file.Sync(); e != nil {
+		return e
+	}
+	if e := file.Close(); e != nil {
+		return e
+	}
+	if e := os.Rename(file.Name(), path); e != nil {
+		return e
+	}
+	committed = true
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package cbarchive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/codingbeard/cbtransaction"
+	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
+	"github.com/codingbeard/cbtransaction/encryption/cbnone"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// getSource returns a storage holding a master which lists buckets
+func getSource(t *testing.T, buckets map[string]string) *cbmemory.Storage {
+	source, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	master, e := cbtransaction.NewMasterFromFile(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for fileName, contents := range buckets {
+		hash := sha256.Sum256([]byte(contents))
+		master.SaveBucket(&cbtransaction.Bucket{FileName: fileName, Hash: hex.EncodeToString(hash[:]), Size: int64(len(contents))})
+		_ = source.Upload(fileName, strings.NewReader(contents))
+	}
+	buffer := &bytes.Buffer{}
+	if e := master.SerialiseWriter(buffer, cbmsgpack.New()); e != nil {
+		t.Fatal(e)
+	}
+	_ = source.Upload("master", buffer)
+	return source
+}
+
+func TestExport(t *testing.T) {
+	buckets := map[string]string{
+		"2020/bucket1": "bucket1-contents",
+		"2020/bucket2": "bucket2-contents",
+	}
+	for _, filename := range []string{"snapshot.tar", "snapshot.zip"} {
+		t.Run(filename, func(t *testing.T) {
+			dir := getDir(t)
+			defer os.RemoveAll(dir)
+			source := getSource(t, buckets)
+			// the server appends to the current bucket after publishing the master
+			_ = source.Upload("2020/bucket2", strings.NewReader("bucket2-contents-appended"))
+
+			path := filepath.Join(dir, filename)
+			e := Export(context.Background(), source, path, []cbtransaction.Encoding{cbmsgpack.New()})
+			if e != nil {
+				t.Errorf("Export() error = %v", e)
+				return
+			}
+
+			archive := getStorage(t, path)
+			defer archive.Close()
+			client, e := cbtransaction.NewClient(cbtransaction.ClientConfig{
+				ErrorHandler:         cbtransaction.DefaultErrorHandler{},
+				DefaultEncryptionKey: cbnone.Key,
+				EncryptionProviders:  []cbtransaction.Encryption{&cbnone.Encryption{}},
+				DefaultEncodingKey:   cbmsgpack.Key,
+				EncodingProviders:    []cbtransaction.Encoding{cbmsgpack.New()},
+				StorageProvider:      archive,
+				DataDir:              filepath.Join(dir, "data"),
+			})
+			if e != nil {
+				t.Fatal(e)
+			}
+			if e := client.Download(); e != nil {
+				t.Errorf("Download() error = %v", e)
+				return
+			}
+			for fileName, want := range buckets {
+				got, e := ioutil.ReadFile(filepath.Join(dir, "data", fileName))
+				if e != nil || string(got) != want {
+					t.Errorf("downloaded bucket %s = %s, %v, want %s", fileName, got, e, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExport_HashMismatch(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	source := getSource(t, map[string]string{"bucket": "contents"})
+	_ = source.Upload("bucket", strings.NewReader("modified"))
+
+	path := filepath.Join(dir, "snapshot.tar")
+	if e := Export(context.Background(), source, path, []cbtransaction.Encoding{cbmsgpack.New()}); e == nil {
+		t.Error("Export() error = nil for a bucket which does not match the master")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Export() left %d files behind", len(files))
+	}
+}
@@ -0,0 +1,153 @@
+package cbazureblob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiVersion = "2019-12-12"
+	sasVersion = "2019-12-12"
+	sasTime    = "2006-01-02T15:04:05Z"
+)
+
+// sharedKey signs requests with the Shared Key scheme of the storage services
+type sharedKey struct {
+	account string
+	key     []byte
+}
+
+// sign adds the Authorization header, every other header must already be set
+func (k *sharedKey) sign(req *http.Request) {
+	req.Header.Set("Authorization", "SharedKey "+k.account+":"+k.signature(req))
+}
+
+func (k *sharedKey) signature(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalizedHeaders(req) + k.canonicalizedResource(req.URL)
+
+	return k.hmac(stringToSign)
+}
+
+func (k *sharedKey) hmac(stringToSign string) string {
+	mac := hmac.New(sha256.New, k.key)
+	_, _ = mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func canonicalizedHeaders(req *http.Request) string {
+	var names []string
+	for name := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	var canonical strings.Builder
+	for _, name := range names {
+		var values []string
+		for _, value := range req.Header[name] {
+			values = append(values, strings.TrimSpace(value))
+		}
+		canonical.WriteString(strings.ToLower(name) + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	return canonical.String()
+}
+
+func (k *sharedKey) canonicalizedResource(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	resource := "/" + k.account + path
+
+	query := map[string][]string{}
+	var names []string
+	for name, values := range u.Query() {
+		name = strings.ToLower(name)
+		if _, ok := query[name]; !ok {
+			names = append(names, name)
+		}
+		query[name] = append(query[name], values...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + name + ":" + strings.Join(values, ",")
+	}
+
+	return resource
+}
+
+// blobReadSAS returns a service SAS granting read access to a single blob
+// until expiry, used as the source of server side copies
+func (k *sharedKey) blobReadSAS(container string, blob string, expiry time.Time) url.Values {
+	expiryText := expiry.UTC().Format(sasTime)
+	stringToSign := strings.Join([]string{
+		"r",
+		"",
+		expiryText,
+		"/blob/" + k.account + "/" + container + "/" + blob,
+		"",
+		"",
+		"https,http",
+		sasVersion,
+		"b",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+	}, "\n")
+
+	return url.Values{
+		"sv":  {sasVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"spr": {"https,http"},
+		"se":  {expiryText},
+		"sig": {k.hmac(stringToSign)},
+	}
+}
+
+// parseSASToken accepts a SAS token with or without the leading question mark
+func parseSASToken(token string) (url.Values, error) {
+	values, e := url.ParseQuery(strings.TrimPrefix(token, "?"))
+	if e != nil {
+		return nil, e
+	}
+	if values.Get("sig") == "" {
+		return nil, fmt.Errorf("invalid sas token: no signature")
+	}
+	return values, nil
+}
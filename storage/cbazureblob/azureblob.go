@@ -0,0 +1,736 @@
+package cbazureblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBlockSize = 16 * 1024 * 1024
+	// Put Block accepts blocks up to 4000MiB from version 2019-12-12
+	maxBlockSize = 4000 * 1024 * 1024
+	// Put Block From URL copies at most this many bytes per block
+	maxCopyBlockSize = 100 * 1024 * 1024
+	maxBlocks        = 50000
+	// source SAS tokens for server side copies only need to outlive the copy requests
+	copySourceExpiry = time.Hour
+)
+
+var lastBlockId uint64
+
+type Storage struct {
+	client    *http.Client
+	endpoint  *url.URL
+	account   string
+	container string
+	blockSize int64
+	sharedKey *sharedKey
+	sas       url.Values
+	now       func() time.Time
+}
+
+type Config struct {
+	Account   string
+	Container string
+	// AccountKey is the base64 encoded storage account key used for Shared Key
+	// authorisation, leave it empty to use SASToken instead
+	AccountKey string
+	// SASToken is an account or container SAS with read, write, delete and list
+	// permissions, with or without the leading question mark
+	SASToken string
+	// Endpoint is the base URL of the blob service, defaults to
+	// https://<Account>.blob.core.windows.net. Emulators like Azurite take the
+	// account in the path: http://127.0.0.1:10000/devstoreaccount1
+	Endpoint string
+	// BlockSize is the size of the blocks of block uploads, smaller uploads are
+	// sent in a single Put Blob request. Defaults to 16MB
+	BlockSize  int64
+	HTTPClient *http.Client
+}
+
+// Error is an error response from the blob service
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azure blob: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("azure blob: status %d: %s: %s (request id %s)", e.StatusCode, e.Code, e.Message, e.RequestId)
+}
+
+// Temporary reports whether the request may succeed when retried
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Account == "" {
+		return nil, errors.New("invalid account name")
+	}
+	if config.Container == "" {
+		return nil, errors.New("invalid container name")
+	}
+	if config.AccountKey == "" && config.SASToken == "" {
+		return nil, errors.New("empty account key and sas token")
+	}
+	if config.AccountKey != "" && config.SASToken != "" {
+		return nil, errors.New("only one of account key and sas token can be used")
+	}
+	s := &Storage{
+		account:   config.Account,
+		container: config.Container,
+		blockSize: config.BlockSize,
+		client:    config.HTTPClient,
+		now:       time.Now,
+	}
+	if config.AccountKey != "" {
+		key, e := base64.StdEncoding.DecodeString(config.AccountKey)
+		if e != nil {
+			return nil, fmt.Errorf("invalid account key: %w", e)
+		}
+		s.sharedKey = &sharedKey{account: config.Account, key: key}
+	} else {
+		sas, e := parseSASToken(config.SASToken)
+		if e != nil {
+			return nil, e
+		}
+		s.sas = sas
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://" + config.Account + ".blob.core.windows.net"
+	}
+	endpoint, e := url.Parse(config.Endpoint)
+	if e != nil {
+		return nil, e
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %s", config.Endpoint)
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	endpoint.RawPath = ""
+	s.endpoint = endpoint
+	if s.blockSize == 0 {
+		s.blockSize = defaultBlockSize
+	}
+	if s.blockSize < 0 || s.blockSize > maxBlockSize {
+		return nil, fmt.Errorf("invalid block size: %d", config.BlockSize)
+	}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+
+	return s, nil
+}
+
+func (s *Storage) checkFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." {
+		return fmt.Errorf("invalid filename: %s", filename)
+	}
+
+	return nil
+}
+
+// url returns the address of the blob, or of the container for an empty blob name
+func (s *Storage) url(blob string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path += "/" + s.container
+	u.RawPath = escape(u.Path)
+	if blob != "" {
+		u.Path += "/" + blob
+		u.RawPath += "/" + escape(blob)
+	}
+	values := url.Values{}
+	for name, value := range s.sas {
+		values[name] = value
+	}
+	for name, value := range query {
+		values[name] = value
+	}
+	u.RawQuery = values.Encode()
+
+	return &u
+}
+
+// escape percent-encodes everything except the unreserved characters of RFC 3986 and slashes
+func escape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			escaped.WriteByte(c)
+			continue
+		}
+		escaped.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+
+	return escaped.String()
+}
+
+// do sends an authorised request and returns the response if the service
+// reported success, the caller must close its body. Error responses are
+// returned as *Error
+func (s *Storage) do(ctx context.Context, method string, blob string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, e := http.NewRequest(method, s.url(blob, query).String(), bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Ms-Version", apiVersion)
+	req.Header.Set("X-Ms-Date", s.now().UTC().Format(http.TimeFormat))
+	if s.sharedKey != nil {
+		s.sharedKey.sign(req)
+	}
+
+	response, e := s.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		return nil, readError(response)
+	}
+
+	return response, nil
+}
+
+func readError(response *http.Response) error {
+	apiError := &Error{
+		StatusCode: response.StatusCode,
+		Code:       response.Header.Get("X-Ms-Error-Code"),
+		RequestId:  response.Header.Get("X-Ms-Request-Id"),
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	errorBody := struct {
+		Code    string
+		Message string
+	}{}
+	if xml.Unmarshal(body, &errorBody) == nil {
+		if errorBody.Code != "" {
+			apiError.Code = errorBody.Code
+		}
+		apiError.Message = errorBody.Message
+	}
+
+	return apiError
+}
+
+func statusCode(e error) int {
+	var apiError *Error
+	if errors.As(e, &apiError) {
+		return apiError.StatusCode
+	}
+	return 0
+}
+
+func (s *Storage) notExist(e error, filename string) error {
+	if statusCode(e) == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+	return e
+}
+
+// newBlockId returns a block id unique to this process. All ids have the same
+// length, as the service requires for the blocks of one blob
+func newBlockId() string {
+	id := fmt.Sprintf("cb%016x%012x", time.Now().UnixNano(), atomic.AddUint64(&lastBlockId, 1))
+	return base64.StdEncoding.EncodeToString([]byte(id))
+}
+
+var blockIdLength = len(newBlockId())
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+
+	_, e := s.upload(ctx, filename, reader, nil)
+
+	return e
+}
+
+// upload sends reader in a single Put Blob request if it is no larger than the
+// block size and as blocks committed with Put Block List otherwise. header
+// holds the conditional headers and is sent with the request that creates the
+// blob. It returns the ETag of the new blob
+func (s *Storage) upload(ctx context.Context, filename string, reader io.Reader, header http.Header) (string, error) {
+	first, e := readBlock(reader, s.blockSize)
+	if e != nil {
+		return "", e
+	}
+	var second []byte
+	if int64(len(first)) == s.blockSize {
+		second, e = readBlock(reader, s.blockSize)
+		if e != nil {
+			return "", e
+		}
+	}
+	if len(second) == 0 {
+		return s.putBlob(ctx, filename, first, header)
+	}
+
+	// the service only stores an MD5 for blobs uploaded in one request
+	contentHash := md5.New()
+	var blocks []blockReference
+	for block := first; len(block) > 0; {
+		id, e := s.putBlock(ctx, filename, block, contentHash)
+		if e != nil {
+			return "", e
+		}
+		blocks = append(blocks, blockReference{Latest: id})
+		if second != nil {
+			block, second = second, nil
+			continue
+		}
+		block, e = readBlock(reader, s.blockSize)
+		if e != nil {
+			return "", e
+		}
+	}
+
+	commitHeader := http.Header{"X-Ms-Blob-Content-Md5": {base64.StdEncoding.EncodeToString(contentHash.Sum(nil))}}
+	for name, values := range header {
+		commitHeader[name] = values
+	}
+
+	return s.putBlockList(ctx, filename, blocks, commitHeader)
+}
+
+// readBlock reads up to size bytes, fewer only at the end of reader
+func readBlock(reader io.Reader, size int64) ([]byte, error) {
+	block, e := ioutil.ReadAll(io.LimitReader(reader, size))
+	if e != nil {
+		return nil, e
+	}
+	return block, nil
+}
+
+func (s *Storage) putBlob(ctx context.Context, filename string, data []byte, header http.Header) (string, error) {
+	hash := md5.Sum(data)
+	blobHeader := http.Header{
+		"X-Ms-Blob-Type": {"BlockBlob"},
+		"Content-Md5":    {base64.StdEncoding.EncodeToString(hash[:])},
+	}
+	for name, values := range header {
+		blobHeader[name] = values
+	}
+	response, e := s.do(ctx, http.MethodPut, filename, nil, blobHeader, data)
+	if e != nil {
+		return "", e
+	}
+	defer response.Body.Close()
+
+	return response.Header.Get("ETag"), nil
+}
+
+func (s *Storage) putBlock(ctx context.Context, filename string, data []byte, contentHash hash.Hash) (string, error) {
+	id := newBlockId()
+	_, _ = contentHash.Write(data)
+	response, e := s.do(ctx, http.MethodPut, filename, url.Values{"comp": {"block"}, "blockid": {id}}, nil, data)
+	if e != nil {
+		return "", e
+	}
+
+	return id, response.Body.Close()
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+
+	response, e := s.do(ctx, http.MethodGet, filename, nil, nil, nil)
+	if e != nil {
+		return s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	_, e = io.Copy(writer, response.Body)
+
+	return e
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if length == 0 {
+		return nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	response, e := s.do(ctx, http.MethodGet, filename, nil, http.Header{"X-Ms-Range": {byteRange}}, nil)
+	if e != nil {
+		// a range starting past the end of the blob is empty rather than an error
+		if statusCode(e) == http.StatusRequestedRangeNotSatisfiable {
+			return nil
+		}
+		return s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	_, e = io.Copy(writer, response.Body)
+
+	return e
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+// ConcatContext joins the blobs into destination server side: every source is
+// copied into a block of destination with Put Block From URL and the blocks
+// are committed in order. When destination is the first source its committed
+// blocks are kept as they are, so appending to a blob only copies the new data
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := s.checkFilename(destination); e != nil {
+		return e
+	}
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+	for _, filename := range filenames {
+		if e := s.checkFilename(filename); e != nil {
+			return e
+		}
+	}
+	sizes := make([]int64, len(filenames))
+	for i, filename := range filenames {
+		info, e := s.StatContext(ctx, filename)
+		if e != nil {
+			return e
+		}
+		sizes[i] = info.Size
+	}
+
+	var blocks []blockReference
+	sources := filenames
+	if filenames[0] == destination && sizes[0] > 0 {
+		committed, e := s.committedBlocks(ctx, destination, sizes[0])
+		if e != nil {
+			return e
+		}
+		if committed != nil {
+			blocks = committed
+			sources, sizes = filenames[1:], sizes[1:]
+		}
+	}
+	for i, filename := range sources {
+		for offset := int64(0); offset < sizes[i]; offset += maxCopyBlockSize {
+			length := sizes[i] - offset
+			if length > maxCopyBlockSize {
+				length = maxCopyBlockSize
+			}
+			id, e := s.putBlockFromURL(ctx, destination, filename, offset, length)
+			if e != nil {
+				return e
+			}
+			blocks = append(blocks, blockReference{Latest: id})
+		}
+	}
+	if len(blocks) > maxBlocks {
+		return fmt.Errorf("%s needs more than %d blocks", destination, maxBlocks)
+	}
+
+	if len(blocks) == 0 {
+		_, e := s.putBlob(ctx, destination, nil, nil)
+		return e
+	}
+	_, e := s.putBlockList(ctx, destination, blocks, nil)
+
+	return e
+}
+
+// committedBlocks returns the committed blocks of the blob if they can be
+// reused by Put Block List, which is the case when they make up the whole blob
+// and their ids have the length newBlockId uses. It returns nil otherwise
+func (s *Storage) committedBlocks(ctx context.Context, filename string, size int64) ([]blockReference, error) {
+	response, e := s.do(ctx, http.MethodGet, filename, url.Values{"comp": {"blocklist"}, "blocklisttype": {"committed"}}, nil, nil)
+	if e != nil {
+		return nil, s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	result := struct {
+		CommittedBlocks struct {
+			Block []struct {
+				Name string
+				Size int64
+			}
+		}
+	}{}
+	if e := xml.NewDecoder(response.Body).Decode(&result); e != nil {
+		return nil, e
+	}
+	var blocks []blockReference
+	total := int64(0)
+	for _, block := range result.CommittedBlocks.Block {
+		if len(block.Name) != blockIdLength {
+			return nil, nil
+		}
+		total += block.Size
+		blocks = append(blocks, blockReference{Committed: block.Name})
+	}
+	if total != size {
+		return nil, nil
+	}
+
+	return blocks, nil
+}
+
+// putBlockFromURL stages length bytes of source starting at offset as a new
+// block of destination and returns its id
+func (s *Storage) putBlockFromURL(ctx context.Context, destination string, source string, offset int64, length int64) (string, error) {
+	sourceURL := s.url(source, nil)
+	if s.sharedKey != nil {
+		// the service fetches the source anonymously, so it needs its own SAS
+		sourceURL.RawQuery = s.sharedKey.blobReadSAS(s.container, source, s.now().Add(copySourceExpiry)).Encode()
+	}
+	id := newBlockId()
+	header := http.Header{
+		"X-Ms-Copy-Source":  {sourceURL.String()},
+		"X-Ms-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)},
+	}
+	response, e := s.do(ctx, http.MethodPut, destination, url.Values{"comp": {"block"}, "blockid": {id}}, header, nil)
+	if e != nil {
+		return "", s.notExist(e, source)
+	}
+
+	return id, response.Body.Close()
+}
+
+// blockReference is an entry of a Put Block List request, exactly one of the fields is set
+type blockReference struct {
+	Committed string `xml:",omitempty"`
+	Latest    string `xml:",omitempty"`
+}
+
+func (s *Storage) putBlockList(ctx context.Context, filename string, blocks []blockReference, header http.Header) (string, error) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	body.WriteString("<BlockList>")
+	for _, block := range blocks {
+		if block.Committed != "" {
+			body.WriteString("<Committed>" + block.Committed + "</Committed>")
+		} else {
+			body.WriteString("<Latest>" + block.Latest + "</Latest>")
+		}
+	}
+	body.WriteString("</BlockList>")
+
+	response, e := s.do(ctx, http.MethodPut, filename, url.Values{"comp": {"blocklist"}}, header, body.Bytes())
+	if e != nil {
+		return "", e
+	}
+	defer response.Body.Close()
+
+	return response.Header.Get("ETag"), nil
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	response, e := s.do(ctx, http.MethodDelete, filename, nil, nil, nil)
+	if e != nil {
+		return s.notExist(e, filename)
+	}
+
+	return response.Body.Close()
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	var objects []cbstorage.ObjectInfo
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		response, e := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if e != nil {
+			return nil, e
+		}
+		result := struct {
+			Blobs struct {
+				Blob []struct {
+					Name       string
+					Properties struct {
+						LastModified  string `xml:"Last-Modified"`
+						Etag          string
+						ContentLength int64  `xml:"Content-Length"`
+						ContentMD5    string `xml:"Content-MD5"`
+					}
+				}
+			}
+			NextMarker string
+		}{}
+		e = xml.NewDecoder(response.Body).Decode(&result)
+		_ = response.Body.Close()
+		if e != nil {
+			return nil, e
+		}
+		for _, blob := range result.Blobs.Blob {
+			modTime, _ := http.ParseTime(blob.Properties.LastModified)
+			objects = append(objects, objectInfo(
+				blob.Name,
+				blob.Properties.ContentLength,
+				modTime,
+				blob.Properties.Etag,
+				blob.Properties.ContentMD5,
+			))
+		}
+		if result.NextMarker == "" {
+			break
+		}
+		marker = result.NextMarker
+	}
+
+	return objects, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	response, e := s.do(ctx, http.MethodHead, filename, nil, nil, nil)
+	if e != nil {
+		return cbstorage.ObjectInfo{}, s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+
+	return objectInfo(
+		filename,
+		response.ContentLength,
+		modTime,
+		response.Header.Get("ETag"),
+		response.Header.Get("Content-MD5"),
+	), nil
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+// UploadIfGenerationMatchContext uses the ETag as the generation and sends it
+// in an If-Match header, or If-None-Match: * for an empty generation
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	header := http.Header{"If-None-Match": {"*"}}
+	if generation != "" {
+		header = http.Header{"If-Match": {generation}}
+	}
+
+	etag, e := s.upload(ctx, filename, reader, header)
+	if e != nil {
+		// the service answers If-None-Match: * for an existing blob with 409
+		// BlobAlreadyExists and If-Match for a missing one with 404
+		var apiError *Error
+		if errors.As(e, &apiError) && (apiError.StatusCode == http.StatusPreconditionFailed ||
+			apiError.Code == "BlobAlreadyExists" ||
+			(generation != "" && apiError.StatusCode == http.StatusNotFound)) {
+			return "", fmt.Errorf("%w: %s does not have generation %s", cbstorage.ErrPreconditionFailed, filename, generation)
+		}
+		return "", e
+	}
+
+	return etag, nil
+}
+
+// objectInfo builds the ObjectInfo for a blob, contentMD5 is the base64
+// Content-MD5 property, which is empty for blobs made by Concat
+func objectInfo(name string, size int64, modTime time.Time, etag string, contentMD5 string) cbstorage.ObjectInfo {
+	checksum := ""
+	if hash, e := base64.StdEncoding.DecodeString(contentMD5); e == nil && len(hash) == md5.Size {
+		checksum = hex.EncodeToString(hash)
+	}
+
+	return cbstorage.ObjectInfo{
+		Name:       name,
+		Size:       size,
+		ModTime:    modTime,
+		Checksum:   checksum,
+		ETag:       etag,
+		Generation: etag,
+	}
+}
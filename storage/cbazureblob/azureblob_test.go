@@ -0,0 +1,653 @@
+package cbazureblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	valid := Config{
+		Account:    "account",
+		Container:  "container",
+		AccountKey: fakeAccountKey,
+	}
+	tests := []struct {
+		name    string
+		config  func(config Config) Config
+		wantErr bool
+	}{
+		{
+			name:    "accountKey",
+			config:  func(config Config) Config { return config },
+			wantErr: false,
+		},
+		{
+			name: "sasToken",
+			config: func(config Config) Config {
+				config.AccountKey = ""
+				config.SASToken = fakeSASToken
+				return config
+			},
+			wantErr: false,
+		},
+		{
+			name:    "noAccount",
+			config:  func(config Config) Config { config.Account = ""; return config },
+			wantErr: true,
+		},
+		{
+			name:    "noContainer",
+			config:  func(config Config) Config { config.Container = ""; return config },
+			wantErr: true,
+		},
+		{
+			name:    "noCredentials",
+			config:  func(config Config) Config { config.AccountKey = ""; return config },
+			wantErr: true,
+		},
+		{
+			name:    "bothCredentials",
+			config:  func(config Config) Config { config.SASToken = fakeSASToken; return config },
+			wantErr: true,
+		},
+		{
+			name:    "invalidAccountKey",
+			config:  func(config Config) Config { config.AccountKey = "not base64!"; return config },
+			wantErr: true,
+		},
+		{
+			name: "unsignedSASToken",
+			config: func(config Config) Config {
+				config.AccountKey = ""
+				config.SASToken = "sv=2019-12-12&sp=r"
+				return config
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalidEndpoint",
+			config:  func(config Config) Config { config.Endpoint = "127.0.0.1:10000"; return config },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config(valid))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_url(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		sasToken string
+		blob     string
+		want     string
+	}{
+		{
+			name: "default",
+			blob: "dir/file name.txt",
+			want: "https://account.blob.core.windows.net/container/dir/file%20name.txt",
+		},
+		{
+			name: "container",
+			want: "https://account.blob.core.windows.net/container",
+		},
+		{
+			name:     "emulator",
+			endpoint: "http://127.0.0.1:10000/devstoreaccount1/",
+			blob:     "file.txt",
+			want:     "http://127.0.0.1:10000/devstoreaccount1/container/file.txt",
+		},
+		{
+			name:     "sasToken",
+			sasToken: "?sp=rw&sig=abc%2B",
+			blob:     "file.txt",
+			want:     "https://account.blob.core.windows.net/container/file.txt?sig=abc%2B&sp=rw",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Account:    "account",
+				Container:  "container",
+				AccountKey: fakeAccountKey,
+				Endpoint:   tt.endpoint,
+			}
+			if tt.sasToken != "" {
+				config.AccountKey = ""
+				config.SASToken = tt.sasToken
+			}
+			s, e := New(config)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if got := s.url(tt.blob, nil).String(); got != tt.want {
+				t.Errorf("url() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_Upload(t *testing.T) {
+	tests := []struct {
+		name          string
+		filename      string
+		contents      []byte
+		wantErr       bool
+		wantPutBlobs  int
+		wantPutBlocks int
+	}{
+		{
+			name:     "invalidFilename",
+			filename: "",
+			contents: []byte("contents"),
+			wantErr:  true,
+		},
+		{
+			name:         "empty",
+			filename:     "upload/empty.txt",
+			contents:     []byte{},
+			wantPutBlobs: 1,
+		},
+		{
+			name:         "escapedName",
+			filename:     "upload/file name+é.txt",
+			contents:     []byte("contents"),
+			wantPutBlobs: 1,
+		},
+		{
+			name:         "oneBlock",
+			filename:     "upload/oneBlock",
+			contents:     pattern(1, 1024),
+			wantPutBlobs: 1,
+		},
+		{
+			name:          "blocks",
+			filename:      "upload/blocks",
+			contents:      pattern(2, 1024*2+10),
+			wantPutBlocks: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeBlobService()
+			defer fake.Close()
+			s := fake.storage(t)
+
+			err := s.Upload(tt.filename, bytes.NewReader(tt.contents))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Upload() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, _ := fake.get(tt.filename); !bytes.Equal(got, tt.contents) {
+				t.Errorf("Upload() stored %d bytes, want %d", len(got), len(tt.contents))
+			}
+			if fake.putBlobs != tt.wantPutBlobs || fake.putBlocks != tt.wantPutBlocks {
+				t.Errorf("Upload() put blobs = %d, blocks = %d, want %d and %d", fake.putBlobs, fake.putBlocks, tt.wantPutBlobs, tt.wantPutBlocks)
+			}
+
+			info, e := s.Stat(tt.filename)
+			if e != nil {
+				t.Errorf("Stat() error = %v", e)
+				return
+			}
+			hash := md5.Sum(tt.contents)
+			if info.Checksum != hex.EncodeToString(hash[:]) {
+				t.Errorf("Stat() checksum = %s, want %s", info.Checksum, hex.EncodeToString(hash[:]))
+			}
+
+			writer := &bytes.Buffer{}
+			if e := s.Download(tt.filename, writer); e != nil {
+				t.Errorf("Download() error = %v", e)
+				return
+			}
+			if !bytes.Equal(writer.Bytes(), tt.contents) {
+				t.Errorf("Download() returned %d bytes, want %d", writer.Len(), len(tt.contents))
+			}
+		})
+	}
+}
+
+func TestStorage_Download(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+
+	err := s.Download("missing", &bytes.Buffer{})
+	if !errors.Is(err, cbstorage.ErrNotExist) {
+		t.Errorf("Download() error = %v, want %v", err, cbstorage.ErrNotExist)
+	}
+
+	config := fake.config()
+	config.AccountKey = "d3Jvbmcta2V5"
+	wrongKey, e := New(config)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	err = wrongKey.Download("missing", &bytes.Buffer{})
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.Code != "AuthenticationFailed" {
+		t.Errorf("Download() error = %v, want AuthenticationFailed", err)
+	}
+}
+
+func TestStorage_DownloadRange(t *testing.T) {
+	type args struct {
+		offset int64
+		length int64
+	}
+	tests := []struct {
+		name       string
+		filename   string
+		args       args
+		wantWriter string
+		wantErr    bool
+	}{
+		{
+			name:       "whole",
+			filename:   "range.txt",
+			args:       args{offset: 0, length: -1},
+			wantWriter: "0123456789",
+		},
+		{
+			name:       "tail",
+			filename:   "range.txt",
+			args:       args{offset: 6, length: -1},
+			wantWriter: "6789",
+		},
+		{
+			name:       "middle",
+			filename:   "range.txt",
+			args:       args{offset: 2, length: 3},
+			wantWriter: "234",
+		},
+		{
+			name:       "pastEnd",
+			filename:   "range.txt",
+			args:       args{offset: 20, length: -1},
+			wantWriter: "",
+		},
+		{
+			name:     "negativeOffset",
+			filename: "range.txt",
+			args:     args{offset: -1, length: -1},
+			wantErr:  true,
+		},
+		{
+			name:     "missing",
+			filename: "missing.txt",
+			args:     args{offset: 0, length: -1},
+			wantErr:  true,
+		},
+	}
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("range.txt", []byte("0123456789"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange(tt.filename, tt.args.offset, tt.args.length, writer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := writer.String(); got != tt.wantWriter {
+				t.Errorf("DownloadRange() gotWriter = %s, want %s", got, tt.wantWriter)
+			}
+		})
+	}
+}
+
+func TestStorage_Concat(t *testing.T) {
+	tests := []struct {
+		name             string
+		sasToken         bool
+		sources          [][]byte
+		wantCopiedBlocks int
+	}{
+		{
+			name:             "accountKey",
+			sources:          [][]byte{[]byte("first,"), []byte("second,"), []byte("third")},
+			wantCopiedBlocks: 3,
+		},
+		{
+			name:             "sasToken",
+			sasToken:         true,
+			sources:          [][]byte{[]byte("first,"), []byte("second")},
+			wantCopiedBlocks: 2,
+		},
+		{
+			name:             "emptySources",
+			sources:          [][]byte{{}, []byte("second"), {}},
+			wantCopiedBlocks: 1,
+		},
+		{
+			name:    "allEmpty",
+			sources: [][]byte{{}, {}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeBlobService()
+			defer fake.Close()
+			config := fake.config()
+			if tt.sasToken {
+				config.AccountKey = ""
+				config.SASToken = fakeSASToken
+			}
+			s, e := New(config)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+
+			var filenames []string
+			var want []byte
+			for i, source := range tt.sources {
+				filename := "concat/source" + string(rune('a'+i))
+				fake.put(filename, source)
+				filenames = append(filenames, filename)
+				want = append(want, source...)
+			}
+
+			if err := s.Concat("concat/destination", filenames...); err != nil {
+				t.Errorf("Concat() error = %v", err)
+				return
+			}
+			if got, _ := fake.get("concat/destination"); !bytes.Equal(got, want) {
+				t.Errorf("Concat() destination = %s, want %s", got, want)
+			}
+			if fake.copiedBlocks != tt.wantCopiedBlocks {
+				t.Errorf("Concat() copied blocks = %d, want %d", fake.copiedBlocks, tt.wantCopiedBlocks)
+			}
+		})
+	}
+}
+
+func TestStorage_ConcatAppend(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+
+	// a blob uploaded with Put Blob has no blocks, so the first append copies it
+	fake.put("log", []byte("batch1,"))
+	fake.put("batch2", []byte("batch2,"))
+	fake.put("batch3", []byte("batch3"))
+
+	if err := s.Concat("log", "log", "batch2"); err != nil {
+		t.Errorf("Concat() error = %v", err)
+		return
+	}
+	if fake.copiedBytes != len("batch1,batch2,") {
+		t.Errorf("Concat() copied %d bytes, want %d", fake.copiedBytes, len("batch1,batch2,"))
+	}
+
+	// the second append keeps the committed blocks and only copies the new batch
+	if err := s.Concat("log", "log", "batch3"); err != nil {
+		t.Errorf("Concat() error = %v", err)
+		return
+	}
+	if fake.copiedBytes != len("batch1,batch2,batch3") {
+		t.Errorf("Concat() copied %d bytes, want %d", fake.copiedBytes, len("batch1,batch2,batch3"))
+	}
+	if got, _ := fake.get("log"); string(got) != "batch1,batch2,batch3" {
+		t.Errorf("Concat() log = %s, want batch1,batch2,batch3", got)
+	}
+}
+
+func TestStorage_ConcatInvalid(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("source", []byte("source"))
+
+	tests := []struct {
+		name        string
+		destination string
+		filenames   []string
+	}{
+		{
+			name:        "noSources",
+			destination: "destination",
+		},
+		{
+			name:        "invalidDestination",
+			destination: ".",
+			filenames:   []string{"source"},
+		},
+		{
+			name:        "invalidSource",
+			destination: "destination",
+			filenames:   []string{"source", ".."},
+		},
+		{
+			name:        "missingSource",
+			destination: "destination",
+			filenames:   []string{"source", "missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Concat(tt.destination, tt.filenames...); err == nil {
+				t.Error("Concat() error = nil, want an error")
+			}
+			if _, ok := fake.get("destination"); ok {
+				t.Error("Concat() created the destination")
+			}
+		})
+	}
+}
+
+func TestStorage_Delete(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("delete.txt", []byte("contents"))
+
+	if err := s.Delete("delete.txt"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, ok := fake.get("delete.txt"); ok {
+		t.Error("Delete() did not remove the blob")
+	}
+	if err := s.Delete("delete.txt"); !errors.Is(err, cbstorage.ErrNotExist) {
+		t.Errorf("Delete() error = %v, want %v", err, cbstorage.ErrNotExist)
+	}
+}
+
+func TestStorage_List(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.maxResults = 2
+	for _, name := range []string{"list/c", "list/a", "list/b", "list/d/e", "other"} {
+		fake.put(name, []byte(name))
+	}
+
+	objects, err := s.List("list/")
+	if err != nil {
+		t.Errorf("List() error = %v", err)
+		return
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+		if object.Size != int64(len(object.Name)) || object.Checksum == "" || object.Generation == "" || object.ModTime.IsZero() {
+			t.Errorf("List() object = %+v, want size, checksum, generation and mod time", object)
+		}
+	}
+	want := []string{"list/a", "list/b", "list/c", "list/d/e"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("List() names = %v, want %v", names, want)
+	}
+}
+
+func TestStorage_Stat(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("stat.txt", []byte("file-contents"))
+
+	info, err := s.Stat("stat.txt")
+	if err != nil {
+		t.Errorf("Stat() error = %v", err)
+		return
+	}
+	if info.Name != "stat.txt" || info.Size != 13 || info.Checksum != "53a08cf9217fc1c69a90fd77c4d765db" || info.ModTime.IsZero() {
+		t.Errorf("Stat() = %+v", info)
+	}
+
+	_, err = s.Stat("missing.txt")
+	if !errors.Is(err, cbstorage.ErrNotExist) {
+		t.Errorf("Stat() error = %v, want %v", err, cbstorage.ErrNotExist)
+	}
+
+	exists, err := s.Exists("stat.txt")
+	if err != nil || !exists {
+		t.Errorf("Exists() = %v, %v, want true", exists, err)
+	}
+	exists, err = s.Exists("missing.txt")
+	if err != nil || exists {
+		t.Errorf("Exists() = %v, %v, want false", exists, err)
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	tests := []struct {
+		name                   string
+		existing               []byte
+		generation             func(s *Storage) string
+		contents               []byte
+		wantPreconditionFailed bool
+	}{
+		{
+			name:       "create",
+			generation: func(s *Storage) string { return "" },
+			contents:   []byte("new"),
+		},
+		{
+			name:                   "createExisting",
+			existing:               []byte("old"),
+			generation:             func(s *Storage) string { return "" },
+			contents:               []byte("new"),
+			wantPreconditionFailed: true,
+		},
+		{
+			name:     "replace",
+			existing: []byte("old"),
+			generation: func(s *Storage) string {
+				info, _ := s.Stat("conditional")
+				return info.Generation
+			},
+			contents: []byte("new"),
+		},
+		{
+			name:                   "staleGeneration",
+			existing:               []byte("old"),
+			generation:             func(s *Storage) string { return `"0x8D000000000000"` },
+			contents:               []byte("new"),
+			wantPreconditionFailed: true,
+		},
+		{
+			name:                   "deleted",
+			generation:             func(s *Storage) string { return `"0x8D000000000000"` },
+			contents:               []byte("new"),
+			wantPreconditionFailed: true,
+		},
+		{
+			name:     "blocksReplace",
+			existing: []byte("old"),
+			generation: func(s *Storage) string {
+				info, _ := s.Stat("conditional")
+				return info.Generation
+			},
+			contents: pattern(1, 1024*3),
+		},
+		{
+			name:                   "blocksCreateExisting",
+			existing:               []byte("old"),
+			generation:             func(s *Storage) string { return "" },
+			contents:               pattern(1, 1024*3),
+			wantPreconditionFailed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeBlobService()
+			defer fake.Close()
+			s := fake.storage(t)
+			if tt.existing != nil {
+				fake.put("conditional", tt.existing)
+			}
+
+			got, err := s.UploadIfGenerationMatch("conditional", bytes.NewReader(tt.contents), tt.generation(s))
+			if errors.Is(err, cbstorage.ErrPreconditionFailed) != tt.wantPreconditionFailed {
+				t.Errorf("UploadIfGenerationMatch() error = %v, wantPreconditionFailed %v", err, tt.wantPreconditionFailed)
+				return
+			}
+			stored, _ := fake.get("conditional")
+			if tt.wantPreconditionFailed {
+				if !bytes.Equal(stored, tt.existing) {
+					t.Errorf("UploadIfGenerationMatch() replaced the blob after a failed precondition")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("UploadIfGenerationMatch() error = %v", err)
+				return
+			}
+			if !bytes.Equal(stored, tt.contents) {
+				t.Errorf("UploadIfGenerationMatch() stored %d bytes, want %d", len(stored), len(tt.contents))
+			}
+			info, _ := s.Stat("conditional")
+			if got != info.Generation {
+				t.Errorf("UploadIfGenerationMatch() = %s, want the new generation %s", got, info.Generation)
+			}
+		})
+	}
+}
+
+func TestStorage_Context(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("file.txt", []byte("contents"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.UploadContext(ctx, "upload.txt", bytes.NewReader([]byte("contents"))); !errors.Is(err, context.Canceled) {
+		t.Errorf("UploadContext() error = %v, want %v", err, context.Canceled)
+	}
+	if err := s.DownloadContext(ctx, "file.txt", ioutil.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("DownloadContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, ok := fake.get("upload.txt"); ok {
+		t.Error("UploadContext() stored the blob with a cancelled context")
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	fake := newFakeBlobService()
+	defer fake.Close()
+	storagetest.Contract(t, fake.storage(t))
+}
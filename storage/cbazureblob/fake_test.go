@@ -0,0 +1,546 @@
+package cbazureblob
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeAccount   = "devstoreaccount1"
+	fakeContainer = "container"
+	fakeSASToken  = "?sv=2019-12-12&ss=b&srt=co&sp=rwdlac&se=2100-01-01T00%3A00%3A00Z&sig=fake%2Bsignature%3D"
+)
+
+var fakeAccountKey = base64.StdEncoding.EncodeToString([]byte("fake-account-key"))
+
+type fakeBlock struct {
+	id   string
+	data []byte
+}
+
+type fakeBlob struct {
+	data       []byte
+	etag       string
+	modified   time.Time
+	contentMD5 string
+	blocks     []fakeBlock
+}
+
+// fakeBlobService implements the parts of the Blob service REST API used by
+// Storage for a single container, addressed like Azurite with the account in
+// the path. Every request must carry a valid Shared Key signature or the SAS token
+type fakeBlobService struct {
+	*httptest.Server
+	key *sharedKey
+	// maxResults limits the number of blobs in a list response
+	maxResults int
+
+	lock          sync.Mutex
+	blobs         map[string]*fakeBlob
+	uncommitted   map[string]map[string][]byte
+	lastEtag      int
+	putBlobs      int
+	putBlocks     int
+	copiedBlocks  int
+	copiedBytes   int
+	putBlockLists int
+}
+
+func newFakeBlobService() *fakeBlobService {
+	key, _ := base64.StdEncoding.DecodeString(fakeAccountKey)
+	f := &fakeBlobService{
+		key:         &sharedKey{account: fakeAccount, key: key},
+		maxResults:  5000,
+		blobs:       map[string]*fakeBlob{},
+		uncommitted: map[string]map[string][]byte{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeBlobService) config() Config {
+	return Config{
+		Account:    fakeAccount,
+		Container:  fakeContainer,
+		AccountKey: fakeAccountKey,
+		Endpoint:   f.URL + "/" + fakeAccount,
+		BlockSize:  1024,
+		HTTPClient: f.Client(),
+	}
+}
+
+func (f *fakeBlobService) storage(t *testing.T) *Storage {
+	s, e := New(f.config())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func (f *fakeBlobService) put(name string, data []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	hash := md5.Sum(data)
+	f.store(name, data, base64.StdEncoding.EncodeToString(hash[:]), nil)
+}
+
+func (f *fakeBlobService) get(name string) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	blob, ok := f.blobs[name]
+	if !ok {
+		return nil, false
+	}
+	return blob.data, true
+}
+
+func (f *fakeBlobService) store(name string, data []byte, contentMD5 string, blocks []fakeBlock) *fakeBlob {
+	f.lastEtag++
+	blob := &fakeBlob{
+		data:       data,
+		etag:       fmt.Sprintf(`"0x8D%012X"`, f.lastEtag),
+		modified:   time.Now(),
+		contentMD5: contentMD5,
+		blocks:     blocks,
+	}
+	f.blobs[name] = blob
+	delete(f.uncommitted, name)
+	return blob
+}
+
+func (f *fakeBlobService) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, "InvalidInput", e.Error())
+		return
+	}
+	if e := f.authorise(r); e != nil {
+		f.error(w, http.StatusForbidden, "AuthenticationFailed", e.Error())
+		return
+	}
+	if r.Header.Get("X-Ms-Version") != apiVersion {
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue", "unexpected x-ms-version")
+		return
+	}
+
+	container, name, ok := f.split(r.URL.Path)
+	if !ok || container != fakeContainer {
+		f.error(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case name == "" && r.Method == http.MethodGet && query.Get("restype") == "container" && query.Get("comp") == "list":
+		f.list(w, query)
+	case name == "":
+		f.error(w, http.StatusBadRequest, "UnsupportedQueryParameter", "unsupported container request")
+	case r.Method == http.MethodPut && query.Get("comp") == "block" && r.Header.Get("X-Ms-Copy-Source") != "":
+		f.putBlockFromURL(w, r, name)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		f.putBlock(w, r, name, body)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		f.putBlockList(w, r, name, body)
+	case r.Method == http.MethodPut && query.Get("comp") == "":
+		f.putBlob(w, r, name, body)
+	case r.Method == http.MethodGet && query.Get("comp") == "blocklist":
+		f.getBlockList(w, name)
+	case r.Method == http.MethodGet && query.Get("comp") == "":
+		f.getBlob(w, r, name)
+	case r.Method == http.MethodHead:
+		f.getProperties(w, name)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			f.error(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		f.error(w, http.StatusBadRequest, "UnsupportedHttpVerb", "unsupported request: "+r.Method+" "+r.URL.String())
+	}
+}
+
+// split splits /account/container/blob into the container and blob name
+func (f *fakeBlobService) split(path string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != fakeAccount {
+		return "", "", false
+	}
+	if len(parts) == 2 {
+		return parts[1], "", true
+	}
+	return parts[1], parts[2], true
+}
+
+// authorise accepts requests signed with the account key or carrying the SAS token
+func (f *fakeBlobService) authorise(r *http.Request) error {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return f.checkSASToken(r.URL.Query())
+	}
+	if !strings.HasPrefix(authorization, "SharedKey "+fakeAccount+":") {
+		return fmt.Errorf("unknown authorization: %s", authorization)
+	}
+	if r.Header.Get("X-Ms-Date") == "" {
+		return fmt.Errorf("no x-ms-date")
+	}
+	expected := &http.Request{
+		Method:        r.Method,
+		URL:           &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Header:        r.Header,
+		ContentLength: r.ContentLength,
+	}
+	if signature := f.key.signature(expected); authorization != "SharedKey "+fakeAccount+":"+signature {
+		return fmt.Errorf("signature mismatch, expected %s", signature)
+	}
+	return nil
+}
+
+func (f *fakeBlobService) checkSASToken(query url.Values) error {
+	token, _ := parseSASToken(fakeSASToken)
+	for name := range token {
+		if query.Get(name) != token.Get(name) {
+			return fmt.Errorf("invalid sas token parameter %s", name)
+		}
+	}
+	return nil
+}
+
+// checkSourceSAS accepts the SAS token or a blob SAS signed with the account key
+func (f *fakeBlobService) checkSourceSAS(query url.Values, name string) error {
+	if query.Get("sr") != "b" {
+		return f.checkSASToken(query)
+	}
+	expiry, e := time.Parse(sasTime, query.Get("se"))
+	if e != nil || expiry.Before(time.Now()) {
+		return fmt.Errorf("expired sas")
+	}
+	expected := f.key.blobReadSAS(fakeContainer, name, expiry)
+	for parameter := range expected {
+		if query.Get(parameter) != expected.Get(parameter) {
+			return fmt.Errorf("invalid blob sas parameter %s", parameter)
+		}
+	}
+	return nil
+}
+
+func (f *fakeBlobService) error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	w.Header().Set("X-Ms-Request-Id", "fake-request")
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+// checkConditions applies If-Match and If-None-Match: * to a write
+func (f *fakeBlobService) checkConditions(w http.ResponseWriter, r *http.Request, name string) bool {
+	blob, exists := f.blobs[name]
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		f.error(w, http.StatusConflict, "BlobAlreadyExists", "The specified blob already exists.")
+		return false
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists {
+			f.error(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return false
+		}
+		if match != blob.etag {
+			f.error(w, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeBlobService) putBlob(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+		f.error(w, http.StatusBadRequest, "InvalidBlobType", "only block blobs are supported")
+		return
+	}
+	hash := md5.Sum(body)
+	contentMD5 := base64.StdEncoding.EncodeToString(hash[:])
+	if sent := r.Header.Get("Content-MD5"); sent != "" && sent != contentMD5 {
+		f.error(w, http.StatusBadRequest, "Md5Mismatch", "The MD5 value specified in the request did not match the MD5 value calculated by the server.")
+		return
+	}
+	if !f.checkConditions(w, r, name) {
+		return
+	}
+	f.putBlobs++
+	blob := f.store(name, body, contentMD5, nil)
+	w.Header().Set("ETag", blob.etag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobService) stage(w http.ResponseWriter, r *http.Request, name string, data []byte) bool {
+	id := r.URL.Query().Get("blockid")
+	if _, e := base64.StdEncoding.DecodeString(id); e != nil || id == "" {
+		f.error(w, http.StatusBadRequest, "InvalidQueryParameterValue", "invalid block id")
+		return false
+	}
+	if f.uncommitted[name] == nil {
+		f.uncommitted[name] = map[string][]byte{}
+	}
+	f.uncommitted[name][id] = data
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+func (f *fakeBlobService) putBlock(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	if f.stage(w, r, name, body) {
+		f.putBlocks++
+	}
+}
+
+func (f *fakeBlobService) putBlockFromURL(w http.ResponseWriter, r *http.Request, name string) {
+	source, e := url.Parse(r.Header.Get("X-Ms-Copy-Source"))
+	if e != nil || source.Host != r.Host {
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue", "invalid copy source")
+		return
+	}
+	container, sourceName, ok := f.split(source.Path)
+	if !ok || container != fakeContainer {
+		f.error(w, http.StatusNotFound, "CannotVerifyCopySource", "The specified container does not exist.")
+		return
+	}
+	if e := f.checkSourceSAS(source.Query(), sourceName); e != nil {
+		f.error(w, http.StatusForbidden, "CannotVerifyCopySource", e.Error())
+		return
+	}
+	blob, ok := f.blobs[sourceName]
+	if !ok {
+		f.error(w, http.StatusNotFound, "CannotVerifyCopySource", "The specified blob does not exist.")
+		return
+	}
+	start, end, ok := parseRange(r.Header.Get("X-Ms-Source-Range"), int64(len(blob.data)))
+	if !ok || end >= int64(len(blob.data)) || end-start+1 > maxCopyBlockSize {
+		f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "invalid source range")
+		return
+	}
+	if f.stage(w, r, name, append([]byte{}, blob.data[start:end+1]...)) {
+		f.copiedBlocks++
+		f.copiedBytes += int(end - start + 1)
+	}
+}
+
+func (f *fakeBlobService) putBlockList(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	var blocks []fakeBlock
+	var data []byte
+	committed := map[string][]byte{}
+	if blob, ok := f.blobs[name]; ok {
+		for _, block := range blob.blocks {
+			committed[block.id] = block.data
+		}
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, e := decoder.Token()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			f.error(w, http.StatusBadRequest, "InvalidXmlDocument", e.Error())
+			return
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local == "BlockList" {
+			continue
+		}
+		var id string
+		if e := decoder.DecodeElement(&id, &start); e != nil {
+			f.error(w, http.StatusBadRequest, "InvalidXmlDocument", e.Error())
+			return
+		}
+		var blockData []byte
+		var found bool
+		switch start.Name.Local {
+		case "Latest":
+			if blockData, found = f.uncommitted[name][id]; !found {
+				blockData, found = committed[id]
+			}
+		case "Uncommitted":
+			blockData, found = f.uncommitted[name][id]
+		case "Committed":
+			blockData, found = committed[id]
+		}
+		if !found || (len(blocks) > 0 && len(id) != len(blocks[0].id)) {
+			f.error(w, http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+			return
+		}
+		blocks = append(blocks, fakeBlock{id: id, data: blockData})
+		data = append(data, blockData...)
+	}
+	if !f.checkConditions(w, r, name) {
+		return
+	}
+	f.putBlockLists++
+	blob := f.store(name, data, r.Header.Get("X-Ms-Blob-Content-Md5"), blocks)
+	w.Header().Set("ETag", blob.etag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobService) getBlockList(w http.ResponseWriter, name string) {
+	blob, ok := f.blobs[name]
+	if !ok {
+		f.error(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+	type block struct {
+		Name string
+		Size int
+	}
+	result := struct {
+		XMLName         xml.Name `xml:"BlockList"`
+		CommittedBlocks []block  `xml:"CommittedBlocks>Block"`
+	}{}
+	for _, committed := range blob.blocks {
+		result.CommittedBlocks = append(result.CommittedBlocks, block{Name: committed.id, Size: len(committed.data)})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeBlobService) writeProperties(w http.ResponseWriter, blob *fakeBlob) {
+	w.Header().Set("ETag", blob.etag)
+	w.Header().Set("Last-Modified", blob.modified.UTC().Format(http.TimeFormat))
+	if blob.contentMD5 != "" {
+		w.Header().Set("Content-MD5", blob.contentMD5)
+	}
+}
+
+func (f *fakeBlobService) getProperties(w http.ResponseWriter, name string) {
+	blob, ok := f.blobs[name]
+	if !ok {
+		w.Header().Set("X-Ms-Error-Code", "BlobNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.writeProperties(w, blob)
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob.data)))
+}
+
+func (f *fakeBlobService) getBlob(w http.ResponseWriter, r *http.Request, name string) {
+	blob, ok := f.blobs[name]
+	if !ok {
+		f.error(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+	f.writeProperties(w, blob)
+	size := int64(len(blob.data))
+	rangeHeader := r.Header.Get("X-Ms-Range")
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, _ = w.Write(blob.data)
+		return
+	}
+	start, end, ok := parseRange(rangeHeader, size)
+	if !ok {
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue", "invalid range")
+		return
+	}
+	if start >= size {
+		f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+		return
+	}
+	if end >= size {
+		end = size - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(blob.data[start : end+1])
+}
+
+// parseRange parses bytes=start-end and bytes=start-
+func parseRange(header string, size int64) (int64, int64, bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, e := strconv.ParseInt(bounds[0], 10, 64)
+	if e != nil {
+		return 0, 0, false
+	}
+	end := size - 1
+	if bounds[1] != "" {
+		end, e = strconv.ParseInt(bounds[1], 10, 64)
+		if e != nil || end < start {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+type fakeListBlob struct {
+	Name       string
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		Etag          string
+		ContentLength int    `xml:"Content-Length"`
+		ContentMD5    string `xml:"Content-MD5"`
+	}
+}
+
+func (f *fakeBlobService) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) && name >= query.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := struct {
+		XMLName    xml.Name       `xml:"EnumerationResults"`
+		Prefix     string         `xml:",omitempty"`
+		Blobs      []fakeListBlob `xml:"Blobs>Blob"`
+		NextMarker string
+	}{Prefix: prefix}
+	if len(names) > f.maxResults {
+		result.NextMarker = names[f.maxResults]
+		names = names[:f.maxResults]
+	}
+	for _, name := range names {
+		blob := f.blobs[name]
+		listBlob := fakeListBlob{Name: name}
+		listBlob.Properties.LastModified = blob.modified.UTC().Format(http.TimeFormat)
+		listBlob.Properties.Etag = blob.etag
+		listBlob.Properties.ContentLength = len(blob.data)
+		listBlob.Properties.ContentMD5 = blob.contentMD5
+		result.Blobs = append(result.Blobs, listBlob)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// pattern returns size bytes that differ between offsets, so misplaced ranges are noticed
+func pattern(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
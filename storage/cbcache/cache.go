@@ -0,0 +1,355 @@
+package cbcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	lockDir             = "locks"
+	evictLockName       = "evict.lock"
+	defaultPollInterval = time.Millisecond * 50
+)
+
+// ErrHashMismatch is returned when a downloaded object does not have the requested hash
+var ErrHashMismatch = errors.New("downloaded object does not match its hash")
+
+// Storage is a read-through cache in a local directory which can be shared by
+// every process on the host. Objects are cached by the SHA-256 of their
+// contents through DownloadHashContext, which the client uses for buckets, so
+// a cached entry never goes stale and identical buckets are stored once.
+// Every other method is passed through to the wrapped Storage.
+//
+// Filling an entry holds a file lock, so processes needing the same bucket
+// download it once and the others wait for it. Entries are verified before
+// they are added and the least recently used entries are evicted once the
+// cache grows past MaxSize.
+//
+// The cache has to be the outermost decorator for the client to find it
+type Storage struct {
+	storage      cbtransaction.Storage
+	dir          string
+	maxSize      int64
+	pollInterval time.Duration
+}
+
+type Config struct {
+	Storage cbtransaction.Storage
+	// Dir is the cache directory, processes using the same directory share the cache
+	Dir string
+	// MaxSize is the size of the cached entries in bytes past which the least
+	// recently used entries are evicted, 0 means no limit
+	MaxSize int64
+	// PollInterval is how often a process waiting for a lock retries it, defaults to 50ms
+	PollInterval time.Duration
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Storage == nil {
+		return nil, errors.New("no storage given")
+	}
+	if config.Dir == "" {
+		return nil, errors.New("no cache directory given")
+	}
+	if config.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid max size: %d", config.MaxSize)
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if e := os.MkdirAll(filepath.Join(config.Dir, lockDir), os.ModePerm); e != nil {
+		return nil, e
+	}
+
+	return &Storage{
+		storage:      config.Storage,
+		dir:          config.Dir,
+		maxSize:      config.MaxSize,
+		pollInterval: config.PollInterval,
+	}, nil
+}
+
+func checkHash(hash string) error {
+	if decoded, e := hex.DecodeString(hash); e != nil || len(decoded) != sha256.Size || strings.ToLower(hash) != hash {
+		return fmt.Errorf("invalid sha256 hash: %s", hash)
+	}
+	return nil
+}
+
+func (s *Storage) entryPath(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// lockPath stripes the entry locks over 256 files so they never need cleaning up
+func (s *Storage) lockPath(hash string) string {
+	return filepath.Join(s.dir, lockDir, hash[:2]+".lock")
+}
+
+// lock waits until it holds the lock file at path
+func (s *Storage) lock(ctx context.Context, path string) (func(), error) {
+	for {
+		unlock, locked, e := tryLock(path)
+		if e != nil || locked {
+			return unlock, e
+		}
+
+		timer := time.NewTimer(s.pollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// serve writes a cached entry, it returns false if the entry is not cached.
+// The entry stays readable if it is evicted while it is being served
+func (s *Storage) serve(hash string, writer io.Writer) (bool, error) {
+	file, e := os.Open(s.entryPath(hash))
+	if os.IsNotExist(e) {
+		return false, nil
+	}
+	if e != nil {
+		return false, e
+	}
+	defer file.Close()
+
+	now := time.Now()
+	// the modification time orders the entries for eviction
+	_ = os.Chtimes(s.entryPath(hash), now, now)
+	_, e = io.Copy(writer, file)
+
+	return true, e
+}
+
+// DownloadHashContext writes the object with the given hex encoded SHA-256,
+// downloading filename into the cache first unless it is already cached. An
+// object which does not match the hash fails with ErrHashMismatch and is not
+// cached. Nothing is written to writer unless the object matched
+func (s *Storage) DownloadHashContext(ctx context.Context, filename string, hash string, writer io.Writer) error {
+	if e := checkHash(hash); e != nil {
+		return e
+	}
+	if served, e := s.serve(hash, writer); served || e != nil {
+		return e
+	}
+
+	unlock, e := s.lock(ctx, s.lockPath(hash))
+	if e != nil {
+		return e
+	}
+	filled, e := s.fill(ctx, filename, hash)
+	unlock()
+	if e != nil {
+		return e
+	}
+	if filled {
+		if e := s.evict(hash); e != nil {
+			return e
+		}
+	}
+
+	served, e := s.serve(hash, writer)
+	if e == nil && !served {
+		// evicted straight away because it is larger than the cache
+		return s.DownloadContext(ctx, filename, writer)
+	}
+
+	return e
+}
+
+// fill downloads the entry unless another process filled it while this one
+// waited for the lock, the entry lock must be held
+func (s *Storage) fill(ctx context.Context, filename string, hash string) (bool, error) {
+	path := s.entryPath(hash)
+	if _, e := os.Stat(path); e == nil {
+		return false, nil
+	}
+	if e := os.MkdirAll(filepath.Dir(path), os.ModePerm); e != nil {
+		return false, e
+	}
+
+	temp, e := ioutil.TempFile(filepath.Dir(path), ".download-")
+	if e != nil {
+		return false, e
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	hasher := sha256.New()
+	if e := s.storage.DownloadContext(ctx, filename, io.MultiWriter(temp, hasher)); e != nil {
+		return false, e
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != hash {
+		return false, fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrHashMismatch, filename, actual, hash)
+	}
+	if e := temp.Close(); e != nil {
+		return false, e
+	}
+
+	return true, os.Rename(temp.Name(), path)
+}
+
+type entry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used entries until the cache fits in
+// MaxSize, skipping keep unless it alone is larger than the cache. Eviction
+// is skipped while another process is evicting
+func (s *Storage) evict(keep string) error {
+	if s.maxSize == 0 {
+		return nil
+	}
+	unlock, locked, e := tryLock(filepath.Join(s.dir, lockDir, evictLockName))
+	if e != nil || !locked {
+		return e
+	}
+	defer unlock()
+
+	entries, size, e := s.entries()
+	if e != nil {
+		return e
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, cached := range entries {
+		if size <= s.maxSize {
+			break
+		}
+		if filepath.Base(cached.path) == keep && cached.size <= s.maxSize {
+			continue
+		}
+		if e := os.Remove(cached.path); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+		size -= cached.size
+	}
+
+	return nil
+}
+
+func (s *Storage) entries() ([]entry, int64, error) {
+	var entries []entry
+	var size int64
+	prefixes, e := ioutil.ReadDir(s.dir)
+	if e != nil {
+		return nil, 0, e
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || prefix.Name() == lockDir {
+			continue
+		}
+		files, e := ioutil.ReadDir(filepath.Join(s.dir, prefix.Name()))
+		if e != nil {
+			return nil, 0, e
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			entries = append(entries, entry{
+				path:    filepath.Join(s.dir, prefix.Name(), file.Name()),
+				size:    file.Size(),
+				modTime: file.ModTime(),
+			})
+			size += file.Size()
+		}
+	}
+
+	return entries, size, nil
+}
+
+// Size returns the size of the cached entries in bytes
+func (s *Storage) Size() (int64, error) {
+	_, size, e := s.entries()
+	return size, e
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	return s.storage.UploadContext(ctx, filename, reader)
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return s.storage.DownloadContext(ctx, filename, writer)
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	return s.storage.DownloadRangeContext(ctx, filename, offset, length, writer)
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	return s.storage.ConcatContext(ctx, destination, filenames...)
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	return s.storage.DeleteContext(ctx, filename)
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.storage.ListContext(ctx, prefix)
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	return s.storage.StatContext(ctx, filename)
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	return s.storage.ExistsContext(ctx, filename)
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	return s.storage.UploadIfGenerationMatchContext(ctx, filename, reader, generation)
+}
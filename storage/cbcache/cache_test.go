@@ -0,0 +1,172 @@
+package cbcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage counts the downloads reaching the wrapped storage
+type countingStorage struct {
+	*cbmemory.Storage
+	downloads int32
+}
+
+func (c *countingStorage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	atomic.AddInt32(&c.downloads, 1)
+	return c.Storage.DownloadContext(ctx, filename, writer)
+}
+
+func sha256Hex(contents string) string {
+	hash := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(hash[:])
+}
+
+func getStorage(t *testing.T, dir string, maxSize int64) (*Storage, *countingStorage) {
+	memory, e := cbmemory.New(cbmemory.Config{Latency: time.Millisecond * 20})
+	if e != nil {
+		t.Fatal(e)
+	}
+	counting := &countingStorage{Storage: memory}
+	s, e := New(Config{Storage: counting, Dir: dir, MaxSize: maxSize, PollInterval: time.Millisecond})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s, counting
+}
+
+func getDir(t *testing.T) string {
+	dir, e := ioutil.TempDir("", "cbcache")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return dir
+}
+
+func TestStorage_DownloadHash(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	s, counting := getStorage(t, dir, 0)
+	_ = counting.Upload("bucket", strings.NewReader("contents"))
+
+	for i := 0; i < 3; i++ {
+		writer := &bytes.Buffer{}
+		if e := s.DownloadHashContext(context.Background(), "bucket", sha256Hex("contents"), writer); e != nil {
+			t.Errorf("DownloadHashContext() error = %v", e)
+			return
+		}
+		if writer.String() != "contents" {
+			t.Errorf("DownloadHashContext() = %s, want contents", writer.String())
+		}
+	}
+	if counting.downloads != 1 {
+		t.Errorf("DownloadHashContext() downloaded %d times, want 1", counting.downloads)
+	}
+
+	// the same contents under another name is served from the cache
+	if e := s.DownloadHashContext(context.Background(), "copy", sha256Hex("contents"), ioutil.Discard); e != nil || counting.downloads != 1 {
+		t.Errorf("DownloadHashContext() = %v after %d downloads, want a cache hit", e, counting.downloads)
+	}
+
+	writer := &bytes.Buffer{}
+	e := s.DownloadHashContext(context.Background(), "bucket", sha256Hex("other"), writer)
+	if !errors.Is(e, ErrHashMismatch) || writer.Len() != 0 {
+		t.Errorf("DownloadHashContext() = %q, %v, want %v without writing", writer.String(), e, ErrHashMismatch)
+	}
+	if size, _ := s.Size(); size != int64(len("contents")) {
+		t.Errorf("Size() = %d, want only the matching entry", size)
+	}
+
+	if e := s.DownloadHashContext(context.Background(), "bucket", "../../etc", ioutil.Discard); e == nil {
+		t.Error("DownloadHashContext() error = nil for an invalid hash")
+	}
+}
+
+func TestStorage_Evict(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	s, counting := getStorage(t, dir, 20)
+	contents := map[string]string{"a": "aaaaaaaa", "b": "bbbbbbbb", "c": "cccccccc", "large": strings.Repeat("l", 30)}
+	for filename, data := range contents {
+		_ = counting.Upload(filename, strings.NewReader(data))
+	}
+	download := func(filename string) {
+		writer := &bytes.Buffer{}
+		if e := s.DownloadHashContext(context.Background(), filename, sha256Hex(contents[filename]), writer); e != nil || writer.String() != contents[filename] {
+			t.Errorf("DownloadHashContext(%s) = %s, %v", filename, writer.String(), e)
+		}
+	}
+	cached := func(filename string) bool {
+		_, e := os.Stat(s.entryPath(sha256Hex(contents[filename])))
+		return e == nil
+	}
+
+	download("a")
+	time.Sleep(time.Millisecond * 10)
+	download("b")
+	time.Sleep(time.Millisecond * 10)
+	// a is now more recently used than b
+	download("a")
+	time.Sleep(time.Millisecond * 10)
+	download("c")
+
+	if !cached("a") || cached("b") || !cached("c") {
+		t.Errorf("cached a %v, b %v, c %v, want the least recently used b evicted", cached("a"), cached("b"), cached("c"))
+	}
+
+	download("large")
+	if cached("large") {
+		t.Error("an entry larger than the cache was kept")
+	}
+	if size, _ := s.Size(); size > 20 {
+		t.Errorf("Size() = %d, want at most 20", size)
+	}
+}
+
+func TestStorage_SharedDirectory(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	first, counting := getStorage(t, dir, 0)
+	_ = counting.Upload("bucket", strings.NewReader("contents"))
+	// a second cache on the same directory, as another process would have
+	second, e := New(Config{Storage: counting, Dir: dir, PollInterval: time.Millisecond})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func(s *Storage) {
+			defer wait.Done()
+			writer := &bytes.Buffer{}
+			if e := s.DownloadHashContext(context.Background(), "bucket", sha256Hex("contents"), writer); e != nil || writer.String() != "contents" {
+				t.Errorf("DownloadHashContext() = %s, %v", writer.String(), e)
+			}
+		}([]*Storage{first, second}[i%2])
+	}
+	wait.Wait()
+
+	if counting.downloads != 1 {
+		t.Errorf("concurrent DownloadHashContext() downloaded %d times, want 1", counting.downloads)
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	dir := getDir(t)
+	defer os.RemoveAll(dir)
+	s, _ := getStorage(t, dir, 0)
+	storagetest.Contract(t, s)
+}
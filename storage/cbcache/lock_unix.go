@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package cbcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on path without blocking. The lock is
+// released by the kernel if the process dies while holding it
+func tryLock(path string) (func(), bool, error) {
+	file, e := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if e != nil {
+		return nil, false, e
+	}
+	if e := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); e != nil {
+		_ = file.Close()
+		if e == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, e
+	}
+
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+	}, true, nil
+}
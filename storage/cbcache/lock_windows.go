@@ -0,0 +1,30 @@
+package cbcache
+
+import (
+	"os"
+	"time"
+)
+
+// staleLockAge is how old a lock file has to be before it is assumed to be
+// left behind by a process which died while holding it
+const staleLockAge = time.Minute * 30
+
+// tryLock exclusively creates path without blocking, the lock is released by
+// removing it again
+func tryLock(path string) (func(), bool, error) {
+	file, e := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(e) {
+		if info, e := os.Stat(path); e == nil && time.Since(info.ModTime()) > staleLockAge {
+			_ = os.Remove(path)
+		}
+		return nil, false, nil
+	}
+	if e != nil {
+		return nil, false, e
+	}
+	_ = file.Close()
+
+	return func() {
+		_ = os.Remove(path)
+	}, true, nil
+}
@@ -0,0 +1,395 @@
+package cbchecksum
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const defaultSuffix = ".sha256"
+
+var (
+	// ErrCorrupted is matched by every *CorruptionError
+	ErrCorrupted = errors.New("object is corrupted")
+	// ErrChecksumMissing is returned when an object has no checksum and Config.RequireChecksum is set
+	ErrChecksumMissing = errors.New("object has no checksum")
+)
+
+// CorruptionError is returned when the downloaded bytes do not match the
+// checksum stored when the object was uploaded
+type CorruptionError struct {
+	Filename string
+	Expected string
+	Actual   string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s is corrupted: sha256 is %s, expected %s", e.Filename, e.Actual, e.Expected)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// Storage stores the SHA-256 of every object in a sidecar object next to it
+// and verifies whole object downloads against it. The checksum is computed
+// while the body is buffered before the upload. Concat computes it from the
+// sources before they are concatenated and checks it against the result
+// afterwards, in case a source changed in between.
+//
+// A download is only verified once it is complete, so on a *CorruptionError
+// the writer has already received the corrupted bytes and must be discarded.
+// Ranged downloads are not verified. The checksum of an upload is known before
+// the object is written, so the sidecar lists both the new and the previous
+// checksum while the object is replaced. A download racing the upload matches
+// either, and reads the sidecar again before reporting corruption
+type Storage struct {
+	storage         cbtransaction.Storage
+	suffix          string
+	requireChecksum bool
+	tempDir         string
+}
+
+type Config struct {
+	Storage cbtransaction.Storage
+	// Suffix is appended to the object name to name its sidecar, defaults to .sha256
+	Suffix string
+	// RequireChecksum fails downloads of objects without a sidecar, by default
+	// they are not verified so objects uploaded before the checksums were
+	// introduced can still be read
+	RequireChecksum bool
+	// TempDir is where upload bodies are buffered while their checksum is
+	// computed, defaults to os.TempDir()
+	TempDir string
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Storage == nil {
+		return nil, errors.New("no storage given")
+	}
+	if config.Suffix == "" {
+		config.Suffix = defaultSuffix
+	}
+
+	return &Storage{
+		storage:         config.Storage,
+		suffix:          config.Suffix,
+		requireChecksum: config.RequireChecksum,
+		tempDir:         config.TempDir,
+	}, nil
+}
+
+func (s *Storage) sidecar(filename string) string {
+	return filename + s.suffix
+}
+
+func (s *Storage) checkFilename(filename string) error {
+	if strings.HasSuffix(filename, s.suffix) {
+		return fmt.Errorf("invalid filename, %s is reserved for checksums: %s", s.suffix, filename)
+	}
+
+	return nil
+}
+
+func (s *Storage) writeChecksums(ctx context.Context, filename string, checksums ...string) error {
+	return s.storage.UploadContext(ctx, s.sidecar(filename), strings.NewReader(strings.Join(checksums, "\n")+"\n"))
+}
+
+// replace writes the object through write while its sidecar accepts both the
+// previous checksum and checksum. The sidecar is restored when write fails
+func (s *Storage) replace(ctx context.Context, filename string, checksum string, write func() error) error {
+	previous, e := s.Checksum(ctx, filename)
+	if e != nil {
+		return e
+	}
+
+	if previous != "" && previous != checksum {
+		e = s.writeChecksums(ctx, filename, checksum, previous)
+	} else {
+		e = s.writeChecksums(ctx, filename, checksum)
+	}
+	if e != nil {
+		return e
+	}
+
+	if e := write(); e != nil {
+		if previous == "" {
+			_ = s.storage.DeleteContext(ctx, s.sidecar(filename))
+		} else {
+			_ = s.writeChecksums(ctx, filename, previous)
+		}
+		return e
+	}
+
+	if previous != "" && previous != checksum {
+		return s.writeChecksums(ctx, filename, checksum)
+	}
+
+	return nil
+}
+
+// spool copies the reader to a temporary file so its checksum is known before
+// it is uploaded. The caller has to close and remove the file
+func (s *Storage) spool(reader io.Reader) (*os.File, string, error) {
+	file, e := ioutil.TempFile(s.tempDir, "cbchecksum-")
+	if e != nil {
+		return nil, "", e
+	}
+	hash := sha256.New()
+	_, e = io.Copy(io.MultiWriter(file, hash), reader)
+	if e == nil {
+		_, e = file.Seek(0, io.SeekStart)
+	}
+	if e != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", e
+	}
+
+	return file, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksums returns the checksums the object is allowed to match, the current
+// one first. It is empty if the object has none
+func (s *Storage) checksums(ctx context.Context, filename string) ([]string, error) {
+	buffer := &bytes.Buffer{}
+	e := s.storage.DownloadContext(ctx, s.sidecar(filename), buffer)
+	if errors.Is(e, cbstorage.ErrNotExist) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	checksums := strings.Fields(buffer.String())
+	for _, checksum := range checksums {
+		if decoded, e := hex.DecodeString(checksum); e != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid checksum for %s: %q", filename, checksum)
+		}
+	}
+
+	return checksums, nil
+}
+
+// Checksum returns the hex encoded SHA-256 stored for the object, or "" if it has none
+func (s *Storage) Checksum(ctx context.Context, filename string) (string, error) {
+	checksums, e := s.checksums(ctx, filename)
+	if e != nil || len(checksums) == 0 {
+		return "", e
+	}
+
+	return checksums[0], nil
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	file, checksum, e := s.spool(reader)
+	if e != nil {
+		return e
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	return s.replace(ctx, filename, checksum, func() error {
+		return s.storage.UploadContext(ctx, filename, file)
+	})
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	file, checksum, e := s.spool(reader)
+	if e != nil {
+		return "", e
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var next string
+	e = s.replace(ctx, filename, checksum, func() error {
+		var e error
+		next, e = s.storage.UploadIfGenerationMatchContext(ctx, filename, file, generation)
+		return e
+	})
+	if e != nil {
+		return "", e
+	}
+
+	return next, nil
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := s.checkFilename(destination); e != nil {
+		return e
+	}
+	// the result is the sources one after another, so its checksum is known
+	// before the sources are concatenated
+	hash := sha256.New()
+	for _, filename := range filenames {
+		if e := s.storage.DownloadContext(ctx, filename, hash); e != nil {
+			return e
+		}
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	e := s.replace(ctx, destination, checksum, func() error {
+		return s.storage.ConcatContext(ctx, destination, filenames...)
+	})
+	if e != nil {
+		return e
+	}
+
+	// a source may have changed since it was hashed
+	hash = sha256.New()
+	if e := s.storage.DownloadContext(ctx, destination, hash); e != nil {
+		return e
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		return s.writeChecksums(ctx, destination, actual)
+	}
+
+	return nil
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := s.storage.DeleteContext(ctx, filename); e != nil {
+		return e
+	}
+	if e := s.storage.DeleteContext(ctx, s.sidecar(filename)); e != nil && !errors.Is(e, cbstorage.ErrNotExist) {
+		return e
+	}
+
+	return nil
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	expected, e := s.checksums(ctx, filename)
+	if e != nil {
+		return e
+	}
+	if len(expected) == 0 {
+		if s.requireChecksum {
+			if exists, e := s.storage.ExistsContext(ctx, filename); e == nil && !exists {
+				return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+			}
+			return fmt.Errorf("%w: %s", ErrChecksumMissing, filename)
+		}
+		return s.storage.DownloadContext(ctx, filename, writer)
+	}
+
+	hash := sha256.New()
+	if e := s.storage.DownloadContext(ctx, filename, io.MultiWriter(writer, hash)); e != nil {
+		return e
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if contains(expected, actual) {
+		return nil
+	}
+	// the object may have been replaced after the sidecar was read
+	expected, e = s.checksums(ctx, filename)
+	if e != nil {
+		return e
+	}
+	if len(expected) == 0 || !contains(expected, actual) {
+		return &CorruptionError{Filename: filename, Expected: strings.Join(expected, " or "), Actual: actual}
+	}
+
+	return nil
+}
+
+func contains(checksums []string, checksum string) bool {
+	for _, c := range checksums {
+		if c == checksum {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Verify downloads the object and checks it against its checksum without keeping it
+func (s *Storage) Verify(ctx context.Context, filename string) error {
+	return s.DownloadContext(ctx, filename, ioutil.Discard)
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+// DownloadRangeContext only verifies ranges covering the whole object
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if offset == 0 && length < 0 {
+		return s.DownloadContext(ctx, filename, writer)
+	}
+
+	return s.storage.DownloadRangeContext(ctx, filename, offset, length, writer)
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+// ListContext leaves out the sidecars
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	objects, e := s.storage.ListContext(ctx, prefix)
+	if e != nil {
+		return nil, e
+	}
+
+	filtered := objects[:0]
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Name, s.suffix) {
+			filtered = append(filtered, object)
+		}
+	}
+
+	return filtered, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	return s.storage.StatContext(ctx, filename)
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	return s.storage.ExistsContext(ctx, filename)
+}
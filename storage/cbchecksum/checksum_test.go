@@ -0,0 +1,335 @@
+package cbchecksum
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sha256("contents")
+const contentsChecksum = "d1b2a59fbea7e20077af9f91b27e95e865061b270be03ff539ab3b73587882e8"
+
+func getStorage(t *testing.T, config Config) (*Storage, *cbmemory.Storage) {
+	memory, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	config.Storage = memory
+	s, e := New(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s, memory
+}
+
+func TestStorage_Upload(t *testing.T) {
+	s, memory := getStorage(t, Config{})
+
+	if e := s.Upload("file", io.MultiReader(strings.NewReader("con"), strings.NewReader("tents"))); e != nil {
+		t.Errorf("Upload() error = %v", e)
+		return
+	}
+	sidecar := &bytes.Buffer{}
+	if e := memory.Download("file.sha256", sidecar); e != nil || sidecar.String() != contentsChecksum+"\n" {
+		t.Errorf("sidecar = %q, %v, want %s", sidecar.String(), e, contentsChecksum)
+	}
+
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("contents"), ""); e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+	}
+	if checksum, e := s.Checksum(context.Background(), "master"); e != nil || checksum != contentsChecksum {
+		t.Errorf("Checksum() = %s, %v, want %s", checksum, e, contentsChecksum)
+	}
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("other"), ""); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+	if checksum, _ := s.Checksum(context.Background(), "master"); checksum != contentsChecksum {
+		t.Errorf("Checksum() = %s after a failed upload, want %s", checksum, contentsChecksum)
+	}
+
+	if e := s.Upload("file.sha256", strings.NewReader("contents")); e == nil {
+		t.Error("Upload() error = nil for a sidecar name")
+	}
+}
+
+func TestStorage_Download(t *testing.T) {
+	tests := []struct {
+		name            string
+		stored          string
+		sidecar         string
+		requireChecksum bool
+		wantErr         error
+	}{
+		{
+			name:    "valid",
+			stored:  "contents",
+			sidecar: contentsChecksum,
+		},
+		{
+			name:    "corrupted",
+			stored:  "c0ntents",
+			sidecar: contentsChecksum,
+			wantErr: ErrCorrupted,
+		},
+		{
+			name:   "noChecksum",
+			stored: "contents",
+		},
+		{
+			name:            "noChecksumRequired",
+			stored:          "contents",
+			requireChecksum: true,
+			wantErr:         ErrChecksumMissing,
+		},
+		{
+			name:            "missingRequired",
+			requireChecksum: true,
+			wantErr:         cbstorage.ErrNotExist,
+		},
+		{
+			name:    "missing",
+			wantErr: cbstorage.ErrNotExist,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, memory := getStorage(t, Config{RequireChecksum: tt.requireChecksum})
+			if tt.stored != "" {
+				_ = memory.Upload("file", strings.NewReader(tt.stored))
+			}
+			if tt.sidecar != "" {
+				_ = memory.Upload("file.sha256", strings.NewReader(tt.sidecar))
+			}
+
+			err := s.Download("file", &bytes.Buffer{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Download() error = %v, want %v", err, tt.wantErr)
+			}
+			var corruption *CorruptionError
+			if errors.As(err, &corruption) && (corruption.Expected != contentsChecksum || corruption.Filename != "file") {
+				t.Errorf("Download() error = %+v", corruption)
+			}
+		})
+	}
+}
+
+// hookStorage calls hook before and after every write to the wrapped storage
+type hookStorage struct {
+	cbtransaction.Storage
+	hook func()
+}
+
+func (h *hookStorage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	h.hook()
+	defer h.hook()
+	return h.Storage.UploadContext(ctx, filename, reader)
+}
+
+func (h *hookStorage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	h.hook()
+	defer h.hook()
+	return h.Storage.UploadIfGenerationMatchContext(ctx, filename, reader, generation)
+}
+
+func (h *hookStorage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	h.hook()
+	defer h.hook()
+	return h.Storage.ConcatContext(ctx, destination, filenames...)
+}
+
+func TestStorage_DownloadRacingUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace func(s *Storage) error
+		want    []string
+	}{
+		{
+			name: "upload",
+			replace: func(s *Storage) error {
+				return s.Upload("file", strings.NewReader("new"))
+			},
+			want: []string{"old", "new"},
+		},
+		{
+			name: "uploadIfGenerationMatch",
+			replace: func(s *Storage) error {
+				info, e := s.Stat("file")
+				if e != nil {
+					return e
+				}
+				_, e = s.UploadIfGenerationMatch("file", strings.NewReader("new"), info.Generation)
+				return e
+			},
+			want: []string{"old", "new"},
+		},
+		{
+			name: "concat",
+			replace: func(s *Storage) error {
+				return s.Concat("file", "file", "other")
+			},
+			want: []string{"old", "oldnew"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, e := cbmemory.New(cbmemory.Config{})
+			if e != nil {
+				t.Fatal(e)
+			}
+			reader, e := New(Config{Storage: memory})
+			if e != nil {
+				t.Fatal(e)
+			}
+			_ = reader.Upload("file", strings.NewReader("old"))
+			_ = reader.Upload("other", strings.NewReader("new"))
+
+			hooked := &hookStorage{Storage: memory}
+			writer, e := New(Config{Storage: hooked})
+			if e != nil {
+				t.Fatal(e)
+			}
+			hooked.hook = func() {
+				buffer := &bytes.Buffer{}
+				if e := reader.Download("file", buffer); e != nil {
+					t.Errorf("Download() during the upload error = %v", e)
+					return
+				}
+				if buffer.String() != tt.want[0] && buffer.String() != tt.want[1] {
+					t.Errorf("Download() during the upload = %s, want %v", buffer.String(), tt.want)
+				}
+			}
+
+			if e := tt.replace(writer); e != nil {
+				t.Errorf("upload error = %v", e)
+			}
+			hooked.hook()
+			checksums, _ := reader.checksums(context.Background(), "file")
+			if len(checksums) != 1 {
+				t.Errorf("checksums after the upload = %v, want only the new one", checksums)
+			}
+		})
+	}
+}
+
+func TestStorage_Concat(t *testing.T) {
+	s, memory := getStorage(t, Config{})
+	_ = s.Upload("log", strings.NewReader("con"))
+	_ = s.Upload("batch", strings.NewReader("tents"))
+
+	if e := s.Concat("log", "log", "batch"); e != nil {
+		t.Errorf("Concat() error = %v", e)
+		return
+	}
+	if checksum, _ := s.Checksum(context.Background(), "log"); checksum != contentsChecksum {
+		t.Errorf("Checksum() = %s after Concat, want %s", checksum, contentsChecksum)
+	}
+	if e := s.Download("log", &bytes.Buffer{}); e != nil {
+		t.Errorf("Download() error = %v", e)
+	}
+
+	objects, _ := s.List("")
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"batch", "log"}) {
+		t.Errorf("List() = %v, want the objects without sidecars", names)
+	}
+
+	if e := s.Delete("log"); e != nil {
+		t.Errorf("Delete() error = %v", e)
+	}
+	if exists, _ := memory.Exists("log.sha256"); exists {
+		t.Error("Delete() kept the sidecar")
+	}
+}
+
+// beforeConcatStorage calls before ahead of every concat of the wrapped storage
+type beforeConcatStorage struct {
+	cbtransaction.Storage
+	before func()
+}
+
+func (b *beforeConcatStorage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	b.before()
+	return b.Storage.ConcatContext(ctx, destination, filenames...)
+}
+
+func TestStorage_ConcatSourceChanged(t *testing.T) {
+	memory, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s, e := New(Config{Storage: &beforeConcatStorage{
+		Storage: memory,
+		before: func() {
+			_ = memory.Upload("batch", strings.NewReader("tents"))
+		},
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_ = s.Upload("log", strings.NewReader("con"))
+	_ = s.Upload("batch", strings.NewReader("tenth"))
+
+	if e := s.Concat("log", "log", "batch"); e != nil {
+		t.Errorf("Concat() error = %v", e)
+		return
+	}
+	if checksum, _ := s.Checksum(context.Background(), "log"); checksum != contentsChecksum {
+		t.Errorf("Checksum() = %s after a source changed during Concat, want %s", checksum, contentsChecksum)
+	}
+	if e := s.Download("log", &bytes.Buffer{}); e != nil {
+		t.Errorf("Download() error = %v", e)
+	}
+}
+
+// tempDirReader fails unless the body is being buffered in dir
+type tempDirReader struct {
+	io.Reader
+	dir string
+}
+
+func (r *tempDirReader) Read(p []byte) (int, error) {
+	files, e := ioutil.ReadDir(r.dir)
+	if e != nil {
+		return 0, e
+	}
+	if len(files) != 1 {
+		return 0, fmt.Errorf("%d files in the temp dir, want the buffered body", len(files))
+	}
+	return r.Reader.Read(p)
+}
+
+func TestStorage_UploadTempDir(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "cbchecksum-temp")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	s, _ := getStorage(t, Config{TempDir: tempDir})
+
+	if e := s.Upload("file", &tempDirReader{Reader: strings.NewReader("contents"), dir: tempDir}); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if files, _ := ioutil.ReadDir(tempDir); len(files) != 0 {
+		t.Errorf("Upload() left %d files in the temp dir", len(files))
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	s, _ := getStorage(t, Config{})
+	storagetest.Contract(t, s)
+}
@@ -1,21 +1,49 @@
 package cbfile
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/codingbeard/cbtransaction/storage"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	defaultLockTimeout = time.Minute
+
+	lockSuffix = ".cbfile-lock"
+	// takeoverInfix names the token held while removing a stale lock
+	takeoverInfix = ".takeover"
+	tempInfix     = ".cbfile-tmp."
 )
 
 type Storage struct {
-	basePath string
+	basePath    string
+	lockTimeout time.Duration
+	// checksums caches the cachedChecksum of each file path
+	checksums sync.Map
+}
+
+// cachedChecksum is the md5 of a file while it has the generation
+type cachedChecksum struct {
+	generation string
+	checksum   string
 }
 
 type Config struct {
 	BasePath string
+	// lock files older than this are assumed to be left behind by a crashed writer, defaults to a minute
+	LockTimeout time.Duration
 }
 
 func New(config Config) (*Storage, error) {
@@ -28,7 +56,8 @@ func New(config Config) (*Storage, error) {
 		return nil, fmt.Errorf("basePath is not a valid directory: %s", basePath)
 	}
 	return &Storage{
-		basePath: basePath,
+		basePath:    basePath,
+		lockTimeout: config.LockTimeout,
 	}, nil
 }
 
@@ -36,13 +65,20 @@ func (s *Storage) checkFilename(filename string) error {
 	if filename == "" || filename == "." || filename == ".." {
 		return fmt.Errorf("invalid filename: %s", filename)
 	}
+	if strings.HasSuffix(filename, lockSuffix) || strings.Contains(filename, tempInfix) {
+		return fmt.Errorf("filename is reserved for internal use: %s", filename)
+	}
 
+	base, e := filepath.Abs(s.basePath)
+	if e != nil {
+		return e
+	}
 	abs, e := filepath.Abs(path.Join(s.basePath, filename))
 	if e != nil {
 		return e
 	}
 
-	if !strings.HasPrefix(abs, s.basePath) {
+	if !strings.HasPrefix(abs, base+string(filepath.Separator)) {
 		return fmt.Errorf("absolute file path (%s) is outside of base path (%s)", abs, s.basePath)
 	}
 
@@ -56,37 +92,167 @@ func (s *Storage) checkFilename(filename string) error {
 	return nil
 }
 
+func (s *Storage) checkPrefix(prefix string) error {
+	base, e := filepath.Abs(s.basePath)
+	if e != nil {
+		return e
+	}
+	abs, e := filepath.Abs(path.Join(s.basePath, prefix))
+	if e != nil {
+		return e
+	}
+
+	if abs != base && !strings.HasPrefix(abs, base+string(filepath.Separator)) {
+		return fmt.Errorf("absolute prefix path (%s) is outside of base path (%s)", abs, s.basePath)
+	}
+
+	return nil
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if e := r.ctx.Err(); e != nil {
+		return 0, e
+	}
+	return r.reader.Read(p)
+}
+
 func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+// UploadContext holds the lock of UploadIfGenerationMatchContext, so it never
+// replaces a file between the generation check and the write of a conditional
+// upload
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
 	if e := s.checkFilename(filename); e != nil {
 		return e
 	}
-	writer, e := os.Create(path.Join(s.basePath, filename))
+	filePath := path.Join(s.basePath, filename)
+	unlock, e := s.lock(ctx, filePath)
 	if e != nil {
 		return e
 	}
-	if writer != nil {
-		defer writer.Close()
+	defer unlock()
+
+	return s.writeAtomic(filePath, func(writer io.Writer) error {
+		_, e := io.Copy(writer, &contextReader{ctx: ctx, reader: reader})
+		return e
+	})
+}
+
+// writeAtomic streams into a temporary file next to filePath, then syncs and
+// renames it into place so readers never see a partially written file, even
+// if the process crashes part way through
+func (s *Storage) writeAtomic(filePath string, write func(writer io.Writer) error) error {
+	tempPath := filePath + tempInfix + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(os.Getpid())
+	e := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if e != nil {
+		return e
 	}
-	_, e = io.Copy(writer, reader)
-	return e
+	writer, e := os.OpenFile(tempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if e != nil {
+		return e
+	}
+
+	e = write(writer)
+	if e == nil {
+		e = writer.Sync()
+	}
+	closeE := writer.Close()
+	if e == nil {
+		e = closeE
+	}
+	if e == nil {
+		e = os.Rename(tempPath, filePath)
+	}
+	if e != nil {
+		_ = os.Remove(tempPath)
+		return e
+	}
+
+	return syncDir(filepath.Dir(filePath))
+}
+
+// syncDir makes a rename within the directory durable
+func syncDir(dir string) error {
+	file, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	defer file.Close()
+
+	return file.Sync()
 }
 
 func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	reader, e := os.Open(path.Join(s.basePath, filename))
+	if e != nil {
+		return notExist(e, filename)
+	}
+	defer reader.Close()
+	_, e = io.Copy(writer, &contextReader{ctx: ctx, reader: reader})
+	return e
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
 	if e := s.checkFilename(filename); e != nil {
 		return e
 	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
 	reader, e := os.Open(path.Join(s.basePath, filename))
+	if e != nil {
+		return notExist(e, filename)
+	}
+	defer reader.Close()
+
+	_, e = reader.Seek(offset, io.SeekStart)
 	if e != nil {
 		return e
 	}
-	if reader != nil {
-		defer reader.Close()
+
+	if length < 0 {
+		_, e = io.Copy(writer, &contextReader{ctx: ctx, reader: reader})
+		return e
 	}
-	_, e = io.Copy(writer, reader)
+	_, e = io.Copy(writer, io.LimitReader(&contextReader{ctx: ctx, reader: reader}, length))
 	return e
 }
 
 func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
 	if e := s.checkFilename(destination); e != nil {
 		return e
 	}
@@ -100,34 +266,324 @@ func (s *Storage) Concat(destination string, filenames ...string) error {
 		filePath := path.Join(s.basePath, filename)
 		stat, e := os.Stat(filePath)
 		if e != nil {
-			return e
+			return notExist(e, filename)
 		}
 		if stat.IsDir() {
 			return fmt.Errorf("cannot concat file into destination, %s is a directory", filePath)
 		}
 	}
-	writer, e := os.Create(path.Join(s.basePath, destination))
+	destinationPath := path.Join(s.basePath, destination)
+	unlock, e := s.lock(ctx, destinationPath)
+	if e != nil {
+		return e
+	}
+	defer unlock()
+
+	return s.writeAtomic(destinationPath, func(writer io.Writer) error {
+		for _, filename := range filenames {
+			reader, e := os.Open(path.Join(s.basePath, filename))
+			if e != nil {
+				return e
+			}
+			_, e = io.Copy(writer, &contextReader{ctx: ctx, reader: reader})
+			_ = reader.Close()
+			if e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	filePath := path.Join(s.basePath, filename)
+	unlock, e := s.lock(ctx, filePath)
 	if e != nil {
 		return e
 	}
-	if writer != nil {
-		defer writer.Close()
+	defer unlock()
+
+	e = os.Remove(filePath)
+	if e != nil {
+		return notExist(e, filename)
 	}
-	for _, filename := range filenames {
-		reader, e := os.Open(path.Join(s.basePath, filename))
+	return syncDir(filepath.Dir(filePath))
+}
+
+func (s *Storage) List(prefix string) ([]storage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+
+	// only walk the directory the prefix is in rather than the whole base path
+	root := s.basePath
+	if index := strings.LastIndex(prefix, "/"); index != -1 {
+		if e := s.checkPrefix(prefix); e != nil {
+			return nil, e
+		}
+		root = path.Join(s.basePath, prefix[:index])
+	}
+
+	var objects []storage.ObjectInfo
+	e := filepath.Walk(root, func(filePath string, info os.FileInfo, e error) error {
 		if e != nil {
+			if filePath == root && os.IsNotExist(e) {
+				return filepath.SkipDir
+			}
+			return e
+		}
+		if e := ctx.Err(); e != nil {
 			return e
 		}
-		_, e = io.Copy(writer, reader)
-		_ = reader.Close()
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, e := filepath.Rel(s.basePath, filePath)
 		if e != nil {
 			return e
 		}
+		name = filepath.ToSlash(name)
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, lockSuffix) || strings.Contains(name, tempInfix) {
+			return nil
+		}
+		objects = append(objects, s.objectInfo(name, info))
+		return nil
+	})
+	if e != nil {
+		return nil, e
 	}
 
-	return nil
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
 }
 
-func (s *Storage) Delete(filename string) error {
-	return os.Remove(path.Join(s.basePath, filename))
+func (s *Storage) Stat(filename string) (storage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (storage.ObjectInfo, error) {
+	if e := ctx.Err(); e != nil {
+		return storage.ObjectInfo{}, e
+	}
+	if e := s.checkFilename(filename); e != nil {
+		return storage.ObjectInfo{}, e
+	}
+	info, e := os.Stat(path.Join(s.basePath, filename))
+	if e != nil {
+		return storage.ObjectInfo{}, notExist(e, filename)
+	}
+	if info.IsDir() {
+		return storage.ObjectInfo{}, fmt.Errorf("cbfile: %s is a directory", filename)
+	}
+
+	return s.objectInfo(path.Clean(filename), info), nil
+}
+
+func (s *Storage) Checksum(filename string) (string, error) {
+	return s.ChecksumContext(context.Background(), filename)
+}
+
+// ChecksumContext returns the hex md5 of the file, which StatContext leaves
+// out of ObjectInfo.Checksum as it would read the whole file. It is cached
+// until the size, mod time or inode of the file changes
+func (s *Storage) ChecksumContext(ctx context.Context, filename string) (string, error) {
+	if e := ctx.Err(); e != nil {
+		return "", e
+	}
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	filePath := path.Join(s.basePath, filename)
+	reader, e := os.Open(filePath)
+	if e != nil {
+		return "", notExist(e, filename)
+	}
+	defer reader.Close()
+
+	info, e := reader.Stat()
+	if e != nil {
+		return "", e
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("cbfile: %s is a directory", filename)
+	}
+	generation := s.objectInfo(filename, info).Generation
+	if cached, ok := s.checksums.Load(filePath); ok && cached.(cachedChecksum).generation == generation {
+		return cached.(cachedChecksum).checksum, nil
+	}
+
+	hash := md5.New()
+	_, e = io.Copy(hash, &contextReader{ctx: ctx, reader: reader})
+	if e != nil {
+		return "", e
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	s.checksums.Store(filePath, cachedChecksum{generation: generation, checksum: checksum})
+
+	return checksum, nil
+}
+
+// notExist wraps errors for missing files in storage.ErrNotExist
+func notExist(e error, filename string) error {
+	if os.IsNotExist(e) {
+		return fmt.Errorf("%w: %s: %s", storage.ErrNotExist, filename, e.Error())
+	}
+	return e
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	if e := ctx.Err(); e != nil {
+		return false, e
+	}
+	if e := s.checkFilename(filename); e != nil {
+		return false, e
+	}
+	_, e := os.Stat(path.Join(s.basePath, filename))
+	if e != nil {
+		if os.IsNotExist(e) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+func (s *Storage) objectInfo(name string, info os.FileInfo) storage.ObjectInfo {
+	etag := strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16)
+	return storage.ObjectInfo{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		ETag:    etag,
+		// every conditional write renames a new file into place, so the inode guards against coarse mod times
+		Generation: etag + "-" + strconv.FormatUint(inode(info), 16),
+	}
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := ctx.Err(); e != nil {
+		return "", e
+	}
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	filePath := path.Join(s.basePath, filename)
+
+	unlock, e := s.lock(ctx, filePath)
+	if e != nil {
+		return "", e
+	}
+	defer unlock()
+
+	currentGeneration := ""
+	info, e := os.Stat(filePath)
+	if e == nil {
+		currentGeneration = s.objectInfo(filename, info).Generation
+	} else if !os.IsNotExist(e) {
+		return "", e
+	}
+	if currentGeneration != generation {
+		return "", fmt.Errorf("%w: %s has generation %s, want %s", storage.ErrPreconditionFailed, filename, currentGeneration, generation)
+	}
+
+	e = s.writeAtomic(filePath, func(writer io.Writer) error {
+		_, e := io.Copy(writer, &contextReader{ctx: ctx, reader: reader})
+		return e
+	})
+	if e != nil {
+		return "", e
+	}
+
+	info, e = os.Stat(filePath)
+	if e != nil {
+		return "", e
+	}
+
+	return s.objectInfo(filename, info).Generation, nil
+}
+
+// takeOverStaleLock removes the lock of filePath when it is older than
+// lockTimeout, reporting whether it did. A waiter has to create the takeover
+// token exclusively first and checks the lock is still stale while holding it,
+// so two waiters cannot both remove a lock and one of them the fresh lock of
+// the other
+func takeOverStaleLock(filePath string, lockTimeout time.Duration) bool {
+	lockPath := filePath + lockSuffix
+	tokenPath := filePath + takeoverInfix + lockSuffix
+	token, e := os.OpenFile(tokenPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if e != nil {
+		if info, e := os.Stat(tokenPath); e == nil && time.Since(info.ModTime()) > lockTimeout {
+			// left behind by a waiter which stopped while taking over
+			_ = os.Remove(tokenPath)
+		}
+		return false
+	}
+	_ = token.Close()
+	defer os.Remove(tokenPath)
+
+	info, e := os.Stat(lockPath)
+	if e != nil || time.Since(info.ModTime()) <= lockTimeout {
+		return false
+	}
+	return os.Remove(lockPath) == nil
+}
+
+// lock creates a lock file next to filePath, waiting for any other writer to
+// release theirs and removing locks which are older than the lock timeout
+func (s *Storage) lock(ctx context.Context, filePath string) (func(), error) {
+	lockPath := filePath + lockSuffix
+	lockTimeout := s.lockTimeout
+	if lockTimeout <= 0 {
+		lockTimeout = defaultLockTimeout
+	}
+	if e := os.MkdirAll(filepath.Dir(lockPath), 0755); e != nil {
+		return nil, e
+	}
+	for {
+		lockFile, e := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if e == nil {
+			_ = lockFile.Close()
+			return func() {
+				_ = os.Remove(lockPath)
+			}, nil
+		}
+		if !os.IsExist(e) {
+			return nil, e
+		}
+
+		if takeOverStaleLock(filePath, lockTimeout) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
 }
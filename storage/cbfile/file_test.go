@@ -2,6 +2,10 @@ package cbfile
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,6 +13,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -193,6 +198,15 @@ func TestStorage_Delete(t *testing.T) {
 			test:    nil,
 			cleanup: nil,
 		},
+		{
+			name:    "outsideBasePath",
+			fields:  fields{basePath: tempDir},
+			args:    args{filename: "../file.delete.outsideBasePath.txt"},
+			wantErr: true,
+			setup:   nil,
+			test:    nil,
+			cleanup: nil,
+		},
 		{
 			name:    "validFile",
 			fields:  fields{basePath: tempDir},
@@ -413,6 +427,24 @@ func TestStorage_checkFilename(t *testing.T) {
 			args:    args{filename: "../file.txt"},
 			wantErr: true,
 		},
+		{
+			name:    "siblingOfBasePath",
+			fields:  fields{basePath: filepath.Join(tempDir, "base")},
+			args:    args{filename: "../basesibling/file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "reservedLock",
+			fields:  fields{basePath: tempDir},
+			args:    args{filename: "file.txt" + lockSuffix},
+			wantErr: true,
+		},
+		{
+			name:    "reservedTemp",
+			fields:  fields{basePath: tempDir},
+			args:    args{filename: "file.txt" + tempInfix + "1"},
+			wantErr: true,
+		},
 		{
 			name:    "dir",
 			fields:  fields{basePath: tempDir},
@@ -496,3 +528,918 @@ func TestStorage_checkFilename(t *testing.T) {
 		})
 	}
 }
+
+func TestStorage_cancelledContext(t *testing.T) {
+	tempDir := os.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		call    func(s *Storage) error
+		setup   func()
+		test    func()
+		cleanup func()
+	}{
+		{
+			name: "upload",
+			call: func(s *Storage) error {
+				return s.UploadContext(ctx, "file.cancelled.upload.txt", bytes.NewReader([]byte("contents")))
+			},
+			test: func() {
+				_, e := os.Stat(filepath.Join(tempDir, "file.cancelled.upload.txt"))
+				if e == nil {
+					t.Error("UploadContext() created the file after the context was cancelled")
+				}
+			},
+		},
+		{
+			name: "download",
+			call: func(s *Storage) error {
+				return s.DownloadContext(ctx, "file.cancelled.download.txt", &bytes.Buffer{})
+			},
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "file.cancelled.download.txt"), []byte("contents"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				_ = os.Remove(filepath.Join(tempDir, "file.cancelled.download.txt"))
+			},
+		},
+		{
+			name: "delete",
+			call: func(s *Storage) error {
+				return s.DeleteContext(ctx, "file.cancelled.delete.txt")
+			},
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "file.cancelled.delete.txt"), []byte("contents"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			test: func() {
+				_, e := os.Stat(filepath.Join(tempDir, "file.cancelled.delete.txt"))
+				if e != nil {
+					t.Error("DeleteContext() removed the file after the context was cancelled")
+				}
+			},
+			cleanup: func() {
+				_ = os.Remove(filepath.Join(tempDir, "file.cancelled.delete.txt"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			s := &Storage{
+				basePath: tempDir,
+			}
+			if err := tt.call(s); !errors.Is(err, context.Canceled) {
+				t.Errorf("%s error = %v, want %v", tt.name, err, context.Canceled)
+			}
+			if tt.test != nil {
+				tt.test()
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_List(t *testing.T) {
+	type args struct {
+		prefix string
+	}
+	tempDir, e := ioutil.TempDir("", "cbfile-list")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	files := map[string]string{
+		"bucket1.txt":         "bucket1",
+		"bucket2.txt":         "bucket2-longer",
+		"master":              "master",
+		"folder/bucket3.txt":  "bucket3",
+		"folder/other.txt":    "other",
+		"folder2/bucket4.txt": "bucket4",
+	}
+	for name, contents := range files {
+		e := os.MkdirAll(filepath.Dir(filepath.Join(tempDir, name)), os.ModePerm)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		e = ioutil.WriteFile(filepath.Join(tempDir, name), []byte(contents), os.ModePerm)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+	}
+	tests := []struct {
+		name      string
+		args      args
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			name:      "all",
+			args:      args{prefix: ""},
+			wantNames: []string{"bucket1.txt", "bucket2.txt", "folder/bucket3.txt", "folder/other.txt", "folder2/bucket4.txt", "master"},
+		},
+		{
+			name:      "prefix",
+			args:      args{prefix: "bucket"},
+			wantNames: []string{"bucket1.txt", "bucket2.txt"},
+		},
+		{
+			name:      "folderPrefix",
+			args:      args{prefix: "folder/b"},
+			wantNames: []string{"folder/bucket3.txt"},
+		},
+		{
+			name:      "folderNameIsPrefix",
+			args:      args{prefix: "folder"},
+			wantNames: []string{"folder/bucket3.txt", "folder/other.txt", "folder2/bucket4.txt"},
+		},
+		{
+			name:      "missingFolder",
+			args:      args{prefix: "missing/"},
+			wantNames: nil,
+		},
+		{
+			name:    "outsideBasePath",
+			args:    args{prefix: "../other/"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Storage{
+				basePath: tempDir,
+			}
+			got, err := s.List(tt.args.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("List() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var gotNames []string
+			for _, object := range got {
+				gotNames = append(gotNames, object.Name)
+				if object.Size != int64(len(files[object.Name])) {
+					t.Errorf("List() %s size = %d, want %d", object.Name, object.Size, len(files[object.Name]))
+				}
+			}
+			if !reflect.DeepEqual(gotNames, tt.wantNames) {
+				t.Errorf("List() names = %v, want %v", gotNames, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestStorage_Stat(t *testing.T) {
+	type args struct {
+		filename string
+	}
+	tempDir := os.TempDir()
+	tests := []struct {
+		name         string
+		args         args
+		wantSize     int64
+		wantChecksum string
+		wantErr      bool
+		wantNotExist bool
+		setup        func()
+		cleanup      func()
+	}{
+		{
+			name:    "invalidFile",
+			args:    args{filename: "."},
+			wantErr: true,
+		},
+		{
+			name:         "missingFile",
+			args:         args{filename: "file.stat.missingFile.txt"},
+			wantErr:      true,
+			wantNotExist: true,
+		},
+		{
+			name:         "validFile",
+			args:         args{filename: "file.stat.validFile.txt"},
+			wantSize:     13,
+			wantChecksum: "53a08cf9217fc1c69a90fd77c4d765db",
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "file.stat.validFile.txt"), []byte("file-contents"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				_ = os.Remove(filepath.Join(tempDir, "file.stat.validFile.txt"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			s := &Storage{
+				basePath: tempDir,
+			}
+			got, err := s.Stat(tt.args.filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Stat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, storage.ErrNotExist) != tt.wantNotExist {
+				t.Errorf("Stat() error = %v, wantNotExist %v", err, tt.wantNotExist)
+			}
+			if err == nil {
+				if got.Name != tt.args.filename {
+					t.Errorf("Stat() Name = %s, want %s", got.Name, tt.args.filename)
+				}
+				if got.Size != tt.wantSize {
+					t.Errorf("Stat() Size = %d, want %d", got.Size, tt.wantSize)
+				}
+				if got.Checksum != "" {
+					t.Errorf("Stat() Checksum = %s, want it left to Checksum()", got.Checksum)
+				}
+				checksum, e := s.Checksum(tt.args.filename)
+				if e != nil || checksum != tt.wantChecksum {
+					t.Errorf("Checksum() = %s, %v, want %s", checksum, e, tt.wantChecksum)
+				}
+				if got.ETag == "" {
+					t.Error("Stat() ETag is empty")
+				}
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_Checksum(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "cbfile-checksum")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	s := &Storage{basePath: tempDir}
+
+	if _, err := s.Checksum("file"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("Checksum() error = %v, want %v", err, storage.ErrNotExist)
+	}
+	tests := []struct {
+		contents string
+		want     string
+	}{
+		{contents: "file-contents", want: "53a08cf9217fc1c69a90fd77c4d765db"},
+		{contents: "file-contents", want: "53a08cf9217fc1c69a90fd77c4d765db"},
+		// same size, the cached checksum must not be returned
+		{contents: "other-content", want: "327139ee83a97122fbf361f7a78fff6c"},
+	}
+	for _, tt := range tests {
+		if e := s.Upload("file", strings.NewReader(tt.contents)); e != nil {
+			t.Error(e)
+			return
+		}
+		got, err := s.Checksum("file")
+		if err != nil || got != tt.want {
+			t.Errorf("Checksum() = %s, %v for %s, want %s", got, err, tt.contents, tt.want)
+		}
+	}
+}
+
+func TestStorage_Exists(t *testing.T) {
+	type args struct {
+		filename string
+	}
+	tempDir := os.TempDir()
+	tests := []struct {
+		name    string
+		args    args
+		want    bool
+		wantErr bool
+		setup   func()
+		cleanup func()
+	}{
+		{
+			name:    "invalidFile",
+			args:    args{filename: "."},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name:    "missingFile",
+			args:    args{filename: "file.exists.missingFile.txt"},
+			want:    false,
+			wantErr: false,
+		},
+		{
+			name:    "validFile",
+			args:    args{filename: "file.exists.validFile.txt"},
+			want:    true,
+			wantErr: false,
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "file.exists.validFile.txt"), []byte("file-contents"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				_ = os.Remove(filepath.Join(tempDir, "file.exists.validFile.txt"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			s := &Storage{
+				basePath: tempDir,
+			}
+			got, err := s.Exists(tt.args.filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Exists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Exists() = %v, want %v", got, tt.want)
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	type args struct {
+		filename   string
+		contents   string
+		generation func(s *Storage) string
+	}
+	tempDir, e := ioutil.TempDir("", "cbfile-conditional")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	currentGeneration := func(filename string) func(s *Storage) string {
+		return func(s *Storage) string {
+			info, e := s.Stat(filename)
+			if e != nil {
+				t.Error(e)
+			}
+			return info.Generation
+		}
+	}
+	tests := []struct {
+		name                   string
+		args                   args
+		ctx                    func() (context.Context, context.CancelFunc)
+		wantContents           string
+		wantErr                bool
+		wantPreconditionFailed bool
+		setup                  func()
+	}{
+		{
+			name: "create",
+			args: args{
+				filename:   "conditional.create.txt",
+				contents:   "new",
+				generation: func(s *Storage) string { return "" },
+			},
+			wantContents: "new",
+		},
+		{
+			name: "createExisting",
+			args: args{
+				filename:   "conditional.createExisting.txt",
+				contents:   "new",
+				generation: func(s *Storage) string { return "" },
+			},
+			wantContents:           "old",
+			wantErr:                true,
+			wantPreconditionFailed: true,
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "conditional.createExisting.txt"), []byte("old"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+		},
+		{
+			name: "replace",
+			args: args{
+				filename:   "conditional.replace.txt",
+				contents:   "new",
+				generation: currentGeneration("conditional.replace.txt"),
+			},
+			wantContents: "new",
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "conditional.replace.txt"), []byte("old"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+		},
+		{
+			name: "staleGeneration",
+			args: args{
+				filename: "conditional.staleGeneration.txt",
+				contents: "new",
+				generation: func(s *Storage) string {
+					generation := currentGeneration("conditional.staleGeneration.txt")(s)
+					_, e := s.UploadIfGenerationMatch("conditional.staleGeneration.txt", bytes.NewReader([]byte("other")), generation)
+					if e != nil {
+						t.Error(e)
+					}
+					return generation
+				},
+			},
+			wantContents:           "other",
+			wantErr:                true,
+			wantPreconditionFailed: true,
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "conditional.staleGeneration.txt"), []byte("old"), os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+		},
+		{
+			name: "staleLock",
+			args: args{
+				filename:   "conditional.staleLock.txt",
+				contents:   "new",
+				generation: func(s *Storage) string { return "" },
+			},
+			wantContents: "new",
+			setup: func() {
+				lockPath := filepath.Join(tempDir, "conditional.staleLock.txt"+lockSuffix)
+				e := ioutil.WriteFile(lockPath, []byte{}, os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+				old := time.Now().Add(-time.Hour)
+				e = os.Chtimes(lockPath, old, old)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+		},
+		{
+			name: "heldLock",
+			args: args{
+				filename:   "conditional.heldLock.txt",
+				contents:   "new",
+				generation: func(s *Storage) string { return "" },
+			},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*50)
+			},
+			wantErr: true,
+			setup: func() {
+				e := ioutil.WriteFile(filepath.Join(tempDir, "conditional.heldLock.txt"+lockSuffix), []byte{}, os.ModePerm)
+				if e != nil {
+					t.Error(e)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			s := &Storage{
+				basePath: tempDir,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.ctx != nil {
+				ctx, cancel = tt.ctx()
+			}
+			defer cancel()
+			generation := tt.args.generation(s)
+			got, err := s.UploadIfGenerationMatchContext(ctx, tt.args.filename, bytes.NewReader([]byte(tt.args.contents)), generation)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UploadIfGenerationMatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, storage.ErrPreconditionFailed) != tt.wantPreconditionFailed {
+				t.Errorf("UploadIfGenerationMatch() error = %v, wantPreconditionFailed %v", err, tt.wantPreconditionFailed)
+			}
+			if err == nil {
+				if got == generation {
+					t.Errorf("UploadIfGenerationMatch() generation did not change from %s", generation)
+				}
+				if current := currentGeneration(tt.args.filename)(s); got != current {
+					t.Errorf("UploadIfGenerationMatch() = %s, want current generation %s", got, current)
+				}
+			}
+			if tt.wantContents != "" {
+				contents, e := ioutil.ReadFile(filepath.Join(tempDir, tt.args.filename))
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				if string(contents) != tt.wantContents {
+					t.Errorf("UploadIfGenerationMatch() contents = %s, want %s", string(contents), tt.wantContents)
+				}
+			}
+		})
+	}
+}
+
+func TestStorage_DownloadRange(t *testing.T) {
+	type args struct {
+		filename string
+		offset   int64
+		length   int64
+	}
+	tempDir := os.TempDir()
+	e := ioutil.WriteFile(filepath.Join(tempDir, "file.downloadRange.txt"), []byte("0123456789"), os.ModePerm)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.Remove(filepath.Join(tempDir, "file.downloadRange.txt"))
+	tests := []struct {
+		name       string
+		args       args
+		wantWriter string
+		wantErr    bool
+	}{
+		{
+			name:    "invalidFile",
+			args:    args{filename: ".", offset: 0, length: -1},
+			wantErr: true,
+		},
+		{
+			name:    "negativeOffset",
+			args:    args{filename: "file.downloadRange.txt", offset: -1, length: -1},
+			wantErr: true,
+		},
+		{
+			name:       "whole",
+			args:       args{filename: "file.downloadRange.txt", offset: 0, length: -1},
+			wantWriter: "0123456789",
+		},
+		{
+			name:       "tail",
+			args:       args{filename: "file.downloadRange.txt", offset: 6, length: -1},
+			wantWriter: "6789",
+		},
+		{
+			name:       "middle",
+			args:       args{filename: "file.downloadRange.txt", offset: 2, length: 3},
+			wantWriter: "234",
+		},
+		{
+			name:       "pastEnd",
+			args:       args{filename: "file.downloadRange.txt", offset: 20, length: -1},
+			wantWriter: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Storage{
+				basePath: tempDir,
+			}
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange(tt.args.filename, tt.args.offset, tt.args.length, writer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotWriter := writer.String(); gotWriter != tt.wantWriter {
+				t.Errorf("DownloadRange() gotWriter = %v, want %v", gotWriter, tt.wantWriter)
+			}
+		})
+	}
+}
+
+type failingReader struct {
+	reader io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, e := f.reader.Read(p)
+	if e == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, e
+}
+
+func TestStorage_UploadAtomic(t *testing.T) {
+	type args struct {
+		reader io.Reader
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantErr      bool
+		wantContents string
+	}{
+		{
+			name:         "complete",
+			args:         args{reader: bytes.NewReader([]byte("new-contents"))},
+			wantErr:      false,
+			wantContents: "new-contents",
+		},
+		{
+			name:         "failedPartWay",
+			args:         args{reader: &failingReader{reader: bytes.NewReader([]byte("partial"))}},
+			wantErr:      true,
+			wantContents: "old-contents",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir, e := ioutil.TempDir("", "cbfile-atomic")
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			defer os.RemoveAll(tempDir)
+			e = ioutil.WriteFile(filepath.Join(tempDir, "bucket"), []byte("old-contents"), os.ModePerm)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			s := &Storage{
+				basePath: tempDir,
+			}
+			if err := s.Upload("bucket", tt.args.reader); (err != nil) != tt.wantErr {
+				t.Errorf("Upload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			contents, e := ioutil.ReadFile(filepath.Join(tempDir, "bucket"))
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if string(contents) != tt.wantContents {
+				t.Errorf("Upload() contents = %s, want %s", string(contents), tt.wantContents)
+			}
+			files, e := ioutil.ReadDir(tempDir)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if len(files) != 1 {
+				t.Errorf("Upload() left %d files in the directory, want 1", len(files))
+			}
+		})
+	}
+}
+
+func TestStorage_ConcatIntoSource(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "cbfile-concat")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	e = ioutil.WriteFile(filepath.Join(tempDir, "bucket1"), []byte("bucket1"), os.ModePerm)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	e = ioutil.WriteFile(filepath.Join(tempDir, "bucket2"), []byte("bucket2"), os.ModePerm)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	s := &Storage{
+		basePath: tempDir,
+	}
+	e = s.Concat("bucket1", "bucket1", "bucket2")
+	if e != nil {
+		t.Errorf("Concat() error = %v", e)
+		return
+	}
+	contents, e := ioutil.ReadFile(filepath.Join(tempDir, "bucket1"))
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if string(contents) != "bucket1bucket2" {
+		t.Errorf("Concat() contents = %s, want %s", string(contents), "bucket1bucket2")
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cbfile-contract")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s, e := New(Config{BasePath: dir})
+	if e != nil {
+		t.Fatal(e)
+	}
+	storagetest.Contract(t, s)
+}
+
+func TestStorage_UploadIfGenerationMatchNested(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cbfile-nested")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s, e := New(Config{BasePath: dir})
+	if e != nil {
+		t.Fatal(e)
+	}
+	generation, e := s.UploadIfGenerationMatch("masters/00000000000000000001", bytes.NewReader([]byte("master")), "")
+	if e != nil || generation == "" {
+		t.Errorf("UploadIfGenerationMatch() = %s, error = %v", generation, e)
+	}
+}
+
+func TestStorage_takeOverStaleLock(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "cbfile-takeover")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	old := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		lock      *time.Time
+		token     *time.Time
+		want      bool
+		wantLock  bool
+		wantToken bool
+	}{
+		{
+			name: "staleLock",
+			lock: &old,
+			want: true,
+		},
+		{
+			name:     "freshLock",
+			lock:     timePointer(time.Now()),
+			wantLock: true,
+		},
+		{
+			name:      "takeoverInProgress",
+			lock:      &old,
+			token:     timePointer(time.Now()),
+			wantLock:  true,
+			wantToken: true,
+		},
+		{
+			name:     "staleToken",
+			lock:     &old,
+			token:    &old,
+			wantLock: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(tempDir, tt.name)
+			for path, modTime := range map[string]*time.Time{filePath + lockSuffix: tt.lock, filePath + takeoverInfix + lockSuffix: tt.token} {
+				if modTime == nil {
+					continue
+				}
+				if e := ioutil.WriteFile(path, []byte{}, os.ModePerm); e != nil {
+					t.Error(e)
+					return
+				}
+				if e := os.Chtimes(path, *modTime, *modTime); e != nil {
+					t.Error(e)
+					return
+				}
+			}
+
+			if got := takeOverStaleLock(filePath, time.Minute); got != tt.want {
+				t.Errorf("takeOverStaleLock() = %v, want %v", got, tt.want)
+			}
+			if _, e := os.Stat(filePath + lockSuffix); (e == nil) != tt.wantLock {
+				t.Errorf("takeOverStaleLock() lock exists = %v, want %v", e == nil, tt.wantLock)
+			}
+			if _, e := os.Stat(filePath + takeoverInfix + lockSuffix); (e == nil) != tt.wantToken {
+				t.Errorf("takeOverStaleLock() token exists = %v, want %v", e == nil, tt.wantToken)
+			}
+		})
+	}
+}
+
+func timePointer(t time.Time) *time.Time {
+	return &t
+}
+
+func TestStorage_WritesHoldLock(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(ctx context.Context, s *Storage) error
+	}{
+		{
+			name: "upload",
+			write: func(ctx context.Context, s *Storage) error {
+				return s.UploadContext(ctx, "file", bytes.NewReader([]byte("other")))
+			},
+		},
+		{
+			name: "concat",
+			write: func(ctx context.Context, s *Storage) error {
+				return s.ConcatContext(ctx, "file", "file", "file")
+			},
+		},
+		{
+			name: "delete",
+			write: func(ctx context.Context, s *Storage) error {
+				return s.DeleteContext(ctx, "file")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, e := ioutil.TempDir("", "cbfile-lock")
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer os.RemoveAll(dir)
+			s, e := New(Config{BasePath: dir})
+			if e != nil {
+				t.Fatal(e)
+			}
+			if e := s.Upload("file", bytes.NewReader([]byte("contents"))); e != nil {
+				t.Fatal(e)
+			}
+
+			// a conditional upload between checking the generation and writing
+			unlock, e := s.lock(context.Background(), filepath.Join(dir, "file"))
+			if e != nil {
+				t.Fatal(e)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			if err := tt.write(ctx, s); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("write error = %v while the file is locked, want %v", err, context.DeadlineExceeded)
+			}
+			if contents, e := ioutil.ReadFile(filepath.Join(dir, "file")); e != nil || string(contents) != "contents" {
+				t.Errorf("file = %s, %v while it is locked, want contents", contents, e)
+			}
+
+			unlock()
+			if err := tt.write(context.Background(), s); err != nil {
+				t.Errorf("write error = %v once the file is unlocked", err)
+			}
+		})
+	}
+}
+
+func TestStorage_UploadIfGenerationMatchStaleLockWaiters(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "cbfile-waiters")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	s, e := New(Config{BasePath: tempDir})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	lockPath := filepath.Join(tempDir, "master"+lockSuffix)
+	if e := ioutil.WriteFile(lockPath, []byte{}, os.ModePerm); e != nil {
+		t.Error(e)
+		return
+	}
+	old := time.Now().Add(-time.Hour)
+	if e := os.Chtimes(lockPath, old, old); e != nil {
+		t.Error(e)
+		return
+	}
+
+	// every waiter requires the object not to exist, so only one may write it
+	results := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			_, e := s.UploadIfGenerationMatch("master", strings.NewReader("contents"), "")
+			results <- e
+		}()
+	}
+	written := 0
+	for i := 0; i < 8; i++ {
+		e := <-results
+		if e == nil {
+			written++
+		} else if !errors.Is(e, storage.ErrPreconditionFailed) {
+			t.Errorf("UploadIfGenerationMatch() error = %v", e)
+		}
+	}
+	if written != 1 {
+		t.Errorf("UploadIfGenerationMatch() wrote %d times, want 1", written)
+	}
+}
@@ -0,0 +1,447 @@
+package cbgooglebucket
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/option"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeObject struct {
+	data       []byte
+	generation int64
+	updated    time.Time
+}
+
+type fakeUpload struct {
+	name  string
+	query url.Values
+	data  []byte
+}
+
+// fakeServer implements the parts of the GCS JSON and XML APIs used by Storage:
+// multipart and resumable uploads, reads with ranges, object metadata, listing,
+// compose, delete and the generation preconditions
+type fakeServer struct {
+	*httptest.Server
+	bucket string
+
+	lock           sync.Mutex
+	objects        map[string]*fakeObject
+	uploads        map[string]*fakeUpload
+	lastUploadId   int
+	lastGeneration int64
+	composeSources []int
+	// deletes wait for hangDeletes to be closed, or the request to be cancelled
+	hangDeletes chan struct{}
+}
+
+func newFakeServer(bucket string) *fakeServer {
+	f := &fakeServer{
+		bucket:  bucket,
+		objects: map[string]*fakeObject{},
+		uploads: map[string]*fakeUpload{},
+		// real generations are microsecond timestamps, starting there keeps
+		// small made up generations in tests from matching by accident
+		lastGeneration: time.Now().UnixNano() / int64(time.Microsecond),
+	}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeServer) config() Config {
+	return Config{
+		Bucket:        f.bucket,
+		Endpoint:      f.URL + "/storage/v1/",
+		ClientOptions: []option.ClientOption{option.WithHTTPClient(f.Client())},
+	}
+}
+
+func (f *fakeServer) storage(t *testing.T) *Storage {
+	s, e := New(f.config())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func (f *fakeServer) put(name string, data []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.store(name, data)
+}
+
+func (f *fakeServer) get(name string) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	object, ok := f.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return object.data, true
+}
+
+func (f *fakeServer) names() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var names []string
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (f *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete && f.hangDeletes != nil {
+		select {
+		case <-f.hangDeletes:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+
+	switch {
+	case len(parts) == 6 && parts[0] == "upload" && parts[4] == f.bucket && r.URL.Query().Get("upload_id") != "":
+		f.uploadChunk(w, r)
+	case len(parts) == 6 && parts[0] == "upload" && parts[4] == f.bucket && r.Method == http.MethodPost:
+		f.upload(w, r)
+	case len(parts) == 5 && parts[0] == "storage" && parts[3] == f.bucket && parts[4] == "o" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case len(parts) == 6 && parts[0] == "storage" && parts[3] == f.bucket && r.Method == http.MethodGet:
+		f.attrs(w, r, parts[5])
+	case len(parts) == 6 && parts[0] == "storage" && parts[3] == f.bucket && r.Method == http.MethodDelete:
+		f.delete(w, r, parts[5])
+	case len(parts) == 7 && parts[0] == "storage" && parts[3] == f.bucket && parts[6] == "compose":
+		f.compose(w, r, parts[5])
+	case len(parts) >= 2 && parts[0] == f.bucket && r.Method == http.MethodGet:
+		f.read(w, r, strings.Join(parts[1:], "/"))
+	default:
+		f.error(w, http.StatusBadRequest, "unsupported request: "+r.Method+" "+r.URL.String())
+	}
+}
+
+func (f *fakeServer) error(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+func (f *fakeServer) resource(name string, object *fakeObject) map[string]interface{} {
+	hash := md5.Sum(object.data)
+	return map[string]interface{}{
+		"kind":           "storage#object",
+		"name":           name,
+		"bucket":         f.bucket,
+		"size":           strconv.Itoa(len(object.data)),
+		"md5Hash":        base64.StdEncoding.EncodeToString(hash[:]),
+		"generation":     strconv.FormatInt(object.generation, 10),
+		"metageneration": "1",
+		"etag":           strconv.FormatInt(object.generation, 10),
+		"updated":        object.updated.Format(time.RFC3339Nano),
+	}
+}
+
+func (f *fakeServer) writeResource(w http.ResponseWriter, name string, object *fakeObject) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(f.resource(name, object))
+}
+
+// checkPreconditions applies the ifGenerationMatch and ifGenerationNotMatch
+// query parameters, where generation 0 stands for an object that does not exist
+func (f *fakeServer) checkPreconditions(w http.ResponseWriter, query url.Values, name string) bool {
+	generation := "0"
+	if object, ok := f.objects[name]; ok {
+		generation = strconv.FormatInt(object.generation, 10)
+	}
+	if match := query.Get("ifGenerationMatch"); match != "" && match != generation {
+		f.error(w, http.StatusPreconditionFailed, "Precondition Failed")
+		return false
+	}
+	if notMatch := query.Get("ifGenerationNotMatch"); notMatch != "" && notMatch == generation {
+		f.error(w, http.StatusPreconditionFailed, "Precondition Failed")
+		return false
+	}
+	return true
+}
+
+// lookup returns the object, or the requested generation of it if that is still the live one
+func (f *fakeServer) lookup(query url.Values, name string) (*fakeObject, bool) {
+	object, ok := f.objects[name]
+	if !ok {
+		return nil, false
+	}
+	if generation := query.Get("generation"); generation != "" && generation != strconv.FormatInt(object.generation, 10) {
+		return nil, false
+	}
+	return object, true
+}
+
+func (f *fakeServer) store(name string, data []byte) *fakeObject {
+	f.lastGeneration++
+	object := &fakeObject{data: data, generation: f.lastGeneration, updated: time.Now()}
+	f.objects[name] = object
+	return object
+}
+
+func (f *fakeServer) upload(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("uploadType") {
+	case "multipart":
+		f.uploadMultipart(w, r)
+	case "resumable":
+		f.uploadResumable(w, r)
+	default:
+		f.error(w, http.StatusBadRequest, "unsupported upload type")
+	}
+}
+
+func (f *fakeServer) uploadMultipart(w http.ResponseWriter, r *http.Request) {
+	_, params, e := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	metadataPart, e := reader.NextPart()
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	metadata := struct {
+		Name string `json:"name"`
+	}{}
+	e = json.NewDecoder(metadataPart).Decode(&metadata)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	mediaPart, e := reader.NextPart()
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	data, e := ioutil.ReadAll(mediaPart)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	if !f.checkPreconditions(w, r.URL.Query(), metadata.Name) {
+		return
+	}
+	f.writeResource(w, metadata.Name, f.store(metadata.Name, data))
+}
+
+// uploadResumable starts a resumable upload session, the preconditions are
+// checked once the last chunk arrives
+func (f *fakeServer) uploadResumable(w http.ResponseWriter, r *http.Request) {
+	metadata := struct {
+		Name string `json:"name"`
+	}{}
+	e := json.NewDecoder(r.Body).Decode(&metadata)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	f.lastUploadId++
+	uploadId := strconv.Itoa(f.lastUploadId)
+	f.uploads[uploadId] = &fakeUpload{name: metadata.Name, query: r.URL.Query()}
+
+	location := *r.URL
+	query := url.Values{"uploadType": {"resumable"}, "upload_id": {uploadId}}
+	location.RawQuery = query.Encode()
+	w.Header().Set("Location", f.URL+location.RequestURI())
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadChunk appends a chunk to a resumable upload. Content-Range is
+// "bytes first-last/*" for intermediate chunks and "bytes first-last/total" or
+// "bytes */total" for the final one
+func (f *fakeServer) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	upload, ok := f.uploads[r.URL.Query().Get("upload_id")]
+	if !ok {
+		f.error(w, http.StatusNotFound, "No such upload")
+		return
+	}
+	data, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	contentRange := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	slash := strings.LastIndex(contentRange, "/")
+	if slash < 0 {
+		f.error(w, http.StatusBadRequest, "invalid Content-Range: "+contentRange)
+		return
+	}
+	if span := contentRange[:slash]; span != "*" {
+		first, e := strconv.Atoi(strings.SplitN(span, "-", 2)[0])
+		if e != nil || first != len(upload.data) {
+			f.error(w, http.StatusBadRequest, "unexpected chunk offset: "+contentRange)
+			return
+		}
+	}
+	upload.data = append(upload.data, data...)
+
+	if contentRange[slash+1:] == "*" {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		// the go client expects the 308 to be rewritten, as a real 308 would be followed as a redirect
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	total, e := strconv.Atoi(contentRange[slash+1:])
+	if e != nil || total != len(upload.data) {
+		f.error(w, http.StatusBadRequest, "unexpected upload size: "+contentRange)
+		return
+	}
+	delete(f.uploads, r.URL.Query().Get("upload_id"))
+	if !f.checkPreconditions(w, upload.query, upload.name) {
+		return
+	}
+	f.writeResource(w, upload.name, f.store(upload.name, upload.data))
+}
+
+func (f *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) && name >= query.Get("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	response := map[string]interface{}{"kind": "storage#objects"}
+	if maxResults, e := strconv.Atoi(query.Get("maxResults")); e == nil && maxResults > 0 && len(names) > maxResults {
+		response["nextPageToken"] = names[maxResults]
+		names = names[:maxResults]
+	}
+	var items []map[string]interface{}
+	for _, name := range names {
+		items = append(items, f.resource(name, f.objects[name]))
+	}
+	if len(items) > 0 {
+		response["items"] = items
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func (f *fakeServer) attrs(w http.ResponseWriter, r *http.Request, name string) {
+	object, ok := f.lookup(r.URL.Query(), name)
+	if !ok {
+		f.error(w, http.StatusNotFound, "No such object: "+name)
+		return
+	}
+	f.writeResource(w, name, object)
+}
+
+func (f *fakeServer) delete(w http.ResponseWriter, r *http.Request, name string) {
+	if _, ok := f.lookup(r.URL.Query(), name); !ok {
+		f.error(w, http.StatusNotFound, "No such object: "+name)
+		return
+	}
+	if !f.checkPreconditions(w, r.URL.Query(), name) {
+		return
+	}
+	delete(f.objects, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeServer) compose(w http.ResponseWriter, r *http.Request, name string) {
+	request := struct {
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}{}
+	e := json.NewDecoder(r.Body).Decode(&request)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	f.composeSources = append(f.composeSources, len(request.SourceObjects))
+	if len(request.SourceObjects) > maxComposeSources {
+		f.error(w, http.StatusBadRequest, "The number of source components provided exceeds the maximum")
+		return
+	}
+	var data []byte
+	for _, source := range request.SourceObjects {
+		object, ok := f.objects[source.Name]
+		if !ok {
+			f.error(w, http.StatusNotFound, "Object "+source.Name+" not found")
+			return
+		}
+		data = append(data, object.data...)
+	}
+	if !f.checkPreconditions(w, r.URL.Query(), name) {
+		return
+	}
+	f.writeResource(w, name, f.store(name, data))
+}
+
+func (f *fakeServer) read(w http.ResponseWriter, r *http.Request, name string) {
+	object, ok := f.lookup(r.URL.Query(), name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	w.Header().Set("Last-Modified", object.updated.UTC().Format(http.TimeFormat))
+
+	size := int64(len(object.data))
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, _ = w.Write(object.data)
+		return
+	}
+
+	start, end := int64(0), size-1
+	bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+	start, e := strconv.ParseInt(bounds[0], 10, 64)
+	if e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(bounds) == 2 && bounds[1] != "" {
+		end, e = strconv.ParseInt(bounds[1], 10, 64)
+		if e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start >= size {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(object.data[start : end+1])
+}
@@ -3,35 +3,84 @@ package cbgooglebucket
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"io"
+	"net/http"
+	"strconv"
+	"time"
 )
 
+// GCS rejects compose requests with more sources than this
+const maxComposeSources = 32
+
+var defaultCleanupTimeout = time.Minute
+
 type Storage struct {
-	client *storage.Client
-	bucket string
+	client         *storage.Client
+	bucket         string
+	cleanupTimeout time.Duration
+	errorHandler   cbtransaction.ErrorHandler
 }
 
 type Config struct {
 	Bucket          string
 	CredentialsJson []byte
+	// Endpoint overrides the JSON API base path, e.g. https://localhost:4443/storage/v1/
+	// for an emulator, downloads are sent to the same host. Without
+	// CredentialsJson or ClientOptions the requests are not authenticated
+	Endpoint string
+	// ClientOptions are passed to storage.NewClient after the options built from
+	// the fields above, e.g. option.WithHTTPClient
+	ClientOptions []option.ClientOption
+	// CleanupTimeout bounds deleting the intermediate objects of a Concat,
+	// which runs after its context may have been cancelled, defaults to a minute
+	CleanupTimeout time.Duration
+	// ErrorHandler receives the errors of deleting intermediate objects
+	ErrorHandler cbtransaction.ErrorHandler
 }
 
 func New(config Config) (*Storage, error) {
 	if config.Bucket == "" {
 		return nil, errors.New("invalid bucket name")
 	}
-	if len(config.CredentialsJson) == 0 {
+	if len(config.CredentialsJson) == 0 && config.Endpoint == "" && len(config.ClientOptions) == 0 {
 		return nil, errors.New("empty credentials json")
 	}
-	client, e := storage.NewClient(context.Background(), option.WithCredentialsJSON(config.CredentialsJson))
+	if config.CleanupTimeout <= 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = cbtransaction.DefaultErrorHandler{}
+	}
+	var options []option.ClientOption
+	if len(config.CredentialsJson) > 0 {
+		options = append(options, option.WithCredentialsJSON(config.CredentialsJson))
+	}
+	if config.Endpoint != "" {
+		options = append(options, option.WithEndpoint(config.Endpoint))
+		if len(config.CredentialsJson) == 0 && len(config.ClientOptions) == 0 {
+			options = append(options, option.WithoutAuthentication())
+		}
+	}
+	options = append(options, config.ClientOptions...)
+	client, e := storage.NewClient(context.Background(), options...)
 	if e != nil {
 		return nil, e
 	}
 
-	return &Storage{bucket: config.Bucket, client: client}, nil
+	return &Storage{
+		bucket:         config.Bucket,
+		client:         client,
+		cleanupTimeout: config.CleanupTimeout,
+		errorHandler:   config.ErrorHandler,
+	}, nil
 }
 
 func (s *Storage) checkFilename(filename string) error {
@@ -43,72 +92,269 @@ func (s *Storage) checkFilename(filename string) error {
 }
 
 func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
 	if e := s.checkFilename(filename); e != nil {
 		return e
 	}
 	object := s.client.Bucket(s.bucket).Object(filename)
 
-	ctx := context.Background()
+	_, e := s.upload(ctx, object, reader)
+
+	return e
+}
+
+func (s *Storage) upload(ctx context.Context, object *storage.ObjectHandle, reader io.Reader) (*storage.ObjectAttrs, error) {
+	// cancelling the writer's context is the only way to abort a partial upload
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	writer := object.NewWriter(ctx)
 
 	_, e := io.Copy(writer, reader)
 	if e != nil {
-		return e
+		return nil, e
 	}
 
 	if e := writer.Close(); e != nil {
-		return e
+		return nil, e
 	}
 
-	return nil
+	return writer.Attrs(), nil
 }
 
 func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
 	if e := s.checkFilename(filename); e != nil {
 		return e
 	}
 
 	object := s.client.Bucket(s.bucket).Object(filename)
 
-	ctx := context.Background()
 	reader, e := object.NewReader(ctx)
 	if e != nil {
-		return e
+		return notExist(e, filename)
 	}
+	defer reader.Close()
 
 	_, e = io.Copy(writer, reader)
 	if e != nil {
 		return e
 	}
 
-	if e := reader.Close(); e != nil {
+	return nil
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
 		return e
 	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
 
-	return nil
+	object := s.client.Bucket(s.bucket).Object(filename)
+
+	reader, e := object.NewRangeReader(ctx, offset, length)
+	if e != nil {
+		return notExist(e, filename)
+	}
+	defer reader.Close()
+
+	_, e = io.Copy(writer, reader)
+
+	return e
 }
 
 func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
 	if e := s.checkFilename(destination); e != nil {
 		return e
 	}
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+	for _, filename := range filenames {
+		if e := s.checkFilename(filename); e != nil {
+			return e
+		}
+	}
+
+	// compose in rounds of at most maxComposeSources objects, each round
+	// combining consecutive sources into intermediate objects so order is kept
+	var intermediates []string
+	defer func() {
+		// clean up even if ctx has been cancelled, but not for longer than cleanupTimeout
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), s.cleanupTimeout)
+		defer cancel()
+		for _, intermediate := range intermediates {
+			e := s.client.Bucket(s.bucket).Object(intermediate).Delete(cleanupCtx)
+			if e != nil {
+				s.errorHandler.Error(fmt.Errorf("deleting intermediate object %s: %w", intermediate, e))
+			}
+		}
+	}()
+	prefix := destination + ".cbcompose-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	sources := filenames
+	for round := 0; len(sources) > maxComposeSources; round++ {
+		var next []string
+		for start := 0; start < len(sources); start += maxComposeSources {
+			end := start + maxComposeSources
+			if end > len(sources) {
+				end = len(sources)
+			}
+			if end-start == 1 {
+				next = append(next, sources[start])
+				continue
+			}
+			intermediate := fmt.Sprintf("%s-%d-%d", prefix, round, start)
+			if e := s.compose(ctx, intermediate, sources[start:end]); e != nil {
+				return e
+			}
+			intermediates = append(intermediates, intermediate)
+			next = append(next, intermediate)
+		}
+		sources = next
+	}
 
-	dst := s.client.Bucket(s.bucket).Object(destination)
+	return s.compose(ctx, destination, sources)
+}
 
+func (s *Storage) compose(ctx context.Context, destination string, filenames []string) error {
 	var objects []*storage.ObjectHandle
 	for _, filename := range filenames {
 		objects = append(objects, s.client.Bucket(s.bucket).Object(filename))
 	}
 
-	_, e := dst.ComposerFrom(objects...).Run(context.Background())
+	_, e := s.client.Bucket(s.bucket).Object(destination).ComposerFrom(objects...).Run(ctx)
+	var apiError *googleapi.Error
+	if errors.As(e, &apiError) && apiError.Code == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, apiError.Message)
+	}
 
 	return e
 }
 
 func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
 	if e := s.checkFilename(filename); e != nil {
 		return e
 	}
 	object := s.client.Bucket(s.bucket).Object(filename)
-	return object.Delete(context.Background())
+	return notExist(object.Delete(ctx), filename)
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	var objects []cbstorage.ObjectInfo
+	it := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, e := it.Next()
+		if e == iterator.Done {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		objects = append(objects, s.objectInfo(attrs))
+	}
+
+	return objects, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	attrs, e := s.client.Bucket(s.bucket).Object(filename).Attrs(ctx)
+	if e != nil {
+		return cbstorage.ObjectInfo{}, notExist(e, filename)
+	}
+
+	return s.objectInfo(attrs), nil
+}
+
+// notExist wraps storage.ErrObjectNotExist in cbstorage.ErrNotExist
+func notExist(e error, filename string) error {
+	if errors.Is(e, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+	return e
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	conditions := storage.Conditions{DoesNotExist: true}
+	if generation != "" {
+		generationNumber, e := strconv.ParseInt(generation, 10, 64)
+		if e != nil || generationNumber <= 0 {
+			return "", fmt.Errorf("invalid generation: %s", generation)
+		}
+		conditions = storage.Conditions{GenerationMatch: generationNumber}
+	}
+	object := s.client.Bucket(s.bucket).Object(filename).If(conditions)
+
+	attrs, e := s.upload(ctx, object, reader)
+	if e != nil {
+		var apiError *googleapi.Error
+		if errors.As(e, &apiError) && apiError.Code == http.StatusPreconditionFailed {
+			return "", fmt.Errorf("%w: %s does not have generation %s", cbstorage.ErrPreconditionFailed, filename, generation)
+		}
+		return "", e
+	}
+
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+func (s *Storage) objectInfo(attrs *storage.ObjectAttrs) cbstorage.ObjectInfo {
+	return cbstorage.ObjectInfo{
+		Name:       attrs.Name,
+		Size:       attrs.Size,
+		ModTime:    attrs.Updated,
+		Checksum:   hex.EncodeToString(attrs.MD5),
+		ETag:       attrs.Etag,
+		Generation: strconv.FormatInt(attrs.Generation, 10),
+	}
 }
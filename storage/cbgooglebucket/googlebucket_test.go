@@ -2,17 +2,38 @@ package cbgooglebucket
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
 	"io"
 	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var bucket = flag.String("bucket", "", "bucket name")
 var credentialsJsonPath = flag.String("credentialsJsonPath", "", "path to google json credentials for the bucket")
 
+var emulatorOnce sync.Once
+var emulator *fakeServer
+
+// getStorage returns a Storage for the bucket given by the flags, or one backed
+// by an in-process fake GCS server when no bucket is given, so the tests can
+// run without credentials: -bucket=mybucket -credentialsJsonPath=../../../creds.json
 func getStorage() (*Storage, error) {
+	if *bucket == "" && *credentialsJsonPath == "" {
+		emulatorOnce.Do(func() {
+			emulator = newFakeServer("cbtransaction-emulator")
+		})
+		return New(emulator.config())
+	}
 	if *bucket == "" || *credentialsJsonPath == "" {
 		return nil, errors.New("please provide a bucket and the path to the json credentials: -bucket=mybucket -credentialsJsonPath=../../../creds.json")
 	}
@@ -373,3 +394,722 @@ func TestStorage_Concat(t *testing.T) {
 		})
 	}
 }
+
+func TestStorage_List(t *testing.T) {
+	type args struct {
+		prefix string
+	}
+	tests := []struct {
+		name      string
+		args      args
+		wantNames []string
+		wantErr   bool
+		setup     func()
+		cleanup   func()
+	}{
+		{
+			name:      "emptyPrefix",
+			args:      args{prefix: "cbtransaction-test/list.emptyPrefix/"},
+			wantNames: nil,
+			wantErr:   false,
+		},
+		{
+			name:      "validFiles",
+			args:      args{prefix: "cbtransaction-test/list.validFiles/bucket"},
+			wantNames: []string{"cbtransaction-test/list.validFiles/bucket1.txt", "cbtransaction-test/list.validFiles/bucket2.txt"},
+			wantErr:   false,
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				for _, filename := range []string{
+					"cbtransaction-test/list.validFiles/bucket1.txt",
+					"cbtransaction-test/list.validFiles/bucket2.txt",
+					"cbtransaction-test/list.validFiles/master",
+				} {
+					e = s.Upload(filename, bytes.NewReader([]byte("content")))
+					if e != nil {
+						t.Error(e)
+					}
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/list.validFiles/bucket1.txt")
+				_ = s.Delete("cbtransaction-test/list.validFiles/bucket2.txt")
+				_ = s.Delete("cbtransaction-test/list.validFiles/master")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := getStorage()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if tt.setup != nil {
+				tt.setup()
+			}
+			got, err := s.List(tt.args.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("List() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var gotNames []string
+			for _, object := range got {
+				gotNames = append(gotNames, object.Name)
+			}
+			if !reflect.DeepEqual(gotNames, tt.wantNames) {
+				t.Errorf("List() names = %v, want %v", gotNames, tt.wantNames)
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_Stat(t *testing.T) {
+	type args struct {
+		filename string
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantSize     int64
+		wantChecksum string
+		wantErr      bool
+		wantNotExist bool
+		setup        func()
+		cleanup      func()
+	}{
+		{
+			name:    "invalidFilename",
+			args:    args{filename: "."},
+			wantErr: true,
+		},
+		{
+			name:         "nonExistentFile",
+			args:         args{filename: "asdfasdfilhbwrgilsdfviefv.txt"},
+			wantErr:      true,
+			wantNotExist: true,
+		},
+		{
+			name:         "validFile",
+			args:         args{filename: "cbtransaction-test/stat.validFile.txt"},
+			wantSize:     7,
+			wantChecksum: "9a0364b9e99bb480dd25e1f0284c8555",
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/stat.validFile.txt", bytes.NewReader([]byte("content")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/stat.validFile.txt")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := getStorage()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if tt.setup != nil {
+				tt.setup()
+			}
+			got, err := s.Stat(tt.args.filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Stat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, cbstorage.ErrNotExist) != tt.wantNotExist {
+				t.Errorf("Stat() error = %v, wantNotExist %v", err, tt.wantNotExist)
+			}
+			if err == nil {
+				if got.Size != tt.wantSize {
+					t.Errorf("Stat() Size = %d, want %d", got.Size, tt.wantSize)
+				}
+				if got.Checksum != tt.wantChecksum {
+					t.Errorf("Stat() Checksum = %s, want %s", got.Checksum, tt.wantChecksum)
+				}
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_Exists(t *testing.T) {
+	type args struct {
+		filename string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    bool
+		wantErr bool
+		setup   func()
+		cleanup func()
+	}{
+		{
+			name:    "invalidFilename",
+			args:    args{filename: "."},
+			want:    false,
+			wantErr: true,
+		},
+		{
+			name:    "nonExistentFile",
+			args:    args{filename: "asdfasdfilhbwrgilsdfviefv.txt"},
+			want:    false,
+			wantErr: false,
+		},
+		{
+			name:    "validFile",
+			args:    args{filename: "cbtransaction-test/exists.validFile.txt"},
+			want:    true,
+			wantErr: false,
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/exists.validFile.txt", bytes.NewReader([]byte("content")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/exists.validFile.txt")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := getStorage()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if tt.setup != nil {
+				tt.setup()
+			}
+			got, err := s.Exists(tt.args.filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Exists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Exists() = %v, want %v", got, tt.want)
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	type args struct {
+		filename   string
+		generation func() string
+	}
+	tests := []struct {
+		name                   string
+		args                   args
+		wantErr                bool
+		wantPreconditionFailed bool
+		setup                  func()
+		cleanup                func()
+	}{
+		{
+			name:    "invalidGeneration",
+			args:    args{filename: "cbtransaction-test/conditional.invalidGeneration.txt", generation: func() string { return "abc" }},
+			wantErr: true,
+		},
+		{
+			name:    "create",
+			args:    args{filename: "cbtransaction-test/conditional.create.txt", generation: func() string { return "" }},
+			wantErr: false,
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/conditional.create.txt")
+			},
+		},
+		{
+			name:                   "createExisting",
+			args:                   args{filename: "cbtransaction-test/conditional.createExisting.txt", generation: func() string { return "" }},
+			wantErr:                true,
+			wantPreconditionFailed: true,
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/conditional.createExisting.txt", bytes.NewReader([]byte("content")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/conditional.createExisting.txt")
+			},
+		},
+		{
+			name: "replace",
+			args: args{filename: "cbtransaction-test/conditional.replace.txt", generation: func() string {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return ""
+				}
+				info, e := s.Stat("cbtransaction-test/conditional.replace.txt")
+				if e != nil {
+					t.Error(e)
+				}
+				return info.Generation
+			}},
+			wantErr: false,
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/conditional.replace.txt", bytes.NewReader([]byte("content")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/conditional.replace.txt")
+			},
+		},
+		{
+			name:                   "staleGeneration",
+			args:                   args{filename: "cbtransaction-test/conditional.staleGeneration.txt", generation: func() string { return "1" }},
+			wantErr:                true,
+			wantPreconditionFailed: true,
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/conditional.staleGeneration.txt", bytes.NewReader([]byte("content")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/conditional.staleGeneration.txt")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := getStorage()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if tt.setup != nil {
+				tt.setup()
+			}
+			generation := tt.args.generation()
+			got, err := s.UploadIfGenerationMatch(tt.args.filename, bytes.NewReader([]byte("new-content")), generation)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UploadIfGenerationMatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, cbstorage.ErrPreconditionFailed) != tt.wantPreconditionFailed {
+				t.Errorf("UploadIfGenerationMatch() error = %v, wantPreconditionFailed %v", err, tt.wantPreconditionFailed)
+			}
+			if err == nil && (got == "" || got == generation) {
+				t.Errorf("UploadIfGenerationMatch() = %s, want a new generation", got)
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_DownloadRange(t *testing.T) {
+	type args struct {
+		filename string
+		offset   int64
+		length   int64
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantWriter string
+		wantErr    bool
+		setup      func()
+		cleanup    func()
+	}{
+		{
+			name:    "invalidFilename",
+			args:    args{filename: ".", offset: 0, length: -1},
+			wantErr: true,
+		},
+		{
+			name:    "nonExistentFile",
+			args:    args{filename: "asdfasdfilhbwrgilsdfviefv.txt", offset: 0, length: -1},
+			wantErr: true,
+		},
+		{
+			name:       "tail",
+			args:       args{filename: "cbtransaction-test/downloadRange.tail.txt", offset: 6, length: -1},
+			wantWriter: "6789",
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/downloadRange.tail.txt", bytes.NewReader([]byte("0123456789")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/downloadRange.tail.txt")
+			},
+		},
+		{
+			name:       "middle",
+			args:       args{filename: "cbtransaction-test/downloadRange.middle.txt", offset: 2, length: 3},
+			wantWriter: "234",
+			setup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				e = s.Upload("cbtransaction-test/downloadRange.middle.txt", bytes.NewReader([]byte("0123456789")))
+				if e != nil {
+					t.Error(e)
+				}
+			},
+			cleanup: func() {
+				s, e := getStorage()
+				if e != nil {
+					t.Error(e)
+					return
+				}
+				_ = s.Delete("cbtransaction-test/downloadRange.middle.txt")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := getStorage()
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if tt.setup != nil {
+				tt.setup()
+			}
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange(tt.args.filename, tt.args.offset, tt.args.length, writer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotWriter := writer.String(); gotWriter != tt.wantWriter {
+				t.Errorf("DownloadRange() gotWriter = %v, want %v", gotWriter, tt.wantWriter)
+			}
+			if tt.cleanup != nil {
+				tt.cleanup()
+			}
+		})
+	}
+}
+
+func TestStorage_ConcatComposeLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		sources      int
+		missing      int
+		wantErr      bool
+		wantComposes int
+	}{
+		{
+			name:         "singleSource",
+			sources:      1,
+			wantComposes: 1,
+		},
+		{
+			name:         "atLimit",
+			sources:      32,
+			wantComposes: 1,
+		},
+		{
+			name:         "overLimit",
+			sources:      33,
+			wantComposes: 2,
+		},
+		{
+			name:         "twoRounds",
+			sources:      1100,
+			wantComposes: 35 + 2 + 1,
+		},
+		{
+			name:         "missingSource",
+			sources:      70,
+			missing:      40,
+			wantErr:      true,
+			wantComposes: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeServer("bucket")
+			defer fake.Close()
+			s := fake.storage(t)
+
+			var filenames []string
+			var want []byte
+			for i := 0; i < tt.sources; i++ {
+				filename := fmt.Sprintf("source-%04d", i)
+				filenames = append(filenames, filename)
+				if tt.missing != 0 && i == tt.missing {
+					continue
+				}
+				fake.put(filename, []byte(strconv.Itoa(i)+","))
+				want = append(want, []byte(strconv.Itoa(i)+",")...)
+			}
+
+			err := s.Concat("destination", filenames...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Concat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(fake.composeSources) != tt.wantComposes {
+				t.Errorf("Concat() compose requests = %d, want %d", len(fake.composeSources), tt.wantComposes)
+			}
+			for _, sources := range fake.composeSources {
+				if sources > maxComposeSources {
+					t.Errorf("Concat() composed %d sources, want at most %d", sources, maxComposeSources)
+				}
+			}
+			if !tt.wantErr {
+				got, _ := fake.get("destination")
+				if !bytes.Equal(got, want) {
+					t.Errorf("Concat() destination = %s, want %s", string(got), string(want))
+				}
+			}
+			for _, name := range fake.names() {
+				if strings.Contains(name, ".cbcompose-") {
+					t.Errorf("Concat() left intermediate object %s behind", name)
+				}
+			}
+		})
+	}
+}
+
+type recordingErrorHandler struct {
+	lock   sync.Mutex
+	errors []error
+}
+
+func (r *recordingErrorHandler) Error(e error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.errors = append(r.errors, e)
+}
+
+func (r *recordingErrorHandler) Recover() {}
+
+func TestStorage_ConcatCleanupTimeout(t *testing.T) {
+	fake := newFakeServer("bucket")
+	defer fake.Close()
+	fake.hangDeletes = make(chan struct{})
+	defer close(fake.hangDeletes)
+	handler := &recordingErrorHandler{}
+	config := fake.config()
+	config.CleanupTimeout = time.Millisecond * 100
+	config.ErrorHandler = handler
+	s, e := New(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var filenames []string
+	for i := 0; i < maxComposeSources+1; i++ {
+		filename := fmt.Sprintf("source-%04d", i)
+		filenames = append(filenames, filename)
+		fake.put(filename, []byte(strconv.Itoa(i)+","))
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ConcatContext(context.Background(), "destination", filenames...)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ConcatContext() error = %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("ConcatContext() did not return while deleting intermediate objects hangs")
+	}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if len(handler.errors) != 1 {
+		t.Errorf("errors handled = %v, want the failed delete of the intermediate object", handler.errors)
+	}
+}
+
+func TestStorage_ConcatInvalidSource(t *testing.T) {
+	fake := newFakeServer("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+
+	tests := []struct {
+		name      string
+		filenames []string
+	}{
+		{
+			name:      "noSources",
+			filenames: []string{},
+		},
+		{
+			name:      "emptySource",
+			filenames: []string{"source1", ""},
+		},
+		{
+			name:      "dotSource",
+			filenames: []string{".", "source2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Concat("destination", tt.filenames...); err == nil {
+				t.Error("Concat() error = nil, want an error")
+			}
+			if len(fake.composeSources) != 0 {
+				t.Errorf("Concat() sent %d compose requests, want 0", len(fake.composeSources))
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "noBucket",
+			config:  Config{Endpoint: "https://localhost/storage/v1/"},
+			wantErr: true,
+		},
+		{
+			name:    "noCredentials",
+			config:  Config{Bucket: "bucket"},
+			wantErr: true,
+		},
+		{
+			name:    "endpoint",
+			config:  Config{Bucket: "bucket", Endpoint: "https://localhost/storage/v1/"},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_UploadResumable(t *testing.T) {
+	fake := newFakeServer("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+
+	// larger than the writer's 16MB chunk size so the upload is split into chunks
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024+1)
+
+	generation, err := s.UploadIfGenerationMatch("resumable", bytes.NewReader(contents), "")
+	if err != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", err)
+		return
+	}
+	got, _ := fake.get("resumable")
+	if !bytes.Equal(got, contents) {
+		t.Errorf("UploadIfGenerationMatch() stored %d bytes, want %d", len(got), len(contents))
+	}
+
+	_, err = s.UploadIfGenerationMatch("resumable", bytes.NewReader(contents), "")
+	if !errors.Is(err, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v, want %v", err, cbstorage.ErrPreconditionFailed)
+	}
+
+	info, err := s.Stat("resumable")
+	if err != nil {
+		t.Errorf("Stat() error = %v", err)
+		return
+	}
+	if info.Generation != generation || info.Size != int64(len(contents)) {
+		t.Errorf("Stat() = %+v, want generation %s and size %d", info, generation, len(contents))
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	fake := newFakeServer("bucket")
+	defer fake.Close()
+	storagetest.Contract(t, fake.storage(t))
+}
@@ -0,0 +1,115 @@
+package cbhttp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeObject struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+// fakeServer serves objects like a static file server or CDN, with failures
+// that can be injected into the next requests
+type fakeServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	objects  map[string]*fakeObject
+	requests []*http.Request
+	// failures is the number of following requests answered with a 503
+	failures int
+	// truncations is the number of following GETs whose body is cut in half
+	truncations int
+	// ignoreRange makes the server answer every GET with the whole object
+	ignoreRange bool
+	lastETag    int
+}
+
+func newFakeServer() *fakeServer {
+	f := &fakeServer{objects: map[string]*fakeObject{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeServer) config() Config {
+	return Config{
+		BaseURL:    f.URL + "/static",
+		RetryDelay: time.Millisecond,
+		HTTPClient: f.Client(),
+	}
+}
+
+func getStorage(t *testing.T, config Config) *Storage {
+	s, e := New(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func (f *fakeServer) put(name string, data string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lastETag++
+	f.objects[name] = &fakeObject{
+		data:    []byte(data),
+		etag:    `"` + strconv.Itoa(f.lastETag) + `"`,
+		modTime: time.Now().Add(time.Duration(f.lastETag) * time.Second).UTC().Truncate(time.Second),
+	}
+}
+
+func (f *fakeServer) requestCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.requests)
+}
+
+func (f *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.requests = append(f.requests, r)
+	object, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/static/")]
+	failure := f.failures > 0
+	if failure {
+		f.failures--
+	}
+	truncate := !failure && ok && r.Method == http.MethodGet && f.truncations > 0
+	if truncate {
+		f.truncations--
+	}
+	ignoreRange := f.ignoreRange
+	f.lock.Unlock()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if failure {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", object.etag)
+	if truncate {
+		// promise the whole object but stop half way, the client sees an unexpected EOF
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(object.data[:len(object.data)/2])
+		return
+	}
+	if ignoreRange {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "", object.modTime, bytes.NewReader(object.data))
+}
@@ -0,0 +1,521 @@
+package cbhttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultRetryDelay  = time.Millisecond * 200
+)
+
+// ErrReadOnly is returned by every method that would modify the storage
+var ErrReadOnly = errors.New("read only storage")
+
+// errNotModified is returned by download when the conditional headers matched
+var errNotModified = errors.New("not modified")
+
+// StatusError is an unexpected HTTP response status
+type StatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.URL, e.StatusCode)
+}
+
+// Temporary reports whether the request may succeed when retried
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// Storage reads objects from any HTTP server or CDN, objects are addressed by
+// appending their name to the base URL. Failed requests are retried with
+// exponential backoff and interrupted downloads resume with a range request
+type Storage struct {
+	client      *http.Client
+	baseURL     *url.URL
+	header      http.Header
+	maxAttempts int
+	retryDelay  time.Duration
+	cacheDir    string
+}
+
+type Config struct {
+	// BaseURL is the URL objects are relative to, its query string is kept,
+	// e.g. for signed CDN URLs
+	BaseURL string
+	// Header is sent with every request, e.g. an Authorization header
+	Header http.Header
+	// MaxAttempts is the number of attempts made for each request, defaults to 3
+	MaxAttempts int
+	// RetryDelay is the wait before the first retry, doubled for every further
+	// retry. Defaults to 200ms
+	RetryDelay time.Duration
+	// CacheDir enables conditional GETs: whole object downloads are kept in
+	// this directory and only downloaded again when their ETag or
+	// Last-Modified changed
+	CacheDir   string
+	HTTPClient *http.Client
+}
+
+func New(config Config) (*Storage, error) {
+	baseURL, e := url.Parse(config.BaseURL)
+	if e != nil {
+		return nil, e
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" || baseURL.Host == "" {
+		return nil, fmt.Errorf("invalid base url: %s", config.BaseURL)
+	}
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/")
+	baseURL.RawPath = ""
+	if config.MaxAttempts < 0 || config.RetryDelay < 0 {
+		return nil, fmt.Errorf("invalid retry configuration: %d attempts, %s delay", config.MaxAttempts, config.RetryDelay)
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.RetryDelay == 0 {
+		config.RetryDelay = defaultRetryDelay
+	}
+	if config.CacheDir != "" {
+		if e := os.MkdirAll(config.CacheDir, os.ModePerm); e != nil {
+			return nil, e
+		}
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	return &Storage{
+		client:      config.HTTPClient,
+		baseURL:     baseURL,
+		header:      config.Header,
+		maxAttempts: config.MaxAttempts,
+		retryDelay:  config.RetryDelay,
+		cacheDir:    config.CacheDir,
+	}, nil
+}
+
+func (s *Storage) checkFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." {
+		return fmt.Errorf("invalid filename: %s", filename)
+	}
+
+	return nil
+}
+
+func (s *Storage) url(filename string) string {
+	u := *s.baseURL
+	u.Path += "/" + filename
+	var segments []string
+	for _, segment := range strings.Split(filename, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	u.RawPath = s.baseURL.EscapedPath() + "/" + strings.Join(segments, "/")
+
+	return u.String()
+}
+
+// do sends a single request and returns the response for success, 304 and
+// 416 statuses, the caller must close its body. A 404 is returned as
+// storage.ErrNotExist and other statuses as a *StatusError
+func (s *Storage) do(ctx context.Context, method string, filename string, header http.Header) (*http.Response, error) {
+	req, e := http.NewRequest(method, s.url(filename), nil)
+	if e != nil {
+		return nil, e
+	}
+	req = req.WithContext(ctx)
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	response, e := s.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	switch {
+	case response.StatusCode < 300,
+		response.StatusCode == http.StatusNotModified,
+		response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return response, nil
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+	_ = response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return nil, &StatusError{StatusCode: response.StatusCode, URL: req.URL.String()}
+}
+
+// writeError is a failure of the caller's writer, which is never retried
+type writeError struct {
+	error
+}
+
+func (e writeError) Unwrap() error {
+	return e.error
+}
+
+// retryable reports whether a failed attempt may succeed when repeated
+func retryable(e error) bool {
+	var statusError *StatusError
+	var failedWrite writeError
+	switch {
+	case errors.Is(e, context.Canceled), errors.Is(e, context.DeadlineExceeded):
+		return false
+	case errors.Is(e, cbstorage.ErrNotExist), errors.Is(e, errNotModified), errors.As(e, &failedWrite):
+		return false
+	case errors.As(e, &statusError):
+		return statusError.Temporary()
+	}
+	// network errors and bodies cut short
+	return true
+}
+
+// retry calls attempt until it succeeds, fails permanently or runs out of attempts
+func (s *Storage) retry(ctx context.Context, attempt func() error) error {
+	delay := s.retryDelay
+	for i := 1; ; i++ {
+		e := attempt()
+		if e == nil || i >= s.maxAttempts || !retryable(e) {
+			return e
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, e := w.writer.Write(p)
+	w.written += int64(n)
+	if e != nil {
+		return n, writeError{e}
+	}
+	return n, nil
+}
+
+// download writes length bytes from offset to writer, a negative length reads
+// to the end. An attempt that fails part way resumes after the bytes already
+// written, using If-Range so a changed object is not spliced together.
+// conditional headers are only sent with the first request and a 304 response
+// is returned as errNotModified. It returns the headers of the first response
+func (s *Storage) download(ctx context.Context, filename string, offset int64, length int64, writer io.Writer, conditional http.Header) (http.Header, error) {
+	var firstHeader http.Header
+	counter := &countingWriter{writer: writer}
+	e := s.retry(ctx, func() error {
+		start := offset + counter.written
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - counter.written
+			if remaining == 0 {
+				return nil
+			}
+		}
+		header := http.Header{}
+		if counter.written == 0 {
+			for name, values := range conditional {
+				header[name] = values
+			}
+		}
+		if start > 0 || remaining >= 0 {
+			byteRange := fmt.Sprintf("bytes=%d-", start)
+			if remaining >= 0 {
+				byteRange += strconv.FormatInt(start+remaining-1, 10)
+			}
+			header.Set("Range", byteRange)
+			if counter.written > 0 && firstHeader.Get("ETag") != "" {
+				header.Set("If-Range", firstHeader.Get("ETag"))
+			}
+		}
+
+		response, e := s.do(ctx, http.MethodGet, filename, header)
+		if e != nil {
+			return e
+		}
+		defer response.Body.Close()
+		if firstHeader == nil {
+			firstHeader = response.Header
+		}
+		switch response.StatusCode {
+		case http.StatusNotModified:
+			return errNotModified
+		case http.StatusRequestedRangeNotSatisfiable:
+			// a range starting past the end of the object is empty rather than an error
+			return nil
+		}
+
+		body := io.Reader(response.Body)
+		if response.StatusCode != http.StatusPartialContent {
+			if counter.written > 0 && response.Header.Get("ETag") != firstHeader.Get("ETag") {
+				return writeError{fmt.Errorf("%s changed during the download", filename)}
+			}
+			// the server ignored the range, skip to the requested bytes ourselves
+			if _, e := io.CopyN(ioutil.Discard, body, start); e != nil && e != io.EOF {
+				return e
+			}
+		}
+		if remaining >= 0 {
+			body = io.LimitReader(body, remaining)
+		}
+		_, e = io.Copy(counter, body)
+
+		return e
+	})
+	var failedWrite writeError
+	if errors.As(e, &failedWrite) {
+		e = failedWrite.error
+	}
+
+	return firstHeader, e
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if s.cacheDir != "" {
+		return s.downloadCached(ctx, filename, writer)
+	}
+
+	_, e := s.download(ctx, filename, 0, -1, writer, nil)
+
+	return e
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if length == 0 {
+		return nil
+	}
+
+	_, e := s.download(ctx, filename, offset, length, writer, nil)
+
+	return e
+}
+
+// cacheEntry records the validators of a cached object, its data is stored in
+// a file named after the ETag or Last-Modified so it is never modified in place
+type cacheEntry struct {
+	ETag         string
+	LastModified string
+	DataFile     string
+}
+
+func (s *Storage) cachePath(filename string) string {
+	hash := sha256.Sum256([]byte(s.url(filename)))
+	return filepath.Join(s.cacheDir, hex.EncodeToString(hash[:]))
+}
+
+func (s *Storage) downloadCached(ctx context.Context, filename string, writer io.Writer) error {
+	entryPath := s.cachePath(filename) + ".json"
+	var cached *cacheEntry
+	if contents, e := ioutil.ReadFile(entryPath); e == nil {
+		entry := &cacheEntry{}
+		if json.Unmarshal(contents, entry) == nil && entry.DataFile != "" {
+			if _, e := os.Stat(filepath.Join(s.cacheDir, entry.DataFile)); e == nil {
+				cached = entry
+			}
+		}
+	}
+	conditional := http.Header{}
+	if cached != nil && cached.ETag != "" {
+		conditional.Set("If-None-Match", cached.ETag)
+	} else if cached != nil && cached.LastModified != "" {
+		conditional.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	temp, e := ioutil.TempFile(s.cacheDir, ".download-")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	header, e := s.download(ctx, filename, 0, -1, io.MultiWriter(writer, temp), conditional)
+	if errors.Is(e, errNotModified) {
+		data, e := os.Open(filepath.Join(s.cacheDir, cached.DataFile))
+		if e != nil {
+			return e
+		}
+		defer data.Close()
+		_, e = io.Copy(writer, data)
+		return e
+	}
+	if e != nil {
+		return e
+	}
+
+	entry := &cacheEntry{ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified")}
+	if entry.ETag == "" && entry.LastModified == "" {
+		return nil
+	}
+	validatorHash := sha256.Sum256([]byte(entry.ETag + "\n" + entry.LastModified))
+	entry.DataFile = filepath.Base(s.cachePath(filename)) + "-" + hex.EncodeToString(validatorHash[:8]) + ".data"
+	// the object was already delivered, failing to cache it is not an error
+	if temp.Close() != nil || os.Rename(temp.Name(), filepath.Join(s.cacheDir, entry.DataFile)) != nil {
+		return nil
+	}
+	if contents, e := json.Marshal(entry); e == nil {
+		if e := writeFileAtomic(entryPath, contents); e == nil && cached != nil && cached.DataFile != entry.DataFile {
+			_ = os.Remove(filepath.Join(s.cacheDir, cached.DataFile))
+		}
+	}
+
+	return nil
+}
+
+func writeFileAtomic(path string, contents []byte) error {
+	temp, e := ioutil.TempFile(filepath.Dir(path), ".entry-")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(temp.Name())
+	if _, e := temp.Write(contents); e != nil {
+		_ = temp.Close()
+		return e
+	}
+	if e := temp.Close(); e != nil {
+		return e
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+// StatContext sends a HEAD request. Checksum is only set if the server sends
+// a Content-MD5 header
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	var info cbstorage.ObjectInfo
+	e := s.retry(ctx, func() error {
+		response, e := s.do(ctx, http.MethodHead, filename, nil)
+		if e != nil {
+			return e
+		}
+		defer response.Body.Close()
+
+		modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+		checksum := ""
+		if hash, e := base64.StdEncoding.DecodeString(response.Header.Get("Content-MD5")); e == nil && len(hash) == 16 {
+			checksum = hex.EncodeToString(hash)
+		}
+		info = cbstorage.ObjectInfo{
+			Name:       filename,
+			Size:       response.ContentLength,
+			ModTime:    modTime,
+			Checksum:   checksum,
+			ETag:       response.Header.Get("ETag"),
+			Generation: response.Header.Get("ETag"),
+		}
+		return nil
+	})
+
+	return info, e
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+// List is not possible over plain HTTP
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	return nil, cbstorage.ErrNotSupported
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	return fmt.Errorf("%w: cannot upload %s", ErrReadOnly, filename)
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	return fmt.Errorf("%w: cannot concat into %s", ErrReadOnly, destination)
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	return fmt.Errorf("%w: cannot delete %s", ErrReadOnly, filename)
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	return "", fmt.Errorf("%w: cannot upload %s", ErrReadOnly, filename)
+}
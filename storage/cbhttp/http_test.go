@@ -0,0 +1,337 @@
+package cbhttp
+
+import (
+	"bytes"
+	"errors"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			config:  Config{BaseURL: "https://cdn.example.com/transactions/"},
+			wantErr: false,
+		},
+		{
+			name:    "noBaseURL",
+			config:  Config{},
+			wantErr: true,
+		},
+		{
+			name:    "unsupportedScheme",
+			config:  Config{BaseURL: "ftp://example.com/transactions"},
+			wantErr: true,
+		},
+		{
+			name:    "negativeAttempts",
+			config:  Config{BaseURL: "https://cdn.example.com", MaxAttempts: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_url(t *testing.T) {
+	s := getStorage(t, Config{BaseURL: "https://cdn.example.com/base/?token=abc"})
+	if got, want := s.url("dir/a file#1"), "https://cdn.example.com/base/dir/a%20file%231?token=abc"; got != want {
+		t.Errorf("url() = %s, want %s", got, want)
+	}
+}
+
+func TestStorage_Download(t *testing.T) {
+	fake := newFakeServer()
+	defer fake.Close()
+	fake.put("dir/file.txt", "contents")
+	s := getStorage(t, fake.config())
+
+	writer := &bytes.Buffer{}
+	if e := s.Download("dir/file.txt", writer); e != nil {
+		t.Errorf("Download() error = %v", e)
+		return
+	}
+	if writer.String() != "contents" {
+		t.Errorf("Download() = %s, want contents", writer.String())
+	}
+	if e := s.Download("missing.txt", writer); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Download() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+}
+
+func TestStorage_DownloadRange(t *testing.T) {
+	type args struct {
+		offset int64
+		length int64
+	}
+	tests := []struct {
+		name        string
+		args        args
+		ignoreRange bool
+		wantWriter  string
+		wantErr     bool
+	}{
+		{
+			name:       "whole",
+			args:       args{offset: 0, length: -1},
+			wantWriter: "0123456789",
+		},
+		{
+			name:       "tail",
+			args:       args{offset: 6, length: -1},
+			wantWriter: "6789",
+		},
+		{
+			name:       "middle",
+			args:       args{offset: 2, length: 3},
+			wantWriter: "234",
+		},
+		{
+			name:        "middleRangeIgnored",
+			args:        args{offset: 2, length: 3},
+			ignoreRange: true,
+			wantWriter:  "234",
+		},
+		{
+			name:       "pastEnd",
+			args:       args{offset: 20, length: 5},
+			wantWriter: "",
+		},
+		{
+			name:    "negativeOffset",
+			args:    args{offset: -1, length: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeServer()
+			defer fake.Close()
+			fake.put("range.txt", "0123456789")
+			fake.ignoreRange = tt.ignoreRange
+			s := getStorage(t, fake.config())
+
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange("range.txt", tt.args.offset, tt.args.length, writer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := writer.String(); got != tt.wantWriter {
+				t.Errorf("DownloadRange() gotWriter = %s, want %s", got, tt.wantWriter)
+			}
+		})
+	}
+}
+
+func TestStorage_DownloadRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		truncations  int
+		ignoreRange  bool
+		changeObject bool
+		wantWriter   string
+		wantErr      bool
+	}{
+		{
+			name:       "serverError",
+			failures:   2,
+			wantWriter: "0123456789",
+		},
+		{
+			name:       "tooManyFailures",
+			failures:   3,
+			wantWriter: "",
+			wantErr:    true,
+		},
+		{
+			name:        "resumeTruncated",
+			truncations: 1,
+			wantWriter:  "0123456789",
+		},
+		{
+			name:        "resumeTruncatedRangeIgnored",
+			truncations: 1,
+			ignoreRange: true,
+			wantWriter:  "0123456789",
+		},
+		{
+			name:         "changedWhileResuming",
+			truncations:  1,
+			changeObject: true,
+			wantWriter:   "01234",
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeServer()
+			defer fake.Close()
+			fake.put("file.txt", "0123456789")
+			fake.failures = tt.failures
+			fake.truncations = tt.truncations
+			fake.ignoreRange = tt.ignoreRange
+			s := getStorage(t, fake.config())
+
+			writer := &bytes.Buffer{}
+			var output writerFunc = func(p []byte) (int, error) {
+				// replace the object once the truncated response was received
+				if tt.changeObject && writer.Len() == 0 {
+					fake.put("file.txt", "abcdefghij")
+				}
+				return writer.Write(p)
+			}
+			err := s.Download("file.txt", output)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Download() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := writer.String(); got != tt.wantWriter {
+				t.Errorf("Download() gotWriter = %s, want %s", got, tt.wantWriter)
+			}
+		})
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestStorage_DownloadNotRetried(t *testing.T) {
+	fake := newFakeServer()
+	defer fake.Close()
+	fake.put("file.txt", "contents")
+	s := getStorage(t, fake.config())
+
+	if e := s.Download("missing.txt", ioutil.Discard); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Download() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+	failed := errors.New("disk full")
+	var output writerFunc = func(p []byte) (int, error) {
+		return 0, failed
+	}
+	if e := s.Download("file.txt", output); !errors.Is(e, failed) {
+		t.Errorf("Download() error = %v, want %v", e, failed)
+	}
+	if count := fake.requestCount(); count != 2 {
+		t.Errorf("Download() sent %d requests, want 2 without retries", count)
+	}
+}
+
+func TestStorage_DownloadCached(t *testing.T) {
+	fake := newFakeServer()
+	defer fake.Close()
+	fake.put("file.txt", "first")
+	cacheDir, e := ioutil.TempDir("", "cbhttp")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(cacheDir)
+	config := fake.config()
+	config.CacheDir = cacheDir
+	s := getStorage(t, config)
+
+	download := func(want string) {
+		t.Helper()
+		writer := &bytes.Buffer{}
+		if e := s.Download("file.txt", writer); e != nil {
+			t.Errorf("Download() error = %v", e)
+			return
+		}
+		if writer.String() != want {
+			t.Errorf("Download() = %s, want %s", writer.String(), want)
+		}
+	}
+
+	download("first")
+	download("first")
+	if last := fake.requests[len(fake.requests)-1]; last.Header.Get("If-None-Match") == "" {
+		t.Error("Download() did not send a conditional request for a cached object")
+	}
+
+	fake.put("file.txt", "second")
+	download("second")
+	download("second")
+
+	files, _ := ioutil.ReadDir(config.CacheDir)
+	if len(files) != 2 {
+		t.Errorf("cache directory has %d files, want an entry and its data", len(files))
+	}
+}
+
+func TestStorage_Stat(t *testing.T) {
+	fake := newFakeServer()
+	defer fake.Close()
+	fake.put("file.txt", "contents")
+	fake.failures = 1
+	s := getStorage(t, fake.config())
+
+	info, e := s.Stat("file.txt")
+	if e != nil {
+		t.Errorf("Stat() error = %v", e)
+		return
+	}
+	object := fake.objects["file.txt"]
+	if info.Name != "file.txt" || info.Size != 8 || info.ETag != object.etag || info.Generation != object.etag || !info.ModTime.Equal(object.modTime) {
+		t.Errorf("Stat() = %+v", info)
+	}
+	if fake.requests[len(fake.requests)-1].Method != http.MethodHead {
+		t.Errorf("Stat() sent %s, want HEAD", fake.requests[len(fake.requests)-1].Method)
+	}
+
+	if exists, e := s.Exists("file.txt"); !exists || e != nil {
+		t.Errorf("Exists() = %v, %v, want true", exists, e)
+	}
+	if exists, e := s.Exists("missing.txt"); exists || e != nil {
+		t.Errorf("Exists() = %v, %v, want false", exists, e)
+	}
+}
+
+func TestStorage_ReadOnly(t *testing.T) {
+	fake := newFakeServer()
+	defer fake.Close()
+	s := getStorage(t, fake.config())
+
+	errs := map[string]error{
+		"Upload": s.Upload("file.txt", strings.NewReader("contents")),
+		"Concat": s.Concat("file.txt", "a", "b"),
+		"Delete": s.Delete("file.txt"),
+	}
+	_, errs["UploadIfGenerationMatch"] = s.UploadIfGenerationMatch("file.txt", strings.NewReader("contents"), "")
+	for method, e := range errs {
+		if !errors.Is(e, ErrReadOnly) {
+			t.Errorf("%s() error = %v, want %v", method, e, ErrReadOnly)
+		}
+	}
+	if _, e := s.List(""); !errors.Is(e, cbstorage.ErrNotSupported) {
+		t.Errorf("List() error = %v, want %v", e, cbstorage.ErrNotSupported)
+	}
+	if count := fake.requestCount(); count != 0 {
+		t.Errorf("read only methods sent %d requests", count)
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	fake := newFakeServer()
+	defer fake.Close()
+	storagetest.ReadOnlyContract(t, getStorage(t, fake.config()))
+}
@@ -0,0 +1,393 @@
+package cbmemory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMaxSizeExceeded is returned by writes that would grow the stored objects past Config.MaxSize
+var ErrMaxSizeExceeded = errors.New("max size exceeded")
+
+type object struct {
+	data       []byte
+	modTime    time.Time
+	generation int64
+}
+
+// Storage keeps objects in memory and is safe for concurrent use. Stored and
+// returned data is copied, so callers can reuse their buffers
+type Storage struct {
+	latency time.Duration
+	maxSize int64
+
+	lock           sync.RWMutex
+	objects        map[string]*object
+	size           int64
+	lastGeneration int64
+}
+
+type Config struct {
+	// Latency is added to every operation, to simulate a remote store
+	Latency time.Duration
+	// MaxSize limits the total size of the stored objects in bytes, 0 means no limit
+	MaxSize int64
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Latency < 0 {
+		return nil, fmt.Errorf("invalid latency: %s", config.Latency)
+	}
+	if config.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid max size: %d", config.MaxSize)
+	}
+
+	return &Storage{
+		latency: config.Latency,
+		maxSize: config.MaxSize,
+		objects: map[string]*object{},
+	}, nil
+}
+
+func (s *Storage) checkFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." {
+		return fmt.Errorf("invalid filename: %s", filename)
+	}
+
+	return nil
+}
+
+// wait applies the configured latency, returning early if ctx is done
+func (s *Storage) wait(ctx context.Context) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if s.latency == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(s.latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Size returns the total size of the stored objects in bytes
+func (s *Storage) Size() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.size
+}
+
+// Len returns the number of stored objects
+func (s *Storage) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.objects)
+}
+
+// store replaces the object, s.lock must be held
+func (s *Storage) store(filename string, data []byte) (*object, error) {
+	size := s.size + int64(len(data))
+	if existing, ok := s.objects[filename]; ok {
+		size -= int64(len(existing.data))
+	}
+	if s.maxSize > 0 && size > s.maxSize {
+		return nil, fmt.Errorf("%w: storing %s needs %d bytes, the limit is %d", ErrMaxSizeExceeded, filename, size, s.maxSize)
+	}
+
+	s.lastGeneration++
+	stored := &object{data: data, modTime: time.Now(), generation: s.lastGeneration}
+	s.objects[filename] = stored
+	s.size = size
+
+	return stored, nil
+}
+
+func (s *Storage) get(filename string) (*object, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	stored, ok := s.objects[filename]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+	return stored, nil
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if e := s.wait(ctx); e != nil {
+		return e
+	}
+	data, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return e
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, e = s.store(filename, data)
+
+	return e
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return s.DownloadRangeContext(ctx, filename, 0, -1, writer)
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if e := s.wait(ctx); e != nil {
+		return e
+	}
+	// stored data is never modified, so it can be written without holding the lock
+	stored, e := s.get(filename)
+	if e != nil {
+		return e
+	}
+
+	data := stored.data
+	if offset >= int64(len(data)) {
+		return nil
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	_, e = writer.Write(data)
+
+	return e
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := s.checkFilename(destination); e != nil {
+		return e
+	}
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+	for _, filename := range filenames {
+		if e := s.checkFilename(filename); e != nil {
+			return e
+		}
+	}
+	if e := s.wait(ctx); e != nil {
+		return e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var data bytes.Buffer
+	for _, filename := range filenames {
+		stored, ok := s.objects[filename]
+		if !ok {
+			return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+		}
+		data.Write(stored.data)
+	}
+	_, e := s.store(destination, data.Bytes())
+
+	return e
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if e := s.wait(ctx); e != nil {
+		return e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, ok := s.objects[filename]
+	if !ok {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+	delete(s.objects, filename)
+	s.size -= int64(len(stored.data))
+
+	return nil
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	if e := s.wait(ctx); e != nil {
+		return nil, e
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var objects []cbstorage.ObjectInfo
+	for filename, stored := range s.objects {
+		if strings.HasPrefix(filename, prefix) {
+			objects = append(objects, objectInfo(filename, stored))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	if e := s.wait(ctx); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	stored, e := s.get(filename)
+	if e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+
+	return objectInfo(filename, stored), nil
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	if e := s.wait(ctx); e != nil {
+		return "", e
+	}
+	data, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return "", e
+	}
+	if e := ctx.Err(); e != nil {
+		return "", e
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current := ""
+	if existing, ok := s.objects[filename]; ok {
+		current = strconv.FormatInt(existing.generation, 10)
+	}
+	if current != generation {
+		return "", fmt.Errorf("%w: %s does not have generation %s", cbstorage.ErrPreconditionFailed, filename, generation)
+	}
+	stored, e := s.store(filename, data)
+	if e != nil {
+		return "", e
+	}
+
+	return strconv.FormatInt(stored.generation, 10), nil
+}
+
+// Snapshot is a point in time copy of the objects of a Storage
+type Snapshot struct {
+	objects map[string]*object
+}
+
+// Snapshot captures the current objects, it is cheap as stored data is never modified
+func (s *Storage) Snapshot() *Snapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	objects := make(map[string]*object, len(s.objects))
+	for filename, stored := range s.objects {
+		objects[filename] = stored
+	}
+	return &Snapshot{objects: objects}
+}
+
+// Restore replaces all objects with the ones in snapshot, ignoring MaxSize.
+// Objects keep the generation they had when the snapshot was taken
+func (s *Storage) Restore(snapshot *Snapshot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects = make(map[string]*object, len(snapshot.objects))
+	s.size = 0
+	for filename, stored := range snapshot.objects {
+		s.objects[filename] = stored
+		s.size += int64(len(stored.data))
+	}
+}
+
+func objectInfo(filename string, stored *object) cbstorage.ObjectInfo {
+	hash := md5.Sum(stored.data)
+	generation := strconv.FormatInt(stored.generation, 10)
+
+	return cbstorage.ObjectInfo{
+		Name:       filename,
+		Size:       int64(len(stored.data)),
+		ModTime:    stored.modTime,
+		Checksum:   hex.EncodeToString(hash[:]),
+		ETag:       generation,
+		Generation: generation,
+	}
+}
@@ -0,0 +1,337 @@
+package cbmemory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getStorage(t *testing.T, config Config) *Storage {
+	s, e := New(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "default",
+			config:  Config{},
+			wantErr: false,
+		},
+		{
+			name:    "negativeLatency",
+			config:  Config{Latency: -time.Second},
+			wantErr: true,
+		},
+		{
+			name:    "negativeMaxSize",
+			config:  Config{MaxSize: -1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_UploadDownload(t *testing.T) {
+	s := getStorage(t, Config{})
+
+	contents := []byte("contents")
+	if e := s.Upload("file.txt", bytes.NewReader(contents)); e != nil {
+		t.Errorf("Upload() error = %v", e)
+		return
+	}
+	// the stored object must not share memory with the caller's buffer
+	contents[0] = 'C'
+
+	writer := &bytes.Buffer{}
+	if e := s.Download("file.txt", writer); e != nil {
+		t.Errorf("Download() error = %v", e)
+		return
+	}
+	if writer.String() != "contents" {
+		t.Errorf("Download() = %s, want contents", writer.String())
+	}
+
+	if e := s.Download("missing.txt", writer); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Download() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+	if e := s.Upload(".", bytes.NewReader(contents)); e == nil {
+		t.Error("Upload() error = nil for an invalid filename")
+	}
+}
+
+func TestStorage_DownloadRange(t *testing.T) {
+	type args struct {
+		offset int64
+		length int64
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantWriter string
+		wantErr    bool
+	}{
+		{
+			name:       "whole",
+			args:       args{offset: 0, length: -1},
+			wantWriter: "0123456789",
+		},
+		{
+			name:       "tail",
+			args:       args{offset: 6, length: -1},
+			wantWriter: "6789",
+		},
+		{
+			name:       "middle",
+			args:       args{offset: 2, length: 3},
+			wantWriter: "234",
+		},
+		{
+			name:       "pastEnd",
+			args:       args{offset: 20, length: 5},
+			wantWriter: "",
+		},
+		{
+			name:    "negativeOffset",
+			args:    args{offset: -1, length: -1},
+			wantErr: true,
+		},
+	}
+	s := getStorage(t, Config{})
+	if e := s.Upload("range.txt", bytes.NewReader([]byte("0123456789"))); e != nil {
+		t.Fatal(e)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange("range.txt", tt.args.offset, tt.args.length, writer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := writer.String(); got != tt.wantWriter {
+				t.Errorf("DownloadRange() gotWriter = %s, want %s", got, tt.wantWriter)
+			}
+		})
+	}
+}
+
+func TestStorage_Concat(t *testing.T) {
+	s := getStorage(t, Config{})
+	for filename, contents := range map[string]string{"log": "1,", "batch1": "2,", "batch2": "3"} {
+		if e := s.Upload(filename, bytes.NewReader([]byte(contents))); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e := s.Concat("log", "log", "batch1", "batch2"); e != nil {
+		t.Errorf("Concat() error = %v", e)
+		return
+	}
+	writer := &bytes.Buffer{}
+	_ = s.Download("log", writer)
+	if writer.String() != "1,2,3" {
+		t.Errorf("Concat() log = %s, want 1,2,3", writer.String())
+	}
+	if s.Size() != int64(len("1,2,3")+len("2,")+len("3")) {
+		t.Errorf("Size() = %d after Concat", s.Size())
+	}
+
+	if e := s.Concat("destination", "batch1", "missing"); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Concat() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+	if e := s.Concat("destination"); e == nil {
+		t.Error("Concat() error = nil without sources")
+	}
+	if exists, _ := s.Exists("destination"); exists {
+		t.Error("Concat() created the destination after an error")
+	}
+}
+
+func TestStorage_ListStatDelete(t *testing.T) {
+	s := getStorage(t, Config{})
+	for _, filename := range []string{"list/c", "list/a", "list/b/d", "other"} {
+		if e := s.Upload(filename, bytes.NewReader([]byte(filename))); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	objects, e := s.List("list/")
+	if e != nil {
+		t.Errorf("List() error = %v", e)
+		return
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if want := []string{"list/a", "list/b/d", "list/c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List() names = %v, want %v", names, want)
+	}
+
+	info, e := s.Stat("other")
+	if e != nil {
+		t.Errorf("Stat() error = %v", e)
+		return
+	}
+	// md5("other")
+	if info.Size != 5 || info.Checksum != "795f3202b17cb6bc3d4b771d8c6c9eaf" || info.Generation == "" {
+		t.Errorf("Stat() = %+v", info)
+	}
+
+	if e := s.Delete("other"); e != nil {
+		t.Errorf("Delete() error = %v", e)
+	}
+	if exists, e := s.Exists("other"); exists || e != nil {
+		t.Errorf("Exists() = %v, %v after Delete, want false", exists, e)
+	}
+	if e := s.Delete("other"); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Delete() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+	if s.Len() != 3 || s.Size() != int64(len("list/c")+len("list/a")+len("list/b/d")) {
+		t.Errorf("Len() = %d, Size() = %d after Delete", s.Len(), s.Size())
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	s := getStorage(t, Config{})
+
+	generation, e := s.UploadIfGenerationMatch("master", bytes.NewReader([]byte("v1")), "")
+	if e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+		return
+	}
+	if _, e := s.UploadIfGenerationMatch("master", bytes.NewReader([]byte("v2")), ""); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+	next, e := s.UploadIfGenerationMatch("master", bytes.NewReader([]byte("v2")), generation)
+	if e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+		return
+	}
+	if _, e := s.UploadIfGenerationMatch("master", bytes.NewReader([]byte("v3")), generation); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+	info, _ := s.Stat("master")
+	if info.Generation != next {
+		t.Errorf("Stat() generation = %s, want %s", info.Generation, next)
+	}
+}
+
+func TestStorage_MaxSize(t *testing.T) {
+	s := getStorage(t, Config{MaxSize: 10})
+
+	if e := s.Upload("a", bytes.NewReader([]byte("123456"))); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if e := s.Upload("b", bytes.NewReader([]byte("123456"))); !errors.Is(e, ErrMaxSizeExceeded) {
+		t.Errorf("Upload() error = %v, want %v", e, ErrMaxSizeExceeded)
+	}
+	// replacing an object only counts the difference
+	if e := s.Upload("a", bytes.NewReader([]byte("1234567890"))); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if e := s.Concat("a", "a", "a"); !errors.Is(e, ErrMaxSizeExceeded) {
+		t.Errorf("Concat() error = %v, want %v", e, ErrMaxSizeExceeded)
+	}
+	if s.Size() != 10 {
+		t.Errorf("Size() = %d, want 10", s.Size())
+	}
+}
+
+func TestStorage_Latency(t *testing.T) {
+	s := getStorage(t, Config{Latency: time.Millisecond * 50})
+
+	start := time.Now()
+	if e := s.Upload("file.txt", bytes.NewReader([]byte("contents"))); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Errorf("Upload() took %s, want at least the latency", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*5)
+	defer cancel()
+	if e := s.DownloadContext(ctx, "file.txt", &bytes.Buffer{}); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("DownloadContext() error = %v, want %v", e, context.DeadlineExceeded)
+	}
+}
+
+func TestStorage_SnapshotRestore(t *testing.T) {
+	s := getStorage(t, Config{})
+	_ = s.Upload("kept", bytes.NewReader([]byte("kept")))
+	_ = s.Upload("changed", bytes.NewReader([]byte("before")))
+	snapshot := s.Snapshot()
+
+	_ = s.Upload("changed", bytes.NewReader([]byte("after")))
+	_ = s.Upload("added", bytes.NewReader([]byte("added")))
+	_ = s.Delete("kept")
+
+	s.Restore(snapshot)
+
+	for filename, want := range map[string]string{"kept": "kept", "changed": "before"} {
+		writer := &bytes.Buffer{}
+		if e := s.Download(filename, writer); e != nil || writer.String() != want {
+			t.Errorf("Download(%s) = %s, %v after Restore, want %s", filename, writer.String(), e, want)
+		}
+	}
+	if exists, _ := s.Exists("added"); exists {
+		t.Error("Exists(added) = true after Restore")
+	}
+	if s.Size() != int64(len("kept")+len("before")) {
+		t.Errorf("Size() = %d after Restore", s.Size())
+	}
+}
+
+func TestStorage_Concurrent(t *testing.T) {
+	s := getStorage(t, Config{})
+	_ = s.Upload("log", bytes.NewReader(nil))
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			filename := fmt.Sprintf("batch%d", i)
+			_ = s.Upload(filename, bytes.NewReader([]byte("x")))
+			_ = s.Concat("log", "log", filename)
+			_, _ = s.List("")
+			_ = s.Download("log", &bytes.Buffer{})
+		}(i)
+	}
+	wait.Wait()
+
+	info, e := s.Stat("log")
+	if e != nil || info.Size != 20 {
+		t.Errorf("Stat() = %+v, %v, want 20 appended bytes", info, e)
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	s, e := New(Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	storagetest.Contract(t, s)
+}
@@ -0,0 +1,841 @@
+package cbreplicated
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unknownGeneration marks a child whose generation is unknown in a combined
+// generation, url.QueryEscape never produces it
+const unknownGeneration = "*"
+
+// pendingPrefix names the marker objects which persist the pending objects of
+// a child, see persistPending
+const pendingPrefix = "cbreplicated-pending-"
+
+// ChildError is the error of a single child
+type ChildError struct {
+	Child int
+	Err   error
+}
+
+func (e *ChildError) Error() string {
+	return fmt.Sprintf("child %d: %v", e.Child, e.Err)
+}
+
+func (e *ChildError) Unwrap() error {
+	return e.Err
+}
+
+// Error is returned when an operation did not succeed on enough children.
+// errors.Is matches any of the child errors
+type Error struct {
+	Op        string
+	Filename  string
+	Succeeded int
+	Required  int
+	Errors    []*ChildError
+}
+
+func (e *Error) Error() string {
+	var messages []string
+	for _, childError := range e.Errors {
+		messages = append(messages, childError.Error())
+	}
+	return fmt.Sprintf(
+		"%s %s: %d children succeeded, %d required: %s",
+		e.Op,
+		e.Filename,
+		e.Succeeded,
+		e.Required,
+		strings.Join(messages, "; "),
+	)
+}
+
+func (e *Error) Is(target error) bool {
+	for _, childError := range e.Errors {
+		if errors.Is(childError.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RepairError lists the objects Storage.Repair could not repair, errors.Is
+// matches any of the child errors
+type RepairError struct {
+	Errors []*ChildError
+}
+
+func (e *RepairError) Error() string {
+	var messages []string
+	for _, childError := range e.Errors {
+		messages = append(messages, childError.Error())
+	}
+	return fmt.Sprintf("could not repair %d objects: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (e *RepairError) Is(target error) bool {
+	for _, childError := range e.Errors {
+		if errors.Is(childError.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChildStatus describes the state of a child, see Storage.Status
+type ChildStatus struct {
+	// Healthy is false when the last operation on the child failed
+	Healthy   bool
+	LastError error
+	// Pending are the objects which will be copied to the child by the next
+	// repair. They are persisted as marker objects on the other children,
+	// which Repair reads back after a restart
+	Pending []string
+}
+
+// Storage replicates every write to all of its children and reads from the
+// first healthy child, falling back to the others. Writes succeed once the
+// write quorum is reached, children which missed a write are repaired by
+// copying the object from a child which has it.
+//
+// Generations are the generations of all children combined, so the master can
+// still be published with UploadIfGenerationMatch
+type Storage struct {
+	children     []cbtransaction.Storage
+	quorum       int
+	tempDir      string
+	errorHandler cbtransaction.ErrorHandler
+
+	// writes hold the read lock so they can run concurrently, repairs hold
+	// the write lock so they never replace a newer write with an older copy
+	writeLock sync.RWMutex
+
+	stateLock sync.Mutex
+	lastError []error
+	pending   []map[string]bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Config struct {
+	Children []cbtransaction.Storage
+	// WriteQuorum is the number of children a write has to succeed on,
+	// defaults to a majority of the children
+	WriteQuorum int
+	// RepairInterval is how often children which missed writes are repaired in
+	// the background, 0 disables the background repair. See Storage.Repair
+	RepairInterval time.Duration
+	// TempDir is where upload bodies which cannot be read concurrently are
+	// buffered, defaults to os.TempDir()
+	TempDir string
+	// ErrorHandler receives the errors of children when the write quorum was
+	// still met, and the errors of the background repair
+	ErrorHandler cbtransaction.ErrorHandler
+}
+
+func New(config Config) (*Storage, error) {
+	if len(config.Children) == 0 {
+		return nil, errors.New("no children given")
+	}
+	if config.WriteQuorum == 0 {
+		config.WriteQuorum = len(config.Children)/2 + 1
+	}
+	if config.WriteQuorum < 1 || config.WriteQuorum > len(config.Children) {
+		return nil, fmt.Errorf("invalid write quorum %d for %d children", config.WriteQuorum, len(config.Children))
+	}
+	if config.RepairInterval < 0 {
+		return nil, fmt.Errorf("invalid repair interval: %s", config.RepairInterval)
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = cbtransaction.DefaultErrorHandler{}
+	}
+
+	s := &Storage{
+		children:     config.Children,
+		quorum:       config.WriteQuorum,
+		tempDir:      config.TempDir,
+		errorHandler: config.ErrorHandler,
+		lastError:    make([]error, len(config.Children)),
+		pending:      make([]map[string]bool, len(config.Children)),
+	}
+	for i := range s.pending {
+		s.pending[i] = map[string]bool{}
+	}
+	if config.RepairInterval > 0 {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		s.done = make(chan struct{})
+		go s.repairLoop(ctx, config.RepairInterval)
+	}
+
+	return s, nil
+}
+
+// Close stops the background repair
+func (s *Storage) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	return nil
+}
+
+func (s *Storage) repairLoop(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	defer s.errorHandler.Recover()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if e := s.Repair(ctx); e != nil && ctx.Err() == nil {
+				s.errorHandler.Error(e)
+			}
+		}
+	}
+}
+
+// Status returns the state of every child, in the order of Config.Children
+func (s *Storage) Status() []ChildStatus {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	statuses := make([]ChildStatus, len(s.children))
+	for i := range s.children {
+		statuses[i] = ChildStatus{Healthy: s.lastError[i] == nil, LastError: s.lastError[i]}
+		for filename := range s.pending[i] {
+			statuses[i].Pending = append(statuses[i].Pending, filename)
+		}
+		sort.Strings(statuses[i].Pending)
+	}
+	return statuses
+}
+
+// record updates the health of a child from the result of an operation.
+// Missing objects and failed preconditions say nothing about the child's health
+func (s *Storage) record(child int, e error) {
+	if e != nil && (errors.Is(e, cbstorage.ErrNotExist) ||
+		errors.Is(e, cbstorage.ErrPreconditionFailed) ||
+		errors.Is(e, context.Canceled) ||
+		errors.Is(e, context.DeadlineExceeded)) {
+		return
+	}
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.lastError[child] = e
+}
+
+// order returns the children to read from, healthy children first
+func (s *Storage) order() []int {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	var healthy, unhealthy []int
+	for i := range s.children {
+		if s.lastError[i] == nil {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// each calls call for every child concurrently and returns the errors by child
+func (s *Storage) each(call func(child int, storage cbtransaction.Storage) error) []error {
+	errs := make([]error, len(s.children))
+	var wait sync.WaitGroup
+	for i, child := range s.children {
+		wait.Add(1)
+		go func(i int, child cbtransaction.Storage) {
+			defer wait.Done()
+			errs[i] = call(i, child)
+			s.record(i, errs[i])
+		}(i, child)
+	}
+	wait.Wait()
+	return errs
+}
+
+// write checks the quorum of a write. When the quorum was met the children
+// which failed are marked for repair, otherwise the children which took the
+// write are, so the repair undoes it, and the error lists every child error
+func (s *Storage) write(ctx context.Context, op string, filename string, errs []error) error {
+	succeeded := 0
+	var childErrors []*ChildError
+	for i, e := range errs {
+		if e == nil {
+			succeeded++
+			continue
+		}
+		childErrors = append(childErrors, &ChildError{Child: i, Err: e})
+	}
+	result := &Error{Op: op, Filename: filename, Succeeded: succeeded, Required: s.quorum, Errors: childErrors}
+	met := succeeded >= s.quorum
+
+	var added, cleared []int
+	s.stateLock.Lock()
+	for i, e := range errs {
+		switch {
+		case (e == nil) != met:
+			if !s.pending[i][filename] {
+				added = append(added, i)
+			}
+			s.pending[i][filename] = true
+		case met && s.pending[i][filename]:
+			delete(s.pending[i], filename)
+			cleared = append(cleared, i)
+		}
+	}
+	s.stateLock.Unlock()
+	s.persistPending(ctx, filename, added, cleared)
+	if !met {
+		return result
+	}
+	if len(childErrors) > 0 {
+		s.errorHandler.Error(result)
+	}
+
+	return nil
+}
+
+// persistPending writes a marker for every child in added to the children
+// which are not pending for filename, and removes the markers of the children
+// in cleared from every child. Failures go to the error handler, a stale
+// marker only repairs an object which is already up to date again
+func (s *Storage) persistPending(ctx context.Context, filename string, added []int, cleared []int) {
+	if len(added) == 0 && len(cleared) == 0 {
+		return
+	}
+	behind := make([]bool, len(s.children))
+	s.stateLock.Lock()
+	for i := range s.children {
+		behind[i] = s.pending[i][filename]
+	}
+	s.stateLock.Unlock()
+
+	for i, storage := range s.children {
+		for _, child := range added {
+			if behind[i] {
+				continue
+			}
+			e := storage.UploadContext(ctx, pendingMarker(child, filename), strings.NewReader(""))
+			if e != nil {
+				s.errorHandler.Error(&ChildError{Child: i, Err: fmt.Errorf("marking %s pending: %w", filename, e)})
+			}
+		}
+		for _, child := range cleared {
+			e := storage.DeleteContext(ctx, pendingMarker(child, filename))
+			if e != nil && !errors.Is(e, cbstorage.ErrNotExist) {
+				s.errorHandler.Error(&ChildError{Child: i, Err: fmt.Errorf("clearing pending %s: %w", filename, e)})
+			}
+		}
+	}
+}
+
+// loadPending adds the objects the markers on the children record as pending,
+// such as those of writes before a restart. Children which cannot be listed
+// are read again by the next repair
+func (s *Storage) loadPending(ctx context.Context) {
+	for i, storage := range s.children {
+		markers, e := storage.ListContext(ctx, pendingPrefix)
+		if e != nil {
+			continue
+		}
+		s.stateLock.Lock()
+		for _, marker := range markers {
+			child, filename, ok := s.parsePendingMarker(marker.Name)
+			if ok && child != i {
+				s.pending[child][filename] = true
+			}
+		}
+		s.stateLock.Unlock()
+	}
+}
+
+func pendingMarker(child int, filename string) string {
+	return pendingPrefix + strconv.Itoa(child) + "-" + url.QueryEscape(filename)
+}
+
+func (s *Storage) parsePendingMarker(name string) (int, string, bool) {
+	if !strings.HasPrefix(name, pendingPrefix) {
+		return 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, pendingPrefix), "-", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	child, e := strconv.Atoi(parts[0])
+	if e != nil || child < 0 || child >= len(s.children) {
+		return 0, "", false
+	}
+	filename, e := url.QueryUnescape(parts[1])
+	if e != nil {
+		return 0, "", false
+	}
+	return child, filename, true
+}
+
+// checkFilename rejects the names of the pending markers
+func checkFilename(filename string) error {
+	if strings.HasPrefix(filename, pendingPrefix) {
+		return fmt.Errorf("filename is reserved for internal use: %s", filename)
+	}
+	return nil
+}
+
+// spool returns a function opening independent readers of the body, so it can
+// be uploaded to every child concurrently. Bodies which are not an
+// io.ReaderAt and io.Seeker are buffered in a temporary file first
+func (s *Storage) spool(reader io.Reader) (func() io.Reader, func(), error) {
+	type readSeekerAt interface {
+		io.ReaderAt
+		io.Seeker
+	}
+	cleanup := func() {}
+	source, ok := reader.(readSeekerAt)
+	if !ok {
+		file, e := ioutil.TempFile(s.tempDir, "cbreplicated-")
+		if e != nil {
+			return nil, nil, e
+		}
+		cleanup = func() {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+		if _, e := io.Copy(file, reader); e != nil {
+			cleanup()
+			return nil, nil, e
+		}
+		if _, e := file.Seek(0, io.SeekStart); e != nil {
+			cleanup()
+			return nil, nil, e
+		}
+		source = file
+	}
+
+	start, e := source.Seek(0, io.SeekCurrent)
+	if e != nil {
+		cleanup()
+		return nil, nil, e
+	}
+	end, e := source.Seek(0, io.SeekEnd)
+	if e != nil {
+		cleanup()
+		return nil, nil, e
+	}
+	if _, e := source.Seek(start, io.SeekStart); e != nil {
+		cleanup()
+		return nil, nil, e
+	}
+
+	return func() io.Reader {
+		return io.NewSectionReader(source, start, end-start)
+	}, cleanup, nil
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := checkFilename(filename); e != nil {
+		return e
+	}
+	open, cleanup, e := s.spool(reader)
+	if e != nil {
+		return e
+	}
+	defer cleanup()
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	errs := s.each(func(child int, storage cbtransaction.Storage) error {
+		return storage.UploadContext(ctx, filename, open())
+	})
+
+	return s.write(ctx, "upload", filename, errs)
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+	if e := checkFilename(destination); e != nil {
+		return e
+	}
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	errs := s.each(func(child int, storage cbtransaction.Storage) error {
+		return storage.ConcatContext(ctx, destination, filenames...)
+	})
+
+	return s.write(ctx, "concat", destination, errs)
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+// DeleteContext counts children which did not have the object as successful,
+// unless none of the children had it
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := checkFilename(filename); e != nil {
+		return e
+	}
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	missing := 0
+	errs := s.each(func(child int, storage cbtransaction.Storage) error {
+		return storage.DeleteContext(ctx, filename)
+	})
+	for i, e := range errs {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			missing++
+			errs[i] = nil
+		}
+	}
+	if missing == len(errs) {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return s.write(ctx, "delete", filename, errs)
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+// UploadIfGenerationMatchContext applies the precondition to every child with
+// its own generation. Children whose generation was unknown when the combined
+// generation was created are written unconditionally
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := checkFilename(filename); e != nil {
+		return "", e
+	}
+	generations, e := s.splitGeneration(generation)
+	if e != nil {
+		return "", e
+	}
+	open, cleanup, e := s.spool(reader)
+	if e != nil {
+		return "", e
+	}
+	defer cleanup()
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	next := make([]string, len(s.children))
+	errs := s.each(func(child int, storage cbtransaction.Storage) error {
+		next[child] = unknownGeneration
+		if generations[child] != unknownGeneration {
+			childGeneration, e := storage.UploadIfGenerationMatchContext(ctx, filename, open(), generations[child])
+			if e == nil {
+				next[child] = childGeneration
+			}
+			return e
+		}
+
+		if e := storage.UploadContext(ctx, filename, open()); e != nil {
+			return e
+		}
+		if info, e := storage.StatContext(ctx, filename); e == nil {
+			next[child] = info.Generation
+		}
+		return nil
+	})
+	if e := s.write(ctx, "upload", filename, errs); e != nil {
+		return "", e
+	}
+
+	return joinGeneration(next), nil
+}
+
+// joinGeneration combines the generations of the children, unknownGeneration
+// marks children whose generation is unknown
+func joinGeneration(generations []string) string {
+	escaped := make([]string, len(generations))
+	for i, generation := range generations {
+		if generation == unknownGeneration {
+			escaped[i] = unknownGeneration
+		} else {
+			escaped[i] = url.QueryEscape(generation)
+		}
+	}
+	return strings.Join(escaped, ",")
+}
+
+func (s *Storage) splitGeneration(generation string) ([]string, error) {
+	generations := make([]string, len(s.children))
+	if generation == "" {
+		return generations, nil
+	}
+	parts := strings.Split(generation, ",")
+	if len(parts) != len(s.children) {
+		return nil, fmt.Errorf("invalid generation for %d children: %s", len(s.children), generation)
+	}
+	for i, part := range parts {
+		if part == unknownGeneration {
+			generations[i] = unknownGeneration
+			continue
+		}
+		unescaped, e := url.QueryUnescape(part)
+		if e != nil {
+			return nil, fmt.Errorf("invalid generation: %s", generation)
+		}
+		generations[i] = unescaped
+	}
+	return generations, nil
+}
+
+// read calls call for the children in order until one succeeds. A read only
+// fails with storage.ErrNotExist when every child failed with it
+func (s *Storage) read(op string, filename string, call func(storage cbtransaction.Storage) error) error {
+	var childErrors []*ChildError
+	missing := 0
+	for _, i := range s.order() {
+		e := call(s.children[i])
+		s.record(i, e)
+		if e == nil {
+			return nil
+		}
+		var failedWrite writeError
+		if errors.As(e, &failedWrite) {
+			return failedWrite.error
+		}
+		if errors.Is(e, context.Canceled) || errors.Is(e, context.DeadlineExceeded) {
+			return e
+		}
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			missing++
+		}
+		childErrors = append(childErrors, &ChildError{Child: i, Err: e})
+	}
+	if missing == len(s.children) {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return &Error{Op: op, Filename: filename, Succeeded: 0, Required: 1, Errors: childErrors}
+}
+
+// writeError is a failure of the caller's writer, which is not retried on another child
+type writeError struct {
+	error
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, e := w.writer.Write(p)
+	w.written += int64(n)
+	if e != nil {
+		return n, writeError{e}
+	}
+	return n, nil
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return s.DownloadRangeContext(ctx, filename, 0, -1, writer)
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+// DownloadRangeContext continues after the bytes already written when it
+// falls back to the next child part way through a download
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	counter := &countingWriter{writer: writer}
+
+	return s.read("download", filename, func(storage cbtransaction.Storage) error {
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - counter.written
+			if remaining == 0 {
+				return nil
+			}
+		}
+		return storage.DownloadRangeContext(ctx, filename, offset+counter.written, remaining, counter)
+	})
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+// ListContext leaves out the pending markers
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	var objects []cbstorage.ObjectInfo
+	e := s.read("list", prefix, func(storage cbtransaction.Storage) error {
+		childObjects, e := storage.ListContext(ctx, prefix)
+		if e != nil {
+			return e
+		}
+		objects = objects[:0]
+		for _, object := range childObjects {
+			if !strings.HasPrefix(object.Name, pendingPrefix) {
+				objects = append(objects, object)
+			}
+		}
+		return nil
+	})
+
+	return objects, e
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+// StatContext returns the object as seen by the first healthy child which has
+// it, with the generations of all children combined
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	infos := make([]cbstorage.ObjectInfo, len(s.children))
+	errs := s.each(func(child int, storage cbtransaction.Storage) error {
+		var e error
+		infos[child], e = storage.StatContext(ctx, filename)
+		return e
+	})
+
+	generations := make([]string, len(s.children))
+	found := -1
+	for _, i := range s.order() {
+		switch {
+		case errs[i] == nil:
+			generations[i] = infos[i].Generation
+			if found < 0 {
+				found = i
+			}
+		case errors.Is(errs[i], cbstorage.ErrNotExist):
+			generations[i] = ""
+		default:
+			generations[i] = unknownGeneration
+		}
+	}
+	if found < 0 {
+		return cbstorage.ObjectInfo{}, s.read("stat", filename, func(storage cbtransaction.Storage) error {
+			_, e := storage.StatContext(ctx, filename)
+			return e
+		})
+	}
+
+	info := infos[found]
+	info.Generation = joinGeneration(generations)
+
+	return info, nil
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+// Repair copies every object a child missed from a child which has it, or
+// deletes it from the child when it no longer exists anywhere else. Objects
+// which could not be repaired stay pending for the next repair. The pending
+// markers on the children are read first, so writes missed before a restart
+// are repaired as well
+func (s *Storage) Repair(ctx context.Context) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.loadPending(ctx)
+
+	var childErrors []*ChildError
+	for child, status := range s.Status() {
+		for _, filename := range status.Pending {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			e := s.repair(ctx, child, filename)
+			s.record(child, e)
+			if e != nil {
+				childErrors = append(childErrors, &ChildError{Child: child, Err: fmt.Errorf("%s: %w", filename, e)})
+				continue
+			}
+			s.stateLock.Lock()
+			delete(s.pending[child], filename)
+			s.stateLock.Unlock()
+			s.persistPending(ctx, filename, nil, []int{child})
+		}
+	}
+	if len(childErrors) > 0 {
+		return &RepairError{Errors: childErrors}
+	}
+
+	return nil
+}
+
+// repair brings filename on child up to date, s.writeLock must be held
+func (s *Storage) repair(ctx context.Context, child int, filename string) error {
+	for _, source := range s.order() {
+		s.stateLock.Lock()
+		behind := s.pending[source][filename]
+		s.stateLock.Unlock()
+		if source == child || behind {
+			continue
+		}
+
+		exists, e := s.children[source].ExistsContext(ctx, filename)
+		if e != nil {
+			continue
+		}
+		if !exists {
+			e := s.children[child].DeleteContext(ctx, filename)
+			if errors.Is(e, cbstorage.ErrNotExist) {
+				return nil
+			}
+			return e
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			_ = writer.CloseWithError(s.children[source].DownloadContext(ctx, filename, writer))
+		}()
+		e = s.children[child].UploadContext(ctx, filename, reader)
+		_ = reader.CloseWithError(io.ErrClosedPipe)
+
+		return e
+	}
+
+	return fmt.Errorf("no up to date child to repair %s from", filename)
+}
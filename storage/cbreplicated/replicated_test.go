@@ -0,0 +1,482 @@
+package cbreplicated
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errOffline = errors.New("offline")
+
+// flakyStorage is a cbmemory.Storage which fails every operation while offline
+type flakyStorage struct {
+	*cbmemory.Storage
+	lock    sync.Mutex
+	offline bool
+}
+
+func (f *flakyStorage) setOffline(offline bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.offline = offline
+}
+
+func (f *flakyStorage) check() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.offline {
+		return errOffline
+	}
+	return nil
+}
+
+func (f *flakyStorage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := f.check(); e != nil {
+		return e
+	}
+	return f.Storage.UploadContext(ctx, filename, reader)
+}
+
+func (f *flakyStorage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := f.check(); e != nil {
+		return e
+	}
+	return f.Storage.DownloadRangeContext(ctx, filename, offset, length, writer)
+}
+
+func (f *flakyStorage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return f.DownloadRangeContext(ctx, filename, 0, -1, writer)
+}
+
+func (f *flakyStorage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := f.check(); e != nil {
+		return e
+	}
+	return f.Storage.ConcatContext(ctx, destination, filenames...)
+}
+
+func (f *flakyStorage) DeleteContext(ctx context.Context, filename string) error {
+	if e := f.check(); e != nil {
+		return e
+	}
+	return f.Storage.DeleteContext(ctx, filename)
+}
+
+func (f *flakyStorage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	if e := f.check(); e != nil {
+		return nil, e
+	}
+	return f.Storage.ListContext(ctx, prefix)
+}
+
+func (f *flakyStorage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := f.check(); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	return f.Storage.StatContext(ctx, filename)
+}
+
+func (f *flakyStorage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	if e := f.check(); e != nil {
+		return false, e
+	}
+	return f.Storage.ExistsContext(ctx, filename)
+}
+
+func (f *flakyStorage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := f.check(); e != nil {
+		return "", e
+	}
+	return f.Storage.UploadIfGenerationMatchContext(ctx, filename, reader, generation)
+}
+
+type recordingErrorHandler struct {
+	lock   sync.Mutex
+	errors []error
+}
+
+func (r *recordingErrorHandler) Error(e error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.errors = append(r.errors, e)
+}
+
+func (r *recordingErrorHandler) Recover() {}
+
+func getStorage(t *testing.T, count int, config Config) (*Storage, []*flakyStorage) {
+	var children []*flakyStorage
+	for i := 0; i < count; i++ {
+		memory, e := cbmemory.New(cbmemory.Config{})
+		if e != nil {
+			t.Fatal(e)
+		}
+		children = append(children, &flakyStorage{Storage: memory})
+		config.Children = append(config.Children, children[i])
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = &recordingErrorHandler{}
+	}
+	s, e := New(config)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s, children
+}
+
+func contents(t *testing.T, storage cbtransaction.Storage, filename string) string {
+	writer := &bytes.Buffer{}
+	if e := storage.Download(filename, writer); e != nil {
+		return e.Error()
+	}
+	return writer.String()
+}
+
+func TestNew(t *testing.T) {
+	memory, _ := cbmemory.New(cbmemory.Config{})
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:    "defaultQuorum",
+			config:  Config{Children: []cbtransaction.Storage{memory, memory, memory}},
+			wantErr: false,
+		},
+		{
+			name:    "noChildren",
+			config:  Config{},
+			wantErr: true,
+		},
+		{
+			name:    "quorumTooLarge",
+			config:  Config{Children: []cbtransaction.Storage{memory}, WriteQuorum: 2},
+			wantErr: true,
+		},
+		{
+			name:    "negativeRepairInterval",
+			config:  Config{Children: []cbtransaction.Storage{memory}, RepairInterval: -time.Second},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if s != nil && s.quorum != 2 {
+				t.Errorf("New() quorum = %d, want a majority of 2", s.quorum)
+			}
+		})
+	}
+}
+
+func TestStorage_UploadQuorum(t *testing.T) {
+	tests := []struct {
+		name      string
+		offline   []int
+		reader    io.Reader
+		wantErr   bool
+		wantStale []int
+	}{
+		{
+			name:   "allChildren",
+			reader: strings.NewReader("contents"),
+		},
+		{
+			name:      "quorumMet",
+			offline:   []int{2},
+			reader:    strings.NewReader("contents"),
+			wantStale: []int{2},
+		},
+		{
+			name:    "quorumMissed",
+			offline: []int{1, 2},
+			reader:  strings.NewReader("contents"),
+			wantErr: true,
+		},
+		{
+			name:   "notSeekable",
+			reader: io.MultiReader(strings.NewReader("con"), strings.NewReader("tents")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &recordingErrorHandler{}
+			s, children := getStorage(t, 3, Config{ErrorHandler: handler})
+			for _, i := range tt.offline {
+				children[i].setOffline(true)
+			}
+
+			err := s.Upload("file", tt.reader)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Upload() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				var replicationError *Error
+				if !errors.As(err, &replicationError) || len(replicationError.Errors) != len(tt.offline) || !errors.Is(err, errOffline) {
+					t.Errorf("Upload() error = %v, want an error for every offline child", err)
+				}
+				return
+			}
+			if len(tt.wantStale) > 0 && len(handler.errors) != 1 {
+				t.Errorf("Upload() reported %d errors, want the failed child", len(handler.errors))
+			}
+			for i, status := range s.Status() {
+				stale := len(status.Pending) > 0
+				wantStale := false
+				for _, j := range tt.wantStale {
+					wantStale = wantStale || i == j
+				}
+				if stale != wantStale || status.Healthy == wantStale {
+					t.Errorf("Status()[%d] = %+v, want stale %v", i, status, wantStale)
+				}
+				if !wantStale && contents(t, children[i], "file") != "contents" {
+					t.Errorf("child %d = %s, want contents", i, contents(t, children[i], "file"))
+				}
+			}
+		})
+	}
+}
+
+func TestStorage_DownloadFallback(t *testing.T) {
+	s, children := getStorage(t, 3, Config{})
+	if e := s.Upload("file", strings.NewReader("0123456789")); e != nil {
+		t.Fatal(e)
+	}
+
+	children[0].setOffline(true)
+	if got := contents(t, s, "file"); got != "0123456789" {
+		t.Errorf("Download() = %s, want 0123456789", got)
+	}
+	writer := &bytes.Buffer{}
+	if e := s.DownloadRange("file", 2, 3, writer); e != nil || writer.String() != "234" {
+		t.Errorf("DownloadRange() = %s, %v, want 234", writer.String(), e)
+	}
+	// the offline child is only tried after the healthy ones
+	if order := s.order(); order[len(order)-1] != 0 {
+		t.Errorf("order() = %v, want the failed child last", order)
+	}
+
+	children[1].setOffline(true)
+	children[2].setOffline(true)
+	err := s.Download("file", &bytes.Buffer{})
+	var replicationError *Error
+	if !errors.As(err, &replicationError) || len(replicationError.Errors) != 3 {
+		t.Errorf("Download() error = %v, want an error for every child", err)
+	}
+
+	for _, child := range children {
+		child.setOffline(false)
+	}
+	if e := s.Download("missing", &bytes.Buffer{}); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Download() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	s, children := getStorage(t, 3, Config{})
+
+	generation, e := s.UploadIfGenerationMatch("master", strings.NewReader("v1"), "")
+	if e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+		return
+	}
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v2"), ""); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+	info, e := s.Stat("master")
+	if e != nil || info.Generation != generation {
+		t.Errorf("Stat() generation = %s, %v, want %s", info.Generation, e, generation)
+	}
+
+	// a child which is offline while the generation is read is written unconditionally
+	children[2].setOffline(true)
+	info, _ = s.Stat("master")
+	children[2].setOffline(false)
+	generation, e = s.UploadIfGenerationMatch("master", strings.NewReader("v2"), info.Generation)
+	if e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+		return
+	}
+	for i, child := range children {
+		if got := contents(t, child, "master"); got != "v2" {
+			t.Errorf("child %d master = %s, want v2", i, got)
+		}
+	}
+	if info, _ := s.Stat("master"); info.Generation != generation {
+		t.Errorf("Stat() generation = %s, want %s", info.Generation, generation)
+	}
+
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v3"), "1,2"); e == nil {
+		t.Error("UploadIfGenerationMatch() error = nil for a generation of 2 children")
+	}
+}
+
+func TestStorage_Repair(t *testing.T) {
+	s, children := getStorage(t, 3, Config{})
+	if e := s.Upload("deleted", strings.NewReader("deleted")); e != nil {
+		t.Fatal(e)
+	}
+
+	children[1].setOffline(true)
+	if e := s.Upload("file", strings.NewReader("contents")); e != nil {
+		t.Fatal(e)
+	}
+	if e := s.Delete("deleted"); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := s.Repair(context.Background()); !errors.Is(e, errOffline) {
+		t.Errorf("Repair() error = %v while the child is offline, want %v", e, errOffline)
+	}
+	children[1].setOffline(false)
+	if e := s.Repair(context.Background()); e != nil {
+		t.Errorf("Repair() error = %v", e)
+	}
+
+	if got := contents(t, children[1], "file"); got != "contents" {
+		t.Errorf("child 1 file = %s, want contents", got)
+	}
+	if exists, _ := children[1].Exists("deleted"); exists {
+		t.Error("child 1 still has the deleted object")
+	}
+	if status := s.Status()[1]; !status.Healthy || len(status.Pending) > 0 {
+		t.Errorf("Status()[1] = %+v after Repair", status)
+	}
+}
+
+func TestStorage_RepairAfterRestart(t *testing.T) {
+	s, children := getStorage(t, 3, Config{})
+	children[2].setOffline(true)
+	if e := s.Upload("file", strings.NewReader("contents")); e != nil {
+		t.Fatal(e)
+	}
+	for i, child := range children[:2] {
+		if exists, _ := child.Exists(pendingMarker(2, "file")); !exists {
+			t.Errorf("child %d has no pending marker for child 2", i)
+		}
+	}
+	if objects, _ := s.List(""); len(objects) != 1 || objects[0].Name != "file" {
+		t.Errorf("List() = %+v, want only file", objects)
+	}
+	if e := s.Upload(pendingMarker(2, "file"), strings.NewReader("")); e == nil {
+		t.Error("Upload() error = nil for a pending marker name")
+	}
+
+	// a new Storage over the same children knows nothing pending until it repairs
+	children[2].setOffline(false)
+	restarted, e := New(Config{Children: s.children, ErrorHandler: &recordingErrorHandler{}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := restarted.Repair(context.Background()); e != nil {
+		t.Errorf("Repair() error = %v", e)
+	}
+	if got := contents(t, children[2], "file"); got != "contents" {
+		t.Errorf("child 2 file = %s after Repair, want contents", got)
+	}
+	for i, child := range children {
+		if exists, _ := child.Exists(pendingMarker(2, "file")); exists {
+			t.Errorf("child %d kept the pending marker after Repair", i)
+		}
+	}
+	if status := restarted.Status()[2]; len(status.Pending) > 0 {
+		t.Errorf("Status()[2] = %+v after Repair", status)
+	}
+}
+
+func TestStorage_RepairMissedQuorum(t *testing.T) {
+	s, children := getStorage(t, 3, Config{})
+	if e := s.Upload("file", strings.NewReader("old")); e != nil {
+		t.Fatal(e)
+	}
+
+	children[1].setOffline(true)
+	children[2].setOffline(true)
+	if e := s.Upload("file", strings.NewReader("new")); e == nil {
+		t.Fatal("Upload() error = nil without the quorum")
+	}
+	if status := s.Status()[0]; !reflect.DeepEqual(status.Pending, []string{"file"}) {
+		t.Errorf("Status()[0] = %+v, want the child which took the write pending", status)
+	}
+
+	children[1].setOffline(false)
+	children[2].setOffline(false)
+	if e := s.Repair(context.Background()); e != nil {
+		t.Errorf("Repair() error = %v", e)
+	}
+	for i, child := range children {
+		if got := contents(t, child, "file"); got != "old" {
+			t.Errorf("child %d file = %s after Repair, want the write undone", i, got)
+		}
+	}
+}
+
+func TestStorage_RepairInBackground(t *testing.T) {
+	s, children := getStorage(t, 2, Config{WriteQuorum: 1, RepairInterval: time.Millisecond * 10})
+	defer s.Close()
+
+	children[0].setOffline(true)
+	if e := s.Upload("file", strings.NewReader("contents")); e != nil {
+		t.Fatal(e)
+	}
+	children[0].setOffline(false)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(s.Status()[0].Pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := contents(t, children[0], "file"); got != "contents" {
+		t.Errorf("child 0 file = %s after the background repair, want contents", got)
+	}
+}
+
+func TestStorage_ListStatConcat(t *testing.T) {
+	s, children := getStorage(t, 2, Config{})
+	for _, filename := range []string{"log", "batch"} {
+		if e := s.Upload(filename, strings.NewReader(filename+",")); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := s.Concat("log", "log", "batch"); e != nil {
+		t.Errorf("Concat() error = %v", e)
+	}
+	if got := contents(t, children[1], "log"); got != "log,batch," {
+		t.Errorf("child 1 log = %s, want log,batch,", got)
+	}
+
+	children[0].setOffline(true)
+	objects, e := s.List("")
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if e != nil || !reflect.DeepEqual(names, []string{"batch", "log"}) {
+		t.Errorf("List() = %v, %v, want batch and log", names, e)
+	}
+	if exists, e := s.Exists("log"); !exists || e != nil {
+		t.Errorf("Exists() = %v, %v, want true", exists, e)
+	}
+	if exists, e := s.Exists("missing"); exists || e != nil {
+		t.Errorf("Exists() = %v, %v, want false", exists, e)
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	s, _ := getStorage(t, 3, Config{})
+	storagetest.Contract(t, s)
+}
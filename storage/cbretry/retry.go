@@ -0,0 +1,411 @@
+package cbretry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts  = 5
+	defaultInitialDelay = time.Millisecond * 100
+	defaultMaxDelay     = time.Second * 10
+	defaultMultiplier   = 2
+	defaultJitter       = 0.2
+)
+
+// Retryable is the default classification of errors: network errors, cut off
+// responses and errors with a Temporary method returning true, such as the
+// cbs3, cbazureblob and cbhttp errors for 5xx and 429 responses, are retried.
+// Missing objects, failed preconditions and cancelled contexts never are
+func Retryable(e error) bool {
+	switch {
+	case e == nil:
+		return false
+	case errors.Is(e, context.Canceled),
+		errors.Is(e, context.DeadlineExceeded),
+		errors.Is(e, cbstorage.ErrNotExist),
+		errors.Is(e, cbstorage.ErrNotSupported),
+		errors.Is(e, cbstorage.ErrPreconditionFailed):
+		return false
+	case errors.Is(e, io.ErrUnexpectedEOF):
+		return true
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(e, &temporary) && temporary.Temporary() {
+		return true
+	}
+	var googleError *googleapi.Error
+	if errors.As(e, &googleError) {
+		return googleError.Code >= 500 || googleError.Code == 429 || googleError.Code == 408
+	}
+	var networkError net.Error
+	return errors.As(e, &networkError)
+}
+
+// Error is returned when the last attempt failed
+type Error struct {
+	Attempts int
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Storage retries the operations of another Storage which fail with a
+// retryable error, waiting an exponentially growing delay between attempts.
+//
+// Upload bodies are re-read from the start for every attempt, bodies which
+// are not an io.Seeker are buffered in a temporary file first. Downloads which
+// fail part way continue after the bytes already written.
+//
+// A retried Delete or UploadIfGenerationMatch whose earlier attempt succeeded
+// without the response arriving fails with storage.ErrNotExist or
+// storage.ErrPreconditionFailed
+type Storage struct {
+	storage      cbtransaction.Storage
+	maxAttempts  int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	jitter       float64
+	retryable    func(e error) bool
+	tempDir      string
+	logger       cbtransaction.Logger
+
+	randomLock sync.Mutex
+	random     *rand.Rand
+}
+
+type Config struct {
+	Storage cbtransaction.Storage
+	// MaxAttempts includes the first attempt, defaults to 5
+	MaxAttempts int
+	// InitialDelay is the wait before the first retry, defaults to 100ms
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between attempts, defaults to 10s
+	MaxDelay time.Duration
+	// Multiplier grows the delay after every retry, defaults to 2
+	Multiplier float64
+	// Jitter randomly shortens every delay by up to this fraction, so clients
+	// failing together do not retry together. Defaults to 0.2, -1 disables it
+	Jitter float64
+	// Retryable classifies errors, defaults to Retryable
+	Retryable func(e error) bool
+	// TempDir is where upload bodies which cannot be re-read are buffered,
+	// defaults to os.TempDir()
+	TempDir string
+	// Logger receives a message for every retry, nothing is logged when nil
+	Logger cbtransaction.Logger
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Storage == nil {
+		return nil, errors.New("no storage given")
+	}
+	if config.MaxAttempts < 0 || config.InitialDelay < 0 || config.MaxDelay < 0 || config.Multiplier < 0 {
+		return nil, errors.New("invalid retry configuration: negative value")
+	}
+	if config.Jitter == -1 {
+		config.Jitter = 0
+	} else if config.Jitter == 0 {
+		config.Jitter = defaultJitter
+	}
+	if config.Jitter < 0 || config.Jitter > 1 {
+		return nil, fmt.Errorf("invalid jitter: %f", config.Jitter)
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.InitialDelay == 0 {
+		config.InitialDelay = defaultInitialDelay
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = defaultMaxDelay
+	}
+	if config.Multiplier == 0 {
+		config.Multiplier = defaultMultiplier
+	}
+	if config.Retryable == nil {
+		config.Retryable = Retryable
+	}
+
+	return &Storage{
+		storage:      config.Storage,
+		maxAttempts:  config.MaxAttempts,
+		initialDelay: config.InitialDelay,
+		maxDelay:     config.MaxDelay,
+		multiplier:   config.Multiplier,
+		jitter:       config.Jitter,
+		retryable:    config.Retryable,
+		tempDir:      config.TempDir,
+		logger:       config.Logger,
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// delay returns the wait before the given retry, starting at 1
+func (s *Storage) delay(retry int) time.Duration {
+	delay := float64(s.initialDelay)
+	for i := 1; i < retry && delay < float64(s.maxDelay); i++ {
+		delay *= s.multiplier
+	}
+	if delay > float64(s.maxDelay) {
+		delay = float64(s.maxDelay)
+	}
+
+	s.randomLock.Lock()
+	delay -= delay * s.jitter * s.random.Float64()
+	s.randomLock.Unlock()
+
+	return time.Duration(delay)
+}
+
+// retry calls attempt until it succeeds, fails with an error which is not
+// retryable or runs out of attempts
+func (s *Storage) retry(ctx context.Context, op string, filename string, attempt func() error) error {
+	for i := 1; ; i++ {
+		e := attempt()
+		var failedWrite writeError
+		if errors.As(e, &failedWrite) {
+			return failedWrite.error
+		}
+		if e == nil || !s.retryable(e) {
+			return e
+		}
+		if i >= s.maxAttempts {
+			return &Error{Attempts: i, Err: e}
+		}
+
+		delay := s.delay(i)
+		if s.logger != nil {
+			s.logger.InfoF("cbretry", "%s %s failed, retrying in %s: %v", op, filename, delay, e)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// rewindable returns a function which returns the body positioned at its
+// start for every attempt
+func (s *Storage) rewindable(reader io.Reader) (func() (io.Reader, error), func(), error) {
+	cleanup := func() {}
+	seeker, ok := reader.(io.ReadSeeker)
+	if !ok {
+		file, e := ioutil.TempFile(s.tempDir, "cbretry-")
+		if e != nil {
+			return nil, nil, e
+		}
+		cleanup = func() {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+		if _, e := io.Copy(file, reader); e != nil {
+			cleanup()
+			return nil, nil, e
+		}
+		if _, e := file.Seek(0, io.SeekStart); e != nil {
+			cleanup()
+			return nil, nil, e
+		}
+		seeker = file
+	}
+
+	start, e := seeker.Seek(0, io.SeekCurrent)
+	if e != nil {
+		cleanup()
+		return nil, nil, e
+	}
+	return func() (io.Reader, error) {
+		if _, e := seeker.Seek(start, io.SeekStart); e != nil {
+			return nil, writeError{e}
+		}
+		return seeker, nil
+	}, cleanup, nil
+}
+
+// writeError is a failure outside of the storage, such as the caller's
+// writer failing, which is never retried
+type writeError struct {
+	error
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, e := w.writer.Write(p)
+	w.written += int64(n)
+	if e != nil {
+		return n, writeError{e}
+	}
+	return n, nil
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if s.maxAttempts == 1 {
+		return s.storage.UploadContext(ctx, filename, reader)
+	}
+	rewind, cleanup, e := s.rewindable(reader)
+	if e != nil {
+		return e
+	}
+	defer cleanup()
+
+	return s.retry(ctx, "upload", filename, func() error {
+		body, e := rewind()
+		if e != nil {
+			return e
+		}
+		return s.storage.UploadContext(ctx, filename, body)
+	})
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return s.DownloadRangeContext(ctx, filename, 0, -1, writer)
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	counter := &countingWriter{writer: writer}
+
+	return s.retry(ctx, "download", filename, func() error {
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - counter.written
+			if remaining == 0 {
+				return nil
+			}
+		}
+		if offset == 0 && remaining < 0 && counter.written == 0 {
+			return s.storage.DownloadContext(ctx, filename, counter)
+		}
+		return s.storage.DownloadRangeContext(ctx, filename, offset+counter.written, remaining, counter)
+	})
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	return s.retry(ctx, "concat", destination, func() error {
+		return s.storage.ConcatContext(ctx, destination, filenames...)
+	})
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	return s.retry(ctx, "delete", filename, func() error {
+		return s.storage.DeleteContext(ctx, filename)
+	})
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	var objects []cbstorage.ObjectInfo
+	e := s.retry(ctx, "list", prefix, func() error {
+		var e error
+		objects, e = s.storage.ListContext(ctx, prefix)
+		return e
+	})
+
+	return objects, e
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	var info cbstorage.ObjectInfo
+	e := s.retry(ctx, "stat", filename, func() error {
+		var e error
+		info, e = s.storage.StatContext(ctx, filename)
+		return e
+	})
+
+	return info, e
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	var exists bool
+	e := s.retry(ctx, "exists", filename, func() error {
+		var e error
+		exists, e = s.storage.ExistsContext(ctx, filename)
+		return e
+	})
+
+	return exists, e
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if s.maxAttempts == 1 {
+		return s.storage.UploadIfGenerationMatchContext(ctx, filename, reader, generation)
+	}
+	rewind, cleanup, e := s.rewindable(reader)
+	if e != nil {
+		return "", e
+	}
+	defer cleanup()
+
+	var next string
+	e = s.retry(ctx, "upload", filename, func() error {
+		body, e := rewind()
+		if e != nil {
+			return e
+		}
+		next, e = s.storage.UploadIfGenerationMatchContext(ctx, filename, body, generation)
+		return e
+	})
+
+	return next, e
+}
@@ -0,0 +1,293 @@
+package cbretry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/cbhttp"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"google.golang.org/api/googleapi"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errTemporary = &cbhttp.StatusError{StatusCode: 503, URL: "http://example.com"}
+
+// flakyStorage is a cbmemory.Storage whose uploads and downloads fail with err
+// the next failures times. Failed uploads read part of the body first and
+// failed downloads write part of the object first
+type flakyStorage struct {
+	*cbmemory.Storage
+	failures int
+	err      error
+	attempts int
+}
+
+func (f *flakyStorage) fail() bool {
+	f.attempts++
+	if f.failures > 0 {
+		f.failures--
+		return true
+	}
+	return false
+}
+
+func (f *flakyStorage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if f.fail() {
+		_, _ = io.CopyN(ioutil.Discard, reader, 2)
+		return f.err
+	}
+	return f.Storage.UploadContext(ctx, filename, reader)
+}
+
+func (f *flakyStorage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	return f.DownloadRangeContext(ctx, filename, 0, -1, writer)
+}
+
+func (f *flakyStorage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if f.fail() {
+		if e := f.Storage.DownloadRangeContext(ctx, filename, offset, 2, writer); e != nil {
+			return e
+		}
+		return f.err
+	}
+	return f.Storage.DownloadRangeContext(ctx, filename, offset, length, writer)
+}
+
+func (f *flakyStorage) DeleteContext(ctx context.Context, filename string) error {
+	if f.fail() {
+		return f.err
+	}
+	return f.Storage.DeleteContext(ctx, filename)
+}
+
+func getStorage(t *testing.T, failures int, err error) (*Storage, *flakyStorage) {
+	memory, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	flaky := &flakyStorage{Storage: memory, failures: failures, err: err}
+	s, e := New(Config{Storage: flaky, MaxAttempts: 3, InitialDelay: time.Millisecond})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s, flaky
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			want: false,
+		},
+		{
+			name: "notExist",
+			err:  fmt.Errorf("%w: file", cbstorage.ErrNotExist),
+			want: false,
+		},
+		{
+			name: "preconditionFailed",
+			err:  fmt.Errorf("%w: master", cbstorage.ErrPreconditionFailed),
+			want: false,
+		},
+		{
+			name: "cancelled",
+			err:  context.Canceled,
+			want: false,
+		},
+		{
+			name: "serviceUnavailable",
+			err:  fmt.Errorf("download: %w", errTemporary),
+			want: true,
+		},
+		{
+			name: "forbidden",
+			err:  &cbhttp.StatusError{StatusCode: 403},
+			want: false,
+		},
+		{
+			name: "googleRateLimited",
+			err:  &googleapi.Error{Code: 429},
+			want: true,
+		},
+		{
+			name: "googleNotFound",
+			err:  &googleapi.Error{Code: 404},
+			want: false,
+		},
+		{
+			name: "network",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			want: true,
+		},
+		{
+			name: "unexpectedEOF",
+			err:  io.ErrUnexpectedEOF,
+			want: true,
+		},
+		{
+			name: "other",
+			err:  errors.New("invalid filename"),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Retryable(tt.err); got != tt.want {
+				t.Errorf("Retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_delay(t *testing.T) {
+	s, e := New(Config{Storage: &flakyStorage{}, InitialDelay: time.Second, MaxDelay: time.Second * 5, Jitter: -1})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: time.Second * 2, 3: time.Second * 4, 4: time.Second * 5, 50: time.Second * 5} {
+		if got := s.delay(retry); got != want {
+			t.Errorf("delay(%d) = %s, want %s", retry, got, want)
+		}
+	}
+
+	s.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := s.delay(1); got < time.Millisecond*500 || got > time.Second {
+			t.Errorf("delay(1) = %s with jitter, want between 500ms and 1s", got)
+		}
+	}
+}
+
+func TestStorage_Upload(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		err          error
+		reader       io.Reader
+		wantErr      bool
+		wantAttempts int
+	}{
+		{
+			name:         "firstAttempt",
+			failures:     0,
+			err:          errTemporary,
+			reader:       strings.NewReader("contents"),
+			wantAttempts: 1,
+		},
+		{
+			name:         "retriedSeeker",
+			failures:     2,
+			err:          errTemporary,
+			reader:       strings.NewReader("contents"),
+			wantAttempts: 3,
+		},
+		{
+			name:         "retriedBuffered",
+			failures:     2,
+			err:          errTemporary,
+			reader:       io.MultiReader(strings.NewReader("con"), strings.NewReader("tents")),
+			wantAttempts: 3,
+		},
+		{
+			name:         "tooManyFailures",
+			failures:     3,
+			err:          errTemporary,
+			reader:       strings.NewReader("contents"),
+			wantErr:      true,
+			wantAttempts: 3,
+		},
+		{
+			name:         "notRetryable",
+			failures:     1,
+			err:          errors.New("permission denied"),
+			reader:       strings.NewReader("contents"),
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, flaky := getStorage(t, tt.failures, tt.err)
+			err := s.Upload("file", tt.reader)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Upload() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if flaky.attempts != tt.wantAttempts {
+				t.Errorf("Upload() attempts = %d, want %d", flaky.attempts, tt.wantAttempts)
+			}
+			if err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Upload() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			writer := &bytes.Buffer{}
+			_ = flaky.Storage.Download("file", writer)
+			if writer.String() != "contents" {
+				t.Errorf("Upload() stored %s, want the full body", writer.String())
+			}
+		})
+	}
+}
+
+func TestStorage_Download(t *testing.T) {
+	s, flaky := getStorage(t, 2, errTemporary)
+	_ = flaky.Storage.Upload("file", strings.NewReader("0123456789"))
+
+	writer := &bytes.Buffer{}
+	if e := s.Download("file", writer); e != nil {
+		t.Errorf("Download() error = %v", e)
+		return
+	}
+	if writer.String() != "0123456789" {
+		t.Errorf("Download() = %s, want every byte exactly once", writer.String())
+	}
+
+	flaky.failures = 1
+	writer.Reset()
+	if e := s.DownloadRange("file", 3, 5, writer); e != nil || writer.String() != "34567" {
+		t.Errorf("DownloadRange() = %s, %v, want 34567", writer.String(), e)
+	}
+
+	flaky.attempts = 0
+	if e := s.Download("missing", writer); !errors.Is(e, cbstorage.ErrNotExist) || flaky.attempts != 1 {
+		t.Errorf("Download() error = %v after %d attempts, want %v without retries", e, flaky.attempts, cbstorage.ErrNotExist)
+	}
+}
+
+func TestStorage_Cancel(t *testing.T) {
+	memory, _ := cbmemory.New(cbmemory.Config{})
+	flaky := &flakyStorage{Storage: memory, failures: 5, err: errTemporary}
+	s, e := New(Config{Storage: flaky, InitialDelay: time.Hour})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if e := s.DeleteContext(ctx, "file"); !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("DeleteContext() error = %v, want %v", e, context.DeadlineExceeded)
+	}
+	if flaky.attempts != 1 {
+		t.Errorf("DeleteContext() attempts = %d, want 1", flaky.attempts)
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	s, _ := getStorage(t, 0, nil)
+	storagetest.Contract(t, s)
+}
@@ -0,0 +1,497 @@
+package cbs3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeAccessKeyId     = "AKIDFAKE"
+	fakeSecretAccessKey = "fake-secret"
+	fakeRegion          = "eu-west-1"
+)
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int]*fakeObject
+}
+
+// fakeS3 implements the parts of the S3 REST API used by Storage with path
+// style addressing. Every request must carry a valid SigV4 signature
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+	// maxKeys limits the number of keys in a list response
+	maxKeys int
+
+	lock          sync.Mutex
+	objects       map[string]*fakeObject
+	uploads       map[string]*fakeUpload
+	lastUploadId  int
+	puts          int
+	uploadedParts int
+	copiedParts   int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	f := &fakeS3{
+		bucket:  bucket,
+		maxKeys: 1000,
+		objects: map[string]*fakeObject{},
+		uploads: map[string]*fakeUpload{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeS3) config() Config {
+	return Config{
+		Bucket:          f.bucket,
+		Region:          fakeRegion,
+		Endpoint:        f.URL,
+		AccessKeyId:     fakeAccessKeyId,
+		SecretAccessKey: fakeSecretAccessKey,
+		PathStyle:       true,
+		PartSize:        minPartSize,
+		HTTPClient:      f.Client(),
+	}
+}
+
+func (f *fakeS3) storage(t *testing.T) *Storage {
+	s, e := New(f.config())
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.objects[key] = newFakeObject(data)
+}
+
+func (f *fakeS3) get(key string) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	object, ok := f.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return object.data, true
+}
+
+func newFakeObject(data []byte) *fakeObject {
+	hash := md5.Sum(data)
+	return &fakeObject{data: data, etag: `"` + hex.EncodeToString(hash[:]) + `"`, modified: time.Now()}
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody", e.Error())
+		return
+	}
+	if e := f.verify(r, body); e != nil {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch", e.Error())
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != f.bucket && !strings.HasPrefix(path, f.bucket+"/") {
+		f.error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, f.bucket), "/")
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case key == "":
+		f.error(w, http.StatusBadRequest, "InvalidRequest", "unsupported bucket request")
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		f.createUpload(w, key)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		f.completeUpload(w, r, key, body)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "" && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copyPart(w, r, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		f.uploadPart(w, r, key, body)
+	case r.Method == http.MethodPut:
+		f.putObject(w, r, key, body)
+	case r.Method == http.MethodGet:
+		f.getObject(w, r, key)
+	case r.Method == http.MethodHead:
+		f.headObject(w, key)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusBadRequest, "InvalidRequest", "unsupported request: "+r.Method+" "+r.URL.String())
+	}
+}
+
+// verify recomputes the signature from the headers the client claims to have signed
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, signingAlgorithm+" Credential="+fakeAccessKeyId+"/") {
+		return fmt.Errorf("unknown credential: %s", authorization)
+	}
+	bodyHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(bodyHash[:]) {
+		return fmt.Errorf("payload hash does not match the body")
+	}
+	date, e := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if e != nil {
+		return e
+	}
+	signedHeaders := ""
+	for _, field := range strings.Split(authorization, ", ") {
+		if strings.HasPrefix(field, "SignedHeaders=") {
+			signedHeaders = strings.TrimPrefix(field, "SignedHeaders=")
+		}
+	}
+
+	expected := &http.Request{
+		Method: r.Method,
+		URL:    &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:   r.Host,
+		Header: http.Header{},
+	}
+	for _, name := range strings.Split(signedHeaders, ";") {
+		if name != "host" {
+			expected.Header[http.CanonicalHeaderKey(name)] = r.Header[http.CanonicalHeaderKey(name)]
+		}
+	}
+	s := &signer{
+		accessKeyId:     fakeAccessKeyId,
+		secretAccessKey: fakeSecretAccessKey,
+		region:          fakeRegion,
+		now:             func() time.Time { return date },
+	}
+	s.sign(expected, r.Header.Get("X-Amz-Content-Sha256"))
+	if expected.Header.Get("Authorization") != authorization {
+		return fmt.Errorf("signature mismatch, expected %s", expected.Header.Get("Authorization"))
+	}
+
+	return nil
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		RequestId string
+	}{Code: code, Message: message, RequestId: "fake-request"})
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(value)
+}
+
+// checkConditions applies If-Match and If-None-Match: * like S3, which reports
+// If-Match on a missing object as a missing key
+func (f *fakeS3) checkConditions(w http.ResponseWriter, r *http.Request, key string) bool {
+	object, exists := f.objects[key]
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		f.error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return false
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists {
+			f.error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return false
+		}
+		if match != object.etag {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	if !f.checkConditions(w, r, key) {
+		return
+	}
+	f.puts++
+	object := newFakeObject(body)
+	f.objects[key] = object
+	w.Header().Set("ETag", object.etag)
+}
+
+func (f *fakeS3) createUpload(w http.ResponseWriter, key string) {
+	f.lastUploadId++
+	uploadId := "upload-" + strconv.Itoa(f.lastUploadId)
+	f.uploads[uploadId] = &fakeUpload{key: key, parts: map[int]*fakeObject{}}
+	f.writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: f.bucket, Key: key, UploadId: uploadId})
+}
+
+func (f *fakeS3) upload(w http.ResponseWriter, r *http.Request, key string) (*fakeUpload, int, bool) {
+	upload, ok := f.uploads[r.URL.Query().Get("uploadId")]
+	if !ok || upload.key != key {
+		f.error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return nil, 0, false
+	}
+	partNumber, e := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if r.Method == http.MethodPut && (e != nil || partNumber < 1 || partNumber > maxParts) {
+		f.error(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return nil, 0, false
+	}
+	return upload, partNumber, true
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	upload, partNumber, ok := f.upload(w, r, key)
+	if !ok {
+		return
+	}
+	f.uploadedParts++
+	part := newFakeObject(body)
+	upload.parts[partNumber] = part
+	w.Header().Set("ETag", part.etag)
+}
+
+func (f *fakeS3) copyPart(w http.ResponseWriter, r *http.Request, key string) {
+	upload, partNumber, ok := f.upload(w, r, key)
+	if !ok {
+		return
+	}
+	source, e := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if e != nil || !strings.HasPrefix(source, "/"+f.bucket+"/") {
+		f.error(w, http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+		return
+	}
+	object, exists := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+	if !exists {
+		f.error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	data := object.data
+	if sourceRange := r.Header.Get("X-Amz-Copy-Source-Range"); sourceRange != "" {
+		start, end, ok := parseRange(sourceRange, int64(len(data)))
+		if !ok || end >= int64(len(data)) {
+			f.error(w, http.StatusBadRequest, "InvalidArgument", "invalid copy source range")
+			return
+		}
+		data = data[start : end+1]
+	}
+	if int64(len(data)) > maxCopyPartSize {
+		f.error(w, http.StatusBadRequest, "InvalidRequest", "copy part too large")
+		return
+	}
+	f.copiedParts++
+	part := newFakeObject(append([]byte{}, data...))
+	upload.parts[partNumber] = part
+	f.writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified time.Time
+	}{ETag: part.etag, LastModified: part.modified})
+}
+
+func (f *fakeS3) completeUpload(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	upload, _, ok := f.upload(w, r, key)
+	if !ok {
+		return
+	}
+	request := struct {
+		Parts []completedPart `xml:"Part"`
+	}{}
+	if e := xml.Unmarshal(body, &request); e != nil || len(request.Parts) == 0 {
+		f.error(w, http.StatusBadRequest, "MalformedXML", "invalid part list")
+		return
+	}
+	var data, hashes []byte
+	for i, completed := range request.Parts {
+		part, ok := upload.parts[completed.PartNumber]
+		if !ok || part.etag != completed.ETag || (i > 0 && completed.PartNumber <= request.Parts[i-1].PartNumber) {
+			f.error(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+			return
+		}
+		if i < len(request.Parts)-1 && len(part.data) < minPartSize {
+			f.error(w, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size")
+			return
+		}
+		data = append(data, part.data...)
+		hash := md5.Sum(part.data)
+		hashes = append(hashes, hash[:]...)
+	}
+	if !f.checkConditions(w, r, key) {
+		return
+	}
+	delete(f.uploads, r.URL.Query().Get("uploadId"))
+	hash := md5.Sum(hashes)
+	object := &fakeObject{
+		data:     data,
+		etag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(hash[:]), len(request.Parts)),
+		modified: time.Now(),
+	}
+	f.objects[key] = object
+	f.writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: f.bucket, Key: key, ETag: object.etag})
+}
+
+func (f *fakeS3) writeObjectHeaders(w http.ResponseWriter, object *fakeObject) {
+	w.Header().Set("ETag", object.etag)
+	w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+}
+
+func (f *fakeS3) headObject(w http.ResponseWriter, key string) {
+	object, ok := f.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.writeObjectHeaders(w, object)
+	w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := f.objects[key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	f.writeObjectHeaders(w, object)
+	size := int64(len(object.data))
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, _ = w.Write(object.data)
+		return
+	}
+	start, end, ok := parseRange(rangeHeader, size)
+	if !ok {
+		f.error(w, http.StatusBadRequest, "InvalidArgument", "invalid range")
+		return
+	}
+	if start >= size {
+		f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+		return
+	}
+	if end >= size {
+		end = size - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(object.data[start : end+1])
+}
+
+// parseRange parses bytes=start-end and bytes=start-
+func parseRange(header string, size int64) (int64, int64, bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, e := strconv.ParseInt(bounds[0], 10, 64)
+	if e != nil {
+		return 0, 0, false
+	}
+	end := size - 1
+	if bounds[1] != "" {
+		end, e = strconv.ParseInt(bounds[1], 10, 64)
+		if e != nil || end < start {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+type fakeContents struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key >= query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []fakeContents
+	}{Name: f.bucket, Prefix: prefix}
+	if len(keys) > f.maxKeys {
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[f.maxKeys]
+		keys = keys[:f.maxKeys]
+	}
+	for _, key := range keys {
+		object := f.objects[key]
+		result.Contents = append(result.Contents, fakeContents{
+			Key:          key,
+			LastModified: object.modified.UTC(),
+			ETag:         object.etag,
+			Size:         len(object.data),
+		})
+	}
+	result.KeyCount = len(keys)
+	f.writeXML(w, result)
+}
+
+// pattern returns size bytes that differ between offsets, so misplaced ranges are noticed
+func pattern(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
+
+func joined(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,122 @@
+package cbs3
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type multipartUpload struct {
+	storage   *Storage
+	key       string
+	uploadId  string
+	parts     []completedPart
+	completed bool
+}
+
+func (s *Storage) createMultipartUpload(ctx context.Context, key string) (*multipartUpload, error) {
+	result := struct {
+		UploadId string
+	}{}
+	e := s.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &result)
+	if e != nil {
+		return nil, e
+	}
+	if result.UploadId == "" {
+		return nil, fmt.Errorf("no upload id returned for %s", key)
+	}
+
+	return &multipartUpload{storage: s, key: key, uploadId: result.UploadId}, nil
+}
+
+func (u *multipartUpload) nextPartNumber() (int, error) {
+	if len(u.parts) >= maxParts {
+		return 0, fmt.Errorf("%s needs more than %d parts", u.key, maxParts)
+	}
+	return len(u.parts) + 1, nil
+}
+
+func (u *multipartUpload) partQuery(partNumber int) url.Values {
+	return url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {u.uploadId}}
+}
+
+func (u *multipartUpload) uploadPart(ctx context.Context, data []byte) error {
+	partNumber, e := u.nextPartNumber()
+	if e != nil {
+		return e
+	}
+	response, e := u.storage.do(ctx, http.MethodPut, u.key, u.partQuery(partNumber), nil, data)
+	if e != nil {
+		return e
+	}
+	defer response.Body.Close()
+
+	u.parts = append(u.parts, completedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+
+	return nil
+}
+
+// copyPart adds length bytes of source starting at offset as the next part,
+// copied server side with UploadPartCopy
+func (u *multipartUpload) copyPart(ctx context.Context, source string, offset int64, length int64) error {
+	partNumber, e := u.nextPartNumber()
+	if e != nil {
+		return e
+	}
+	header := http.Header{
+		"X-Amz-Copy-Source":       {"/" + escape(u.storage.bucket, true) + "/" + escape(source, false)},
+		"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)},
+	}
+	result := struct {
+		ETag string
+	}{}
+	e = u.storage.doXML(ctx, http.MethodPut, u.key, u.partQuery(partNumber), header, nil, &result)
+	if e != nil {
+		return u.storage.notExist(e, source)
+	}
+
+	u.parts = append(u.parts, completedPart{PartNumber: partNumber, ETag: result.ETag})
+
+	return nil
+}
+
+// complete assembles the parts into the object and returns its ETag. header
+// holds the conditional headers for the object
+func (u *multipartUpload) complete(ctx context.Context, header http.Header) (string, error) {
+	body, e := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: u.parts})
+	if e != nil {
+		return "", e
+	}
+	result := struct {
+		ETag string
+	}{}
+	e = u.storage.doXML(ctx, http.MethodPost, u.key, url.Values{"uploadId": {u.uploadId}}, header, body, &result)
+	if e != nil {
+		return "", e
+	}
+	u.completed = true
+
+	return result.ETag, nil
+}
+
+// abortUnlessCompleted discards the uploaded parts, S3 keeps and bills for them otherwise
+func (u *multipartUpload) abortUnlessCompleted() {
+	if u.completed {
+		return
+	}
+	response, e := u.storage.do(context.Background(), http.MethodDelete, u.key, url.Values{"uploadId": {u.uploadId}}, nil, nil)
+	if e == nil {
+		_ = response.Body.Close()
+	}
+}
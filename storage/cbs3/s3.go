@@ -0,0 +1,639 @@
+package cbs3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPartSize = 16 * 1024 * 1024
+	// S3 rejects multipart uploads with a part other than the last one smaller than this
+	minPartSize = 5 * 1024 * 1024
+	// UploadPartCopy copies at most this many bytes per part
+	maxCopyPartSize = 5 * 1024 * 1024 * 1024
+	maxParts        = 10000
+)
+
+type Storage struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	partSize  int64
+	signer    *signer
+}
+
+type Config struct {
+	Bucket string
+	Region string
+	// Endpoint is the base URL of the S3 API, defaults to https://s3.<Region>.amazonaws.com
+	Endpoint        string
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses objects as <Endpoint>/<Bucket>/<key> instead of
+	// <Bucket>.<Endpoint host>/<key>, most S3 compatible stores need it
+	PathStyle bool
+	// PartSize is the size of the parts of multipart uploads, smaller uploads
+	// are sent in a single request. Defaults to 16MB, S3 requires at least 5MB
+	PartSize   int64
+	HTTPClient *http.Client
+}
+
+// Error is an error response from S3
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: status %d: %s: %s (request id %s)", e.StatusCode, e.Code, e.Message, e.RequestId)
+}
+
+// Temporary reports whether the request may succeed when retried
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("invalid bucket name")
+	}
+	if config.Region == "" {
+		return nil, errors.New("invalid region")
+	}
+	if config.AccessKeyId == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("empty access key id or secret access key")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	endpoint, e := url.Parse(config.Endpoint)
+	if e != nil {
+		return nil, e
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %s", config.Endpoint)
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	endpoint.RawPath = ""
+	if config.PartSize == 0 {
+		config.PartSize = defaultPartSize
+	}
+	if config.PartSize < minPartSize || config.PartSize > maxCopyPartSize {
+		return nil, fmt.Errorf("invalid part size: %d", config.PartSize)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	return &Storage{
+		client:    config.HTTPClient,
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		pathStyle: config.PathStyle,
+		partSize:  config.PartSize,
+		signer: &signer{
+			accessKeyId:     config.AccessKeyId,
+			secretAccessKey: config.SecretAccessKey,
+			sessionToken:    config.SessionToken,
+			region:          config.Region,
+			now:             time.Now,
+		},
+	}, nil
+}
+
+func (s *Storage) checkFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." {
+		return fmt.Errorf("invalid filename: %s", filename)
+	}
+
+	return nil
+}
+
+// url returns the address of key in the bucket, or of the bucket itself for an empty key
+func (s *Storage) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path, rawPath := u.Path, u.Path
+	if s.pathStyle {
+		path += "/" + s.bucket
+		rawPath += "/" + escape(s.bucket, true)
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	if key != "" || !s.pathStyle {
+		path += "/" + key
+		rawPath += "/" + escape(key, false)
+	}
+	u.Path = path
+	u.RawPath = rawPath
+	u.RawQuery = encodeQuery(query)
+
+	return &u
+}
+
+// do sends a signed request and returns the response if S3 reported success,
+// the caller must close its body. Error responses are returned as *Error
+func (s *Storage) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, e := http.NewRequest(method, s.url(key, query).String(), bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(hash[:])
+	}
+	s.signer.sign(req, payloadHash)
+
+	response, e := s.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		return nil, readError(response)
+	}
+
+	return response, nil
+}
+
+func readError(response *http.Response) error {
+	apiError := &Error{StatusCode: response.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	errorBody := struct {
+		Code      string
+		Message   string
+		RequestId string
+	}{}
+	if xml.Unmarshal(body, &errorBody) == nil {
+		apiError.Code = errorBody.Code
+		apiError.Message = errorBody.Message
+		apiError.RequestId = errorBody.RequestId
+	}
+
+	return apiError
+}
+
+// doXML sends a request and decodes the XML response into result. S3 can
+// report a failed copy or multipart completion with a 200 response carrying an
+// Error document, which is returned as an *Error
+func (s *Storage) doXML(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte, result interface{}) error {
+	response, e := s.do(ctx, method, key, query, header, body)
+	if e != nil {
+		return e
+	}
+	defer response.Body.Close()
+
+	responseBody, e := ioutil.ReadAll(response.Body)
+	if e != nil {
+		return e
+	}
+	root := struct {
+		XMLName   xml.Name
+		Code      string
+		Message   string
+		RequestId string
+	}{}
+	if e := xml.Unmarshal(responseBody, &root); e != nil {
+		return e
+	}
+	if root.XMLName.Local == "Error" {
+		return &Error{StatusCode: response.StatusCode, Code: root.Code, Message: root.Message, RequestId: root.RequestId}
+	}
+
+	return xml.Unmarshal(responseBody, result)
+}
+
+func statusCode(e error) int {
+	var apiError *Error
+	if errors.As(e, &apiError) {
+		return apiError.StatusCode
+	}
+	return 0
+}
+
+func (s *Storage) notExist(e error, filename string) error {
+	if statusCode(e) == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+	return e
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+
+	_, e := s.upload(ctx, filename, reader, nil)
+
+	return e
+}
+
+// upload sends reader in a single PutObject request if it is no larger than
+// the part size and as a multipart upload otherwise. header holds the
+// conditional headers and is sent with the request that creates the object.
+// It returns the ETag of the new object
+func (s *Storage) upload(ctx context.Context, filename string, reader io.Reader, header http.Header) (string, error) {
+	first, e := readPart(reader, s.partSize)
+	if e != nil {
+		return "", e
+	}
+	var second []byte
+	if int64(len(first)) == s.partSize {
+		second, e = readPart(reader, s.partSize)
+		if e != nil {
+			return "", e
+		}
+	}
+	if len(second) == 0 {
+		return s.put(ctx, filename, first, header)
+	}
+
+	upload, e := s.createMultipartUpload(ctx, filename)
+	if e != nil {
+		return "", e
+	}
+	defer upload.abortUnlessCompleted()
+
+	for part := first; len(part) > 0; {
+		if e := upload.uploadPart(ctx, part); e != nil {
+			return "", e
+		}
+		if second != nil {
+			part, second = second, nil
+			continue
+		}
+		part, e = readPart(reader, s.partSize)
+		if e != nil {
+			return "", e
+		}
+	}
+
+	return upload.complete(ctx, header)
+}
+
+// readPart reads up to size bytes, fewer only at the end of reader
+func readPart(reader io.Reader, size int64) ([]byte, error) {
+	part, e := ioutil.ReadAll(io.LimitReader(reader, size))
+	if e != nil {
+		return nil, e
+	}
+	return part, nil
+}
+
+func (s *Storage) put(ctx context.Context, filename string, data []byte, header http.Header) (string, error) {
+	response, e := s.do(ctx, http.MethodPut, filename, nil, header, data)
+	if e != nil {
+		return "", e
+	}
+	defer response.Body.Close()
+
+	return response.Header.Get("ETag"), nil
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+
+	response, e := s.do(ctx, http.MethodGet, filename, nil, nil, nil)
+	if e != nil {
+		return s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	_, e = io.Copy(writer, response.Body)
+
+	return e
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if length == 0 {
+		return nil
+	}
+
+	return s.downloadRange(ctx, filename, offset, length, writer)
+}
+
+func (s *Storage) downloadRange(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	response, e := s.do(ctx, http.MethodGet, filename, nil, http.Header{"Range": {byteRange}}, nil)
+	if e != nil {
+		// a range starting past the end of the object is empty rather than an error
+		if statusCode(e) == http.StatusRequestedRangeNotSatisfiable {
+			return nil
+		}
+		return s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	reader := io.Reader(response.Body)
+	if response.StatusCode != http.StatusPartialContent {
+		// the server ignored the range, skip to the requested bytes ourselves
+		if _, e := io.CopyN(ioutil.Discard, reader, offset); e != nil && e != io.EOF {
+			return e
+		}
+		if length > 0 {
+			reader = io.LimitReader(reader, length)
+		}
+	}
+
+	_, e = io.Copy(writer, reader)
+
+	return e
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+// ConcatContext joins the objects into destination with a multipart upload.
+// Ranges of at least 5MB are copied server side with UploadPartCopy, smaller
+// objects are downloaded and uploaded as parts as S3 does not accept smaller
+// parts other than the last one
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if e := s.checkFilename(destination); e != nil {
+		return e
+	}
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+	for _, filename := range filenames {
+		if e := s.checkFilename(filename); e != nil {
+			return e
+		}
+	}
+	sizes := make([]int64, len(filenames))
+	for i, filename := range filenames {
+		info, e := s.StatContext(ctx, filename)
+		if e != nil {
+			return e
+		}
+		sizes[i] = info.Size
+	}
+
+	var upload *multipartUpload
+	defer func() {
+		if upload != nil {
+			upload.abortUnlessCompleted()
+		}
+	}()
+	pending := &bytes.Buffer{}
+	for i, filename := range filenames {
+		offset, size := int64(0), sizes[i]
+		if pending.Len() > 0 {
+			// fill the pending part up so it can be uploaded
+			take := int64(minPartSize - pending.Len())
+			if take > size {
+				take = size
+			}
+			if take > 0 {
+				if e := s.downloadRange(ctx, filename, 0, take, pending); e != nil {
+					return e
+				}
+			}
+			offset = take
+		}
+		if size-offset >= minPartSize || pending.Len() >= minPartSize {
+			if upload == nil {
+				var e error
+				upload, e = s.createMultipartUpload(ctx, destination)
+				if e != nil {
+					return e
+				}
+			}
+		}
+		if pending.Len() >= minPartSize {
+			if e := upload.uploadPart(ctx, pending.Bytes()); e != nil {
+				return e
+			}
+			pending.Reset()
+		}
+		if size-offset < minPartSize {
+			if size-offset > 0 {
+				if e := s.downloadRange(ctx, filename, offset, size-offset, pending); e != nil {
+					return e
+				}
+			}
+			continue
+		}
+		for offset < size {
+			length := size - offset
+			if length > maxCopyPartSize {
+				length = maxCopyPartSize
+				if size-offset-length < minPartSize {
+					length = size - offset - minPartSize
+				}
+			}
+			if e := upload.copyPart(ctx, filename, offset, length); e != nil {
+				return e
+			}
+			offset += length
+		}
+	}
+
+	if upload == nil {
+		_, e := s.put(ctx, destination, pending.Bytes(), nil)
+		return e
+	}
+	if pending.Len() > 0 {
+		if e := upload.uploadPart(ctx, pending.Bytes()); e != nil {
+			return e
+		}
+	}
+	_, e := upload.complete(ctx, nil)
+
+	return e
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+// DeleteContext removes the object. S3 does not report deleting an object that
+// does not exist as an error
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	if e := s.checkFilename(filename); e != nil {
+		return e
+	}
+	// S3 deletes missing keys without an error
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		return e
+	}
+	response, e := s.do(ctx, http.MethodDelete, filename, nil, nil, nil)
+	if e != nil {
+		return e
+	}
+
+	return response.Body.Close()
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	var objects []cbstorage.ObjectInfo
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		result := struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+				ETag         string
+				Size         int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		if e := s.doXML(ctx, http.MethodGet, "", query, nil, nil, &result); e != nil {
+			return nil, e
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, objectInfo(content.Key, content.Size, content.LastModified, content.ETag))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	response, e := s.do(ctx, http.MethodHead, filename, nil, nil, nil)
+	if e != nil {
+		return cbstorage.ObjectInfo{}, s.notExist(e, filename)
+	}
+	defer response.Body.Close()
+
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+
+	return objectInfo(filename, response.ContentLength, modTime, response.Header.Get("ETag")), nil
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, e := s.StatContext(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+// UploadIfGenerationMatchContext uses the ETag as the generation and sends it
+// in an If-Match header, or If-None-Match: * for an empty generation. The store
+// must support conditional writes, S3 itself does since 2024
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	if e := s.checkFilename(filename); e != nil {
+		return "", e
+	}
+	header := http.Header{"If-None-Match": {"*"}}
+	if generation != "" {
+		header = http.Header{"If-Match": {generation}}
+	}
+
+	etag, e := s.upload(ctx, filename, reader, header)
+	if e != nil {
+		var apiError *Error
+		// S3 answers If-Match for a missing object with 404 and a concurrent
+		// conditional write with 409 ConditionalRequestConflict
+		if errors.As(e, &apiError) && (apiError.StatusCode == http.StatusPreconditionFailed ||
+			apiError.Code == "ConditionalRequestConflict" ||
+			(generation != "" && apiError.StatusCode == http.StatusNotFound)) {
+			return "", fmt.Errorf("%w: %s does not have generation %s", cbstorage.ErrPreconditionFailed, filename, generation)
+		}
+		return "", e
+	}
+
+	return etag, nil
+}
+
+// objectInfo builds the ObjectInfo for an object, the ETag is only the MD5 of
+// the contents for objects that were not uploaded in parts
+func objectInfo(name string, size int64, modTime time.Time, etag string) cbstorage.ObjectInfo {
+	checksum := strings.Trim(etag, `"`)
+	if _, e := hex.DecodeString(checksum); e != nil || len(checksum) != 32 {
+		checksum = ""
+	}
+
+	return cbstorage.ObjectInfo{
+		Name:       name,
+		Size:       size,
+		ModTime:    modTime,
+		Checksum:   checksum,
+		ETag:       etag,
+		Generation: etag,
+	}
+}
@@ -0,0 +1,603 @@
+package cbs3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	valid := Config{
+		Bucket:          "bucket",
+		Region:          "eu-west-1",
+		AccessKeyId:     "key",
+		SecretAccessKey: "secret",
+	}
+	tests := []struct {
+		name    string
+		config  func(config Config) Config
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			config:  func(config Config) Config { return config },
+			wantErr: false,
+		},
+		{
+			name:    "noBucket",
+			config:  func(config Config) Config { config.Bucket = ""; return config },
+			wantErr: true,
+		},
+		{
+			name:    "noRegion",
+			config:  func(config Config) Config { config.Region = ""; return config },
+			wantErr: true,
+		},
+		{
+			name:    "noSecret",
+			config:  func(config Config) Config { config.SecretAccessKey = ""; return config },
+			wantErr: true,
+		},
+		{
+			name:    "invalidEndpoint",
+			config:  func(config Config) Config { config.Endpoint = "localhost:9000"; return config },
+			wantErr: true,
+		},
+		{
+			name:    "smallPartSize",
+			config:  func(config Config) Config { config.PartSize = 1024; return config },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config(valid))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStorage_url(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoint  string
+		pathStyle bool
+		key       string
+		want      string
+	}{
+		{
+			name: "virtualHost",
+			key:  "dir/file.txt",
+			want: "https://bucket.s3.eu-west-1.amazonaws.com/dir/file.txt",
+		},
+		{
+			name: "virtualHostBucket",
+			key:  "",
+			want: "https://bucket.s3.eu-west-1.amazonaws.com/",
+		},
+		{
+			name:      "pathStyle",
+			endpoint:  "http://localhost:9000/",
+			pathStyle: true,
+			key:       "dir/file name+1.txt",
+			want:      "http://localhost:9000/bucket/dir/file%20name%2B1.txt",
+		},
+		{
+			name:      "pathStyleBucket",
+			endpoint:  "http://localhost:9000/prefix",
+			pathStyle: true,
+			key:       "",
+			want:      "http://localhost:9000/prefix/bucket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e := New(Config{
+				Bucket:          "bucket",
+				Region:          "eu-west-1",
+				Endpoint:        tt.endpoint,
+				AccessKeyId:     "key",
+				SecretAccessKey: "secret",
+				PathStyle:       tt.pathStyle,
+			})
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if got := s.url(tt.key, nil).String(); got != tt.want {
+				t.Errorf("url() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_Upload(t *testing.T) {
+	tests := []struct {
+		name              string
+		filename          string
+		contents          []byte
+		wantErr           bool
+		wantPuts          int
+		wantUploadedParts int
+	}{
+		{
+			name:     "invalidFilename",
+			filename: ".",
+			contents: []byte("contents"),
+			wantErr:  true,
+		},
+		{
+			name:     "empty",
+			filename: "upload/empty.txt",
+			contents: []byte{},
+			wantPuts: 1,
+		},
+		{
+			name:     "escapedName",
+			filename: "upload/file name+é.txt",
+			contents: []byte("contents"),
+			wantPuts: 1,
+		},
+		{
+			name:     "onePart",
+			filename: "upload/onePart",
+			contents: pattern(1, minPartSize),
+			wantPuts: 1,
+		},
+		{
+			name:              "multipart",
+			filename:          "upload/multipart",
+			contents:          pattern(2, minPartSize*2+10),
+			wantUploadedParts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3("bucket")
+			defer fake.Close()
+			s := fake.storage(t)
+
+			err := s.Upload(tt.filename, bytes.NewReader(tt.contents))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Upload() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got, _ := fake.get(tt.filename); !bytes.Equal(got, tt.contents) {
+				t.Errorf("Upload() stored %d bytes, want %d", len(got), len(tt.contents))
+			}
+			if fake.puts != tt.wantPuts || fake.uploadedParts != tt.wantUploadedParts {
+				t.Errorf("Upload() puts = %d, parts = %d, want %d and %d", fake.puts, fake.uploadedParts, tt.wantPuts, tt.wantUploadedParts)
+			}
+			if len(fake.uploads) != 0 {
+				t.Errorf("Upload() left %d multipart uploads open", len(fake.uploads))
+			}
+
+			writer := &bytes.Buffer{}
+			if e := s.Download(tt.filename, writer); e != nil {
+				t.Errorf("Download() error = %v", e)
+				return
+			}
+			if !bytes.Equal(writer.Bytes(), tt.contents) {
+				t.Errorf("Download() returned %d bytes, want %d", writer.Len(), len(tt.contents))
+			}
+		})
+	}
+}
+
+func TestStorage_Download(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+
+	err := s.Download("missing", &bytes.Buffer{})
+	if !errors.Is(err, cbstorage.ErrNotExist) {
+		t.Errorf("Download() error = %v, want %v", err, cbstorage.ErrNotExist)
+	}
+
+	config := fake.config()
+	config.SecretAccessKey = "wrong-secret"
+	wrongSecret, e := New(config)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	err = wrongSecret.Download("missing", &bytes.Buffer{})
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.Code != "SignatureDoesNotMatch" {
+		t.Errorf("Download() error = %v, want SignatureDoesNotMatch", err)
+	}
+}
+
+func TestStorage_DownloadRange(t *testing.T) {
+	type args struct {
+		offset int64
+		length int64
+	}
+	tests := []struct {
+		name       string
+		filename   string
+		args       args
+		wantWriter string
+		wantErr    bool
+	}{
+		{
+			name:       "whole",
+			filename:   "range.txt",
+			args:       args{offset: 0, length: -1},
+			wantWriter: "0123456789",
+		},
+		{
+			name:       "tail",
+			filename:   "range.txt",
+			args:       args{offset: 6, length: -1},
+			wantWriter: "6789",
+		},
+		{
+			name:       "middle",
+			filename:   "range.txt",
+			args:       args{offset: 2, length: 3},
+			wantWriter: "234",
+		},
+		{
+			name:       "pastEnd",
+			filename:   "range.txt",
+			args:       args{offset: 20, length: -1},
+			wantWriter: "",
+		},
+		{
+			name:     "negativeOffset",
+			filename: "range.txt",
+			args:     args{offset: -1, length: -1},
+			wantErr:  true,
+		},
+		{
+			name:     "missing",
+			filename: "missing.txt",
+			args:     args{offset: 0, length: -1},
+			wantErr:  true,
+		},
+	}
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("range.txt", []byte("0123456789"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange(tt.filename, tt.args.offset, tt.args.length, writer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := writer.String(); got != tt.wantWriter {
+				t.Errorf("DownloadRange() gotWriter = %s, want %s", got, tt.wantWriter)
+			}
+		})
+	}
+}
+
+func TestStorage_Concat(t *testing.T) {
+	small1, small2 := pattern(1, 10), pattern(2, 20)
+	large1, large2 := pattern(3, minPartSize+100), pattern(4, minPartSize*2+5)
+	tests := []struct {
+		name            string
+		sources         [][]byte
+		wantErr         bool
+		wantCopiedParts int
+	}{
+		{
+			name:    "smallOnly",
+			sources: [][]byte{small1, small2},
+		},
+		{
+			name:            "largeThenSmall",
+			sources:         [][]byte{large1, small1},
+			wantCopiedParts: 1,
+		},
+		{
+			name:            "smallThenLarge",
+			sources:         [][]byte{small1, large2},
+			wantCopiedParts: 1,
+		},
+		{
+			name:            "largeOnly",
+			sources:         [][]byte{large1, large2},
+			wantCopiedParts: 2,
+		},
+		{
+			name:            "mixed",
+			sources:         [][]byte{small1, large1, small2, {}, large2, small1},
+			wantCopiedParts: 1,
+		},
+		{
+			name:    "empty",
+			sources: [][]byte{{}, {}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3("bucket")
+			defer fake.Close()
+			s := fake.storage(t)
+
+			var filenames []string
+			for i, source := range tt.sources {
+				filename := "concat/source" + string(rune('a'+i))
+				fake.put(filename, source)
+				filenames = append(filenames, filename)
+			}
+
+			err := s.Concat("concat/destination", filenames...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Concat() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got, _ := fake.get("concat/destination"); !bytes.Equal(got, joined(tt.sources...)) {
+				t.Errorf("Concat() destination has %d bytes, want %d in source order", len(got), len(joined(tt.sources...)))
+			}
+			if fake.copiedParts != tt.wantCopiedParts {
+				t.Errorf("Concat() copied parts = %d, want %d", fake.copiedParts, tt.wantCopiedParts)
+			}
+			if len(fake.uploads) != 0 {
+				t.Errorf("Concat() left %d multipart uploads open", len(fake.uploads))
+			}
+		})
+	}
+}
+
+func TestStorage_ConcatIntoSource(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+
+	log, batch := pattern(1, minPartSize+1), pattern(2, 100)
+	fake.put("log", log)
+	fake.put("batch", batch)
+
+	if err := s.Concat("log", "log", "batch"); err != nil {
+		t.Errorf("Concat() error = %v", err)
+		return
+	}
+	if got, _ := fake.get("log"); !bytes.Equal(got, joined(log, batch)) {
+		t.Errorf("Concat() log has %d bytes, want %d", len(got), len(log)+len(batch))
+	}
+}
+
+func TestStorage_ConcatInvalid(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("source", []byte("source"))
+
+	tests := []struct {
+		name        string
+		destination string
+		filenames   []string
+	}{
+		{
+			name:        "noSources",
+			destination: "destination",
+		},
+		{
+			name:        "invalidDestination",
+			destination: "",
+			filenames:   []string{"source"},
+		},
+		{
+			name:        "invalidSource",
+			destination: "destination",
+			filenames:   []string{"source", "."},
+		},
+		{
+			name:        "missingSource",
+			destination: "destination",
+			filenames:   []string{"source", "missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Concat(tt.destination, tt.filenames...); err == nil {
+				t.Error("Concat() error = nil, want an error")
+			}
+			if _, ok := fake.get("destination"); ok {
+				t.Error("Concat() created the destination")
+			}
+		})
+	}
+}
+
+func TestStorage_Delete(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("delete.txt", []byte("contents"))
+
+	if err := s.Delete("delete.txt"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, ok := fake.get("delete.txt"); ok {
+		t.Error("Delete() did not remove the object")
+	}
+	if err := s.Delete(".."); err == nil {
+		t.Error("Delete() error = nil for an invalid filename")
+	}
+}
+
+func TestStorage_List(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.maxKeys = 2
+	for _, name := range []string{"list/c", "list/a", "list/b", "list/d/e", "other"} {
+		fake.put(name, []byte(name))
+	}
+
+	objects, err := s.List("list/")
+	if err != nil {
+		t.Errorf("List() error = %v", err)
+		return
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+		if object.Size != int64(len(object.Name)) || object.Checksum == "" || object.Generation == "" {
+			t.Errorf("List() object = %+v, want size, checksum and generation", object)
+		}
+	}
+	want := []string{"list/a", "list/b", "list/c", "list/d/e"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("List() names = %v, want %v", names, want)
+	}
+}
+
+func TestStorage_Stat(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("stat.txt", []byte("file-contents"))
+
+	info, err := s.Stat("stat.txt")
+	if err != nil {
+		t.Errorf("Stat() error = %v", err)
+		return
+	}
+	if info.Name != "stat.txt" || info.Size != 13 || info.Checksum != "53a08cf9217fc1c69a90fd77c4d765db" || info.ModTime.IsZero() {
+		t.Errorf("Stat() = %+v", info)
+	}
+
+	_, err = s.Stat("missing.txt")
+	if !errors.Is(err, cbstorage.ErrNotExist) {
+		t.Errorf("Stat() error = %v, want %v", err, cbstorage.ErrNotExist)
+	}
+
+	exists, err := s.Exists("stat.txt")
+	if err != nil || !exists {
+		t.Errorf("Exists() = %v, %v, want true", exists, err)
+	}
+	exists, err = s.Exists("missing.txt")
+	if err != nil || exists {
+		t.Errorf("Exists() = %v, %v, want false", exists, err)
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	tests := []struct {
+		name                   string
+		existing               []byte
+		generation             func(s *Storage) string
+		contents               []byte
+		wantPreconditionFailed bool
+	}{
+		{
+			name:       "create",
+			generation: func(s *Storage) string { return "" },
+			contents:   []byte("new"),
+		},
+		{
+			name:                   "createExisting",
+			existing:               []byte("old"),
+			generation:             func(s *Storage) string { return "" },
+			contents:               []byte("new"),
+			wantPreconditionFailed: true,
+		},
+		{
+			name:     "replace",
+			existing: []byte("old"),
+			generation: func(s *Storage) string {
+				info, _ := s.Stat("conditional")
+				return info.Generation
+			},
+			contents: []byte("new"),
+		},
+		{
+			name:                   "staleGeneration",
+			existing:               []byte("old"),
+			generation:             func(s *Storage) string { return `"stale"` },
+			contents:               []byte("new"),
+			wantPreconditionFailed: true,
+		},
+		{
+			name:                   "deleted",
+			generation:             func(s *Storage) string { return `"stale"` },
+			contents:               []byte("new"),
+			wantPreconditionFailed: true,
+		},
+		{
+			name:                   "multipartCreateExisting",
+			existing:               []byte("old"),
+			generation:             func(s *Storage) string { return "" },
+			contents:               pattern(1, minPartSize+1),
+			wantPreconditionFailed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3("bucket")
+			defer fake.Close()
+			s := fake.storage(t)
+			if tt.existing != nil {
+				fake.put("conditional", tt.existing)
+			}
+
+			got, err := s.UploadIfGenerationMatch("conditional", bytes.NewReader(tt.contents), tt.generation(s))
+			if errors.Is(err, cbstorage.ErrPreconditionFailed) != tt.wantPreconditionFailed {
+				t.Errorf("UploadIfGenerationMatch() error = %v, wantPreconditionFailed %v", err, tt.wantPreconditionFailed)
+				return
+			}
+			stored, _ := fake.get("conditional")
+			if tt.wantPreconditionFailed {
+				if !bytes.Equal(stored, tt.existing) {
+					t.Errorf("UploadIfGenerationMatch() replaced the object after a failed precondition")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("UploadIfGenerationMatch() error = %v", err)
+				return
+			}
+			if !bytes.Equal(stored, tt.contents) {
+				t.Errorf("UploadIfGenerationMatch() stored %s, want %s", stored, tt.contents)
+			}
+			info, _ := s.Stat("conditional")
+			if got != info.Generation {
+				t.Errorf("UploadIfGenerationMatch() = %s, want the new generation %s", got, info.Generation)
+			}
+		})
+	}
+}
+
+func TestStorage_Context(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	s := fake.storage(t)
+	fake.put("file.txt", []byte("contents"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.UploadContext(ctx, "upload.txt", bytes.NewReader([]byte("contents"))); !errors.Is(err, context.Canceled) {
+		t.Errorf("UploadContext() error = %v, want %v", err, context.Canceled)
+	}
+	if err := s.DownloadContext(ctx, "file.txt", ioutil.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("DownloadContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, ok := fake.get("upload.txt"); ok {
+		t.Error("UploadContext() stored the object with a cancelled context")
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	fake := newFakeS3("bucket")
+	defer fake.Close()
+	storagetest.Contract(t, fake.storage(t))
+}
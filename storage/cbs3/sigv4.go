@@ -0,0 +1,175 @@
+package cbs3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	signingService   = "s3"
+	amzDateFormat    = "20060102T150405Z"
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signer signs requests with AWS Signature Version 4 using the Authorization header
+type signer struct {
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+	now             func() time.Time
+}
+
+// sign adds the X-Amz-Date, X-Amz-Content-Sha256, X-Amz-Security-Token and
+// Authorization headers. payloadHash is the hex SHA-256 of the request body
+func (s *signer) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := s.canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{now.Format("20060102"), s.region, signingService, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		signingAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, signingService)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgorithm,
+		s.accessKeyId,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// canonicalHeaders returns the canonical header block and the signed header
+// list. Host, the x-amz-* headers and the headers S3 interprets are signed
+func (s *signer) canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for name, headerValues := range req.Header {
+		name = strings.ToLower(name)
+		if !isSignedHeader(name) {
+			continue
+		}
+		var trimmed []string
+		for _, value := range headerValues {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		values[name] = strings.Join(trimmed, ",")
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + values[name] + "\n")
+	}
+
+	return canonical.String(), strings.Join(names, ";")
+}
+
+func isSignedHeader(name string) bool {
+	switch name {
+	case "content-md5", "content-type", "range", "if-match", "if-none-match":
+		return true
+	}
+	return strings.HasPrefix(name, "x-amz-") && name != "x-amz-client-context"
+}
+
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escape(key, true)+"="+escape(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// escape percent-encodes everything except the unreserved characters of RFC
+// 3986, as SigV4 requires, keeping slashes unless encodeSlash is set
+func escape(s string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			escaped.WriteByte(c)
+			continue
+		}
+		escaped.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+
+	return escaped.String()
+}
+
+// encodeQuery encodes query the same way canonicalQuery does, so the signed
+// and the sent query strings match
+func encodeQuery(query url.Values) string {
+	u := &url.URL{RawQuery: query.Encode()}
+	return canonicalQuery(u)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
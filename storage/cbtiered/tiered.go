@@ -0,0 +1,521 @@
+package cbtiered
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/cbtransaction"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Tier string
+
+const (
+	Hot  Tier = "hot"
+	Cold Tier = "cold"
+)
+
+// Policy decides which tier an object belongs in
+type Policy interface {
+	Place(object cbstorage.ObjectInfo, now time.Time) Tier
+}
+
+// PolicyFunc adapts a function to a Policy
+type PolicyFunc func(object cbstorage.ObjectInfo, now time.Time) Tier
+
+func (f PolicyFunc) Place(object cbstorage.ObjectInfo, now time.Time) Tier {
+	return f(object, now)
+}
+
+// AgePolicy places objects which have not changed for MaxAge in the cold tier.
+// Objects named in HotNames, such as the master, always stay hot
+type AgePolicy struct {
+	MaxAge   time.Duration
+	HotNames []string
+}
+
+func (p AgePolicy) Place(object cbstorage.ObjectInfo, now time.Time) Tier {
+	for _, name := range p.HotNames {
+		if object.Name == name {
+			return Hot
+		}
+	}
+	if now.Sub(object.ModTime) > p.MaxAge {
+		return Cold
+	}
+	return Hot
+}
+
+// Storage keeps objects in a hot tier, such as cbfile on local disk, and a
+// cold tier, such as cbgooglebucket, and serves them through a single Storage.
+// New objects are written to the hot tier, Migrate moves objects between the
+// tiers as the policy places them. Reads try the hot tier first.
+//
+// Uploads which do not change an object are skipped, so a sealed bucket which
+// is uploaded again neither looks recently modified nor leaves the cold tier.
+// Uploads changing an object in the cold tier move it back to the hot tier.
+//
+// Generations are prefixed with the tier of the object
+type Storage struct {
+	hot          cbtransaction.Storage
+	cold         cbtransaction.Storage
+	policy       Policy
+	tempDir      string
+	errorHandler cbtransaction.ErrorHandler
+
+	// writes hold the read lock so they can run concurrently, migrations hold
+	// the write lock so an object cannot change while it is moved
+	writeLock sync.RWMutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Config struct {
+	Hot  cbtransaction.Storage
+	Cold cbtransaction.Storage
+	// Policy defaults to an AgePolicy moving objects unchanged for 7 days to
+	// the cold tier and keeping the master hot
+	Policy Policy
+	// MigrationInterval is how often Migrate runs in the background, 0
+	// disables the background migration
+	MigrationInterval time.Duration
+	// TempDir is where upload bodies which cannot be re-read are buffered,
+	// defaults to os.TempDir()
+	TempDir string
+	// ErrorHandler receives the errors of the background migration
+	ErrorHandler cbtransaction.ErrorHandler
+}
+
+func New(config Config) (*Storage, error) {
+	if config.Hot == nil || config.Cold == nil {
+		return nil, errors.New("a hot and a cold storage are required")
+	}
+	if config.MigrationInterval < 0 {
+		return nil, fmt.Errorf("invalid migration interval: %s", config.MigrationInterval)
+	}
+	if config.Policy == nil {
+		config.Policy = AgePolicy{MaxAge: time.Hour * 24 * 7, HotNames: []string{"master"}}
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = cbtransaction.DefaultErrorHandler{}
+	}
+
+	s := &Storage{
+		hot:          config.Hot,
+		cold:         config.Cold,
+		policy:       config.Policy,
+		tempDir:      config.TempDir,
+		errorHandler: config.ErrorHandler,
+	}
+	if config.MigrationInterval > 0 {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		s.done = make(chan struct{})
+		go s.migrateLoop(ctx, config.MigrationInterval)
+	}
+
+	return s, nil
+}
+
+// Close stops the background migration
+func (s *Storage) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	return nil
+}
+
+func (s *Storage) migrateLoop(ctx context.Context, interval time.Duration) {
+	defer close(s.done)
+	defer s.errorHandler.Recover()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if e := s.Migrate(ctx); e != nil && ctx.Err() == nil {
+				s.errorHandler.Error(e)
+			}
+		}
+	}
+}
+
+func (s *Storage) tier(tier Tier) cbtransaction.Storage {
+	if tier == Cold {
+		return s.cold
+	}
+	return s.hot
+}
+
+// locate returns the tier holding the object, the hot tier wins if both have it
+func (s *Storage) locate(ctx context.Context, filename string) (Tier, cbstorage.ObjectInfo, error) {
+	info, e := s.hot.StatContext(ctx, filename)
+	if e == nil {
+		return Hot, info, nil
+	}
+	if !errors.Is(e, cbstorage.ErrNotExist) {
+		return "", info, e
+	}
+	info, e = s.cold.StatContext(ctx, filename)
+	if e != nil {
+		return "", info, e
+	}
+	return Cold, info, nil
+}
+
+// TierContext implements cbtransaction.Tierer
+func (s *Storage) TierContext(ctx context.Context, filename string) (string, error) {
+	tier, _, e := s.locate(ctx, filename)
+	return string(tier), e
+}
+
+// move copies the object to the other tier and deletes it from its current
+// one, unless it changed while it was copied. s.writeLock must be held
+func (s *Storage) move(ctx context.Context, object cbstorage.ObjectInfo, from Tier, to Tier) error {
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(s.tier(from).DownloadContext(ctx, object.Name, writer))
+	}()
+	e := s.tier(to).UploadContext(ctx, object.Name, reader)
+	_ = reader.CloseWithError(io.ErrClosedPipe)
+	if e != nil {
+		return e
+	}
+
+	current, e := s.tier(from).StatContext(ctx, object.Name)
+	if e != nil {
+		return e
+	}
+	if current.Generation != object.Generation || current.Size != object.Size || !current.ModTime.Equal(object.ModTime) {
+		return fmt.Errorf("%s changed while it was moved to the %s tier", object.Name, to)
+	}
+
+	return s.tier(from).DeleteContext(ctx, object.Name)
+}
+
+// Migrate moves every object which the policy places in the other tier
+func (s *Storage) Migrate(ctx context.Context) error {
+	now := time.Now()
+	var messages []string
+	for _, from := range []Tier{Hot, Cold} {
+		objects, e := s.tier(from).ListContext(ctx, "")
+		if e != nil {
+			return e
+		}
+		for _, object := range objects {
+			to := s.policy.Place(object, now)
+			if to == from || (to != Hot && to != Cold) {
+				continue
+			}
+			s.writeLock.Lock()
+			e := s.move(ctx, object, from, to)
+			s.writeLock.Unlock()
+			if e != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				messages = append(messages, fmt.Sprintf("%s: %v", object.Name, e))
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("could not migrate %d objects: %s", len(messages), strings.Join(messages, "; "))
+	}
+
+	return nil
+}
+
+// rewindable returns a function which returns the body positioned at its
+// start, along with the size and md5 of the body
+func (s *Storage) rewindable(reader io.Reader) (func() (io.Reader, error), int64, string, func(), error) {
+	cleanup := func() {}
+	hash := md5.New()
+	seeker, ok := reader.(io.ReadSeeker)
+	var size int64
+	if ok {
+		start, e := seeker.Seek(0, io.SeekCurrent)
+		if e != nil {
+			return nil, 0, "", nil, e
+		}
+		size, e = io.Copy(hash, seeker)
+		if e != nil {
+			return nil, 0, "", nil, e
+		}
+		return func() (io.Reader, error) {
+			_, e := seeker.Seek(start, io.SeekStart)
+			return seeker, e
+		}, size, hex.EncodeToString(hash.Sum(nil)), cleanup, nil
+	}
+
+	file, e := ioutil.TempFile(s.tempDir, "cbtiered-")
+	if e != nil {
+		return nil, 0, "", nil, e
+	}
+	cleanup = func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}
+	size, e = io.Copy(io.MultiWriter(file, hash), reader)
+	if e != nil {
+		cleanup()
+		return nil, 0, "", nil, e
+	}
+	return func() (io.Reader, error) {
+		_, e := file.Seek(0, io.SeekStart)
+		return file, e
+	}, size, hex.EncodeToString(hash.Sum(nil)), cleanup, nil
+}
+
+// checksummer is implemented by storages which leave ObjectInfo.Checksum
+// empty but compute it when asked, such as cbfile
+type checksummer interface {
+	ChecksumContext(ctx context.Context, filename string) (string, error)
+}
+
+// unchanged reports whether the object in tier already has the size and checksum
+func (s *Storage) unchanged(ctx context.Context, tier Tier, info cbstorage.ObjectInfo, size int64, checksum string) bool {
+	if info.Size != size {
+		return false
+	}
+	if info.Checksum == "" {
+		tierChecksummer, ok := s.tier(tier).(checksummer)
+		if !ok {
+			return false
+		}
+		var e error
+		info.Checksum, e = tierChecksummer.ChecksumContext(ctx, info.Name)
+		if e != nil {
+			return false
+		}
+	}
+	return info.Checksum == checksum
+}
+
+func (s *Storage) Upload(filename string, reader io.Reader) error {
+	return s.UploadContext(context.Background(), filename, reader)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, filename string, reader io.Reader) error {
+	rewind, size, checksum, cleanup, e := s.rewindable(reader)
+	if e != nil {
+		return e
+	}
+	defer cleanup()
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	tier, info, e := s.locate(ctx, filename)
+	if e != nil && !errors.Is(e, cbstorage.ErrNotExist) {
+		return e
+	}
+	if e == nil && s.unchanged(ctx, tier, info, size, checksum) {
+		return nil
+	}
+
+	body, e := rewind()
+	if e != nil {
+		return e
+	}
+	if e := s.hot.UploadContext(ctx, filename, body); e != nil {
+		return e
+	}
+	if tier == Cold {
+		return s.deleteIfExists(ctx, s.cold, filename)
+	}
+
+	return nil
+}
+
+func (s *Storage) UploadIfGenerationMatch(filename string, reader io.Reader, generation string) (string, error) {
+	return s.UploadIfGenerationMatchContext(context.Background(), filename, reader, generation)
+}
+
+// UploadIfGenerationMatchContext writes the object in the tier the generation
+// was read from, new objects are written to the hot tier
+func (s *Storage) UploadIfGenerationMatchContext(ctx context.Context, filename string, reader io.Reader, generation string) (string, error) {
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+
+	tier, childGeneration := Hot, ""
+	if generation != "" {
+		parts := strings.SplitN(generation, ":", 2)
+		if len(parts) != 2 || (Tier(parts[0]) != Hot && Tier(parts[0]) != Cold) {
+			return "", fmt.Errorf("invalid generation: %s", generation)
+		}
+		tier, childGeneration = Tier(parts[0]), parts[1]
+	} else if exists, e := s.cold.ExistsContext(ctx, filename); e != nil || exists {
+		if e != nil {
+			return "", e
+		}
+		return "", fmt.Errorf("%w: %s does not have generation %s", cbstorage.ErrPreconditionFailed, filename, generation)
+	}
+
+	next, e := s.tier(tier).UploadIfGenerationMatchContext(ctx, filename, reader, childGeneration)
+	if e != nil {
+		return "", e
+	}
+	return string(tier) + ":" + next, nil
+}
+
+func (s *Storage) Concat(destination string, filenames ...string) error {
+	return s.ConcatContext(context.Background(), destination, filenames...)
+}
+
+// ConcatContext concatenates in the hot tier, sources in the cold tier are
+// copied to the hot tier first
+func (s *Storage) ConcatContext(ctx context.Context, destination string, filenames ...string) error {
+	if len(filenames) == 0 {
+		return errors.New("no filenames given to concat")
+	}
+
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	for _, filename := range filenames {
+		exists, e := s.hot.ExistsContext(ctx, filename)
+		if e != nil {
+			return e
+		}
+		if exists {
+			continue
+		}
+		reader, writer := io.Pipe()
+		go func(filename string) {
+			_ = writer.CloseWithError(s.cold.DownloadContext(ctx, filename, writer))
+		}(filename)
+		e = s.hot.UploadContext(ctx, filename, reader)
+		_ = reader.CloseWithError(io.ErrClosedPipe)
+		if e != nil {
+			return e
+		}
+	}
+
+	if e := s.hot.ConcatContext(ctx, destination, filenames...); e != nil {
+		return e
+	}
+
+	return s.deleteIfExists(ctx, s.cold, destination)
+}
+
+func (s *Storage) deleteIfExists(ctx context.Context, storage cbtransaction.Storage, filename string) error {
+	if e := storage.DeleteContext(ctx, filename); e != nil && !errors.Is(e, cbstorage.ErrNotExist) {
+		return e
+	}
+	return nil
+}
+
+func (s *Storage) Delete(filename string) error {
+	return s.DeleteContext(context.Background(), filename)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, filename string) error {
+	s.writeLock.RLock()
+	defer s.writeLock.RUnlock()
+	hotErr := s.hot.DeleteContext(ctx, filename)
+	if hotErr != nil && !errors.Is(hotErr, cbstorage.ErrNotExist) {
+		return hotErr
+	}
+	coldErr := s.cold.DeleteContext(ctx, filename)
+	if coldErr != nil && !errors.Is(coldErr, cbstorage.ErrNotExist) {
+		return coldErr
+	}
+	if hotErr != nil && coldErr != nil {
+		return fmt.Errorf("%w: %s", cbstorage.ErrNotExist, filename)
+	}
+
+	return nil
+}
+
+func (s *Storage) Download(filename string, writer io.Writer) error {
+	return s.DownloadContext(context.Background(), filename, writer)
+}
+
+func (s *Storage) DownloadContext(ctx context.Context, filename string, writer io.Writer) error {
+	e := s.hot.DownloadContext(ctx, filename, writer)
+	if errors.Is(e, cbstorage.ErrNotExist) {
+		return s.cold.DownloadContext(ctx, filename, writer)
+	}
+	return e
+}
+
+func (s *Storage) DownloadRange(filename string, offset int64, length int64, writer io.Writer) error {
+	return s.DownloadRangeContext(context.Background(), filename, offset, length, writer)
+}
+
+func (s *Storage) DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error {
+	e := s.hot.DownloadRangeContext(ctx, filename, offset, length, writer)
+	if errors.Is(e, cbstorage.ErrNotExist) {
+		return s.cold.DownloadRangeContext(ctx, filename, offset, length, writer)
+	}
+	return e
+}
+
+func (s *Storage) List(prefix string) ([]cbstorage.ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+// ListContext lists both tiers, generations are prefixed like Stat's
+func (s *Storage) ListContext(ctx context.Context, prefix string) ([]cbstorage.ObjectInfo, error) {
+	seen := map[string]bool{}
+	var objects []cbstorage.ObjectInfo
+	for _, tier := range []Tier{Hot, Cold} {
+		tierObjects, e := s.tier(tier).ListContext(ctx, prefix)
+		if e != nil {
+			return nil, e
+		}
+		for _, object := range tierObjects {
+			if seen[object.Name] {
+				continue
+			}
+			seen[object.Name] = true
+			object.Generation = string(tier) + ":" + object.Generation
+			objects = append(objects, object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
+}
+
+func (s *Storage) Stat(filename string) (cbstorage.ObjectInfo, error) {
+	return s.StatContext(context.Background(), filename)
+}
+
+func (s *Storage) StatContext(ctx context.Context, filename string) (cbstorage.ObjectInfo, error) {
+	tier, info, e := s.locate(ctx, filename)
+	if e != nil {
+		return cbstorage.ObjectInfo{}, e
+	}
+	info.Generation = string(tier) + ":" + info.Generation
+
+	return info, nil
+}
+
+func (s *Storage) Exists(filename string) (bool, error) {
+	return s.ExistsContext(context.Background(), filename)
+}
+
+func (s *Storage) ExistsContext(ctx context.Context, filename string) (bool, error) {
+	_, _, e := s.locate(ctx, filename)
+	if e != nil {
+		if errors.Is(e, cbstorage.ErrNotExist) {
+			return false, nil
+		}
+		return false, e
+	}
+	return true, nil
+}
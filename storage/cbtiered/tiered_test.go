@@ -0,0 +1,259 @@
+package cbtiered
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	cbstorage "github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/cbfile"
+	"github.com/codingbeard/cbtransaction/storage/cbmemory"
+	"github.com/codingbeard/cbtransaction/storage/storagetest"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// coldNames places the named objects in the cold tier
+type coldNames map[string]bool
+
+func (c coldNames) Place(object cbstorage.ObjectInfo, now time.Time) Tier {
+	if c[object.Name] {
+		return Cold
+	}
+	return Hot
+}
+
+func getStorage(t *testing.T, policy Policy) (*Storage, *cbmemory.Storage, *cbmemory.Storage) {
+	hot, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	cold, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s, e := New(Config{Hot: hot, Cold: cold, Policy: policy})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return s, hot, cold
+}
+
+func contents(storage interface {
+	Download(filename string, writer io.Writer) error
+}, filename string) string {
+	writer := &bytes.Buffer{}
+	if e := storage.Download(filename, writer); e != nil {
+		return e.Error()
+	}
+	return writer.String()
+}
+
+// TestStorage_UploadUnchangedChecksummer uses a cold tier whose Stat leaves the checksum out
+func TestStorage_UploadUnchangedChecksummer(t *testing.T) {
+	tempDir, e := ioutil.TempDir("", "cbtiered")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	hot, e := cbmemory.New(cbmemory.Config{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	cold, e := cbfile.New(cbfile.Config{BasePath: tempDir})
+	if e != nil {
+		t.Fatal(e)
+	}
+	s, e := New(Config{Hot: hot, Cold: cold, Policy: coldNames{"sealed": true}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_ = s.Upload("sealed", strings.NewReader("sealed"))
+	if e := s.Migrate(context.Background()); e != nil {
+		t.Errorf("Migrate() error = %v", e)
+		return
+	}
+
+	if e := s.Upload("sealed", strings.NewReader("sealed")); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if exists, _ := hot.Exists("sealed"); exists {
+		t.Error("Upload() of an unchanged object moved it to the hot tier")
+	}
+	if e := s.Upload("sealed", strings.NewReader("s3aled")); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if exists, _ := cold.Exists("sealed"); exists || contents(hot, "sealed") != "s3aled" {
+		t.Error("Upload() of a changed object did not move it to the hot tier")
+	}
+}
+
+func TestAgePolicy_Place(t *testing.T) {
+	now := time.Now()
+	policy := AgePolicy{MaxAge: time.Hour, HotNames: []string{"master"}}
+	tests := []struct {
+		name   string
+		object cbstorage.ObjectInfo
+		want   Tier
+	}{
+		{
+			name:   "recent",
+			object: cbstorage.ObjectInfo{Name: "bucket", ModTime: now.Add(-time.Minute)},
+			want:   Hot,
+		},
+		{
+			name:   "old",
+			object: cbstorage.ObjectInfo{Name: "bucket", ModTime: now.Add(-time.Hour * 2)},
+			want:   Cold,
+		},
+		{
+			name:   "oldMaster",
+			object: cbstorage.ObjectInfo{Name: "master", ModTime: now.Add(-time.Hour * 2)},
+			want:   Hot,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Place(tt.object, now); got != tt.want {
+				t.Errorf("Place() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_Migrate(t *testing.T) {
+	s, hot, cold := getStorage(t, coldNames{"sealed": true})
+	_ = s.Upload("sealed", strings.NewReader("sealed"))
+	_ = s.Upload("current", strings.NewReader("current"))
+
+	if e := s.Migrate(context.Background()); e != nil {
+		t.Errorf("Migrate() error = %v", e)
+		return
+	}
+	if exists, _ := hot.Exists("sealed"); exists {
+		t.Error("Migrate() kept sealed in the hot tier")
+	}
+	if got := contents(cold, "sealed"); got != "sealed" {
+		t.Errorf("cold sealed = %s, want sealed", got)
+	}
+	for filename, want := range map[string]string{"sealed": "cold", "current": "hot"} {
+		if tier, e := s.TierContext(context.Background(), filename); tier != want || e != nil {
+			t.Errorf("TierContext(%s) = %s, %v, want %s", filename, tier, e, want)
+		}
+		if got := contents(s, filename); got != filename {
+			t.Errorf("Download(%s) = %s, want %s", filename, got, filename)
+		}
+	}
+	writer := &bytes.Buffer{}
+	if e := s.DownloadRange("sealed", 1, 3, writer); e != nil || writer.String() != "eal" {
+		t.Errorf("DownloadRange() = %s, %v, want eal", writer.String(), e)
+	}
+
+	// uploading the unchanged sealed bucket again leaves it in the cold tier
+	if e := s.Upload("sealed", strings.NewReader("sealed")); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if exists, _ := hot.Exists("sealed"); exists {
+		t.Error("Upload() of an unchanged object moved it to the hot tier")
+	}
+	// changing it moves it back
+	if e := s.Upload("sealed", strings.NewReader("changed")); e != nil {
+		t.Errorf("Upload() error = %v", e)
+	}
+	if exists, _ := cold.Exists("sealed"); exists || contents(hot, "sealed") != "changed" {
+		t.Error("Upload() of a changed object did not move it to the hot tier")
+	}
+
+	s.policy = coldNames{}
+	_ = s.Migrate(context.Background())
+	_ = s.Upload("other", strings.NewReader("other"))
+	s.policy = coldNames{"other": true}
+	_ = s.Migrate(context.Background())
+	s.policy = coldNames{}
+	if e := s.Migrate(context.Background()); e != nil {
+		t.Errorf("Migrate() error = %v", e)
+	}
+	if got := contents(hot, "other"); got != "other" {
+		t.Errorf("Migrate() did not promote other back to the hot tier: %s", got)
+	}
+}
+
+func TestStorage_ConcatDeleteList(t *testing.T) {
+	s, hot, cold := getStorage(t, coldNames{"log": true})
+	_ = s.Upload("log", strings.NewReader("1,"))
+	_ = s.Upload("batch", strings.NewReader("2"))
+	_ = s.Migrate(context.Background())
+
+	objects, e := s.List("")
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if e != nil || !reflect.DeepEqual(names, []string{"batch", "log"}) {
+		t.Errorf("List() = %v, %v, want both tiers", names, e)
+	}
+
+	if e := s.Concat("log", "log", "batch"); e != nil {
+		t.Errorf("Concat() error = %v", e)
+		return
+	}
+	if got := contents(hot, "log"); got != "1,2" {
+		t.Errorf("hot log = %s, want 1,2", got)
+	}
+	if exists, _ := cold.Exists("log"); exists {
+		t.Error("Concat() left the old log in the cold tier")
+	}
+
+	_ = s.Migrate(context.Background())
+	if e := s.Delete("log"); e != nil {
+		t.Errorf("Delete() error = %v", e)
+	}
+	if exists, _ := s.Exists("log"); exists {
+		t.Error("Exists() = true after Delete")
+	}
+	if e := s.Delete("log"); !errors.Is(e, cbstorage.ErrNotExist) {
+		t.Errorf("Delete() error = %v, want %v", e, cbstorage.ErrNotExist)
+	}
+}
+
+func TestStorage_UploadIfGenerationMatch(t *testing.T) {
+	s, _, cold := getStorage(t, coldNames{"master": true})
+
+	generation, e := s.UploadIfGenerationMatch("master", strings.NewReader("v1"), "")
+	if e != nil || !strings.HasPrefix(generation, "hot:") {
+		t.Errorf("UploadIfGenerationMatch() = %s, %v, want a hot generation", generation, e)
+		return
+	}
+	_ = s.Migrate(context.Background())
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v2"), generation); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v after the object moved, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v2"), ""); !errors.Is(e, cbstorage.ErrPreconditionFailed) {
+		t.Errorf("UploadIfGenerationMatch() error = %v for an object in the cold tier, want %v", e, cbstorage.ErrPreconditionFailed)
+	}
+
+	info, e := s.Stat("master")
+	if e != nil || !strings.HasPrefix(info.Generation, "cold:") {
+		t.Errorf("Stat() = %+v, %v, want a cold generation", info, e)
+		return
+	}
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v2"), info.Generation); e != nil {
+		t.Errorf("UploadIfGenerationMatch() error = %v", e)
+	}
+	if got := contents(cold, "master"); got != "v2" {
+		t.Errorf("cold master = %s, want v2", got)
+	}
+	if _, e := s.UploadIfGenerationMatch("master", strings.NewReader("v3"), "warm:1"); e == nil {
+		t.Error("UploadIfGenerationMatch() error = nil for an unknown tier")
+	}
+}
+
+func TestStorage_Contract(t *testing.T) {
+	s, _, _ := getStorage(t, nil)
+	storagetest.Contract(t, s)
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotExist           = errors.New("object does not exist")
+	ErrNotSupported       = errors.New("operation not supported by storage")
+	ErrPreconditionFailed = errors.New("object generation did not match precondition")
+)
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// hex encoded md5 of the contents, empty when the backend cannot provide it cheaply
+	Checksum string
+	ETag     string
+	// opaque token which changes every time the object is written, see UploadIfGenerationMatch
+	Generation string
+}
@@ -0,0 +1,93 @@
+// Package storagetest holds the behaviour every storage provider shares, for
+// the tests of the providers to run against their own implementation
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction/storage"
+	"io"
+	"testing"
+)
+
+// Storage is the part of cbtransaction.Storage the contract covers
+type Storage interface {
+	UploadContext(ctx context.Context, filename string, reader io.Reader) error
+	DownloadContext(ctx context.Context, filename string, writer io.Writer) error
+	DownloadRangeContext(ctx context.Context, filename string, offset int64, length int64, writer io.Writer) error
+	DeleteContext(ctx context.Context, filename string) error
+	StatContext(ctx context.Context, filename string) (storage.ObjectInfo, error)
+	ExistsContext(ctx context.Context, filename string) (bool, error)
+}
+
+// Contract checks that s reports missing objects with storage.ErrNotExist
+// from every read and delete, which the client, the server and the storage
+// decorators rely on to tell a missing object from a failure
+func Contract(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	t.Run("missing", func(t *testing.T) {
+		checkNotExist(t, s, "storagetest/missing")
+		if e := s.DeleteContext(ctx, "storagetest/missing"); !errors.Is(e, storage.ErrNotExist) {
+			t.Errorf("DeleteContext() error = %v, want %v", e, storage.ErrNotExist)
+		}
+	})
+
+	const name = "storagetest/object"
+	e := s.UploadContext(ctx, name, bytes.NewReader([]byte("contents")))
+	if e != nil {
+		t.Errorf("UploadContext() error = %v", e)
+		return
+	}
+
+	t.Run("existing", func(t *testing.T) {
+		buffer := &bytes.Buffer{}
+		if e := s.DownloadContext(ctx, name, buffer); e != nil || buffer.String() != "contents" {
+			t.Errorf("DownloadContext() = %s, error = %v, want contents", buffer.String(), e)
+		}
+		buffer.Reset()
+		if e := s.DownloadRangeContext(ctx, name, 1, 3, buffer); e != nil || buffer.String() != "ont" {
+			t.Errorf("DownloadRangeContext() = %s, error = %v, want ont", buffer.String(), e)
+		}
+		if info, e := s.StatContext(ctx, name); e != nil || info.Size != int64(len("contents")) {
+			t.Errorf("StatContext() = %+v, error = %v", info, e)
+		}
+		if exists, e := s.ExistsContext(ctx, name); e != nil || !exists {
+			t.Errorf("ExistsContext() = %v, error = %v, want true", exists, e)
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		if e := s.DeleteContext(ctx, name); e != nil {
+			t.Errorf("DeleteContext() error = %v", e)
+			return
+		}
+		checkNotExist(t, s, name)
+		if e := s.DeleteContext(ctx, name); !errors.Is(e, storage.ErrNotExist) {
+			t.Errorf("DeleteContext() error = %v, want %v", e, storage.ErrNotExist)
+		}
+	})
+}
+
+// ReadOnlyContract is Contract for storage which cannot be written to, it
+// only checks the reads of a missing object
+func ReadOnlyContract(t *testing.T, s Storage) {
+	checkNotExist(t, s, "storagetest/missing")
+}
+
+func checkNotExist(t *testing.T, s Storage, name string) {
+	ctx := context.Background()
+	if e := s.DownloadContext(ctx, name, &bytes.Buffer{}); !errors.Is(e, storage.ErrNotExist) {
+		t.Errorf("DownloadContext() error = %v, want %v", e, storage.ErrNotExist)
+	}
+	if e := s.DownloadRangeContext(ctx, name, 0, 1, &bytes.Buffer{}); !errors.Is(e, storage.ErrNotExist) {
+		t.Errorf("DownloadRangeContext() error = %v, want %v", e, storage.ErrNotExist)
+	}
+	if _, e := s.StatContext(ctx, name); !errors.Is(e, storage.ErrNotExist) {
+		t.Errorf("StatContext() error = %v, want %v", e, storage.ErrNotExist)
+	}
+	if exists, e := s.ExistsContext(ctx, name); e != nil || exists {
+		t.Errorf("ExistsContext() = %v, error = %v, want false", exists, e)
+	}
+}
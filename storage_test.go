@@ -0,0 +1,236 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction/storage"
+	"github.com/codingbeard/cbtransaction/storage/cbfile"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// basicTestStorage is a BasicStorage whose calls can be held until the test
+// releases them. started is closed once a call has begun and the result of a
+// held call is sent on finished
+type basicTestStorage struct {
+	calls    int
+	contents []byte
+	started  chan struct{}
+	release  chan struct{}
+	finished chan error
+}
+
+func (b *basicTestStorage) begin() {
+	b.calls++
+	if b.started != nil {
+		close(b.started)
+	}
+	if b.release != nil {
+		<-b.release
+	}
+}
+
+func (b *basicTestStorage) end(e error) error {
+	if b.finished != nil {
+		b.finished <- e
+	}
+	return e
+}
+
+func (b *basicTestStorage) Upload(filename string, reader io.Reader) error {
+	b.begin()
+	_, e := io.Copy(ioutil.Discard, reader)
+	return b.end(e)
+}
+
+func (b *basicTestStorage) Download(filename string, writer io.Writer) error {
+	b.begin()
+	// write in small chunks so ranges cross write boundaries
+	for i := 0; i < len(b.contents); i += 3 {
+		end := i + 3
+		if end > len(b.contents) {
+			end = len(b.contents)
+		}
+		_, e := writer.Write(b.contents[i:end])
+		if e != nil {
+			return b.end(e)
+		}
+	}
+	return b.end(nil)
+}
+
+func (b *basicTestStorage) Concat(destination string, filenames ...string) error {
+	b.begin()
+	return b.end(nil)
+}
+
+func (b *basicTestStorage) Delete(filename string) error {
+	b.begin()
+	return b.end(nil)
+}
+
+func TestNewStorageAdapter(t *testing.T) {
+	fileStorage, e := cbfile.New(cbfile.Config{BasePath: os.TempDir()})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	if got := NewStorageAdapter(fileStorage); got != fileStorage {
+		t.Errorf("NewStorageAdapter() = %v, want the given Storage unwrapped", got)
+	}
+
+	basic := &basicTestStorage{}
+	adapter, ok := NewStorageAdapter(basic).(*storageAdapter)
+	if !ok {
+		t.Error("NewStorageAdapter() did not wrap the BasicStorage")
+		return
+	}
+	if adapter.storage != basic {
+		t.Errorf("NewStorageAdapter() wrapped %v, want %v", adapter.storage, basic)
+	}
+	if _, e := adapter.Stat("file.txt"); !errors.Is(e, storage.ErrNotSupported) {
+		t.Errorf("Stat() error = %v, want %v", e, storage.ErrNotSupported)
+	}
+}
+
+func TestStorageAdapter_Context(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		// hold keeps the call running until ctx has been cancelled
+		hold      bool
+		ctx       context.Context
+		call      func(ctx context.Context, s Storage, writer io.Writer) error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name: "upload",
+			ctx:  context.Background(),
+			call: func(ctx context.Context, s Storage, writer io.Writer) error {
+				return s.UploadContext(ctx, "file.txt", bytes.NewReader([]byte("content")))
+			},
+			wantErr:   nil,
+			wantCalls: 1,
+		},
+		{
+			name: "cancelledBeforeCall",
+			ctx:  cancelled,
+			call: func(ctx context.Context, s Storage, writer io.Writer) error {
+				return s.DownloadContext(ctx, "file.txt", writer)
+			},
+			wantErr:   context.Canceled,
+			wantCalls: 0,
+		},
+		{
+			name: "cancelledDuringDelete",
+			hold: true,
+			ctx:  context.Background(),
+			call: func(ctx context.Context, s Storage, writer io.Writer) error {
+				return s.DeleteContext(ctx, "file.txt")
+			},
+			wantErr:   context.Canceled,
+			wantCalls: 1,
+		},
+		{
+			name: "cancelledDuringDownload",
+			hold: true,
+			ctx:  context.Background(),
+			call: func(ctx context.Context, s Storage, writer io.Writer) error {
+				return s.DownloadContext(ctx, "file.txt", writer)
+			},
+			wantErr:   context.Canceled,
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basic := &basicTestStorage{contents: []byte("0123456789")}
+			if tt.hold {
+				basic.started = make(chan struct{})
+				basic.release = make(chan struct{})
+				basic.finished = make(chan error, 1)
+			}
+			s := NewStorageAdapter(basic)
+			ctx, cancel := context.WithCancel(tt.ctx)
+			defer cancel()
+			if tt.hold {
+				go func() {
+					<-basic.started
+					cancel()
+				}()
+			}
+
+			writer := &bytes.Buffer{}
+			err := tt.call(ctx, s, writer)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("call error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.hold {
+				// the abandoned call finishes without reaching the caller's writer
+				close(basic.release)
+				<-basic.finished
+				if writer.Len() != 0 {
+					t.Errorf("abandoned call wrote %q after returning", writer.String())
+				}
+			}
+			if basic.calls != tt.wantCalls {
+				t.Errorf("calls to BasicStorage = %d, want %d", basic.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStorageAdapter_DownloadRange(t *testing.T) {
+	type args struct {
+		offset int64
+		length int64
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "whole",
+			args: args{offset: 0, length: -1},
+			want: "0123456789",
+		},
+		{
+			name: "tail",
+			args: args{offset: 4, length: -1},
+			want: "456789",
+		},
+		{
+			name: "middle",
+			args: args{offset: 2, length: 5},
+			want: "23456",
+		},
+		{
+			name: "pastEnd",
+			args: args{offset: 20, length: 5},
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStorageAdapter(&basicTestStorage{contents: []byte("0123456789")})
+			writer := &bytes.Buffer{}
+			err := s.DownloadRange("file.txt", tt.args.offset, tt.args.length, writer)
+			if err != nil {
+				t.Errorf("DownloadRange() error = %v", err)
+				return
+			}
+			if got := writer.String(); got != tt.want {
+				t.Errorf("DownloadRange() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package cbtransaction
+
+// ShreddedTransaction is returned by Client.Decrypt in place of a transaction
+// about a subject which has been forgotten, see Server.ForgetSubject. It is
+// the transaction as stored, its data can no longer be decrypted
+type ShreddedTransaction struct {
+	Transaction
+	SubjectID string
+}
+
+// IsShredded reports whether a transaction returned by Client.Decrypt has been shredded
+func IsShredded(transaction Transaction) bool {
+	_, ok := transaction.(*ShreddedTransaction)
+	return ok
+}
@@ -0,0 +1,180 @@
+package cbtransaction
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/codingbeard/cbtransaction/encoding/cbmsgpack"
+	"github.com/codingbeard/cbtransaction/encryption/cbenvelope"
+	"github.com/codingbeard/cbtransaction/encryption/cbnone"
+	"github.com/codingbeard/cbtransaction/encryption/cbshred"
+	"github.com/codingbeard/cbtransaction/transaction"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClient_DecryptShredded(t *testing.T) {
+	dataDir, e := ioutil.TempDir("", "cbtransaction-subject")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	keyStore, e := cbshred.NewFileKeyStore(cbshred.FileKeyStoreConfig{Dir: filepath.Join(dataDir, "subjects")})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	shred, _ := cbshred.New(cbshred.Config{KeyStore: keyStore})
+	s, e := NewServer(ServerConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbnone.Key,
+		EncryptionProviders:  []Encryption{&cbnone.Encryption{}, shred},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if e := s.AddSubjectTransaction(transaction.ActionAdd, "", "data"); e == nil {
+		t.Error("AddSubjectTransaction() error = nil for an empty subject")
+	}
+
+	// transactions encrypted the way insertTransactionsQueue encrypts them
+	transactions := map[string]*cbslice.Transaction{}
+	for _, subjectID := range []string{"user-1", "user-2"} {
+		key, encrypted, e := s.encryptTransactionData(transactionInsertQueueItem{subjectID: subjectID}, []byte(subjectID), nil, nil)
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		tran := cbslice.NewVersion1()
+		tran.SetEncryptionProviderKey(key)
+		tran.SetData(encrypted)
+		transactions[subjectID] = tran
+	}
+	if e := s.ForgetSubject("user-2"); e != nil {
+		t.Errorf("ForgetSubject() error = %v", e)
+		return
+	}
+
+	c, e := NewClient(ClientConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbnone.Key,
+		EncryptionProviders:  []Encryption{&cbnone.Encryption{}, shred},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	decrypted, err := c.Decrypt(transactions["user-1"])
+	if err != nil || IsShredded(decrypted) || string(decrypted.GetData()) != "user-1" {
+		t.Errorf("Decrypt() = %v, error = %v, want user-1", decrypted, err)
+	}
+	decrypted, err = c.Decrypt(transactions["user-2"])
+	if err != nil || !IsShredded(decrypted) {
+		t.Errorf("Decrypt() = %v, error = %v, want shredded", decrypted, err)
+		return
+	}
+	if shredded := decrypted.(*ShreddedTransaction); shredded.SubjectID != "user-2" {
+		t.Errorf("Decrypt() shredded subject = %s, want user-2", shredded.SubjectID)
+	}
+}
+
+func TestClient_DecryptSubjectLayered(t *testing.T) {
+	dataDir, e := ioutil.TempDir("", "cbtransaction-subject")
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	keyStore, e := cbshred.NewFileKeyStore(cbshred.FileKeyStoreConfig{Dir: filepath.Join(dataDir, "subjects")})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	shred, _ := cbshred.New(cbshred.Config{KeyStore: keyStore})
+	keyManager, e := cbenvelope.NewFileKeyManager(cbenvelope.FileKeyManagerConfig{Dir: filepath.Join(dataDir, "keys")})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	envelope, _ := cbenvelope.New(cbenvelope.Config{KeyManager: keyManager})
+	s, e := NewServer(ServerConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbenvelope.Key,
+		EncryptionProviders:  []Encryption{envelope, shred},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+
+	// a transaction encrypted the way insertTransactionsQueue encrypts it
+	wrappedKey, e := envelope.NewDataKeyContext(context.Background())
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	key, encrypted, e := s.encryptTransactionData(transactionInsertQueueItem{subjectID: "user-1"}, []byte("data"), envelope, wrappedKey)
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if key != cbshred.Key {
+		t.Errorf("encryptTransactionData() key = %v, want %v", key, cbshred.Key)
+	}
+	if bytes.Contains(encrypted, []byte("user-1")) {
+		t.Error("encryptTransactionData() left the subject header outside of the bucket encryption")
+	}
+	tran := cbslice.NewVersion1()
+	tran.SetEncryptionProviderKey(key)
+	tran.SetData(encrypted)
+
+	c, e := NewClient(ClientConfig{
+		Logger:               defaultLogger{},
+		ErrorHandler:         DefaultErrorHandler{},
+		DefaultEncryptionKey: cbnone.Key,
+		EncryptionProviders:  []Encryption{&cbnone.Encryption{}, envelope, shred},
+		DefaultEncodingKey:   cbmsgpack.Key,
+		EncodingProviders:    []Encoding{cbmsgpack.New()},
+		DataDir:              dataDir,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	c.master, _ = NewMasterFromFile(nil)
+	bucket, _ := NewBucketFromFile(nil)
+	bucket.SetFileName("bucket")
+	bucket.SetWrappedDataKey(wrappedKey)
+	c.master.SaveBucket(bucket)
+
+	decrypted, err := c.Decrypt(tran)
+	if err != nil || IsShredded(decrypted) || string(decrypted.GetData()) != "data" {
+		t.Errorf("Decrypt() = %v, error = %v, want data", decrypted, err)
+	}
+
+	// without the data key of the bucket the subject layer cannot be reached
+	c.master, _ = NewMasterFromFile(nil)
+	fresh, _ := cbenvelope.New(cbenvelope.Config{KeyManager: keyManager})
+	c.encryptionProviders = []Encryption{&cbnone.Encryption{}, fresh, shred}
+	if _, err := c.Decrypt(tran); !errors.Is(err, cbenvelope.ErrNoDataKey) {
+		t.Errorf("Decrypt() error = %v, want %v", err, cbenvelope.ErrNoDataKey)
+	}
+}
@@ -2,6 +2,7 @@ package cbtransaction
 
 import (
 	"github.com/codingbeard/cbtransaction/transaction"
+	"github.com/codingbeard/cbtransaction/transaction/cbslice"
 	"github.com/google/uuid"
 	"io"
 )
@@ -23,3 +24,36 @@ type Transaction interface {
 	Serialise() []byte
 	SerialiseWriter(writer io.Writer) (n int, err error)
 }
+
+// eachTransaction calls fn with every transaction in a bucket and its offset.
+// It returns the offset at which it stopped, the end of the bucket unless a
+// transaction was incomplete or fn returned an error
+func eachTransaction(reader io.Reader, fn func(offset int64, tran *cbslice.Transaction) error) (int64, error) {
+	counting := &countingReader{reader: reader}
+	var offset int64
+	for {
+		tran, e := cbslice.NewFromReader(counting)
+		if e != nil {
+			if counting.read == offset {
+				return offset, nil
+			}
+			return offset, e
+		}
+		e = fn(offset, tran)
+		if e != nil {
+			return offset, e
+		}
+		offset = counting.read
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, e := r.reader.Read(p)
+	r.read += int64(n)
+	return n, e
+}
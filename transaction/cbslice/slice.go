@@ -1,6 +1,7 @@
 package cbslice
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"github.com/codingbeard/cbtransaction/transaction"
@@ -12,6 +13,7 @@ import (
 
 var (
 	Version1                            VersionEnum = 1
+	Version2                            VersionEnum = 2
 	DidNotReadEnoughDataTransactionSize             = errors.New("did not read expected amount of data for the size of the transaction")
 	DidNotReadEnoughData                            = errors.New("did not read expected amount of data")
 	NilSerialisedData                               = errors.New("nil serialised data")
@@ -32,6 +34,11 @@ const (
 	actionOffset1                = 17
 	encodingProviderKeyOffset1   = 18
 	encryptionProviderKeyOffset1 = 26
+
+	// version 2 has the version 1 header followed by the hash of the previous
+	// transaction of a hash chain
+	headerLength2       = 66
+	previousHashOffset2 = 34
 )
 
 type VersionEnum byte
@@ -59,6 +66,12 @@ func NewVersion1() *Transaction {
 	return &tran
 }
 
+func NewVersion2() *Transaction {
+	tran := make(Transaction, headerLength2)
+	tran[versionOffset] = byte(Version2)
+	return &tran
+}
+
 func NewFromReader(serialised io.Reader) (*Transaction, error) {
 	tran, e := NewUnserialiseReader(serialised)
 	if e != nil {
@@ -82,7 +95,7 @@ func (b *Transaction) GetVersion() VersionEnum {
 func (b *Transaction) SetTransactionId(transactionId uuid.UUID) {
 	tran := *b
 	var offset int
-	if b.GetVersion() == Version1 {
+	if b.GetVersion() == Version1 || b.GetVersion() == Version2 {
 		offset = transactionIdOffset1
 	}
 	tran[offset] = transactionId[0]
@@ -105,7 +118,7 @@ func (b *Transaction) SetTransactionId(transactionId uuid.UUID) {
 }
 
 func (b *Transaction) GetTransactionId() uuid.UUID {
-	if b.GetVersion() == Version1 {
+	if b.GetVersion() == Version1 || b.GetVersion() == Version2 {
 		tran := *b
 
 		transactionId := uuid.UUID{}
@@ -136,7 +149,7 @@ func (b *Transaction) GetTime() time.Time {
 }
 
 func (b *Transaction) SetActionEnum(action transaction.ActionEnum) {
-	if b.GetVersion() == Version1 {
+	if b.GetVersion() == Version1 || b.GetVersion() == Version2 {
 		tran := *b
 		tran[actionOffset1] = byte(action)
 		*b = tran
@@ -144,7 +157,7 @@ func (b *Transaction) SetActionEnum(action transaction.ActionEnum) {
 }
 
 func (b *Transaction) GetActionEnum() transaction.ActionEnum {
-	if b.GetVersion() == Version1 {
+	if b.GetVersion() == Version1 || b.GetVersion() == Version2 {
 		tran := *b
 		return transaction.ActionEnum(tran[actionOffset1])
 	}
@@ -154,7 +167,7 @@ func (b *Transaction) GetActionEnum() transaction.ActionEnum {
 
 func (b *Transaction) SetEncodingProviderKey(key [8]byte) {
 	var encodingOffset, encryptionOffset int
-	if b.GetVersion() == Version1 {
+	if b.GetVersion() == Version1 || b.GetVersion() == Version2 {
 		encodingOffset = encodingProviderKeyOffset1
 		encryptionOffset = encryptionProviderKeyOffset1
 	}
@@ -176,7 +189,7 @@ func (b *Transaction) SetEncodingProviderKey(key [8]byte) {
 
 func (b *Transaction) GetEncodingProviderKey() [8]byte {
 	var encodingOffset, encryptionOffset int
-	if b.GetVersion() == Version1 {
+	if b.GetVersion() == Version1 || b.GetVersion() == Version2 {
 		encodingOffset = encodingProviderKeyOffset1
 		encryptionOffset = encryptionProviderKeyOffset1
 	}
@@ -198,6 +211,9 @@ func (b *Transaction) SetEncryptionProviderKey(key [8]byte) {
 	if b.GetVersion() == Version1 {
 		encryptionOffset = encryptionProviderKeyOffset1
 		headerLength = headerLength1
+	} else if b.GetVersion() == Version2 {
+		encryptionOffset = encryptionProviderKeyOffset1
+		headerLength = previousHashOffset2
 	}
 	tran := *b
 	prefix := append(
@@ -220,6 +236,9 @@ func (b *Transaction) GetEncryptionProviderKey() [8]byte {
 	if b.GetVersion() == Version1 {
 		encryptionOffset = encryptionProviderKeyOffset1
 		headerLength = headerLength1
+	} else if b.GetVersion() == Version2 {
+		encryptionOffset = encryptionProviderKeyOffset1
+		headerLength = previousHashOffset2
 	}
 	tran := *b
 	return [8]byte{
@@ -242,11 +261,38 @@ func (b *Transaction) GetData() []byte {
 	var headerLength int
 	if b.GetVersion() == Version1 {
 		headerLength = headerLength1
+	} else if b.GetVersion() == Version2 {
+		headerLength = headerLength2
 	}
 	tran := *b
 	return tran[headerLength:]
 }
 
+// SetPreviousHash stores the hash of the transaction before this one in a
+// hash chain, only version 2 transactions have room for it
+func (b *Transaction) SetPreviousHash(hash [32]byte) {
+	if b.GetVersion() == Version2 {
+		tran := *b
+		copy(tran[previousHashOffset2:headerLength2], hash[:])
+		*b = tran
+	}
+}
+
+func (b *Transaction) GetPreviousHash() [32]byte {
+	hash := [32]byte{}
+	if b.GetVersion() == Version2 {
+		tran := *b
+		copy(hash[:], tran[previousHashOffset2:headerLength2])
+	}
+	return hash
+}
+
+// Hash returns the sha256 of the transaction, which the next transaction of a
+// hash chain stores with SetPreviousHash
+func (b *Transaction) Hash() [32]byte {
+	return sha256.Sum256(*b)
+}
+
 func (b *Transaction) GetLength() uint64 {
 	return uint64(len(*b))
 }
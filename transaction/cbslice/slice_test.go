@@ -198,6 +198,56 @@ func TestTransaction_Serialise(t *testing.T) {
 	}
 }
 
+func TestTransaction_SerialiseVersion2(t *testing.T) {
+	slice := NewVersion2()
+
+	previousHash := [32]byte{}
+	for i := range previousHash {
+		previousHash[i] = byte(100 + i)
+	}
+	transactionId := uuid.New()
+	slice.SetTransactionId(transactionId)
+	slice.SetActionEnum(transaction.ActionAdd)
+	slice.SetEncodingProviderKey([8]byte{0, 1, 2, 3, 4, 5, 6, 7})
+	slice.SetEncryptionProviderKey([8]byte{8, 9, 10, 11, 12, 13, 14, 15})
+	slice.SetPreviousHash(previousHash)
+	slice.SetData([]byte{16, 17, 18})
+
+	expected := []byte{
+		69, 0, 0, 0, 0, 0, 0, 0, //len(transaction)
+		byte(Version2),                                                         //Version2
+		transactionId[0], transactionId[1], transactionId[2], transactionId[3], //UUID
+		transactionId[4], transactionId[5], transactionId[6], transactionId[7], //UUID
+		transactionId[8], transactionId[9], transactionId[10], transactionId[11], //UUID
+		transactionId[12], transactionId[13], transactionId[14], transactionId[15], //UUID
+		43,                     //ActionAdd
+		0, 1, 2, 3, 4, 5, 6, 7, //encodingProviderKey
+		8, 9, 10, 11, 12, 13, 14, 15, //encryptionProviderKey
+	}
+	expected = append(expected, previousHash[:]...) //previousHash
+	expected = append(expected, 16, 17, 18)         //data
+
+	serialised := slice.Serialise()
+	if bytes.Compare(expected, serialised) != 0 {
+		t.Errorf("serialised was incorrect, \ngot : %v, \nwant: %v", serialised, expected)
+	}
+	if get := slice.GetPreviousHash(); get != previousHash {
+		t.Errorf("previousHash was incorrect, got: %v, want: %v", get, previousHash)
+	}
+	if get := slice.GetData(); bytes.Compare(get, []byte{16, 17, 18}) != 0 {
+		t.Errorf("data was incorrect, got: %v, want: %v", get, []byte{16, 17, 18})
+	}
+	if get := slice.GetEncryptionProviderKey(); get != [8]byte{8, 9, 10, 11, 12, 13, 14, 15} {
+		t.Errorf("encryptionProviderKey was incorrect, got: %v", get)
+	}
+
+	version1 := NewVersion1()
+	version1.SetPreviousHash(previousHash)
+	if get := version1.GetPreviousHash(); get != [32]byte{} || len(*version1) != headerLength1 {
+		t.Errorf("version 1 previousHash was set, got: %v", get)
+	}
+}
+
 func TestTransaction_SerialiseWriter(t *testing.T) {
 	slice := NewVersion1()
 